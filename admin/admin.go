@@ -0,0 +1,374 @@
+// Package admin serves the health, readiness and admin endpoints of a pipeline
+// over HTTP:
+//
+//	GET  /healthz                           the process is alive
+//	GET  /readyz                            every Streamer and receiver is ready
+//	GET  /admin/streams                     the shards of every stream with positions
+//	GET  /admin/streams/{name}              a stream
+//	GET  /admin/streams/{name}/ratelimit    the read rate limit of a stream
+//	PUT  /admin/streams/{name}/ratelimit    changes the read rate limit of a stream
+//	GET  /admin/receivers                   the receivers with their translation
+//	GET  /admin/receivers/{name}            a receiver
+//	POST /admin/receivers/{name}/pause      pauses a receiver in every stream
+//	POST /admin/receivers/{name}/resume     resumes a receiver in every stream
+//	GET  /admin/receivers/{name}/ratelimit  the rate limit of a receiver in every stream
+//	PUT  /admin/receivers/{name}/ratelimit  changes the rate limit of a receiver in every stream
+//
+// The receiver actions take an optional stream query parameter to act on a
+// single stream. The rate limits are sent and returned as a kinesis.RateLimit
+// in JSON.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nicolasassi/kinestesia/kinesis"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"github.com/nicolasassi/kinestesia/translator"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReadyTimeout    = 5 * time.Second
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+// Config sets what a Server reports and controls.
+type Config struct {
+	Streamers []*kinesis.Streamer
+	// Receivers are the receivers given to the Streamers. The ones which are a
+	// receivers.ReadyReceiver, as the chains of receivers.Chain around one, are
+	// checked by /readyz.
+	Receivers []receivers.Receiver
+	// ReadyTimeout bounds the checks of the receivers by /readyz. The default is
+	// 5 seconds.
+	ReadyTimeout time.Duration
+}
+
+// Server is the http.Handler of the endpoints of the package.
+type Server struct {
+	cfg Config
+	mux *http.ServeMux
+}
+
+func NewServer(cfg Config) *Server {
+	if cfg.ReadyTimeout <= 0 {
+		cfg.ReadyTimeout = defaultReadyTimeout
+	}
+	s := &Server{cfg: cfg, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/healthz", s.healthz)
+	s.mux.HandleFunc("/readyz", s.readyz)
+	s.mux.HandleFunc("/admin/streams", s.streams)
+	s.mux.HandleFunc("/admin/streams/", s.stream)
+	s.mux.HandleFunc("/admin/receivers", s.receivers)
+	s.mux.HandleFunc("/admin/receivers/", s.receiver)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves on addr until ctx is done, then shuts the server down
+// waiting for the requests being served.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// Readiness is the response of /readyz.
+type Readiness struct {
+	Ready bool
+	// Errors tell why the pipeline is not ready.
+	Errors []string
+}
+
+// ReceiverStatus is a receiver as reported by /admin/receivers.
+type ReceiverStatus struct {
+	Name string
+	// Paused has the streams where the receiver is paused.
+	Paused []string
+	// Translation is nil for receivers which don't translate or whose
+	// translation can't be inspected.
+	Translation *translator.Config
+}
+
+// ReceiverRateLimit is the rate limit of a receiver in a stream as reported by
+// /admin/receivers/{name}/ratelimit.
+type ReceiverRateLimit struct {
+	Stream    string
+	RateLimit kinesis.RateLimit
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"Status": "ok"})
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	readiness := s.readiness(r.Context())
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, readiness)
+}
+
+// readiness checks the Streamers and the receivers, the receivers concurrently.
+func (s *Server) readiness(ctx context.Context) Readiness {
+	readiness := Readiness{Errors: []string{}}
+	for _, streamer := range s.cfg.Streamers {
+		if !streamer.Ready() {
+			status := streamer.Status()
+			msg := fmt.Sprintf("stream %s is not ready", status.StreamName)
+			if status.Error != "" {
+				msg += ": " + status.Error
+			}
+			readiness.Errors = append(readiness.Errors, msg)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.ReadyTimeout)
+	defer cancel()
+	errs := make([]error, len(s.cfg.Receivers))
+	var wg sync.WaitGroup
+	for i, rec := range s.cfg.Receivers {
+		ready, ok := rec.(receivers.ReadyReceiver)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, rec receivers.ReadyReceiver) {
+			defer wg.Done()
+			errs[i] = rec.Ready(ctx)
+		}(i, ready)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			readiness.Errors = append(readiness.Errors, fmt.Sprintf("receiver %s is not ready: %v", s.cfg.Receivers[i].String(), err))
+		}
+	}
+	readiness.Ready = len(readiness.Errors) == 0
+	return readiness
+}
+
+func (s *Server) streams(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	statuses := []kinesis.StreamStatus{}
+	for _, streamer := range s.cfg.Streamers {
+		statuses = append(statuses, streamer.Status())
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// stream serves /admin/streams/{name} and its rate limit.
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	name, action := splitAction(strings.TrimPrefix(r.URL.Path, "/admin/streams/"))
+	streamers, ok := s.streamers(name)
+	if name == "" || !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("stream %q not found", name))
+		return
+	}
+	streamer := streamers[0]
+	switch action {
+	case "":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, streamer.Status())
+	case "ratelimit":
+		if !allowMethod(w, r, http.MethodGet, http.MethodPut) {
+			return
+		}
+		if r.Method == http.MethodPut {
+			l, ok := readRateLimit(w, r)
+			if !ok {
+				return
+			}
+			streamer.SetReadRateLimit(l)
+		}
+		writeJSON(w, http.StatusOK, streamer.ReadRateLimit())
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown action %q", action))
+	}
+}
+
+func (s *Server) receivers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	statuses := []ReceiverStatus{}
+	for _, rec := range s.cfg.Receivers {
+		statuses = append(statuses, s.receiverStatus(rec))
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// receiver serves /admin/receivers/{name} and its pause, resume and rate limit
+// actions.
+func (s *Server) receiver(w http.ResponseWriter, r *http.Request) {
+	name, action := splitAction(strings.TrimPrefix(r.URL.Path, "/admin/receivers/"))
+	rec := s.lookup(name)
+	if rec == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("receiver %q not found", name))
+		return
+	}
+	switch action {
+	case "":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+	case "pause", "resume":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		streamers, ok := s.streamers(r.URL.Query().Get("stream"))
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("stream %q not found", r.URL.Query().Get("stream")))
+			return
+		}
+		for _, streamer := range streamers {
+			if action == "pause" {
+				streamer.PauseReceiver(name)
+			} else {
+				streamer.ResumeReceiver(name)
+			}
+		}
+	case "ratelimit":
+		if !allowMethod(w, r, http.MethodGet, http.MethodPut) {
+			return
+		}
+		streamers, ok := s.streamers(r.URL.Query().Get("stream"))
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("stream %q not found", r.URL.Query().Get("stream")))
+			return
+		}
+		var l kinesis.RateLimit
+		if r.Method == http.MethodPut {
+			if l, ok = readRateLimit(w, r); !ok {
+				return
+			}
+		}
+		limits := []ReceiverRateLimit{}
+		for _, streamer := range streamers {
+			if r.Method == http.MethodPut {
+				streamer.SetReceiverRateLimit(name, l)
+			}
+			limits = append(limits, ReceiverRateLimit{Stream: streamer.Name(), RateLimit: streamer.ReceiverRateLimit(name)})
+		}
+		writeJSON(w, http.StatusOK, limits)
+		return
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown action %q", action))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.receiverStatus(rec))
+}
+
+// splitAction splits path into a name and the action after its last slash, if
+// any.
+func splitAction(path string) (name, action string) {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// readRateLimit decodes the rate limit in the body of r, writing the error if it
+// is not a valid one.
+func readRateLimit(w http.ResponseWriter, r *http.Request) (kinesis.RateLimit, bool) {
+	var l kinesis.RateLimit
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&l); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid rate limit: %v", err))
+		return l, false
+	}
+	if l.MessagesPerSecond < 0 || l.MessageBurst < 0 || l.BytesPerSecond < 0 || l.ByteBurst < 0 {
+		writeError(w, http.StatusBadRequest, "invalid rate limit: negative value")
+		return l, false
+	}
+	return l, true
+}
+
+func (s *Server) lookup(name string) receivers.Receiver {
+	for _, rec := range s.cfg.Receivers {
+		if rec.String() == name {
+			return rec
+		}
+	}
+	return nil
+}
+
+// streamers returns the Streamer of stream, or every Streamer if stream is
+// empty. It is false if there is no such stream.
+func (s *Server) streamers(stream string) ([]*kinesis.Streamer, bool) {
+	if stream == "" {
+		return s.cfg.Streamers, true
+	}
+	for _, streamer := range s.cfg.Streamers {
+		if streamer.Name() == stream {
+			return []*kinesis.Streamer{streamer}, true
+		}
+	}
+	return nil, false
+}
+
+func (s *Server) receiverStatus(rec receivers.Receiver) ReceiverStatus {
+	status := ReceiverStatus{Name: rec.String(), Paused: []string{}}
+	for _, streamer := range s.cfg.Streamers {
+		if streamer.ReceiverPaused(rec.String()) {
+			status.Paused = append(status.Paused, streamer.Name())
+		}
+	}
+	if translating, ok := rec.(receivers.TranslationReceiver); ok {
+		if t := translating.Translation(); t != nil {
+			cfg := t.Config()
+			status.Translation = &cfg
+		}
+	}
+	return status
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	return false
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"Error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
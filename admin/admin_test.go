@@ -0,0 +1,290 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awskinesis "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/kinesis"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"github.com/nicolasassi/kinestesia/translator"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKinesis serves the records of a single open shard.
+type fakeKinesis struct {
+	kinesisiface.KinesisAPI
+
+	mu      sync.Mutex
+	records []string
+}
+
+func (f *fakeKinesis) add(record string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records = append(f.records, record)
+}
+
+func (f *fakeKinesis) ListShardsWithContext(ctx aws.Context, input *awskinesis.ListShardsInput, opts ...request.Option) (*awskinesis.ListShardsOutput, error) {
+	return &awskinesis.ListShardsOutput{Shards: []*awskinesis.Shard{{ShardId: aws.String("s1")}}}, nil
+}
+
+func (f *fakeKinesis) DescribeStreamSummaryWithContext(ctx aws.Context, input *awskinesis.DescribeStreamSummaryInput, opts ...request.Option) (*awskinesis.DescribeStreamSummaryOutput, error) {
+	return &awskinesis.DescribeStreamSummaryOutput{StreamDescriptionSummary: &awskinesis.StreamDescriptionSummary{
+		StreamStatus: aws.String(awskinesis.StreamStatusActive),
+	}}, nil
+}
+
+func (f *fakeKinesis) GetShardIteratorWithContext(ctx aws.Context, input *awskinesis.GetShardIteratorInput, opts ...request.Option) (*awskinesis.GetShardIteratorOutput, error) {
+	return &awskinesis.GetShardIteratorOutput{ShardIterator: aws.String("0")}, nil
+}
+
+func (f *fakeKinesis) GetRecords(input *awskinesis.GetRecordsInput) (*awskinesis.GetRecordsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	index, _ := strconv.Atoi(aws.StringValue(input.ShardIterator))
+	out := &awskinesis.GetRecordsOutput{MillisBehindLatest: aws.Int64(0)}
+	if index < len(f.records) {
+		out.Records = []*awskinesis.Record{{SequenceNumber: aws.String(f.records[index]), Data: []byte(f.records[index])}}
+		index++
+	}
+	out.NextShardIterator = aws.String(strconv.Itoa(index))
+	return out, nil
+}
+
+// fakeReceiver is a receivers.ReadyReceiver and receivers.TranslationReceiver.
+type fakeReceiver struct {
+	translator *translator.Translator
+
+	mu       sync.Mutex
+	ready    error
+	messages []string
+}
+
+func (f *fakeReceiver) Send(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeReceiver) AddMessage(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, string(b))
+}
+
+func (f *fakeReceiver) Translate(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func (f *fakeReceiver) TranslationRequired() bool {
+	return false
+}
+
+func (f *fakeReceiver) String() string {
+	return "fake"
+}
+
+func (f *fakeReceiver) Ready(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ready
+}
+
+func (f *fakeReceiver) Translation() *translator.Translator {
+	return f.translator
+}
+
+func (f *fakeReceiver) setReady(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ready = err
+}
+
+func (f *fakeReceiver) received() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.messages)
+}
+
+func do(t *testing.T, srv *httptest.Server, method, path string, wantStatus int, out interface{}) {
+	doBody(t, srv, method, path, "", wantStatus, out)
+}
+
+func doBody(t *testing.T, srv *httptest.Server, method, path, body string, wantStatus int, out interface{}) {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != wantStatus {
+		t.Errorf("%s %s status = %v, want %v", method, path, resp.StatusCode, wantStatus)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Errorf("%s %s: %v", method, path, err)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServer_Healthz(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{}))
+	defer srv.Close()
+	var body map[string]string
+	do(t, srv, http.MethodGet, "/healthz", http.StatusOK, &body)
+	if body["Status"] != "ok" {
+		t.Errorf("/healthz got = %v", body)
+	}
+	do(t, srv, http.MethodPost, "/healthz", http.StatusMethodNotAllowed, nil)
+}
+
+func TestServer(t *testing.T) {
+	api := &fakeKinesis{records: []string{"a", "b", "c"}}
+	streamer, err := kinesis.NewStreamer(context.Background(), "stream",
+		kinesis.WithKinesisClient(api), kinesis.WithConsumerOptions(consumer.WithScanInterval(time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &fakeReceiver{translator: translator.NewTranslator(map[string]string{"payload.id": "id"}, "")}
+	chain := receivers.Chain(rec, receivers.Logging(nil))
+	srv := httptest.NewServer(NewServer(Config{
+		Streamers: []*kinesis.Streamer{streamer},
+		Receivers: []receivers.Receiver{chain},
+	}))
+	defer srv.Close()
+
+	var readiness Readiness
+	do(t, srv, http.MethodGet, "/readyz", http.StatusServiceUnavailable, &readiness)
+	if readiness.Ready || fmt.Sprint(readiness.Errors) != "[stream stream is not ready]" {
+		t.Errorf("/readyz before streaming got = %+v", readiness)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- streamer.Stream(ctx, chain)
+	}()
+	waitFor(t, "the records", func() bool { return rec.received() == 3 })
+	do(t, srv, http.MethodGet, "/readyz", http.StatusOK, nil)
+	rec.setReady(fmt.Errorf("topic missing"))
+	readiness = Readiness{}
+	do(t, srv, http.MethodGet, "/readyz", http.StatusServiceUnavailable, &readiness)
+	if fmt.Sprint(readiness.Errors) != "[receiver fake is not ready: topic missing]" {
+		t.Errorf("/readyz with a receiver not ready got = %+v", readiness)
+	}
+
+	var streams []kinesis.StreamStatus
+	do(t, srv, http.MethodGet, "/admin/streams", http.StatusOK, &streams)
+	if len(streams) != 1 || len(streams[0].Shards) != 1 || streams[0].Shards[0].SequenceNumber != "c" {
+		t.Errorf("/admin/streams got = %+v", streams)
+	}
+
+	var statuses []ReceiverStatus
+	do(t, srv, http.MethodGet, "/admin/receivers", http.StatusOK, &statuses)
+	if len(statuses) != 1 || statuses[0].Name != "fake" || statuses[0].Translation == nil || statuses[0].Translation.Reference["payload.id"] != "id" {
+		t.Errorf("/admin/receivers got = %+v", statuses)
+	}
+
+	var status ReceiverStatus
+	do(t, srv, http.MethodPost, "/admin/receivers/fake/pause", http.StatusOK, &status)
+	if fmt.Sprint(status.Paused) != "[stream]" || !streamer.ReceiverPaused("fake") {
+		t.Errorf("pause got = %+v", status)
+	}
+	api.add("d")
+	time.Sleep(20 * time.Millisecond)
+	if got := rec.received(); got != 3 {
+		t.Errorf("paused receiver got %v messages, want 3", got)
+	}
+	status = ReceiverStatus{}
+	do(t, srv, http.MethodPost, "/admin/receivers/fake/resume?stream=stream", http.StatusOK, &status)
+	if len(status.Paused) != 0 {
+		t.Errorf("resume got = %+v", status)
+	}
+	waitFor(t, "the record read while paused", func() bool { return rec.received() == 4 })
+
+	do(t, srv, http.MethodGet, "/admin/receivers/fake", http.StatusOK, nil)
+	do(t, srv, http.MethodGet, "/admin/receivers/fake/pause", http.StatusMethodNotAllowed, nil)
+	do(t, srv, http.MethodGet, "/admin/receivers/missing", http.StatusNotFound, nil)
+	do(t, srv, http.MethodPost, "/admin/receivers/fake/stop", http.StatusNotFound, nil)
+	do(t, srv, http.MethodPost, "/admin/receivers/fake/pause?stream=other", http.StatusNotFound, nil)
+
+	var stream kinesis.StreamStatus
+	do(t, srv, http.MethodGet, "/admin/streams/stream", http.StatusOK, &stream)
+	if stream.StreamName != "stream" {
+		t.Errorf("/admin/streams/stream got = %+v", stream)
+	}
+	do(t, srv, http.MethodGet, "/admin/streams/other", http.StatusNotFound, nil)
+	do(t, srv, http.MethodGet, "/admin/streams/stream/stop", http.StatusNotFound, nil)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	streamer, err := kinesis.NewStreamer(context.Background(), "stream", kinesis.WithKinesisClient(&fakeKinesis{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewServer(Config{
+		Streamers: []*kinesis.Streamer{streamer},
+		Receivers: []receivers.Receiver{&fakeReceiver{}},
+	}))
+	defer srv.Close()
+
+	var limit kinesis.RateLimit
+	do(t, srv, http.MethodGet, "/admin/streams/stream/ratelimit", http.StatusOK, &limit)
+	if limit != (kinesis.RateLimit{}) {
+		t.Errorf("read rate limit got = %+v, want none", limit)
+	}
+	doBody(t, srv, http.MethodPut, "/admin/streams/stream/ratelimit", `{"MessagesPerSecond": 100}`, http.StatusOK, &limit)
+	// the burst defaults to one second of the rate
+	if want := (kinesis.RateLimit{MessagesPerSecond: 100, MessageBurst: 100}); limit != want || streamer.ReadRateLimit() != want {
+		t.Errorf("read rate limit got = %+v, streamer %+v, want %+v", limit, streamer.ReadRateLimit(), want)
+	}
+	doBody(t, srv, http.MethodPut, "/admin/streams/stream/ratelimit", `{"MessagesPerSecond": -1}`, http.StatusBadRequest, nil)
+	doBody(t, srv, http.MethodPut, "/admin/streams/stream/ratelimit", `{"Messages": 1}`, http.StatusBadRequest, nil)
+	do(t, srv, http.MethodPost, "/admin/streams/stream/ratelimit", http.StatusMethodNotAllowed, nil)
+	do(t, srv, http.MethodGet, "/admin/streams/other/ratelimit", http.StatusNotFound, nil)
+
+	var limits []ReceiverRateLimit
+	doBody(t, srv, http.MethodPut, "/admin/receivers/fake/ratelimit?stream=stream", `{"BytesPerSecond": 1024, "ByteBurst": 2048}`, http.StatusOK, &limits)
+	want := []ReceiverRateLimit{{Stream: "stream", RateLimit: kinesis.RateLimit{BytesPerSecond: 1024, ByteBurst: 2048}}}
+	if !reflect.DeepEqual(limits, want) || streamer.ReceiverRateLimit("fake") != want[0].RateLimit {
+		t.Errorf("receiver rate limit got = %+v, want %+v", limits, want)
+	}
+	limits = nil
+	do(t, srv, http.MethodGet, "/admin/receivers/fake/ratelimit", http.StatusOK, &limits)
+	if !reflect.DeepEqual(limits, want) {
+		t.Errorf("receiver rate limit got = %+v, want %+v", limits, want)
+	}
+	doBody(t, srv, http.MethodPut, "/admin/receivers/fake/ratelimit", `not json`, http.StatusBadRequest, nil)
+	do(t, srv, http.MethodGet, "/admin/receivers/fake/ratelimit?stream=other", http.StatusNotFound, nil)
+	do(t, srv, http.MethodGet, "/admin/receivers/missing/ratelimit", http.StatusNotFound, nil)
+}
@@ -0,0 +1,262 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"github.com/nicolasassi/kinestesia/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+const (
+	defaultBatchMaxCount    = 500
+	defaultBatchMaxBytes    = 5 << 20
+	defaultBatchLinger      = 100 * time.Millisecond
+	defaultBatchMaxAttempts = 3
+	defaultBatchBackoff     = 100 * time.Millisecond
+)
+
+// BatchConfig sets how the batches of a receivers.BatchReceiver are assembled
+// and retried.
+type BatchConfig struct {
+	// MaxCount is the maximum number of messages in a batch. The default is 500.
+	MaxCount int
+	// MaxBytes is the maximum size of the messages of a batch. A message bigger
+	// than it goes alone. The default is 5MB.
+	MaxBytes int
+	// Linger is how long a batch waits to be filled once it has a message.
+	// The default is 100ms.
+	Linger time.Duration
+	// MaxAttempts is the number of times a message which failed with a
+	// retryable error is sent. The default is 3.
+	MaxAttempts int
+	// Backoff is the wait before sending the failed messages again, doubled on
+	// every attempt. The default is 100ms.
+	Backoff time.Duration
+	// Retryable tells whether a message failing with err should be sent again.
+	// The default is receivers.DefaultRetryable.
+	Retryable func(err error) bool
+	// DeadLetter is given the messages which failed every attempt or with an
+	// error which is not retryable. The Stream goes on once DeadLetter returns
+	// nil for them. Nil ends the Stream with a *DeliveryError.
+	DeadLetter receivers.DeadLetterFunc
+}
+
+func (c BatchConfig) withDefaults() BatchConfig {
+	if c.MaxCount <= 0 {
+		c.MaxCount = defaultBatchMaxCount
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaultBatchMaxBytes
+	}
+	if c.Linger <= 0 {
+		c.Linger = defaultBatchLinger
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultBatchMaxAttempts
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = defaultBatchBackoff
+	}
+	if c.Retryable == nil {
+		c.Retryable = receivers.DefaultRetryable
+	}
+	return c
+}
+
+// workBatches delivers the records of lane in batches to q.rec, which is a
+// receivers.BatchReceiver.
+func (d *dispatcher) workBatches(ctx context.Context, q *receiverQueue, lane <-chan delivery) {
+	var next *delivery
+	for {
+		batch, carry, ok := q.collect(ctx, lane, next)
+		if !ok {
+			return
+		}
+		next = carry
+		batch = d.dropDuplicates(ctx, q, batch)
+		if len(batch) == 0 {
+			continue
+		}
+		size := 0
+		for _, del := range batch {
+			size += len(del.record.Data)
+		}
+		w, err := d.acquireWorker(ctx, q, len(batch), size)
+		if err != nil {
+			for _, del := range batch {
+				d.forget(ctx, q, del)
+			}
+			return
+		}
+		undelivered := d.deliverBatch(ctx, q, batch, w)
+		w.release()
+		for _, del := range undelivered {
+			d.forget(ctx, q, del)
+		}
+		for _, del := range batch {
+			d.release(q, del)
+		}
+	}
+}
+
+// dropDuplicates releases the deliveries of batch already delivered to q and
+// returns the others.
+func (d *dispatcher) dropDuplicates(ctx context.Context, q *receiverQueue, batch []delivery) []delivery {
+	if q.dedup == nil {
+		return batch
+	}
+	unique := batch[:0]
+	for _, del := range batch {
+		if d.duplicate(ctx, q, del) {
+			d.release(q, del)
+			continue
+		}
+		unique = append(unique, del)
+	}
+	return unique
+}
+
+// collect waits for the first delivery of a batch, starting with first if it
+// is not nil, and then fills the batch until it is full or lingered enough.
+// The delivery which did not fit in the batch is returned to start the next.
+func (q *receiverQueue) collect(ctx context.Context, lane <-chan delivery, first *delivery) ([]delivery, *delivery, bool) {
+	if first == nil {
+		select {
+		case <-ctx.Done():
+			return nil, nil, false
+		case del := <-lane:
+			first = &del
+		}
+	}
+	batch := []delivery{*first}
+	size := len(first.record.Data)
+	linger := time.NewTimer(q.batch.Linger)
+	defer linger.Stop()
+	for len(batch) < q.batch.MaxCount && size < q.batch.MaxBytes {
+		select {
+		case <-ctx.Done():
+			return batch, nil, true
+		case <-linger.C:
+			return batch, nil, true
+		case del := <-lane:
+			if size+len(del.record.Data) > q.batch.MaxBytes {
+				return batch, &del, true
+			}
+			batch = append(batch, del)
+			size += len(del.record.Data)
+		}
+	}
+	return batch, nil, true
+}
+
+// deliverBatch translates the records of batch and sends them to the receiver
+// of q with the worker w, sending again the messages which failed with a
+// retryable error and giving the others to the dead-letter function, if any.
+// w is given back during the backoff. It returns the deliveries which failed
+// to translate or to be delivered.
+func (d *dispatcher) deliverBatch(ctx context.Context, q *receiverQueue, batch []delivery, w *worker) (undelivered []delivery) {
+	rec := q.rec.(receivers.BatchReceiver)
+	// dels are the deliveries of messages, which skip the dropped records
+	var messages [][]byte
+	var dels []delivery
+	for _, del := range batch {
+		data, ok := d.translate(ctx, rec, del)
+		if !ok {
+			undelivered = append(undelivered, del)
+			continue
+		}
+		if data != nil {
+			messages = append(messages, data)
+			dels = append(dels, del)
+		}
+	}
+	if len(messages) == 0 {
+		return undelivered
+	}
+	batchCtx, span := d.s.tracer.Start(batch[0].ctx, "receiver.deliver_batch", trace.WithAttributes(
+		attribute.String("receiver", rec.String()),
+		attribute.Int("batch_size", len(messages)),
+	))
+	defer span.End()
+	batchCtx = receivers.WithIdle(batchCtx, w.release, w.acquire)
+	cfg := q.batch
+	backoff := cfg.Backoff
+	for attempt := 1; ; attempt++ {
+		errs := rec.DeliverBatch(batchCtx, messages)
+		if len(errs) == 0 {
+			return undelivered
+		}
+		if len(errs) != len(messages) {
+			err := &DeliveryError{
+				StreamName: d.s.name,
+				Receiver:   rec.String(),
+				Err:        fmt.Errorf("%d results for a batch of %d messages", len(errs), len(messages)),
+			}
+			tracing.SetError(span, err)
+			for _, del := range dels {
+				del.read.fail(err)
+			}
+			d.report(err)
+			return append(undelivered, dels...)
+		}
+		var retry [][]byte
+		var retryDels []delivery
+		var failed error
+		for i, err := range errs {
+			if err == nil {
+				continue
+			}
+			if cfg.Retryable(err) && attempt < cfg.MaxAttempts {
+				retry = append(retry, messages[i])
+				retryDels = append(retryDels, dels[i])
+				continue
+			}
+			if cfg.DeadLetter != nil {
+				deadLetterErr := cfg.DeadLetter(dels[i].ctx, messages[i], err)
+				if deadLetterErr == nil {
+					d.s.metrics.Add(metrics.DeadLetters, 1, metrics.Labels{"receiver": rec.String()})
+					continue
+				}
+				err = fmt.Errorf("%w, dead letter error: %w", err, deadLetterErr)
+			}
+			dels[i].read.fail(err)
+			undelivered = append(undelivered, dels[i])
+			if failed == nil {
+				failed = &DeliveryError{
+					StreamName:     d.s.name,
+					ShardID:        dels[i].shardID,
+					SequenceNumber: aws.StringValue(dels[i].record.SequenceNumber),
+					Receiver:       rec.String(),
+					Err:            err,
+				}
+			}
+		}
+		if failed != nil {
+			tracing.SetError(span, failed)
+			d.report(failed)
+			return append(undelivered, retryDels...)
+		}
+		if len(retry) == 0 {
+			return undelivered
+		}
+		d.s.metrics.Add(metrics.DeliveryRetries, float64(len(retry)), metrics.Labels{"receiver": rec.String()})
+		w.release()
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return append(undelivered, retryDels...)
+		}
+		if err := w.acquire(ctx); err != nil {
+			return append(undelivered, retryDels...)
+		}
+		backoff *= 2
+		messages, dels = retry, retryDels
+	}
+}
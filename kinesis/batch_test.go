@@ -0,0 +1,157 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchReceiver records the size of every batch and fails the messages of fail
+// the first time they are delivered.
+type batchReceiver struct {
+	*fakeReceiver
+	fail map[string]error
+
+	batchMu sync.Mutex
+	sizes   []int
+}
+
+func (b *batchReceiver) DeliverBatch(ctx context.Context, batch [][]byte) []error {
+	b.batchMu.Lock()
+	b.sizes = append(b.sizes, len(batch))
+	var errs []error
+	for i, m := range batch {
+		if err, ok := b.fail[string(m)]; ok {
+			delete(b.fail, string(m))
+			if errs == nil {
+				errs = make([]error, len(batch))
+			}
+			errs[i] = err
+		}
+	}
+	b.batchMu.Unlock()
+	for i, m := range batch {
+		if errs == nil || errs[i] == nil {
+			b.AddMessage(m)
+		}
+	}
+	return errs
+}
+
+func (b *batchReceiver) batchSizes() []int {
+	b.batchMu.Lock()
+	defer b.batchMu.Unlock()
+	return append([]int(nil), b.sizes...)
+}
+
+func TestStreamer_StreamBatches(t *testing.T) {
+	deadLetters := make(chan string, 1)
+	tests := []struct {
+		name      string
+		records   []string
+		batch     BatchConfig
+		fail      map[string]error
+		wantSizes string
+		wantErr   bool
+	}{
+		{
+			name:      "maxCount",
+			records:   []string{"a", "b", "c", "d", "e"},
+			batch:     BatchConfig{MaxCount: 2, Linger: time.Second},
+			wantSizes: "[2 2 1]",
+		},
+		{
+			name:      "maxBytes",
+			records:   []string{"aa", "bb", "cc"},
+			batch:     BatchConfig{MaxBytes: 4, Linger: time.Second},
+			wantSizes: "[2 1]",
+		},
+		{
+			name:      "retryFailedMessages",
+			records:   []string{"a", "b", "c"},
+			batch:     BatchConfig{MaxCount: 3, Linger: time.Second, Backoff: time.Millisecond},
+			fail:      map[string]error{"b": errors.New("throttled")},
+			wantSizes: "[3 1]",
+		},
+		{
+			name:    "notRetryable",
+			records: []string{"a", "b", "c"},
+			batch: BatchConfig{MaxCount: 3, Linger: time.Second, Retryable: func(err error) bool {
+				return false
+			}},
+			fail:      map[string]error{"b": errors.New("invalid")},
+			wantSizes: "[3]",
+			wantErr:   true,
+		},
+		{
+			name:    "deadLetter",
+			records: []string{"a", "b", "c"},
+			batch: BatchConfig{MaxCount: 3, Linger: time.Second, MaxAttempts: 1, DeadLetter: func(ctx context.Context, b []byte, err error) error {
+				deadLetters <- string(b)
+				return nil
+			}},
+			fail:      map[string]error{"b": errors.New("throttled")},
+			wantSizes: "[3]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := len(tt.records)
+			if tt.wantErr {
+				want = -1
+			} else if tt.batch.DeadLetter != nil {
+				// the failed messages only reach the dead-letter function
+				want -= len(tt.fail)
+			}
+			rec := &batchReceiver{fakeReceiver: newFakeReceiver("batch", want, nil), fail: tt.fail}
+			s := newTestStreamer(t, &fakeKinesis{}, WithReceiverConfig("batch", ReceiverConfig{Workers: 1, Batch: tt.batch}))
+			s.c = sliceScanner{"s1": tt.records}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go func() {
+				<-rec.done
+				cancel()
+			}()
+			err := s.Stream(ctx, rec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Stream() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := fmt.Sprint(rec.batchSizes()); got != tt.wantSizes {
+				t.Errorf("batch sizes = %v, want %v", got, tt.wantSizes)
+			}
+			if tt.batch.DeadLetter != nil {
+				if got := <-deadLetters; got != "b" {
+					t.Errorf("dead letter got = %v, want b", got)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamer_StreamBatchLinger(t *testing.T) {
+	rec := &batchReceiver{fakeReceiver: newFakeReceiver("batch", 2, nil)}
+	s := newTestStreamer(t, &fakeKinesis{}, WithReceiverConfig("batch", ReceiverConfig{
+		Workers: 1,
+		Batch:   BatchConfig{MaxCount: 10, Linger: 20 * time.Millisecond},
+	}))
+	s.c = sliceScanner{"s1": {"a", "b"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-rec.done
+		cancel()
+	}()
+	start := time.Now()
+	if err := s.Stream(ctx, rec); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	if got, want := fmt.Sprint(rec.batchSizes()), "[2]"; got != want {
+		t.Errorf("batch sizes = %v, want %v", got, want)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stream() took %v, want the partial batch sent after lingering", elapsed)
+	}
+}
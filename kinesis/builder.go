@@ -0,0 +1,172 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"github.com/nicolasassi/kinestesia/translator"
+)
+
+// StreamConfig configures a stream of a StreamersBuilder.
+type StreamConfig struct {
+	// StartingPosition is where the shards without a checkpoint start being read.
+	// If its Type is empty LATEST is used.
+	StartingPosition StartingPosition
+	// ConsumerOptions are passed to the polling consumer of the stream.
+	ConsumerOptions []consumer.Option
+	// Options are applied after the ones of the builder, overriding them for
+	// the stream.
+	Options []StreamerOption
+	// Translator translates the records of the stream for every receiver of
+	// the stream instead of their own translation, as receivers.Translation. If
+	// nil each receiver translates as configured.
+	Translator *translator.Translator
+	// Receivers get the records of the stream besides the receivers routed to it.
+	Receivers []receivers.Receiver
+}
+
+// RoutingTable lists the names of the receivers of every stream.
+type RoutingTable map[string][]string
+
+// StreamersBuilder builds Streamers where each stream has its own options and
+// receivers:
+//
+//	streamers, err := kinesis.NewStreamersBuilder(kinesis.WithKinesisClient(client)).
+//		Stream("orders", kinesis.StreamConfig{Receivers: []receivers.Receiver{topicA}}).
+//		Stream("clicks", kinesis.StreamConfig{}).
+//		Receiver(sink).
+//		Route("clicks", sink.String()).
+//		Build(ctx)
+//
+// Streamers.Stream then sends every stream to its receivers only.
+type StreamersBuilder struct {
+	opts      []StreamerOption
+	streams   []string
+	configs   map[string]StreamConfig
+	receivers map[string]receivers.Receiver
+	routes    RoutingTable
+	err       error
+}
+
+// NewStreamersBuilder returns a builder whose streams all get opts.
+func NewStreamersBuilder(opts ...StreamerOption) *StreamersBuilder {
+	return &StreamersBuilder{
+		opts:      opts,
+		configs:   map[string]StreamConfig{},
+		receivers: map[string]receivers.Receiver{},
+		routes:    RoutingTable{},
+	}
+}
+
+// Stream adds the stream name configured with cfg.
+func (b *StreamersBuilder) Stream(name string, cfg StreamConfig) *StreamersBuilder {
+	switch _, ok := b.configs[name]; {
+	case name == "":
+		b.fail(fmt.Errorf("stream name is required"))
+	case ok:
+		b.fail(fmt.Errorf("stream %s added twice", name))
+	default:
+		b.streams = append(b.streams, name)
+		b.configs[name] = cfg
+	}
+	return b
+}
+
+// Receiver adds rec to be routed to streams by its name.
+func (b *StreamersBuilder) Receiver(rec receivers.Receiver) *StreamersBuilder {
+	if _, ok := b.receivers[rec.String()]; ok {
+		b.fail(fmt.Errorf("receiver %s added twice", rec.String()))
+		return b
+	}
+	b.receivers[rec.String()] = rec
+	return b
+}
+
+// Route sends the records of stream to the receivers added with Receiver
+// named receiverNames.
+func (b *StreamersBuilder) Route(stream string, receiverNames ...string) *StreamersBuilder {
+	b.routes[stream] = append(b.routes[stream], receiverNames...)
+	return b
+}
+
+// Routes adds every route of table, as Route.
+func (b *StreamersBuilder) Routes(table RoutingTable) *StreamersBuilder {
+	for stream, receiverNames := range table {
+		b.Route(stream, receiverNames...)
+	}
+	return b
+}
+
+func (b *StreamersBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Build creates the Streamers of the streams in the order they were added. It
+// fails if a route names an unknown stream or receiver or a stream has no
+// receivers, and with a *StreamersError if some of the Streamers fail to be
+// created, as NewStreamers.
+func (b *StreamersBuilder) Build(ctx context.Context) (*Streamers, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.streams) == 0 {
+		return nil, fmt.Errorf("no streams added")
+	}
+	bound := map[string][]receivers.Receiver{}
+	for stream, receiverNames := range b.routes {
+		if _, ok := b.configs[stream]; !ok {
+			return nil, fmt.Errorf("route of unknown stream %s", stream)
+		}
+		for _, name := range receiverNames {
+			rec, ok := b.receivers[name]
+			if !ok {
+				return nil, fmt.Errorf("stream %s routed to unknown receiver %s", stream, name)
+			}
+			bound[stream] = append(bound[stream], rec)
+		}
+	}
+	for _, name := range b.streams {
+		cfg := b.configs[name]
+		recs := append(append([]receivers.Receiver(nil), cfg.Receivers...), bound[name]...)
+		if len(recs) == 0 {
+			return nil, fmt.Errorf("stream %s has no receivers", name)
+		}
+		if cfg.Translator != nil {
+			for i, rec := range recs {
+				recs[i] = receivers.Chain(rec, receivers.Translation(cfg.Translator))
+			}
+		}
+		bound[name] = recs
+	}
+	streamers, err := newStreamers(ctx, b.streams, func(name string) []StreamerOption {
+		return b.streamerOptions(b.configs[name])
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, streamer := range streamers {
+		streamer.bound = bound[streamer.name]
+	}
+	return &streamers, nil
+}
+
+func (b *StreamersBuilder) streamerOptions(cfg StreamConfig) []StreamerOption {
+	opts := append([]StreamerOption(nil), b.opts...)
+	if cfg.StartingPosition.Type != "" {
+		opts = append(opts, WithStartingPosition(cfg.StartingPosition))
+	}
+	opts = append(opts, cfg.Options...)
+	if len(cfg.ConsumerOptions) > 0 {
+		opts = append(opts, WithConsumerOptions(cfg.ConsumerOptions...))
+	}
+	return opts
+}
+
+// Receivers returns the receivers the Streamer streams to when it was built by
+// a StreamersBuilder.
+func (s *Streamer) Receivers() []receivers.Receiver {
+	return append([]receivers.Receiver(nil), s.bound...)
+}
@@ -0,0 +1,139 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"github.com/nicolasassi/kinestesia/translator"
+	"sync"
+	"testing"
+	"time"
+)
+
+// iteratorKinesis records the shard iterator types requested.
+type iteratorKinesis struct {
+	*fakeKinesis
+
+	mu    sync.Mutex
+	types []string
+}
+
+func (f *iteratorKinesis) GetShardIteratorWithContext(ctx aws.Context, input *kinesis.GetShardIteratorInput, opts ...request.Option) (*kinesis.GetShardIteratorOutput, error) {
+	f.mu.Lock()
+	f.types = append(f.types, aws.StringValue(input.ShardIteratorType))
+	f.mu.Unlock()
+	return f.fakeKinesis.GetShardIteratorWithContext(ctx, input, opts...)
+}
+
+func TestStreamersBuilder_Build(t *testing.T) {
+	rec := newFakeReceiver("rec", 1, nil)
+	tests := []struct {
+		name    string
+		build   func(b *StreamersBuilder)
+		wantErr string
+	}{
+		{"noStreams", func(b *StreamersBuilder) {}, "no streams added"},
+		{"streamTwice", func(b *StreamersBuilder) {
+			b.Stream("a", StreamConfig{Receivers: []receivers.Receiver{rec}}).Stream("a", StreamConfig{})
+		}, "stream a added twice"},
+		{"receiverTwice", func(b *StreamersBuilder) {
+			b.Stream("a", StreamConfig{}).Receiver(rec).Receiver(rec).Route("a", "rec")
+		}, "receiver rec added twice"},
+		{"unknownStream", func(b *StreamersBuilder) {
+			b.Stream("a", StreamConfig{}).Receiver(rec).Route("b", "rec")
+		}, "route of unknown stream b"},
+		{"unknownReceiver", func(b *StreamersBuilder) {
+			b.Stream("a", StreamConfig{}).Routes(RoutingTable{"a": {"other"}})
+		}, "stream a routed to unknown receiver other"},
+		{"noReceivers", func(b *StreamersBuilder) {
+			b.Stream("a", StreamConfig{Receivers: []receivers.Receiver{rec}}).Stream("b", StreamConfig{})
+		}, "stream b has no receivers"},
+		{"atTimestampWithoutTimestamp", func(b *StreamersBuilder) {
+			b.Stream("a", StreamConfig{
+				StartingPosition: StartingPosition{Type: kinesis.ShardIteratorTypeAtTimestamp},
+				Receivers:        []receivers.Receiver{rec},
+			})
+		}, "streams a failed: stream a: new streamer error: starting position AT_TIMESTAMP requires a timestamp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewStreamersBuilder(WithKinesisClient(&fakeKinesis{}))
+			tt.build(b)
+			_, err := b.Build(context.Background())
+			if fmt.Sprint(err) != tt.wantErr {
+				t.Errorf("Build() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStreamersBuilder_Stream(t *testing.T) {
+	orders := &iteratorKinesis{fakeKinesis: &fakeKinesis{
+		shards:  []*kinesis.Shard{shard("s1", "", "")},
+		records: map[string][]string{"s1": {`{"id":1}`, `{"id":2}`}},
+	}}
+	clicks := &iteratorKinesis{fakeKinesis: &fakeKinesis{
+		shards:  []*kinesis.Shard{shard("s1", "", "")},
+		records: map[string][]string{"s1": {`{"page":"home"}`}},
+	}}
+	topic := newFakeReceiver("topic", 2, nil)
+	sink := newFakeReceiver("sink", 1, nil)
+	streamers, err := NewStreamersBuilder(WithDrainTimeout(time.Second)).
+		Stream("orders", StreamConfig{
+			StartingPosition: StartingPosition{Type: kinesis.ShardIteratorTypeTrimHorizon},
+			ConsumerOptions:  []consumer.Option{consumer.WithScanInterval(time.Millisecond)},
+			Options:          []StreamerOption{WithKinesisClient(orders)},
+			Translator:       translator.NewTranslator(map[string]string{"id": "order_id"}, ""),
+			Receivers:        []receivers.Receiver{topic},
+		}).
+		Stream("clicks", StreamConfig{
+			ConsumerOptions: []consumer.Option{consumer.WithScanInterval(time.Millisecond)},
+			Options:         []StreamerOption{WithKinesisClient(clicks)},
+		}).
+		Receiver(sink).
+		Route("clicks", "sink").
+		Build(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := []string{(*streamers)[0].Name(), (*streamers)[1].Name()}; fmt.Sprint(got) != "[orders clicks]" {
+		t.Errorf("streams got = %v, want in the order added", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-topic.done
+		<-sink.done
+		cancel()
+	}()
+	if err := streamers.Stream(ctx); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	if got, want := fmt.Sprint(topic.received()), `[{"order_id":1} {"order_id":2}]`; got != want {
+		t.Errorf("topic received = %v, want %v", got, want)
+	}
+	if got, want := fmt.Sprint(sink.received()), `[{"page":"home"}]`; got != want {
+		t.Errorf("sink received = %v, want %v", got, want)
+	}
+	tests := []struct {
+		name string
+		api  *iteratorKinesis
+		want string
+	}{
+		{"orders", orders, kinesis.ShardIteratorTypeTrimHorizon},
+		{"clicks", clicks, kinesis.ShardIteratorTypeLatest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.api.mu.Lock()
+			defer tt.api.mu.Unlock()
+			if len(tt.api.types) == 0 || tt.api.types[0] != tt.want {
+				t.Errorf("shard iterator types got = %v, want %v first", tt.api.types, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package kinesis
+
+import (
+	"context"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"sync/atomic"
+)
+
+// readRecord follows a record read from a shard until every receiver it was
+// queued for is done with it, ending its span and checkpointing it then. It
+// starts held by the scan until the record is queued.
+type readRecord struct {
+	span       trace.Span
+	checkpoint *checkpointRecord
+	pending    int32
+	lost       int32
+}
+
+func newReadRecord(span trace.Span, checkpoint *checkpointRecord) *readRecord {
+	return &readRecord{span: span, checkpoint: checkpoint, pending: 1}
+}
+
+// add holds the record for a receiver.
+func (r *readRecord) add() {
+	atomic.AddInt32(&r.pending, 1)
+}
+
+// done releases a hold. With the last one the span ends and the record is
+// checkpointed unless it was lost.
+func (r *readRecord) done() {
+	if atomic.AddInt32(&r.pending, -1) != 0 {
+		return
+	}
+	r.span.End()
+	if r.checkpoint != nil {
+		r.checkpoint.done(atomic.LoadInt32(&r.lost) == 0)
+	}
+}
+
+// fail marks the record as not delivered by err, so neither it nor the records
+// read after it from its shard are checkpointed.
+func (r *readRecord) fail(err error) {
+	atomic.StoreInt32(&r.lost, 1)
+	tracing.SetError(r.span, err)
+}
+
+// checkpointer stores the checkpoint of a shard once its records are delivered.
+// A shard is checkpointed at the last record such that it and every record read
+// before it from the shard were delivered, so the records lost by a failure or
+// left by the drain are read again.
+type checkpointer struct {
+	streamName string
+	store      consumer.Store
+	onError    func(error)
+
+	mu     sync.Mutex
+	shards map[string]*shardCheckpoints
+}
+
+// shardCheckpoints are the records of a shard not checkpointed yet in the order
+// they were read. changed is closed whenever records are checkpointed.
+type shardCheckpoints struct {
+	records []*checkpointRecord
+	changed chan struct{}
+}
+
+type checkpointRecord struct {
+	c              *checkpointer
+	shardID        string
+	sequenceNumber string
+	delivered      bool
+}
+
+// newCheckpointer returns a checkpointer saving to store and passing the errors
+// of the store to onError.
+func newCheckpointer(streamName string, store consumer.Store, onError func(error)) *checkpointer {
+	return &checkpointer{
+		streamName: streamName,
+		store:      store,
+		onError:    onError,
+		shards:     map[string]*shardCheckpoints{},
+	}
+}
+
+// read adds the record read from shardID with sequenceNumber, which must be read
+// after every record already added for the shard.
+func (c *checkpointer) read(shardID, sequenceNumber string) *checkpointRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	shard, ok := c.shards[shardID]
+	if !ok {
+		shard = &shardCheckpoints{changed: make(chan struct{})}
+		c.shards[shardID] = shard
+	}
+	r := &checkpointRecord{c: c, shardID: shardID, sequenceNumber: sequenceNumber}
+	shard.records = append(shard.records, r)
+	return r
+}
+
+// done ends the record, checkpointing its shard as far as the records are
+// delivered.
+func (r *checkpointRecord) done(delivered bool) {
+	c := r.c
+	c.mu.Lock()
+	r.delivered = delivered
+	shard := c.shards[r.shardID]
+	n := 0
+	for n < len(shard.records) && shard.records[n].delivered {
+		n++
+	}
+	if n == 0 {
+		c.mu.Unlock()
+		return
+	}
+	last := shard.records[n-1].sequenceNumber
+	shard.records = shard.records[n:]
+	close(shard.changed)
+	shard.changed = make(chan struct{})
+	// stored under the lock so the checkpoints of a shard only move forward
+	var err error
+	if c.store != nil && last != "" {
+		err = c.store.SetCheckpoint(c.streamName, r.shardID, last)
+	}
+	c.mu.Unlock()
+	if err != nil && c.onError != nil {
+		c.onError(&StreamError{StreamName: c.streamName, ShardID: r.shardID, Op: "checkpoint", Err: err})
+	}
+}
+
+// wait waits until every record read from shardID is checkpointed or ctx is
+// done. A lost record blocks it until ctx is done.
+func (c *checkpointer) wait(ctx context.Context, shardID string) error {
+	for {
+		c.mu.Lock()
+		shard, ok := c.shards[shardID]
+		if !ok || len(shard.records) == 0 {
+			delete(c.shards, shardID)
+			c.mu.Unlock()
+			return nil
+		}
+		changed := shard.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckpointer(t *testing.T) {
+	store := new(memoryStore)
+	c := newCheckpointer("stream", store, nil)
+	records := []*checkpointRecord{c.read("s1", "1"), c.read("s1", "2"), c.read("s1", "3"), c.read("s1", "4")}
+	checkpoint := func() string {
+		seq, _ := store.GetCheckpoint("stream", "s1")
+		return seq
+	}
+	records[1].done(true)
+	if got := checkpoint(); got != "" {
+		t.Errorf("checkpoint got = %v, want none before the first record is delivered", got)
+	}
+	records[0].done(true)
+	if got := checkpoint(); got != "2" {
+		t.Errorf("checkpoint got = %v, want 2", got)
+	}
+	records[2].done(false)
+	records[3].done(true)
+	if got := checkpoint(); got != "2" {
+		t.Errorf("checkpoint got = %v, want 2 until the lost record", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.wait(ctx, "s1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait() error = %v, want the lost record to block it", err)
+	}
+}
+
+func TestCheckpointer_Wait(t *testing.T) {
+	c := newCheckpointer("stream", new(memoryStore), nil)
+	r := c.read("s1", "1")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.done(true)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.wait(ctx, "s1"); err != nil {
+		t.Errorf("wait() error = %v", err)
+	}
+}
+
+// failingStore is a checkpoint store failing every write.
+type failingStore struct {
+	memoryStore
+}
+
+func (*failingStore) SetCheckpoint(streamName, shardID, sequenceNumber string) error {
+	return errors.New("store down")
+}
+
+func TestCheckpointer_StoreError(t *testing.T) {
+	var got error
+	c := newCheckpointer("stream", &failingStore{}, func(err error) {
+		got = err
+	})
+	c.read("s1", "1").done(true)
+	var streamErr *StreamError
+	if !errors.As(got, &streamErr) || streamErr.Op != "checkpoint" || streamErr.ShardID != "s1" {
+		t.Errorf("onError got = %v, want the checkpoint StreamError", got)
+	}
+}
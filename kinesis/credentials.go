@@ -11,6 +11,8 @@ import (
 )
 
 // Credentials provides de credentials to access AWS Kinesis service.
+// Its value is never refreshed, credentials which expire should be given by a
+// RefreshingProvider.
 type Credentials struct {
 	Value      credentials.Value
 	// expiration sets the max time the credentials are valid.
@@ -57,32 +59,40 @@ func WithParameters(AccessKeyID, SecretAccessKey, SessionToken, ProviderName str
 // secret_access_key
 // session_token
 // provider_name
+// expiration, in RFC 3339
 // If any of the parameters are not given its value will be an empty string.
+// Values which are not strings are an error.
 func WithJSONFile(path string) (*Credentials, error) {
 	var valuesMap map[string]interface{}
-	f, err := os.Open(path)
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("[CREDENTIALS]: %v", err)
+		return nil, credentialsErrorf(path, "%w", err)
 	}
-	b, err := ioutil.ReadAll(f)
 	if err := json.Unmarshal(b, &valuesMap); err != nil {
-		return nil, fmt.Errorf("[CREDENTIALS]: %v", err)
+		return nil, credentialsErrorf(path, "%w", err)
 	}
-	value := credentials.Value{}
+	c := &Credentials{}
 	for k, v := range valuesMap {
-		v = v.(string)
+		s, ok := v.(string)
+		if !ok {
+			return nil, credentialsErrorf(path, "%s should be a string not %T", k, v)
+		}
 		switch k {
 		case "access_key_id":
-			value.AccessKeyID = v.(string)
+			c.Value.AccessKeyID = s
 		case "secret_access_key":
-			value.SecretAccessKey = v.(string)
+			c.Value.SecretAccessKey = s
 		case "session_token":
-			value.SessionToken = v.(string)
+			c.Value.SessionToken = s
 		case "provider_name":
-			value.ProviderName = v.(string)
+			c.Value.ProviderName = s
+		case "expiration":
+			if c.expiration, err = time.Parse(time.RFC3339, s); err != nil {
+				return nil, credentialsErrorf(path, "invalid expiration: %w", err)
+			}
 		}
 	}
-	return &Credentials{Value: value}, nil
+	return c, nil
 }
 
 // SetExpiration is a setter for the expiration field on Credentials.
@@ -198,6 +198,10 @@ func TestWithJSONFile(t *testing.T) {
 			args{path: fmt.Sprintf("%s/404.json",
 				testsFilesDirectory)},
 			nil, true},
+		{"notString",
+			args{path: fmt.Sprintf("%s/aws_credentials_invalid_test.json",
+				testsFilesDirectory)},
+			nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
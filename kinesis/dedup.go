@@ -0,0 +1,129 @@
+package kinesis
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"github.com/aws/aws-sdk-go/aws"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/logging"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"github.com/nicolasassi/kinestesia/translator"
+	"time"
+)
+
+const (
+	defaultDedupWindow   = 10 * time.Minute
+	defaultDedupCapacity = 100000
+)
+
+// DedupKeyFunc returns the key identifying the duplicates of a record read from
+// shardID.
+type DedupKeyFunc func(shardID string, r *consumer.Record) string
+
+// SequenceNumberKey is the default DedupKeyFunc. It drops the records read
+// again after a restart but not the ones put twice by a producer.
+func SequenceNumberKey(shardID string, r *consumer.Record) string {
+	return shardID + "/" + aws.StringValue(r.SequenceNumber)
+}
+
+// ContentHashKey is a DedupKeyFunc taking the SHA-256 of the data of the record.
+func ContentHashKey(shardID string, r *consumer.Record) string {
+	sum := sha256.Sum256(r.Data)
+	return hex.EncodeToString(sum[:])
+}
+
+// FieldDedupKey returns a DedupKeyFunc taking the key from the field at path of
+// the JSON payload of the record, as FieldOrderingKey. Records without the field
+// fall back to ContentHashKey.
+func FieldDedupKey(path string) DedupKeyFunc {
+	t := translator.NewTranslator(map[string]string{path: translatedKeyField}, "")
+	return func(shardID string, r *consumer.Record) string {
+		if key, ok := translatedKey(t, r.Data); ok {
+			return key
+		}
+		return ContentHashKey(shardID, r)
+	}
+}
+
+// DedupConfig sets how the duplicated records of a receiver are dropped. A key
+// is recorded when its record is taken for delivery, dropping the duplicates
+// delivered meanwhile, and forgotten if the delivery fails or is left by the
+// shutdown, so the record is delivered when read again.
+type DedupConfig struct {
+	// Key identifies the duplicates. The default is SequenceNumberKey.
+	Key DedupKeyFunc
+	// Window is how long a key is remembered. The default is 10 minutes.
+	Window time.Duration
+	// Store remembers the keys. It can be shared by receivers. The default is a
+	// MemoryDedupStore of 100000 keys for the receiver.
+	Store DedupStore
+}
+
+func (c DedupConfig) withDefaults() DedupConfig {
+	if c.Key == nil {
+		c.Key = SequenceNumberKey
+	}
+	if c.Window <= 0 {
+		c.Window = defaultDedupWindow
+	}
+	if c.Store == nil {
+		c.Store = NewMemoryDedupStore(defaultDedupCapacity)
+	}
+	return c
+}
+
+// DedupStore remembers the keys of the records delivered. It is the
+// receivers.DedupStore of the receivers.Dedup middleware.
+type DedupStore = receivers.DedupStore
+
+// duplicate tells whether del was already delivered to q, counting
+// metrics.DedupHits. Records are delivered when the store fails.
+func (d *dispatcher) duplicate(ctx context.Context, q *receiverQueue, del delivery) bool {
+	if q.dedup == nil {
+		return false
+	}
+	seen, err := q.dedup.Store.Seen(ctx, dedupKey(q, del), q.dedup.Window)
+	if err != nil {
+		d.s.logger.Log(logging.LevelWarn, logging.DedupFailed, logging.Fields{"stream": d.s.name, "receiver": q.rec.String(), "error": err})
+		return false
+	}
+	if seen {
+		d.s.metrics.Add(metrics.DedupHits, 1, metrics.Labels{"stream": d.s.name, "receiver": q.rec.String()})
+	}
+	return seen
+}
+
+// forget removes the key of del recorded for q by duplicate, as del was not
+// delivered.
+func (d *dispatcher) forget(ctx context.Context, q *receiverQueue, del delivery) {
+	if q.dedup == nil {
+		return
+	}
+	// del may be left because ctx is done
+	if err := q.dedup.Store.Forget(context.WithoutCancel(ctx), dedupKey(q, del)); err != nil {
+		d.s.logger.Log(logging.LevelWarn, logging.DedupFailed, logging.Fields{"stream": d.s.name, "receiver": q.rec.String(), "error": err})
+	}
+}
+
+// dedupKey is the key of del for q. The receiver name keeps the keys of
+// receivers sharing a store apart.
+func dedupKey(q *receiverQueue, del delivery) string {
+	return q.rec.String() + "\x00" + q.dedup.Key(del.shardID, del.record)
+}
+
+// MemoryDedupStore keeps the keys in memory, as receivers.MemoryDedupStore.
+type MemoryDedupStore = receivers.MemoryDedupStore
+
+func NewMemoryDedupStore(capacity int) *MemoryDedupStore {
+	return receivers.NewMemoryDedupStore(capacity)
+}
+
+// SQLDedupStore keeps the keys in a SQL table, as receivers.SQLDedupStore.
+type SQLDedupStore = receivers.SQLDedupStore
+
+func NewSQLDedupStore(db *sql.DB, tableName string) *SQLDedupStore {
+	return receivers.NewSQLDedupStore(db, tableName)
+}
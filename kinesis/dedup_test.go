@@ -0,0 +1,130 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"testing"
+	"time"
+)
+
+func TestDedupKeys(t *testing.T) {
+	r := &consumer.Record{}
+	r.Data = []byte(`{"event":{"id":"e1"}}`)
+	r.SequenceNumber = aws.String("42")
+	tests := []struct {
+		name string
+		key  DedupKeyFunc
+		data string
+		want string
+	}{
+		{"sequenceNumber", SequenceNumberKey, `{"event":{"id":"e1"}}`, "s1/42"},
+		{"contentHash", ContentHashKey, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"field", FieldDedupKey("event.id"), `{"event":{"id":"e1"}}`, "e1"},
+		{"missingField", FieldDedupKey("event.id"), "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.Data = []byte(tt.data)
+			if got := tt.key("s1", r); got != tt.want {
+				t.Errorf("key() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamer_StreamDedup(t *testing.T) {
+	records := []string{`{"id":1}`, `{"id":2}`, `{"id":1,"retry":true}`, `{"id":3}`, `{"id":2}`}
+	recorder := newFakeRecorder()
+	store := NewMemoryDedupStore(10)
+	s := newTestStreamer(t, &fakeKinesis{}, WithMetrics(recorder),
+		// a single worker keeps the order of the records with the same key
+		WithReceiverConfig("byField", ReceiverConfig{Workers: 1, Dedup: &DedupConfig{Key: FieldDedupKey("id"), Store: store}}),
+		WithReceiverConfig("byContent", ReceiverConfig{Dedup: &DedupConfig{Key: ContentHashKey, Store: store}}),
+		WithReceiverConfig("batches", ReceiverConfig{
+			Workers: 1,
+			Batch:   BatchConfig{Linger: time.Millisecond},
+			Dedup:   &DedupConfig{Key: FieldDedupKey("id")},
+		}),
+	)
+	s.c = sliceScanner{"s1": records}
+	byField := newFakeReceiver("byField", 3, nil)
+	byContent := newFakeReceiver("byContent", 4, nil)
+	batches := &batchReceiver{fakeReceiver: newFakeReceiver("batches", 3, nil)}
+	all := newFakeReceiver("all", 5, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-byField.done
+		<-byContent.done
+		<-batches.done
+		<-all.done
+		cancel()
+	}()
+	if err := s.Stream(ctx, byField, byContent, batches, all); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	tests := []struct {
+		rec      *fakeReceiver
+		want     string
+		wantHits float64
+	}{
+		{byField, `[{"id":1} {"id":2} {"id":3}]`, 2},
+		{byContent, `[{"id":1,"retry":true} {"id":1} {"id":2} {"id":3}]`, 1},
+		{batches.fakeReceiver, `[{"id":1} {"id":2} {"id":3}]`, 2},
+		{all, `[{"id":1,"retry":true} {"id":1} {"id":2} {"id":2} {"id":3}]`, 0},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tt.rec.received()); got != tt.want {
+			t.Errorf("%s received = %v, want %v", tt.rec.name, got, tt.want)
+		}
+		labels := metrics.Labels{"stream": "stream", "receiver": tt.rec.name}
+		if got := recorder.value(metrics.DedupHits, labels); got != tt.wantHits {
+			t.Errorf("%v%v = %v, want %v", metrics.DedupHits, labels, got, tt.wantHits)
+		}
+	}
+}
+
+func TestStreamer_StreamDedupForgetsFailed(t *testing.T) {
+	fail := func(b []byte) error {
+		if string(b) == `{"id":1}` {
+			return errors.New("down")
+		}
+		return nil
+	}
+	tests := []struct {
+		name string
+		rec  receivers.Receiver
+		cfg  ReceiverConfig
+	}{
+		{"deliverer", &failingReceiver{fakeReceiver: newFakeReceiver("rec", -1, nil), fail: fail}, ReceiverConfig{}},
+		{"batches", &batchReceiver{fakeReceiver: newFakeReceiver("rec", -1, nil), fail: map[string]error{`{"id":1}`: errors.New("down")}},
+			ReceiverConfig{Batch: BatchConfig{MaxCount: 1, Retryable: func(error) bool { return false }}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryDedupStore(10)
+			tt.cfg.Workers = 1
+			tt.cfg.Dedup = &DedupConfig{Key: FieldDedupKey("id"), Store: store}
+			s := newTestStreamer(t, &fakeKinesis{}, WithReceiverConfig("rec", tt.cfg))
+			s.c = sliceScanner{"s1": {`{"id":2}`, `{"id":1}`}}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var deliveryErr *DeliveryError
+			if err := s.Stream(ctx, tt.rec); !errors.As(err, &deliveryErr) {
+				t.Fatalf("Stream() error = %v, want *DeliveryError", err)
+			}
+			// the failed record is delivered when read again
+			if seen, _ := store.Seen(ctx, "rec\x001", time.Minute); seen {
+				t.Errorf("key of the failed record recorded")
+			}
+			if seen, _ := store.Seen(ctx, "rec\x002", time.Minute); !seen {
+				t.Errorf("key of the delivered record not recorded")
+			}
+		})
+	}
+}
@@ -0,0 +1,546 @@
+package kinesis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/logging"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"github.com/nicolasassi/kinestesia/tracing"
+	"github.com/nicolasassi/kinestesia/translator"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// DeliveryMode sets the order in which the records are delivered to each receiver.
+type DeliveryMode int
+
+const (
+	// UnorderedDelivery delivers the records to a receiver in parallel as its
+	// workers are free. It is the default.
+	UnorderedDelivery DeliveryMode = iota
+	// ShardOrderedDelivery delivers the records of a shard to a receiver one at a
+	// time in the order they were read. Different shards are delivered in parallel.
+	ShardOrderedDelivery
+	// KeyOrderedDelivery delivers the records with the same ordering key to a
+	// receiver one at a time in the order they were read. Different keys are
+	// delivered in parallel. The key is the partition key of the record unless
+	// set with WithOrderingKey, and it is given to receivers.ContextReceiver in
+	// the context of the message.
+	KeyOrderedDelivery
+)
+
+// OrderingKeyFunc returns the ordering key of a record read from shardID.
+type OrderingKeyFunc func(shardID string, r *consumer.Record) string
+
+// PartitionKey is the default OrderingKeyFunc.
+func PartitionKey(shardID string, r *consumer.Record) string {
+	return aws.StringValue(r.PartitionKey)
+}
+
+// FieldOrderingKey returns an OrderingKeyFunc taking the key from the field at
+// path of the JSON payload of the record. path follows the syntax of the
+// translator, as "payload.contacts.[0].id". Records without the field fall back
+// to their partition key.
+func FieldOrderingKey(path string) OrderingKeyFunc {
+	t := translator.NewTranslator(map[string]string{path: translatedKeyField}, "")
+	return func(shardID string, r *consumer.Record) string {
+		if key, ok := translatedKey(t, r.Data); ok {
+			return key
+		}
+		return PartitionKey(shardID, r)
+	}
+}
+
+// translatedKey returns the translatedKeyField of data translated by t. It is
+// false if data is not JSON or has no such field.
+func translatedKey(t *translator.Translator, data []byte) (string, bool) {
+	var m translator.ObjectJSON
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", false
+	}
+	resp := t.Translate(m)
+	if resp == nil {
+		return "", false
+	}
+	switch key := (*resp)[translatedKeyField].(type) {
+	case nil:
+		return "", false
+	case string:
+		return key, true
+	default:
+		return fmt.Sprint(key), true
+	}
+}
+
+// translatedKeyField is the translated name of the field holding a key. It can't
+// clash with the untranslated fields of the payload.
+const translatedKeyField = "\x00key"
+
+// ReceiverConfig sets how the records are delivered to a receiver.
+type ReceiverConfig struct {
+	// Workers is the maximum number of records delivered to the receiver at once.
+	// The default is a fair share of the workers of the Streamer, at least one,
+	// so a slow receiver cannot take the workers of the others.
+	Workers int
+	// QueueSize is the number of records waiting for a worker of the receiver.
+	// Scanning blocks while the queue is full. The default is Workers.
+	QueueSize int
+	// Batch sets how the batches of a receivers.BatchReceiver are assembled.
+	// Each batch takes one worker.
+	Batch BatchConfig
+	// MaxInFlight is the number of records of the receiver queued or being
+	// delivered at once. Scanning pauses while it is reached. The default is
+	// QueueSize plus Workers.
+	MaxInFlight int
+	// MaxInFlightBytes is the size of the records of the receiver queued or being
+	// delivered at once. Scanning pauses while it is reached. A record bigger
+	// than the limit is delivered alone. The default is no limit.
+	MaxInFlightBytes int64
+	// RateLimit limits the records delivered to the receiver. Records wait in
+	// the queue while it is reached, pausing the scan once the queue is full.
+	// It can be changed while streaming with Streamer.SetReceiverRateLimit.
+	RateLimit RateLimit
+	// Dedup drops the records already delivered to the receiver within a time
+	// window. Nil delivers every record.
+	Dedup *DedupConfig
+	// Sample delivers a fraction of the records to the receiver, as for a shadow
+	// receiver getting part of the traffic. Nil delivers every record.
+	Sample *SampleConfig
+}
+
+// WithWorkers sets the maximum number of records delivered at once across every
+// receiver. The default is 20.
+func WithWorkers(n int) StreamerOption {
+	return func(s *Streamer) {
+		s.workers = n
+	}
+}
+
+// WithReceiverConfig sets how the records are delivered to the receiver whose
+// String method returns receiver.
+func WithReceiverConfig(receiver string, cfg ReceiverConfig) StreamerOption {
+	return func(s *Streamer) {
+		if s.receiverConfigs == nil {
+			s.receiverConfigs = map[string]ReceiverConfig{}
+		}
+		s.receiverConfigs[receiver] = cfg
+	}
+}
+
+// WithDeliveryMode sets the order in which the records are delivered.
+func WithDeliveryMode(m DeliveryMode) StreamerOption {
+	return func(s *Streamer) {
+		s.deliveryMode = m
+	}
+}
+
+// WithOrderingKey sets the key of the records for KeyOrderedDelivery.
+func WithOrderingKey(fn OrderingKeyFunc) StreamerOption {
+	return func(s *Streamer) {
+		s.orderingKey = fn
+	}
+}
+
+// delivery is a record waiting to be delivered to a receiver. ctx holds the
+// span of the record. key chooses the lane of ordered deliveries.
+type delivery struct {
+	id      uint64
+	ctx     context.Context
+	read    *readRecord
+	key     string
+	shardID string
+	record  *consumer.Record
+}
+
+// receiverQueue holds the deliveries of a receiver. Unordered deliveries share
+// one lane read by every worker of the receiver while ordered deliveries are
+// spread by key across lanes with a single worker each.
+type receiverQueue struct {
+	rec     receivers.Receiver
+	workers int
+	lanes   []chan delivery
+	flow    *flowControl
+	limiter *receivers.RateLimiter
+	batch   BatchConfig
+	dedup   *DedupConfig
+	sample  *SampleConfig
+	pause   *pauseGate
+}
+
+func newReceiverQueue(streamName string, rec receivers.Receiver, cfg ReceiverConfig, mode DeliveryMode, limiter *receivers.RateLimiter, logger logging.Logger) *receiverQueue {
+	q := &receiverQueue{
+		rec:     rec,
+		workers: cfg.Workers,
+		flow:    newFlowControl(logging.With(logger, logging.Fields{"stream": streamName, "receiver": rec.String()}), cfg.MaxInFlight, cfg.MaxInFlightBytes),
+		limiter: limiter,
+		batch:   cfg.Batch.withDefaults(),
+		sample:  cfg.Sample,
+	}
+	if cfg.Dedup != nil {
+		dedup := cfg.Dedup.withDefaults()
+		q.dedup = &dedup
+	}
+	if mode == UnorderedDelivery {
+		q.lanes = []chan delivery{make(chan delivery, cfg.QueueSize)}
+		return q
+	}
+	laneSize := cfg.QueueSize / cfg.Workers
+	if laneSize < 1 {
+		laneSize = 1
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		q.lanes = append(q.lanes, make(chan delivery, laneSize))
+	}
+	return q
+}
+
+// push waits for room in the lane of d.
+func (q *receiverQueue) push(ctx context.Context, d delivery) error {
+	lane := q.lanes[0]
+	if len(q.lanes) > 1 {
+		h := fnv.New32a()
+		h.Write([]byte(d.key))
+		lane = q.lanes[h.Sum32()%uint32(len(q.lanes))]
+	}
+	select {
+	case lane <- d:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dispatcher delivers the records of a Streamer to its receivers. The workers
+// of every receiver share the global limit of the Streamer, which is split
+// evenly between the receivers without a number of workers.
+type dispatcher struct {
+	s       Streamer
+	sem     *semaphore.Weighted
+	limit   int
+	workers int64
+	queues  []*receiverQueue
+	errc    chan<- error
+
+	// pending has the deliveries queued or being delivered by id.
+	mu      sync.Mutex
+	lastID  uint64
+	pending map[uint64]pendingDelivery
+}
+
+func (s Streamer) newDispatcher(args []receivers.Receiver, errc chan<- error) *dispatcher {
+	limit := s.workers
+	if limit <= 0 {
+		limit = maxWorkersForReceivers
+	}
+	d := &dispatcher{
+		s:       s,
+		sem:     semaphore.NewWeighted(int64(limit)),
+		limit:   limit,
+		errc:    errc,
+		pending: map[uint64]pendingDelivery{},
+	}
+	share := limit
+	if len(args) > 0 {
+		share = limit / len(args)
+	}
+	if share < 1 {
+		share = 1
+	}
+	for _, rec := range args {
+		cfg := s.receiverConfigs[rec.String()]
+		if cfg.Workers <= 0 {
+			cfg.Workers = share
+		}
+		// a worker of a BatchReceiver holds a whole batch
+		batchSize := 1
+		if _, ok := rec.(receivers.BatchReceiver); ok {
+			cfg.Batch = cfg.Batch.withDefaults()
+			batchSize = cfg.Batch.MaxCount
+		}
+		if cfg.QueueSize <= 0 {
+			cfg.QueueSize = cfg.Workers * batchSize
+		}
+		if cfg.MaxInFlight <= 0 {
+			cfg.MaxInFlight = cfg.QueueSize + cfg.Workers*batchSize
+		}
+		limiter := s.rateLimits.receiver(rec.String(), cfg.RateLimit)
+		q := newReceiverQueue(s.name, rec, cfg, s.deliveryMode, limiter, s.logger)
+		q.pause = s.state.gate(rec.String())
+		d.queues = append(d.queues, q)
+	}
+	return d
+}
+
+// start runs the workers of every receiver until ctx is done.
+func (d *dispatcher) start(ctx context.Context) {
+	d.s.metrics.Set(metrics.WorkersLimit, float64(d.limit), metrics.Labels{"stream": d.s.name})
+	for _, q := range d.queues {
+		work := d.work
+		if _, ok := q.rec.(receivers.BatchReceiver); ok {
+			work = d.workBatches
+		}
+		if len(q.lanes) > 1 {
+			for _, lane := range q.lanes {
+				go work(ctx, q, lane)
+			}
+			continue
+		}
+		for i := 0; i < q.workers; i++ {
+			go work(ctx, q, q.lanes[0])
+		}
+	}
+}
+
+// dispatch queues the record for every receiver, waiting while ctx is not done.
+// recordCtx is given to the receivers with the record and read is held until
+// each receiver is done with it.
+func (d *dispatcher) dispatch(ctx, recordCtx context.Context, read *readRecord, shardID string, r *consumer.Record) error {
+	del := delivery{ctx: recordCtx, read: read, key: shardID, shardID: shardID, record: r}
+	if d.s.deliveryMode == KeyOrderedDelivery {
+		orderingKey := d.s.orderingKey
+		if orderingKey == nil {
+			orderingKey = PartitionKey
+		}
+		del.key = orderingKey(shardID, r)
+		del.ctx = receivers.WithOrderingKey(recordCtx, del.key)
+	}
+	for _, q := range d.queues {
+		if !d.sampled(q, shardID, r) {
+			continue
+		}
+		if err := d.acquire(ctx, q, r); err != nil {
+			return err
+		}
+		del.id = d.track(q, del)
+		if err := q.push(ctx, del); err != nil {
+			d.release(q, del)
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingDelivery is a delivery queued or being delivered.
+type pendingDelivery struct {
+	Undelivered
+	read *readRecord
+}
+
+// track adds del for q to the pending deliveries and returns its id.
+func (d *dispatcher) track(q *receiverQueue, del delivery) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastID++
+	del.read.add()
+	d.pending[d.lastID] = pendingDelivery{
+		Undelivered: Undelivered{
+			Receiver:       q.rec.String(),
+			ShardID:        del.shardID,
+			SequenceNumber: aws.StringValue(del.record.SequenceNumber),
+		},
+		read: del.read,
+	}
+	return d.lastID
+}
+
+// acquire waits for the in-flight limits of q to allow r, pausing the scan.
+func (d *dispatcher) acquire(ctx context.Context, q *receiverQueue, r *consumer.Record) error {
+	labels := metrics.Labels{"stream": d.s.name, "receiver": q.rec.String()}
+	paused, err := q.flow.acquire(ctx, len(r.Data))
+	if paused > 0 {
+		d.s.metrics.Add(metrics.BackpressurePauses, 1, labels)
+		d.s.metrics.Add(metrics.BackpressureSeconds, paused.Seconds(), labels)
+	}
+	if err != nil {
+		return err
+	}
+	count, size := q.flow.inFlight()
+	d.s.metrics.Set(metrics.InFlightRecords, float64(count), labels)
+	d.s.metrics.Set(metrics.InFlightBytes, float64(size), labels)
+	return nil
+}
+
+// release ends the delivery del of q.
+func (d *dispatcher) release(q *receiverQueue, del delivery) {
+	d.mu.Lock()
+	_, pending := d.pending[del.id]
+	delete(d.pending, del.id)
+	d.mu.Unlock()
+	// the deliveries left by the drain already released their record
+	if pending {
+		del.read.done()
+	}
+	q.flow.release(len(del.record.Data))
+	count, size := q.flow.inFlight()
+	labels := metrics.Labels{"stream": d.s.name, "receiver": q.rec.String()}
+	d.s.metrics.Set(metrics.InFlightRecords, float64(count), labels)
+	d.s.metrics.Set(metrics.InFlightBytes, float64(size), labels)
+}
+
+func (d *dispatcher) work(ctx context.Context, q *receiverQueue, lane <-chan delivery) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case del := <-lane:
+			if d.duplicate(ctx, q, del) {
+				d.release(q, del)
+				continue
+			}
+			w, err := d.acquireWorker(ctx, q, 1, len(del.record.Data))
+			if err != nil {
+				d.forget(ctx, q, del)
+				return
+			}
+			delivered := d.deliver(ctx, q.rec, del, w)
+			w.release()
+			if !delivered {
+				d.forget(ctx, q, del)
+			}
+			d.release(q, del)
+		}
+	}
+}
+
+// acquireWorker waits until q is not paused, its rate limit allows count
+// records of size bytes and a worker of the stream is free.
+func (d *dispatcher) acquireWorker(ctx context.Context, q *receiverQueue, count, size int) (*worker, error) {
+	if err := q.pause.wait(ctx); err != nil {
+		return nil, err
+	}
+	if err := d.waitRateLimit(ctx, q, count, size); err != nil {
+		return nil, err
+	}
+	w := &worker{d: d}
+	if err := w.acquire(ctx); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// worker is the worker of the stream taken by a delivery. The receiver gives it
+// back while waiting, as between retries, with receivers.Idle.
+type worker struct {
+	d    *dispatcher
+	mu   sync.Mutex
+	held bool
+}
+
+// acquire takes a worker of the stream unless w already holds one.
+func (w *worker) acquire(ctx context.Context) error {
+	w.mu.Lock()
+	held := w.held
+	w.mu.Unlock()
+	if held {
+		return nil
+	}
+	if err := w.d.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.held {
+		// taken meanwhile by a concurrent wait of the delivery
+		w.d.sem.Release(1)
+		return nil
+	}
+	w.held = true
+	w.d.s.metrics.Set(metrics.WorkersInUse, float64(atomic.AddInt64(&w.d.workers, 1)), metrics.Labels{"stream": w.d.s.name})
+	return nil
+}
+
+// release gives back the worker held by w, if any.
+func (w *worker) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.held {
+		return
+	}
+	w.held = false
+	w.d.sem.Release(1)
+	w.d.s.metrics.Set(metrics.WorkersInUse, float64(atomic.AddInt64(&w.d.workers, -1)), metrics.Labels{"stream": w.d.s.name})
+}
+
+// waitRateLimit waits for the rate limit of q to allow count records of size
+// bytes.
+func (d *dispatcher) waitRateLimit(ctx context.Context, q *receiverQueue, count, size int) error {
+	waited, err := q.limiter.Wait(ctx, count, size)
+	if waited > 0 {
+		d.s.metrics.Add(metrics.RateLimitSeconds, waited.Seconds(), metrics.Labels{"stream": d.s.name, "receiver": q.rec.String()})
+	}
+	return err
+}
+
+// deliver sends del to rec with the worker w. It is false if del failed to
+// translate or to be delivered.
+func (d *dispatcher) deliver(ctx context.Context, rec receivers.Receiver, del delivery, w *worker) bool {
+	data, ok := d.translate(ctx, rec, del)
+	if !ok {
+		return false
+	}
+	if data == nil {
+		return true
+	}
+	addCtx, span := d.s.tracer.Start(del.ctx, "receiver.deliver", trace.WithAttributes(attribute.String("receiver", rec.String())))
+	defer span.End()
+	addCtx = receivers.WithIdle(addCtx, w.release, w.acquire)
+	switch rec := rec.(type) {
+	case receivers.Deliverer:
+		if err := rec.Deliver(addCtx, data); err != nil {
+			tracing.SetError(span, err)
+			del.read.fail(err)
+			d.report(&DeliveryError{StreamName: d.s.name, ShardID: del.shardID, SequenceNumber: aws.StringValue(del.record.SequenceNumber), Receiver: rec.String(), Err: err})
+			return false
+		}
+	case receivers.ContextReceiver:
+		rec.AddMessageContext(addCtx, data)
+	default:
+		rec.AddMessage(data)
+	}
+	return true
+}
+
+// translate returns the data of del for rec, which is nil if the record was
+// dropped by the filter rules. It is false if the record failed to translate,
+// which is reported.
+func (d *dispatcher) translate(ctx context.Context, rec receivers.Receiver, del delivery) ([]byte, bool) {
+	if !rec.TranslationRequired() {
+		return del.record.Data, true
+	}
+	receiverLabels := metrics.Labels{"stream": d.s.name, "receiver": rec.String()}
+	_, span := d.s.tracer.Start(del.ctx, "receiver.translate", trace.WithAttributes(attribute.String("receiver", rec.String())))
+	translated, err := rec.Translate(del.record.Data)
+	tracing.SetError(span, err)
+	span.End()
+	if err != nil {
+		del.read.fail(err)
+		d.s.metrics.Add(metrics.TranslationFailures, 1, receiverLabels)
+		fields := d.s.recordFields(rec.String(), del)
+		fields["error"] = err
+		d.s.logger.Log(logging.LevelError, logging.TranslationFailed, fields)
+		d.report(&TranslationError{StreamName: d.s.name, ShardID: del.shardID, SequenceNumber: aws.StringValue(del.record.SequenceNumber), Receiver: rec.String(), Err: err})
+		return nil, false
+	}
+	if translated == nil {
+		d.s.metrics.Add(metrics.FilterDrops, 1, receiverLabels)
+	}
+	return translated, true
+}
+
+// report stops the Stream with err. Only the first error is kept: the workers
+// failing after it go on without waiting for the Stream to read it, as they
+// would otherwise hold their records until the end of the drain.
+func (d *dispatcher) report(err error) {
+	select {
+	case d.errc <- err:
+	default:
+	}
+}
@@ -0,0 +1,130 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDrainTimeout = 10 * time.Second
+	drainPollInterval   = 10 * time.Millisecond
+)
+
+// WithDrainTimeout sets how long Stream waits, once ctx is done, for the records
+// already read to be delivered and for the receivers to flush. Zero stops right
+// away. The default is 10 seconds.
+func WithDrainTimeout(d time.Duration) StreamerOption {
+	return func(s *Streamer) {
+		s.drainTimeout = d
+	}
+}
+
+// Undelivered is a record which was read but not delivered to a receiver
+// before the end of the drain.
+type Undelivered struct {
+	Receiver       string
+	ShardID        string
+	SequenceNumber string
+}
+
+// DrainError is returned by Stream when records are left undelivered once the
+// drain timeout passes. Their shards are checkpointed before the first of them
+// so they are read again by the next Stream.
+type DrainError struct {
+	StreamName  string
+	Undelivered []Undelivered
+}
+
+func (e *DrainError) Error() string {
+	receivers := map[string]int{}
+	for _, u := range e.Undelivered {
+		receivers[u.Receiver]++
+	}
+	var counts []string
+	for receiver, n := range receivers {
+		counts = append(counts, fmt.Sprintf("%s: %d", receiver, n))
+	}
+	sort.Strings(counts)
+	return fmt.Sprintf("stream %s shut down with undelivered records (%s)", e.StreamName, strings.Join(counts, ", "))
+}
+
+// errNotDelivered marks the spans of the records left by the drain.
+var errNotDelivered = errors.New("record not delivered before the drain timeout")
+
+// valueContext keeps the values of a context, as its trace, without its
+// cancellation so the records read can be delivered after it is done.
+type valueContext struct {
+	context.Context
+}
+
+func (valueContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (valueContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valueContext) Err() error {
+	return nil
+}
+
+// checkpointCloser is implemented by the checkpoint stores which buffer the
+// checkpoints, as the ddb, mysql and postgres stores of kinesis-consumer.
+type checkpointCloser interface {
+	Shutdown() error
+}
+
+// closeStore flushes the final checkpoints of the store of the Streamer.
+func (s Streamer) closeStore() error {
+	store := s.store
+	if s.fanOut != nil && s.fanOut.Store != nil {
+		store = s.fanOut.Store
+	}
+	if c, ok := store.(checkpointCloser); ok {
+		if err := c.Shutdown(); err != nil {
+			return fmt.Errorf("checkpoint store shutdown error: %w", err)
+		}
+	}
+	return nil
+}
+
+// drain waits until every record dispatched was delivered or until deadline,
+// returning the records left.
+func (d *dispatcher) drain(deadline time.Time) []Undelivered {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for d.pendingCount() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var undelivered []Undelivered
+	for id, p := range d.pending {
+		undelivered = append(undelivered, p.Undelivered)
+		p.read.fail(errNotDelivered)
+		p.read.done()
+		delete(d.pending, id)
+	}
+	sort.Slice(undelivered, func(i, j int) bool {
+		a, b := undelivered[i], undelivered[j]
+		if a.Receiver != b.Receiver {
+			return a.Receiver < b.Receiver
+		}
+		if a.ShardID != b.ShardID {
+			return a.ShardID < b.ShardID
+		}
+		return a.SequenceNumber < b.SequenceNumber
+	})
+	return undelivered
+}
+
+func (d *dispatcher) pendingCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
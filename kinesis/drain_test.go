@@ -0,0 +1,150 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	consumer "github.com/harlow/kinesis-consumer"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sequenceScanner scans n records of one shard whose data is their sequence
+// number and then waits for ctx to be done.
+type sequenceScanner struct {
+	n int
+}
+
+func (c *sequenceScanner) Scan(ctx context.Context, fn recordFunc, closed shardFunc) error {
+	for i := 0; i < c.n && ctx.Err() == nil; i++ {
+		seq := fmt.Sprintf("%05d", i)
+		if err := fn("s1", &consumer.Record{Data: []byte(seq), SequenceNumber: aws.String(seq)}); err != nil && err != consumer.ErrSkipCheckpoint {
+			return err
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// shutdownStore is a checkpoint store buffering its checkpoints until Shutdown.
+type shutdownStore struct {
+	memoryStore
+	shutdown bool
+}
+
+func (s *shutdownStore) Shutdown() error {
+	s.shutdown = true
+	return nil
+}
+
+func TestStreamer_StreamDrain(t *testing.T) {
+	scanner := &sequenceScanner{n: 1000}
+	store := new(shutdownStore)
+	slow := &blockingReceiver{fakeReceiver: newFakeReceiver("slow", -1, nil), wait: func() {
+		time.Sleep(time.Millisecond)
+	}}
+	s := newTestStreamer(t, &fakeKinesis{}, WithCheckpointStore(store),
+		WithReceiverConfig("slow", ReceiverConfig{Workers: 2, QueueSize: 50}))
+	s.c = scanner
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Stream(ctx, slow); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	checkpoint, _ := store.GetCheckpoint("stream", "s1")
+	got := slow.received()
+	if len(got) == 0 || len(got) == scanner.n {
+		t.Fatalf("received %v records, want the scan stopped midway", len(got))
+	}
+	// the records read were delivered before Stream returned and checkpointed
+	if want := fmt.Sprintf("%05d", len(got)-1); checkpoint != want {
+		t.Errorf("checkpoint got = %v, want %v", checkpoint, want)
+	}
+	if !store.shutdown {
+		t.Errorf("Stream() did not shut the checkpoint store down")
+	}
+}
+
+func TestStreamer_StreamDrainTimeout(t *testing.T) {
+	scanner := &sequenceScanner{n: 3}
+	store := new(memoryStore)
+	release := make(chan struct{})
+	defer close(release)
+	stalled := &blockingReceiver{fakeReceiver: newFakeReceiver("stalled", -1, nil), wait: func() {
+		<-release
+	}}
+	s := newTestStreamer(t, &fakeKinesis{}, WithDrainTimeout(50*time.Millisecond), WithCheckpointStore(store),
+		WithReceiverConfig("stalled", ReceiverConfig{Workers: 1, QueueSize: 10}))
+	s.c = scanner
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := s.Stream(ctx, stalled)
+	var drainErr *DrainError
+	if !errors.As(err, &drainErr) {
+		t.Fatalf("Stream() error = %v, want *DrainError", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Stream() took %v, want the drain timeout to stop it", elapsed)
+	}
+	want := []Undelivered{
+		{Receiver: "stalled", ShardID: "s1", SequenceNumber: "00000"},
+		{Receiver: "stalled", ShardID: "s1", SequenceNumber: "00001"},
+		{Receiver: "stalled", ShardID: "s1", SequenceNumber: "00002"},
+	}
+	if !reflect.DeepEqual(drainErr.Undelivered, want) {
+		t.Errorf("Undelivered got = %v, want %v", drainErr.Undelivered, want)
+	}
+	if got, want := drainErr.Error(), "stream stream shut down with undelivered records (stalled: 3)"; got != want {
+		t.Errorf("Error() got = %v, want %v", got, want)
+	}
+	// the undelivered records are read again
+	if checkpoint, _ := store.GetCheckpoint("stream", "s1"); checkpoint != "" {
+		t.Errorf("checkpoint got = %v, want none", checkpoint)
+	}
+}
+
+func TestStreamer_StreamCheckpointsDelivered(t *testing.T) {
+	store := new(memoryStore)
+	failing := &failingReceiver{fakeReceiver: newFakeReceiver("failing", -1, nil), fail: func(b []byte) error {
+		if string(b) == "00002" {
+			return errors.New("down")
+		}
+		return nil
+	}}
+	s := newTestStreamer(t, &fakeKinesis{}, WithCheckpointStore(store))
+	s.c = &sequenceScanner{n: 5}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var deliveryErr *DeliveryError
+	if err := s.Stream(ctx, failing); !errors.As(err, &deliveryErr) {
+		t.Fatalf("Stream() error = %v, want *DeliveryError", err)
+	}
+	// the records after the failed one may be delivered but are read again
+	if checkpoint, _ := store.GetCheckpoint("stream", "s1"); checkpoint != "00001" {
+		t.Errorf("checkpoint got = %v, want 00001", checkpoint)
+	}
+}
+
+func TestStreamer_StreamFailingReceiversSkipDrain(t *testing.T) {
+	down := func(b []byte) error {
+		return errors.New("down")
+	}
+	first := &failingReceiver{fakeReceiver: newFakeReceiver("first", -1, nil), fail: down}
+	second := &failingReceiver{fakeReceiver: newFakeReceiver("second", -1, nil), fail: down}
+	s := newTestStreamer(t, &fakeKinesis{}, WithDrainTimeout(10*time.Second))
+	s.c = &sequenceScanner{n: 5}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	start := time.Now()
+	var deliveryErr *DeliveryError
+	if err := s.Stream(ctx, first, second); !errors.As(err, &deliveryErr) {
+		t.Fatalf("Stream() error = %v, want *DeliveryError", err)
+	}
+	// the failures after the first one do not wait for the drain timeout
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Stream() took %v, want it to return before the drain timeout", elapsed)
+	}
+}
@@ -0,0 +1,176 @@
+package kinesis
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"strings"
+)
+
+// ErrThrottled is matched with errors.Is by the errors of the Kinesis requests
+// rejected for exceeding the throughput or the API limits of the stream.
+var ErrThrottled = errors.New("kinesis request throttled")
+
+// ErrStreamNotFound is matched with errors.Is by the errors of the streams
+// which do not exist.
+var ErrStreamNotFound = errors.New("kinesis stream not found")
+
+// ErrStreamNotActive is matched with errors.Is by the errors of the streams
+// which exist but cannot be read, as the ones being created or deleted.
+var ErrStreamNotActive = errors.New("kinesis stream not active")
+
+// ErrConsumerOption is matched with errors.Is by the errors of NewStreamer given
+// a consumer.WithClient or consumer.WithStore option, which are replaced by
+// WithKinesisClient and WithCheckpointStore.
+var ErrConsumerOption = errors.New("unsupported consumer option")
+
+// StreamError is a failure reading a stream, as listing its shards or reading
+// one of them. Stream returns it when the scan fails.
+type StreamError struct {
+	StreamName string
+	// ShardID is empty for the failures which are not of a shard.
+	ShardID string
+	// Op is what failed, as "list shards" or "read shard".
+	Op  string
+	Err error
+}
+
+func (e *StreamError) Error() string {
+	if e.ShardID != "" {
+		return fmt.Sprintf("stream %s: shard %s: %s error: %v", e.StreamName, e.ShardID, e.Op, e.Err)
+	}
+	return fmt.Sprintf("stream %s: %s error: %v", e.StreamName, e.Op, e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrThrottled if the request failed for the limits of the stream
+// and ErrStreamNotFound if the stream does not exist.
+func (e *StreamError) Is(target error) bool {
+	switch target {
+	case ErrThrottled:
+		return throttled(e.Err)
+	case ErrStreamNotFound:
+		return awsErrorCode(e.Err) == kinesis.ErrCodeResourceNotFoundException
+	}
+	return false
+}
+
+func throttled(err error) bool {
+	switch awsErrorCode(err) {
+	case kinesis.ErrCodeProvisionedThroughputExceededException, kinesis.ErrCodeLimitExceededException:
+		return true
+	}
+	return false
+}
+
+// awsErrorCode returns the code of an error of aws-sdk-go or, for the FanOutAPI
+// implemented over aws-sdk-go-v2, of a smithy.APIError.
+func awsErrorCode(err error) string {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return awsErr.Code()
+	}
+	var apiErr interface{ ErrorCode() string }
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// StreamersError is returned by NewStreamers and StreamersBuilder.Build when
+// some of the Streamers fail to be created. Errors has a StreamError for every
+// stream which failed, in the order the streams were given.
+type StreamersError struct {
+	Errors []*StreamError
+}
+
+func (e *StreamersError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("streams %s failed: %s", strings.Join(e.Streams(), ", "), strings.Join(msgs, "; "))
+}
+
+// Streams returns the names of the streams which failed.
+func (e *StreamersError) Streams() []string {
+	names := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		names[i] = err.StreamName
+	}
+	return names
+}
+
+// Unwrap returns the errors of the streams for errors.Is and errors.As, which
+// walk an Unwrap returning a slice since Go 1.20.
+func (e *StreamersError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// TranslationError is returned by Stream when a receiver fails to translate a
+// record.
+type TranslationError struct {
+	StreamName     string
+	ShardID        string
+	SequenceNumber string
+	Receiver       string
+	Err            error
+}
+
+func (e *TranslationError) Error() string {
+	return fmt.Sprintf("receiver %s failed to translate record %s of shard %s of stream %s: %v", e.Receiver, e.SequenceNumber, e.ShardID, e.StreamName, e.Err)
+}
+
+func (e *TranslationError) Unwrap() error {
+	return e.Err
+}
+
+// DeliveryError is returned by Stream when a receiver fails to deliver a
+// record. Err is the error of the receiver, as a *pubsub.PublishError.
+type DeliveryError struct {
+	StreamName     string
+	ShardID        string
+	SequenceNumber string
+	Receiver       string
+	Err            error
+}
+
+func (e *DeliveryError) Error() string {
+	if e.SequenceNumber == "" {
+		return fmt.Sprintf("receiver %s failed to deliver records of stream %s: %v", e.Receiver, e.StreamName, e.Err)
+	}
+	return fmt.Sprintf("receiver %s failed to deliver record %s of shard %s of stream %s: %v", e.Receiver, e.SequenceNumber, e.ShardID, e.StreamName, e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// CredentialsError is a failure to get credentials. Source is the file, profile
+// or provider they were taken from.
+type CredentialsError struct {
+	Source string
+	Err    error
+}
+
+func (e *CredentialsError) Error() string {
+	return "[CREDENTIALS]: " + e.Err.Error()
+}
+
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+// credentialsErrorf returns a *CredentialsError of source whose Err is
+// formatted as fmt.Errorf.
+func credentialsErrorf(source, format string, args ...interface{}) error {
+	return &CredentialsError{Source: source, Err: fmt.Errorf(format, args...)}
+}
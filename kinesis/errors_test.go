@@ -0,0 +1,167 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"os"
+	"testing"
+	"time"
+)
+
+// throttledKinesis fails to list the shards for exceeding the API limits.
+type throttledKinesis struct {
+	*fakeKinesis
+}
+
+func (f throttledKinesis) ListShardsWithContext(ctx aws.Context, input *kinesis.ListShardsInput, opts ...request.Option) (*kinesis.ListShardsOutput, error) {
+	return nil, awserr.New(kinesis.ErrCodeLimitExceededException, "rate exceeded", nil)
+}
+
+func TestStreamer_StreamErrors(t *testing.T) {
+	errDown := errors.New("down")
+	tests := []struct {
+		name      string
+		throttled bool
+		rec       receivers.Receiver
+		check     func(t *testing.T, err error)
+	}{
+		{
+			name: "translation",
+			rec: newFakeReceiver("rec", 1, func(b []byte) ([]byte, error) {
+				return nil, errDown
+			}),
+			check: func(t *testing.T, err error) {
+				var translationErr *TranslationError
+				if !errors.As(err, &translationErr) || !errors.Is(err, errDown) {
+					t.Fatalf("error = %v, want a TranslationError", err)
+				}
+				want := TranslationError{StreamName: "stream", ShardID: "s1", SequenceNumber: "a", Receiver: "rec", Err: errDown}
+				if *translationErr != want {
+					t.Errorf("TranslationError got = %+v, want %+v", *translationErr, want)
+				}
+			},
+		},
+		{
+			name: "delivery",
+			rec: &failingReceiver{fakeReceiver: newFakeReceiver("rec", 1, nil), fail: func(b []byte) error {
+				return errDown
+			}},
+			check: func(t *testing.T, err error) {
+				var deliveryErr *DeliveryError
+				if !errors.As(err, &deliveryErr) || !errors.Is(err, errDown) {
+					t.Fatalf("error = %v, want a DeliveryError", err)
+				}
+				want := DeliveryError{StreamName: "stream", ShardID: "s1", SequenceNumber: "a", Receiver: "rec", Err: errDown}
+				if *deliveryErr != want {
+					t.Errorf("DeliveryError got = %+v, want %+v", *deliveryErr, want)
+				}
+			},
+		},
+		{
+			name:      "throttled",
+			throttled: true,
+			rec:       newFakeReceiver("rec", 1, nil),
+			check: func(t *testing.T, err error) {
+				var streamErr *StreamError
+				if !errors.As(err, &streamErr) || !errors.Is(err, ErrThrottled) {
+					t.Fatalf("error = %v, want a throttled StreamError", err)
+				}
+				if streamErr.StreamName != "stream" || streamErr.Op != "list shards" {
+					t.Errorf("StreamError got = %+v", *streamErr)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeKinesis{
+				shards:  []*kinesis.Shard{shard("s1", "", "")},
+				records: map[string][]string{"s1": {"a"}},
+			}
+			var client kinesisiface.KinesisAPI = api
+			if tt.throttled {
+				client = throttledKinesis{api}
+			}
+			s, err := NewStreamer(context.Background(), "stream", WithKinesisClient(client), WithConsumerOptions(consumer.WithScanInterval(time.Millisecond)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = s.Stream(ctx, tt.rec)
+			if ctx.Err() != nil {
+				t.Fatalf("Stream() did not fail")
+			}
+			tt.check(t, err)
+		})
+	}
+}
+
+func TestStreamError_Is(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"throughput exceeded", awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "slow down", nil), true},
+		{"limit exceeded", awserr.New(kinesis.ErrCodeLimitExceededException, "slow down", nil), true},
+		{"not found", awserr.New(kinesis.ErrCodeResourceNotFoundException, "no stream", nil), false},
+		{"not AWS", errors.New("down"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := &StreamError{StreamName: "stream", Op: "list shards", Err: tt.err}
+			if got := errors.Is(err, ErrThrottled); got != tt.want {
+				t.Errorf("errors.Is(ErrThrottled) got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamersError_Unwrap(t *testing.T) {
+	throttled := &StreamError{StreamName: "b", Op: "list shards", Err: awserr.New(kinesis.ErrCodeLimitExceededException, "slow down", nil)}
+	err := error(&StreamersError{Errors: []*StreamError{
+		{StreamName: "a", Op: "describe stream", Err: os.ErrPermission},
+		throttled,
+	}})
+	if !errors.Is(err, ErrThrottled) || !errors.Is(err, os.ErrPermission) {
+		t.Errorf("errors.Is() of %v does not match the errors of the streams", err)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		t.Errorf("errors.Is(os.ErrNotExist) of %v = true, want false", err)
+	}
+	// errors.As walks the errors of the streams in order
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.StreamName != "a" {
+		t.Errorf("errors.As() got = %v, want the error of stream a", streamErr)
+	}
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) || awsErr.Code() != kinesis.ErrCodeLimitExceededException {
+		t.Errorf("errors.As() got = %v, want the AWS error of stream b", awsErr)
+	}
+}
+
+func TestCredentialsError(t *testing.T) {
+	_, err := WithJSONFile("tests/missing.json")
+	var credsErr *CredentialsError
+	if !errors.As(err, &credsErr) || credsErr.Source != "tests/missing.json" {
+		t.Fatalf("WithJSONFile() error = %v, want a CredentialsError of the file", err)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("WithJSONFile() error = %v, want it to wrap os.ErrNotExist", err)
+	}
+	_, err = WithJSONFile("tests/aws_credentials_invalid_test.json")
+	if !errors.As(err, &credsErr) || credsErr.Source != "tests/aws_credentials_invalid_test.json" {
+		t.Fatalf("WithJSONFile() error = %v, want a CredentialsError of the file", err)
+	}
+	if got, want := err.Error(), "[CREDENTIALS]: secret_access_key should be a string not float64"; got != want {
+		t.Errorf("Error() got = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,275 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"time"
+)
+
+const (
+	// StreamConsumerStatusActive is the status of a registered stream consumer
+	// which is ready to subscribe to shards.
+	StreamConsumerStatusActive = "ACTIVE"
+
+	defaultFanOutRenewInterval        = 5 * time.Minute
+	defaultFanOutConsumerPollInterval = time.Second
+)
+
+// FanOutAPI is the subset of the Kinesis enhanced fan-out API used to consume a
+// stream through a registered stream consumer.
+// The aws-sdk-go version required by this module predates SubscribeToShard, so
+// the operations are described here. sdkv2.NewFanOutAPI implements them with the
+// Kinesis client of aws-sdk-go-v2.
+type FanOutAPI interface {
+	// ListShards returns every shard of the stream, open or closed.
+	ListShards(ctx context.Context, streamName string) ([]*kinesis.Shard, error)
+	// RegisterStreamConsumer registers consumerName on the stream. If the consumer
+	// is already registered the existing one should be returned.
+	RegisterStreamConsumer(ctx context.Context, streamName, consumerName string) (*StreamConsumer, error)
+	DescribeStreamConsumer(ctx context.Context, consumerARN string) (*StreamConsumer, error)
+	// SubscribeToShard opens a HTTP/2 push subscription to a shard.
+	SubscribeToShard(ctx context.Context, input *SubscribeToShardInput) (ShardSubscription, error)
+}
+
+// StreamConsumer describes a consumer registered for enhanced fan-out.
+type StreamConsumer struct {
+	ARN    string
+	Name   string
+	Status string
+}
+
+// StartingPosition sets where a shard subscription begins.
+// Type follows the shard iterator types from the Kinesis API.
+type StartingPosition struct {
+	Type           string
+	SequenceNumber string
+	Timestamp      *time.Time
+}
+
+type SubscribeToShardInput struct {
+	ConsumerARN      string
+	ShardID          string
+	StartingPosition StartingPosition
+}
+
+// SubscribeToShardEvent is a batch of records pushed by a shard subscription.
+// An empty ContinuationSequenceNumber means the shard is closed and every record
+// on it has been delivered.
+type SubscribeToShardEvent struct {
+	Records                    []*consumer.Record
+	ContinuationSequenceNumber string
+	MillisBehindLatest         int64
+}
+
+// ShardSubscription is an open subscription to a shard.
+// Events is closed when the subscription ends, after which Err reports why it
+// ended or nil if it simply expired.
+type ShardSubscription interface {
+	Events() <-chan *SubscribeToShardEvent
+	Err() error
+	Close() error
+}
+
+// FanOutConfig sets a Streamer to consume using enhanced fan-out instead of
+// polling the shards with GetRecords.
+type FanOutConfig struct {
+	// ConsumerName is the name the stream consumer is registered with.
+	ConsumerName string
+	API          FanOutAPI
+	// Store persists the scan progress. If Store is nil the store given
+	// WithCheckpointStore is used, otherwise checkpoints are only kept in memory.
+	Store consumer.Store
+	// ShardIteratorType is the starting point for shards without checkpoint.
+	// If empty LATEST is used.
+	ShardIteratorType string
+	// Timestamp is the starting point of the AT_TIMESTAMP ShardIteratorType.
+	Timestamp *time.Time
+	// RenewInterval sets how often subscriptions are renewed. AWS ends every
+	// subscription after 5 minutes, which is the default.
+	RenewInterval time.Duration
+	// ShardListInterval sets how often new shards are looked for. The default
+	// is 30 seconds.
+	ShardListInterval time.Duration
+}
+
+// WithFanOut sets the Streamer to consume the stream with enhanced fan-out.
+func WithFanOut(cfg FanOutConfig) StreamerOption {
+	return func(s *Streamer) {
+		s.fanOut = &cfg
+	}
+}
+
+type fanOutScanner struct {
+	streamName           string
+	consumerName         string
+	api                  FanOutAPI
+	store                consumer.Store
+	shardIteratorType    string
+	timestamp            *time.Time
+	renewInterval        time.Duration
+	shardListInterval    time.Duration
+	consumerPollInterval time.Duration
+	leases               *LeaseCoordinator
+	onEvent              func(ShardEvent)
+	onList               func(error)
+	metrics              metrics.Recorder
+}
+
+func newFanOutScanner(streamName string, cfg FanOutConfig) (*fanOutScanner, error) {
+	if cfg.API == nil {
+		return nil, fmt.Errorf("fan out API is required")
+	}
+	if cfg.ConsumerName == "" {
+		return nil, fmt.Errorf("fan out consumer name is required")
+	}
+	f := &fanOutScanner{
+		streamName:           streamName,
+		consumerName:         cfg.ConsumerName,
+		api:                  cfg.API,
+		store:                cfg.Store,
+		shardIteratorType:    cfg.ShardIteratorType,
+		timestamp:            cfg.Timestamp,
+		renewInterval:        cfg.RenewInterval,
+		shardListInterval:    cfg.ShardListInterval,
+		consumerPollInterval: defaultFanOutConsumerPollInterval,
+		metrics:              metrics.Discard,
+	}
+	if f.store == nil {
+		f.store = new(memoryStore)
+	}
+	if f.shardIteratorType == "" {
+		f.shardIteratorType = kinesis.ShardIteratorTypeLatest
+	}
+	if f.renewInterval <= 0 {
+		f.renewInterval = defaultFanOutRenewInterval
+	}
+	if f.shardListInterval <= 0 {
+		f.shardListInterval = defaultShardListInterval
+	}
+	return f, nil
+}
+
+// Scan registers the stream consumer and subscribes to every shard of the stream.
+// Child shards are only subscribed after their parents are closed, so records of
+// the same partition key keep their order across resharding.
+func (f *fanOutScanner) Scan(ctx context.Context, fn recordFunc, closed shardFunc) error {
+	consumerARN, err := f.register(ctx)
+	if err != nil {
+		return err
+	}
+	l := &shardLifecycle{
+		streamName: f.streamName,
+		listShards: func(ctx context.Context) ([]*kinesis.Shard, error) {
+			return f.api.ListShards(ctx, f.streamName)
+		},
+		scanShard: func(ctx context.Context, shardID string) error {
+			return f.scanShard(ctx, consumerARN, shardID, fn)
+		},
+		closed:   closed,
+		store:    f.store,
+		interval: f.shardListInterval,
+		leases:   f.leases,
+		onEvent:  f.onEvent,
+		onList:   f.onList,
+	}
+	return l.run(ctx)
+}
+
+func (f *fanOutScanner) register(ctx context.Context) (string, error) {
+	sc, err := f.api.RegisterStreamConsumer(ctx, f.streamName, f.consumerName)
+	if err != nil {
+		return "", &StreamError{StreamName: f.streamName, Op: "register stream consumer", Err: err}
+	}
+	for sc.Status != StreamConsumerStatusActive {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(f.consumerPollInterval):
+		}
+		sc, err = f.api.DescribeStreamConsumer(ctx, sc.ARN)
+		if err != nil {
+			return "", &StreamError{StreamName: f.streamName, Op: "describe stream consumer", Err: err}
+		}
+	}
+	return sc.ARN, nil
+}
+
+// scanShard subscribes to a shard renewing the subscription until the shard is
+// closed, in which case it returns nil.
+func (f *fanOutScanner) scanShard(ctx context.Context, consumerARN, shardID string, fn recordFunc) error {
+	lastSeqNum, err := f.store.GetCheckpoint(f.streamName, shardID)
+	if err != nil {
+		return fmt.Errorf("get checkpoint error: %w", err)
+	}
+	for {
+		sub, err := f.api.SubscribeToShard(ctx, &SubscribeToShardInput{
+			ConsumerARN:      consumerARN,
+			ShardID:          shardID,
+			StartingPosition: f.startingPosition(lastSeqNum),
+		})
+		if err != nil {
+			return fmt.Errorf("subscribe to shard error: %w", err)
+		}
+		shardClosed, err := f.consume(ctx, shardID, sub, &lastSeqNum, fn)
+		sub.Close()
+		if err != nil {
+			return err
+		}
+		if shardClosed {
+			return nil
+		}
+	}
+}
+
+// consume reads the events of a subscription until it ends or must be renewed.
+// lastSeqNum is kept at the position the next subscription should start after.
+func (f *fanOutScanner) consume(ctx context.Context, shardID string, sub ShardSubscription, lastSeqNum *string, fn recordFunc) (bool, error) {
+	renew := time.NewTimer(f.renewInterval)
+	defer renew.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-renew.C:
+			return false, nil
+		case event, ok := <-sub.Events():
+			if !ok {
+				return false, sub.Err()
+			}
+			f.metrics.Set(metrics.MillisBehindLatest, float64(event.MillisBehindLatest), metrics.Labels{
+				"stream": f.streamName,
+				"shard":  shardID,
+			})
+			for _, r := range event.Records {
+				err := fn(shardID, r)
+				if err != nil && err != consumer.ErrSkipCheckpoint {
+					return false, err
+				}
+				if err != consumer.ErrSkipCheckpoint {
+					if err := f.store.SetCheckpoint(f.streamName, shardID, aws.StringValue(r.SequenceNumber)); err != nil {
+						return false, err
+					}
+				}
+				*lastSeqNum = aws.StringValue(r.SequenceNumber)
+			}
+			if event.ContinuationSequenceNumber == "" {
+				return true, nil
+			}
+			*lastSeqNum = event.ContinuationSequenceNumber
+		}
+	}
+}
+
+func (f *fanOutScanner) startingPosition(lastSeqNum string) StartingPosition {
+	if lastSeqNum != "" {
+		return StartingPosition{
+			Type:           kinesis.ShardIteratorTypeAfterSequenceNumber,
+			SequenceNumber: lastSeqNum,
+		}
+	}
+	return StartingPosition{Type: f.shardIteratorType, Timestamp: f.timestamp}
+}
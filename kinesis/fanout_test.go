@@ -0,0 +1,233 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	consumer "github.com/harlow/kinesis-consumer"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFanOut is a local stand-in for the enhanced fan-out API.
+// Each shard pushes one record per event and closed shards end with an event
+// without continuation sequence number.
+type fakeFanOut struct {
+	mu            sync.Mutex
+	shards        []*kinesis.Shard
+	records       map[string][]string
+	closed        map[string]bool
+	describes     int
+	subscriptions int
+}
+
+func (f *fakeFanOut) ListShards(ctx context.Context, streamName string) ([]*kinesis.Shard, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.shards, nil
+}
+
+func (f *fakeFanOut) RegisterStreamConsumer(ctx context.Context, streamName, consumerName string) (*StreamConsumer, error) {
+	return &StreamConsumer{
+		ARN:    fmt.Sprintf("arn:%s:%s", streamName, consumerName),
+		Name:   consumerName,
+		Status: "CREATING",
+	}, nil
+}
+
+func (f *fakeFanOut) DescribeStreamConsumer(ctx context.Context, consumerARN string) (*StreamConsumer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.describes++
+	return &StreamConsumer{ARN: consumerARN, Status: StreamConsumerStatusActive}, nil
+}
+
+func (f *fakeFanOut) SubscribeToShard(ctx context.Context, input *SubscribeToShardInput) (ShardSubscription, error) {
+	f.mu.Lock()
+	f.subscriptions++
+	records := f.records[input.ShardID]
+	closed := f.closed[input.ShardID]
+	f.mu.Unlock()
+	start := 0
+	if input.StartingPosition.Type == kinesis.ShardIteratorTypeAfterSequenceNumber {
+		for i, seq := range records {
+			if seq == input.StartingPosition.SequenceNumber {
+				start = i + 1
+			}
+		}
+	}
+	sub := &fakeSubscription{events: make(chan *SubscribeToShardEvent), done: make(chan struct{})}
+	go func() {
+		defer close(sub.events)
+		for i := start; i < len(records); i++ {
+			event := &SubscribeToShardEvent{
+				Records:                    []*consumer.Record{{SequenceNumber: aws.String(records[i])}},
+				ContinuationSequenceNumber: records[i],
+			}
+			if closed && i == len(records)-1 {
+				event.ContinuationSequenceNumber = ""
+			}
+			select {
+			case sub.events <- event:
+			case <-sub.done:
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		<-sub.done
+	}()
+	return sub, nil
+}
+
+type fakeSubscription struct {
+	events chan *SubscribeToShardEvent
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (s *fakeSubscription) Events() <-chan *SubscribeToShardEvent { return s.events }
+func (s *fakeSubscription) Err() error                            { return nil }
+func (s *fakeSubscription) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func shard(id, parent, adjacentParent string) *kinesis.Shard {
+	s := &kinesis.Shard{ShardId: aws.String(id)}
+	if parent != "" {
+		s.ParentShardId = aws.String(parent)
+	}
+	if adjacentParent != "" {
+		s.AdjacentParentShardId = aws.String(adjacentParent)
+	}
+	return s
+}
+
+func scanAll(t *testing.T, f *fanOutScanner, want int) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var got []string
+	err := f.Scan(ctx, func(shardID string, r *consumer.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, aws.StringValue(r.SequenceNumber))
+		if len(got) == want {
+			cancel()
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	return got
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestFanOutScanner_Scan(t *testing.T) {
+	tests := []struct {
+		name   string
+		api    *fakeFanOut
+		before map[string][]string
+	}{
+		{"split", &fakeFanOut{
+			shards: []*kinesis.Shard{shard("p", "", ""), shard("c1", "p", ""), shard("c2", "p", "")},
+			records: map[string][]string{
+				"p":  {"p1", "p2", "p3"},
+				"c1": {"c11", "c12"},
+				"c2": {"c21"},
+			},
+			closed: map[string]bool{"p": true},
+		}, map[string][]string{"p3": {"c11", "c21"}}},
+		{"merge", &fakeFanOut{
+			shards: []*kinesis.Shard{shard("a", "", ""), shard("b", "", ""), shard("m", "a", "b")},
+			records: map[string][]string{
+				"a": {"a1", "a2"},
+				"b": {"b1", "b2", "b3"},
+				"m": {"m1", "m2"},
+			},
+			closed: map[string]bool{"a": true, "b": true},
+		}, map[string][]string{"a2": {"m1"}, "b3": {"m1"}}},
+		{"expiredParent", &fakeFanOut{
+			shards:  []*kinesis.Shard{shard("c", "gone", "")},
+			records: map[string][]string{"c": {"c1", "c2"}},
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newFanOutScanner("stream", FanOutConfig{ConsumerName: "test", API: tt.api})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.consumerPollInterval = time.Millisecond
+			want := 0
+			for _, records := range tt.api.records {
+				want += len(records)
+			}
+			got := scanAll(t, f, want)
+			if len(got) != want {
+				t.Fatalf("Scan() got %v records, want %v", len(got), want)
+			}
+			for parent, children := range tt.before {
+				for _, child := range children {
+					if indexOf(got, parent) > indexOf(got, child) {
+						t.Errorf("Scan() got %v before %v: %v", child, parent, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFanOutScanner_Renew(t *testing.T) {
+	api := &fakeFanOut{
+		shards:  []*kinesis.Shard{shard("s", "", "")},
+		records: map[string][]string{"s": {"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}},
+	}
+	f, err := newFanOutScanner("stream", FanOutConfig{
+		ConsumerName:  "test",
+		API:           api,
+		RenewInterval: 3 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.consumerPollInterval = time.Millisecond
+	got := scanAll(t, f, 10)
+	if !reflect.DeepEqual(got, api.records["s"]) {
+		t.Errorf("Scan() got = %v, want %v", got, api.records["s"])
+	}
+	if api.subscriptions < 2 {
+		t.Errorf("Scan() subscriptions = %v, want renewed subscriptions", api.subscriptions)
+	}
+}
+
+func TestNewFanOutScanner(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     FanOutConfig
+		wantErr bool
+	}{
+		{"default", FanOutConfig{ConsumerName: "test", API: &fakeFanOut{}}, false},
+		{"missingAPI", FanOutConfig{ConsumerName: "test"}, true},
+		{"missingConsumerName", FanOutConfig{API: &fakeFanOut{}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newFanOutScanner("stream", tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("newFanOutScanner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package kinesis
+
+import (
+	"context"
+	"github.com/nicolasassi/kinestesia/logging"
+	"golang.org/x/sync/semaphore"
+	"sync"
+	"time"
+)
+
+// flowControl limits the records of a receiver queued or being delivered by
+// count and by size.
+type flowControl struct {
+	count    *semaphore.Weighted
+	bytes    *semaphore.Weighted
+	maxBytes int64
+
+	// logger has the stream and receiver in its fields.
+	logger logging.Logger
+
+	mu      sync.Mutex
+	inCount int
+	inBytes int64
+	engaged bool
+}
+
+func newFlowControl(logger logging.Logger, maxCount int, maxBytes int64) *flowControl {
+	f := &flowControl{
+		count:    semaphore.NewWeighted(int64(maxCount)),
+		maxBytes: maxBytes,
+		logger:   logger,
+	}
+	if maxBytes > 0 {
+		f.bytes = semaphore.NewWeighted(maxBytes)
+	}
+	return f
+}
+
+// weight is the share of the byte limit taken by a record of size bytes.
+func (f *flowControl) weight(size int) int64 {
+	if int64(size) > f.maxBytes {
+		return f.maxBytes
+	}
+	return int64(size)
+}
+
+// acquire waits for room for a record of size bytes. It returns how long it
+// waited, which is zero unless a limit was reached.
+func (f *flowControl) acquire(ctx context.Context, size int) (time.Duration, error) {
+	if f.tryAcquire(size) {
+		f.setEngaged(false)
+		return 0, nil
+	}
+	f.setEngaged(true)
+	start := time.Now()
+	if err := f.count.Acquire(ctx, 1); err != nil {
+		return time.Since(start), err
+	}
+	if f.bytes != nil {
+		if err := f.bytes.Acquire(ctx, f.weight(size)); err != nil {
+			f.count.Release(1)
+			return time.Since(start), err
+		}
+	}
+	f.add(1, int64(size))
+	return time.Since(start), nil
+}
+
+func (f *flowControl) tryAcquire(size int) bool {
+	if !f.count.TryAcquire(1) {
+		return false
+	}
+	if f.bytes != nil && !f.bytes.TryAcquire(f.weight(size)) {
+		f.count.Release(1)
+		return false
+	}
+	f.add(1, int64(size))
+	return true
+}
+
+func (f *flowControl) release(size int) {
+	f.add(-1, -int64(size))
+	if f.bytes != nil {
+		f.bytes.Release(f.weight(size))
+	}
+	f.count.Release(1)
+}
+
+func (f *flowControl) add(count int, size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inCount += count
+	f.inBytes += size
+}
+
+func (f *flowControl) inFlight() (int, int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.inCount, f.inBytes
+}
+
+// setEngaged logs when scanning starts pausing for the limits and when it
+// stops doing so.
+func (f *flowControl) setEngaged(engaged bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.engaged == engaged {
+		return
+	}
+	f.engaged = engaged
+	if engaged {
+		f.logger.Log(logging.LevelWarn, logging.BackpressureEngaged, logging.Fields{"records": f.inCount, "bytes": f.inBytes})
+		return
+	}
+	f.logger.Log(logging.LevelInfo, logging.BackpressureReleased, nil)
+}
@@ -0,0 +1,92 @@
+package kinesis
+
+import (
+	"context"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// endlessScanner scans records of size bytes until ctx is done.
+type endlessScanner struct {
+	size    int
+	scanned int64
+}
+
+func (e *endlessScanner) Scan(ctx context.Context, fn recordFunc, closed shardFunc) error {
+	for ctx.Err() == nil {
+		atomic.AddInt64(&e.scanned, 1)
+		if err := fn("s1", &consumer.Record{Data: make([]byte, e.size)}); err != nil && err != consumer.ErrSkipCheckpoint {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStreamer_StreamBackpressure(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		name         string
+		cfg          ReceiverConfig
+		size         int
+		wantInFlight int
+	}{
+		{"count", ReceiverConfig{Workers: 1, QueueSize: 100, MaxInFlight: 5}, 1024, 5},
+		{"bytes", ReceiverConfig{Workers: 1, QueueSize: 100, MaxInFlightBytes: 4 * mb}, mb, 4},
+		{"recordBiggerThanLimit", ReceiverConfig{Workers: 1, QueueSize: 100, MaxInFlightBytes: mb}, 2 * mb, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runtime.GC()
+			var before runtime.MemStats
+			runtime.ReadMemStats(&before)
+
+			scanner := &endlessScanner{size: tt.size}
+			recorder := newFakeRecorder()
+			s := newTestStreamer(t, &fakeKinesis{}, WithMetrics(recorder), WithReceiverConfig("stalled", tt.cfg))
+			s.c = scanner
+			release := make(chan struct{})
+			stalled := &blockingReceiver{fakeReceiver: newFakeReceiver("stalled", -1, nil), wait: func() {
+				<-release
+			}}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- s.Stream(ctx, stalled)
+			}()
+			time.Sleep(100 * time.Millisecond)
+
+			// the record blocked in the scan is the only one over the limit
+			if got := atomic.LoadInt64(&scanner.scanned); got != int64(tt.wantInFlight+1) {
+				t.Errorf("scanned %v records, want %v", got, tt.wantInFlight+1)
+			}
+			labels := metrics.Labels{"stream": "stream", "receiver": "stalled"}
+			if got := recorder.value(metrics.InFlightRecords, labels); got != float64(tt.wantInFlight) {
+				t.Errorf("%v = %v, want %v", metrics.InFlightRecords, got, tt.wantInFlight)
+			}
+			runtime.GC()
+			var after runtime.MemStats
+			runtime.ReadMemStats(&after)
+			if growth := int64(after.HeapAlloc) - int64(before.HeapAlloc); growth > int64(tt.wantInFlight+1)*int64(tt.size)+16*mb {
+				t.Errorf("heap grew %v bytes under a stalled receiver", growth)
+			}
+
+			cancel()
+			close(release)
+			if err := <-done; err != nil {
+				t.Fatalf("Stream() error = %v", err)
+			}
+			// the pause is recorded once the scan gives up waiting, after Stream returns
+			deadline := time.Now().Add(5 * time.Second)
+			for recorder.value(metrics.BackpressurePauses, labels) == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := recorder.value(metrics.BackpressurePauses, labels); got != 1 {
+				t.Errorf("%v = %v, want 1", metrics.BackpressurePauses, got)
+			}
+		})
+	}
+}
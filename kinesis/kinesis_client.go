@@ -7,51 +7,119 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
+	"net/http"
 )
 
 type Client struct {
 	Kinesis *kinesis.Kinesis
 }
 
-type clientController struct {
-	k   *kinesis.Kinesis
-	err error
-}
-
 // NewClient creates a client to manage Kinesis connection.
 // It sets new configuration on AWS and passes Credentials to the service.
-// If no credentials are provided the default method WithEnvironmentVariables
-// will be used.
+// If no credentials are provided the standard AWS chain of
+// NewDefaultChainProvider will be used.
 func NewClient(ctx context.Context, creds ...Credentials) (*Client, error) {
-	newConfig := aws.NewConfig()
 	switch len(creds) {
 	case 0:
-		newConfig.WithCredentials(credentials.NewCredentials(WithEnvironmentVariables()))
+		return NewClientWithOptions(ctx)
 	case 1:
-		newConfig.WithCredentials(credentials.NewCredentials(creds[0]))
+		return NewClientFromProvider(ctx, creds[0])
 	default:
 		return nil, fmt.Errorf("creds length should be 0 or 1 not %v", len(creds))
 	}
-	controller := make(chan clientController, 1)
-	go func() {
-		s, err := session.NewSession(newConfig)
-		if err != nil {
-			controller <- clientController{
-				err: fmt.Errorf("new aws session error: %v", err),
-			}
-			return
-		}
-		controller <- clientController{
-			k: kinesis.New(s),
-		}
-	}()
-	select {
-	case <-ctx.Done():
-		return nil, nil
-	case ctrl := <-controller:
-		if ctrl.err != nil {
-			return nil, ctrl.err
+}
+
+// NewClientFromProvider creates a client as NewClient taking the credentials
+// from p, as the providers of NewProfileProvider, NewAssumeRoleProvider or
+// NewChainProvider.
+func NewClientFromProvider(ctx context.Context, p credentials.Provider) (*Client, error) {
+	return NewClientWithOptions(ctx, WithCredentialsProvider(p))
+}
+
+// ClientOption is used to override defaults when creating a new Client.
+type ClientOption func(*aws.Config)
+
+// WithCredentialsProvider sets the provider of the credentials. The default is
+// NewDefaultChainProvider.
+func WithCredentialsProvider(p credentials.Provider) ClientOption {
+	return func(c *aws.Config) {
+		c.WithCredentials(credentials.NewCredentials(p))
+	}
+}
+
+// WithRegion sets the region of the stream.
+func WithRegion(region string) ClientOption {
+	return func(c *aws.Config) {
+		c.WithRegion(region)
+	}
+}
+
+// WithEndpoint overrides the endpoint of Kinesis, as the one of LocalStack or
+// kinesalite: "http://localhost:4566".
+func WithEndpoint(endpoint string) ClientOption {
+	return func(c *aws.Config) {
+		c.WithEndpoint(endpoint)
+	}
+}
+
+// WithMaxRetries sets the number of times a failed request is retried. The
+// default is decided by the AWS SDK.
+func WithMaxRetries(n int) ClientOption {
+	return func(c *aws.Config) {
+		c.WithMaxRetries(n)
+	}
+}
+
+// WithHTTPClient sets the HTTP client of the requests, as one with timeouts.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(c *aws.Config) {
+		c.WithHTTPClient(client)
+	}
+}
+
+// WithHTTPTransport sets the transport of the HTTP client of the requests. The
+// custom CA bundle of AWS_CA_BUNDLE requires an *http.Transport.
+func WithHTTPTransport(t http.RoundTripper) ClientOption {
+	return func(c *aws.Config) {
+		client := http.Client{}
+		if c.HTTPClient != nil {
+			client = *c.HTTPClient
 		}
-		return &Client{Kinesis: ctrl.k}, nil
+		client.Transport = t
+		c.WithHTTPClient(&client)
+	}
+}
+
+// WithLogger logs the requests with l at level, as aws.LogDebugWithHTTPBody.
+func WithLogger(l aws.Logger, level aws.LogLevelType) ClientOption {
+	return func(c *aws.Config) {
+		c.WithLogger(l).WithLogLevel(level)
 	}
 }
+
+// NewClientWithOptions creates a client to manage Kinesis connection configured
+// with opts. Streamers created with Client.NewStreamer share its connection.
+// It returns the error of ctx if it is done.
+func NewClientWithOptions(ctx context.Context, opts ...ClientOption) (*Client, error) {
+	newConfig := aws.NewConfig()
+	for _, opt := range opts {
+		opt(newConfig)
+	}
+	if newConfig.Credentials == nil {
+		newConfig.WithCredentials(credentials.NewCredentials(NewDefaultChainProvider()))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s, err := session.NewSession(newConfig)
+	if err != nil {
+		return nil, fmt.Errorf("new aws session error: %w", err)
+	}
+	return &Client{Kinesis: kinesis.New(s)}, nil
+}
+
+// NewStreamer creates a Streamer for streamName as NewStreamer reading the
+// stream with c.
+func (c *Client) NewStreamer(ctx context.Context, streamName string, opts ...StreamerOption) (*Streamer, error) {
+	return NewStreamer(ctx, streamName, append([]StreamerOption{WithKinesisClient(c.Kinesis)}, opts...)...)
+}
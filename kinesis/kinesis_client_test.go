@@ -0,0 +1,127 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingTransport counts the requests going through it.
+type countingTransport struct {
+	mu       sync.Mutex
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.requests++
+	c.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestNewClientWithOptions(t *testing.T) {
+	var mu sync.Mutex
+	var auths []string
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auths = append(auths, r.Header.Get("Authorization"))
+		fail := failing
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"__type":"InternalFailure","message":"down"}`)
+			return
+		}
+		fmt.Fprint(w, `{"Shards":[{"ShardId":"shardId-000000000000"}]}`)
+	}))
+	defer srv.Close()
+	// the SDK can only add a custom CA bundle to an *http.Transport
+	if bundle, ok := os.LookupEnv("AWS_CA_BUNDLE"); ok {
+		os.Unsetenv("AWS_CA_BUNDLE")
+		defer os.Setenv("AWS_CA_BUNDLE", bundle)
+	}
+	transport := &countingTransport{}
+	var logs []string
+	c, err := NewClientWithOptions(context.Background(),
+		WithCredentialsProvider(WithParameters("key", "secret", "", "")),
+		WithRegion("eu-west-1"),
+		WithEndpoint(srv.URL),
+		WithMaxRetries(2),
+		WithHTTPTransport(transport),
+		WithLogger(aws.LoggerFunc(func(args ...interface{}) {
+			logs = append(logs, fmt.Sprint(args...))
+		}), aws.LogDebugWithRequestRetries),
+	)
+	if err != nil {
+		t.Fatalf("NewClientWithOptions() error = %v", err)
+	}
+	out, err := c.Kinesis.ListShards(&kinesis.ListShardsInput{StreamName: aws.String("stream")})
+	if err != nil {
+		t.Fatalf("ListShards() error = %v", err)
+	}
+	if len(out.Shards) != 1 {
+		t.Errorf("ListShards() = %v, want the shard of the endpoint", out)
+	}
+	if !strings.Contains(auths[0], "Credential=key/") || !strings.Contains(auths[0], "/eu-west-1/kinesis/") {
+		t.Errorf("Authorization = %v, want it signed by key for eu-west-1", auths[0])
+	}
+
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if _, err := c.Kinesis.ListShards(&kinesis.ListShardsInput{StreamName: aws.String("stream")}); err == nil {
+		t.Fatalf("ListShards() error = nil, want the endpoint failure")
+	}
+	// one request and two retries
+	if got := len(auths); got != 4 {
+		t.Errorf("requests = %v, want 4", got)
+	}
+	if transport.requests != len(auths) {
+		t.Errorf("requests through the transport = %v, want %v", transport.requests, len(auths))
+	}
+	if len(logs) == 0 {
+		t.Errorf("logs = %v, want the retries logged", logs)
+	}
+}
+
+func TestClient_NewStreamer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"StreamDescriptionSummary":{"StreamName":"stream","StreamStatus":"ACTIVE"}}`)
+	}))
+	defer srv.Close()
+	c, err := NewClientWithOptions(context.Background(),
+		WithCredentialsProvider(WithParameters("key", "secret", "", "")),
+		WithRegion("eu-west-1"),
+		WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatalf("NewClientWithOptions() error = %v", err)
+	}
+	s, err := c.NewStreamer(context.Background(), "stream", WithWorkers(3))
+	if err != nil {
+		t.Fatalf("NewStreamer() error = %v", err)
+	}
+	if s.client != c.Kinesis || s.workers != 3 {
+		t.Errorf("NewStreamer() should read with the client and keep the options")
+	}
+	other := &fakeKinesis{}
+	if s, err = c.NewStreamer(context.Background(), "stream", WithKinesisClient(other)); err != nil || s.client != other {
+		t.Errorf("NewStreamer() should let the options override the client")
+	}
+}
+
+func TestNewClientWithOptions_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, err := NewClientWithOptions(ctx, WithRegion("eu-west-1"))
+	if c != nil || err != context.Canceled {
+		t.Errorf("NewClientWithOptions() = %v, %v, want the error of the context", c, err)
+	}
+}
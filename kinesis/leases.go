@@ -0,0 +1,366 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLeaseDuration = 10 * time.Second
+)
+
+// ErrLeaseConflict is returned by LeaseStore.UpdateLease when the stored lease
+// was changed by another worker since it was read.
+var ErrLeaseConflict = errors.New("lease was updated by another worker")
+
+// Lease grants a worker the right to read a shard while it keeps renewing it.
+// Counter is increased on every update and used for optimistic concurrency,
+// so two workers can never both take the same lease.
+//
+// Expiration is the wall-clock time the owner expects to renew the lease by.
+// It is only informational: clocks of the workers may disagree, so a lease is
+// considered expired when its Counter has not changed for LeaseDuration as
+// measured by the local clock of the worker observing it.
+type Lease struct {
+	StreamName string
+	ShardID    string
+	Owner      string
+	Expiration time.Time
+	Counter    int64
+}
+
+// LeaseStore is the storage shared by the workers reading the same streams.
+type LeaseStore interface {
+	ListLeases(ctx context.Context, streamName string) ([]Lease, error)
+	// CreateLease creates an unowned lease. It should do nothing if the lease
+	// already exists.
+	CreateLease(ctx context.Context, streamName, shardID string) error
+	// UpdateLease replaces the stored lease if its Counter is still lease.Counter,
+	// returning the stored lease with the increased Counter. ErrLeaseConflict is
+	// returned otherwise.
+	UpdateLease(ctx context.Context, lease Lease) (Lease, error)
+}
+
+// Clock tells the current time. It can be replaced to simulate time in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// LeaseConfig sets how a LeaseCoordinator claims shards.
+type LeaseConfig struct {
+	// WorkerID identifies this instance and should be unique among the workers.
+	WorkerID string
+	Store    LeaseStore
+	// LeaseDuration is how long a lease is valid without renewal. Leases of dead
+	// workers are taken after it expires. The default is 10 seconds.
+	LeaseDuration time.Duration
+	// RenewInterval is how often leases are renewed and new ones are claimed.
+	// The default is a third of LeaseDuration.
+	RenewInterval time.Duration
+	Clock         Clock
+}
+
+// LeaseCoordinator claims shard leases so that each shard is read by a single
+// worker among every instance sharing the LeaseStore.
+// Shards are balanced evenly: a worker takes unowned and expired leases until it
+// owns its share and then steals a lease from the most loaded worker.
+type LeaseCoordinator struct {
+	workerID      string
+	store         LeaseStore
+	leaseDuration time.Duration
+	renewInterval time.Duration
+	clock         Clock
+
+	mu sync.Mutex
+	// owned keeps the local time until which each lease held is known to be
+	// valid.
+	owned map[string]map[string]time.Time
+	// observed keeps when the current counter of each lease was first seen.
+	observed map[string]map[string]observation
+}
+
+type observation struct {
+	counter int64
+	at      time.Time
+}
+
+func NewLeaseCoordinator(cfg LeaseConfig) (*LeaseCoordinator, error) {
+	if cfg.WorkerID == "" {
+		return nil, fmt.Errorf("lease worker ID is required")
+	}
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("lease store is required")
+	}
+	c := &LeaseCoordinator{
+		workerID:      cfg.WorkerID,
+		store:         cfg.Store,
+		leaseDuration: cfg.LeaseDuration,
+		renewInterval: cfg.RenewInterval,
+		clock:         cfg.Clock,
+		owned:         map[string]map[string]time.Time{},
+		observed:      map[string]map[string]observation{},
+	}
+	if c.leaseDuration <= 0 {
+		c.leaseDuration = defaultLeaseDuration
+	}
+	if c.renewInterval <= 0 {
+		c.renewInterval = c.leaseDuration / 3
+	}
+	if c.clock == nil {
+		c.clock = systemClock{}
+	}
+	return c, nil
+}
+
+// WithLeaseCoordinator sets the Streamer to only read the shards leased by c.
+// Every worker must share the checkpoint store so a shard can be resumed by
+// the worker taking its lease.
+func WithLeaseCoordinator(c *LeaseCoordinator) StreamerOption {
+	return func(s *Streamer) {
+		s.leases = c
+	}
+}
+
+// Owns reports if the worker holds the lease of the shard. A lease which could
+// not be renewed is no longer owned once LeaseDuration passed since it was last
+// claimed, even if the store could not be reached to learn it.
+func (c *LeaseCoordinator) Owns(streamName, shardID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until, ok := c.owned[streamName][shardID]
+	return ok && c.clock.Now().Before(until)
+}
+
+// Coordinate runs a round of lease management for the open shards of a stream:
+// it renews the leases held, takes unowned or expired ones up to the worker
+// share and steals at most one lease from an overloaded worker.
+// Leases are released as soon as the store shows them taken by another worker,
+// while the ones not renewed because of an error lapse after LeaseDuration.
+func (c *LeaseCoordinator) Coordinate(ctx context.Context, streamName string, shardIDs []string) error {
+	leases, err := c.leases(ctx, streamName, shardIDs)
+	if err != nil {
+		return err
+	}
+	now := c.clock.Now()
+	var mine, available []Lease
+	others := map[string][]Lease{}
+	c.mu.Lock()
+	c.forgetClosed(streamName, leases)
+	for _, lease := range leases {
+		switch {
+		case lease.Owner == c.workerID:
+			mine = append(mine, lease)
+		case c.expired(lease, now):
+			delete(c.owned[streamName], lease.ShardID)
+			available = append(available, lease)
+		default:
+			delete(c.owned[streamName], lease.ShardID)
+			others[lease.Owner] = append(others[lease.Owner], lease)
+		}
+	}
+	c.mu.Unlock()
+	var owned int
+	for _, lease := range mine {
+		ok, err := c.take(ctx, lease, now)
+		if err != nil {
+			return err
+		}
+		if ok {
+			owned++
+		}
+	}
+	workers := len(others) + 1
+	target := (len(leases) + workers - 1) / workers
+	for _, lease := range available {
+		if owned >= target {
+			break
+		}
+		ok, err := c.take(ctx, lease, now)
+		if err != nil {
+			return err
+		}
+		if ok {
+			owned++
+		}
+	}
+	if owned < target {
+		if lease, ok := stealCandidate(others, target); ok {
+			if _, err := c.take(ctx, lease, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// forgetClosed drops the state of the leases of shards no longer open.
+func (c *LeaseCoordinator) forgetClosed(streamName string, leases []Lease) {
+	open := map[string]bool{}
+	for _, lease := range leases {
+		open[lease.ShardID] = true
+	}
+	for shardID := range c.owned[streamName] {
+		if !open[shardID] {
+			delete(c.owned[streamName], shardID)
+		}
+	}
+	for shardID := range c.observed[streamName] {
+		if !open[shardID] {
+			delete(c.observed[streamName], shardID)
+		}
+	}
+}
+
+// expired reports if the lease is unowned or its counter did not change for
+// leaseDuration. Only the local clock is used so the clock skew between workers
+// does not matter.
+func (c *LeaseCoordinator) expired(lease Lease, now time.Time) bool {
+	if lease.Owner == "" {
+		return true
+	}
+	if c.observed[lease.StreamName] == nil {
+		c.observed[lease.StreamName] = map[string]observation{}
+	}
+	seen, ok := c.observed[lease.StreamName][lease.ShardID]
+	if !ok || seen.counter != lease.Counter {
+		c.observed[lease.StreamName][lease.ShardID] = observation{counter: lease.Counter, at: now}
+		return false
+	}
+	return now.Sub(seen.at) >= c.leaseDuration
+}
+
+// leases returns the leases of shardIDs creating the missing ones.
+func (c *LeaseCoordinator) leases(ctx context.Context, streamName string, shardIDs []string) ([]Lease, error) {
+	stored, err := c.store.ListLeases(ctx, streamName)
+	if err != nil {
+		return nil, fmt.Errorf("list leases error: %w", err)
+	}
+	byShard := map[string]Lease{}
+	for _, lease := range stored {
+		byShard[lease.ShardID] = lease
+	}
+	var missing bool
+	for _, shardID := range shardIDs {
+		if _, ok := byShard[shardID]; ok {
+			continue
+		}
+		missing = true
+		if err := c.store.CreateLease(ctx, streamName, shardID); err != nil {
+			return nil, fmt.Errorf("create lease error: %w", err)
+		}
+	}
+	if missing {
+		return c.leases(ctx, streamName, shardIDs)
+	}
+	leases := make([]Lease, 0, len(shardIDs))
+	for _, shardID := range shardIDs {
+		leases = append(leases, byShard[shardID])
+	}
+	return leases, nil
+}
+
+// take claims a lease ignoring the conflicts with workers claiming it at the
+// same time. It reports if the lease is now owned.
+func (c *LeaseCoordinator) take(ctx context.Context, lease Lease, now time.Time) (bool, error) {
+	lease.Owner = c.workerID
+	lease.Expiration = now.Add(c.leaseDuration)
+	updated, err := c.store.UpdateLease(ctx, lease)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == ErrLeaseConflict {
+		delete(c.owned[lease.StreamName], lease.ShardID)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("update lease error: %w", err)
+	}
+	if c.owned[lease.StreamName] == nil {
+		c.owned[lease.StreamName] = map[string]time.Time{}
+	}
+	if c.observed[lease.StreamName] == nil {
+		c.observed[lease.StreamName] = map[string]observation{}
+	}
+	// now was taken before the update so the lease is never held for longer
+	// than other workers wait before taking it
+	c.owned[lease.StreamName][lease.ShardID] = now.Add(c.leaseDuration)
+	c.observed[lease.StreamName][lease.ShardID] = observation{counter: updated.Counter, at: now}
+	return true, nil
+}
+
+// stealCandidate returns a lease of the worker with the most leases if it owns
+// more than target.
+func stealCandidate(others map[string][]Lease, target int) (Lease, bool) {
+	var owners []string
+	for owner := range others {
+		owners = append(owners, owner)
+	}
+	// sorted so the choice is deterministic
+	sort.Strings(owners)
+	var victim string
+	for _, owner := range owners {
+		if victim == "" || len(others[owner]) > len(others[victim]) {
+			victim = owner
+		}
+	}
+	if victim == "" || len(others[victim]) <= target {
+		return Lease{}, false
+	}
+	leases := others[victim]
+	return leases[len(leases)-1], true
+}
+
+// MemoryLeaseStore keeps the leases in memory. It is meant for tests and for
+// workers running in the same process.
+type MemoryLeaseStore struct {
+	mu     sync.Mutex
+	leases map[string]Lease
+}
+
+func NewMemoryLeaseStore() *MemoryLeaseStore {
+	return &MemoryLeaseStore{leases: map[string]Lease{}}
+}
+
+func (m *MemoryLeaseStore) ListLeases(ctx context.Context, streamName string) ([]Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var leases []Lease
+	for _, lease := range m.leases {
+		if lease.StreamName == streamName {
+			leases = append(leases, lease)
+		}
+	}
+	return leases, nil
+}
+
+func (m *MemoryLeaseStore) CreateLease(ctx context.Context, streamName, shardID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := streamName + ":" + shardID
+	if _, ok := m.leases[key]; !ok {
+		m.leases[key] = Lease{StreamName: streamName, ShardID: shardID}
+	}
+	return nil
+}
+
+func (m *MemoryLeaseStore) UpdateLease(ctx context.Context, lease Lease) (Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := lease.StreamName + ":" + lease.ShardID
+	stored, ok := m.leases[key]
+	if !ok || stored.Counter != lease.Counter {
+		return Lease{}, ErrLeaseConflict
+	}
+	lease.Counter++
+	m.leases[key] = lease
+	return lease, nil
+}
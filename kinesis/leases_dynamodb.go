@@ -0,0 +1,132 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"strconv"
+	"time"
+)
+
+// DynamoDBLeaseStore keeps the leases in a DynamoDB table whose partition key is
+// the string attribute "lease_key".
+type DynamoDBLeaseStore struct {
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+}
+
+func NewDynamoDBLeaseStore(client dynamodbiface.DynamoDBAPI, tableName string) *DynamoDBLeaseStore {
+	return &DynamoDBLeaseStore{
+		client:    client,
+		tableName: tableName,
+	}
+}
+
+func (d *DynamoDBLeaseStore) ListLeases(ctx context.Context, streamName string) ([]Lease, error) {
+	var leases []Lease
+	var parseErr error
+	err := d.client.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:        aws.String(d.tableName),
+		FilterExpression: aws.String("stream_name = :stream_name"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":stream_name": {S: aws.String(streamName)},
+		},
+	}, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range out.Items {
+			lease, err := leaseFromItem(item)
+			if err != nil {
+				parseErr = err
+				return false
+			}
+			leases = append(leases, lease)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return leases, nil
+}
+
+func (d *DynamoDBLeaseStore) CreateLease(ctx context.Context, streamName, shardID string) error {
+	_, err := d.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"lease_key":     {S: aws.String(leaseKey(streamName, shardID))},
+			"stream_name":   {S: aws.String(streamName)},
+			"shard_id":      {S: aws.String(shardID)},
+			"lease_counter": {N: aws.String("0")},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(lease_key)"),
+	})
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DynamoDBLeaseStore) UpdateLease(ctx context.Context, lease Lease) (Lease, error) {
+	_, err := d.client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"lease_key": {S: aws.String(leaseKey(lease.StreamName, lease.ShardID))},
+		},
+		UpdateExpression:    aws.String("SET lease_owner = :owner, expiration = :expiration, lease_counter = :next"),
+		ConditionExpression: aws.String("lease_counter = :counter"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner":      {S: aws.String(lease.Owner)},
+			":expiration": {N: aws.String(strconv.FormatInt(lease.Expiration.UnixNano(), 10))},
+			":counter":    {N: aws.String(strconv.FormatInt(lease.Counter, 10))},
+			":next":       {N: aws.String(strconv.FormatInt(lease.Counter+1, 10))},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return Lease{}, ErrLeaseConflict
+	}
+	if err != nil {
+		return Lease{}, err
+	}
+	lease.Counter++
+	return lease, nil
+}
+
+func leaseKey(streamName, shardID string) string {
+	return streamName + ":" + shardID
+}
+
+func leaseFromItem(item map[string]*dynamodb.AttributeValue) (Lease, error) {
+	lease := Lease{
+		StreamName: aws.StringValue(item["stream_name"].S),
+		ShardID:    aws.StringValue(item["shard_id"].S),
+	}
+	if v, ok := item["lease_owner"]; ok {
+		// lease_owner is missing until the lease is taken for the first time
+		lease.Owner = aws.StringValue(v.S)
+	}
+	if v, ok := item["expiration"]; ok {
+		nanos, err := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+		if err != nil {
+			return Lease{}, fmt.Errorf("invalid lease expiration: %w", err)
+		}
+		lease.Expiration = time.Unix(0, nanos)
+	}
+	counter, err := strconv.ParseInt(aws.StringValue(item["lease_counter"].N), 10, 64)
+	if err != nil {
+		return Lease{}, fmt.Errorf("invalid lease counter: %w", err)
+	}
+	lease.Counter = counter
+	return lease, nil
+}
+
+func isConditionalCheckFailed(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package kinesis
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"sort"
+	"testing"
+)
+
+// fakeDynamoDB keeps the items of a table by lease_key evaluating the
+// conditions used by DynamoDBLeaseStore. Scans return an item per page.
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func conditionalCheckFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil)
+}
+
+func (f *fakeDynamoDB) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	var keys []string
+	for key, item := range f.items {
+		if aws.StringValue(item["stream_name"].S) == aws.StringValue(input.ExpressionAttributeValues[":stream_name"].S) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		out := &dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{f.items[key]}}
+		if !fn(out, i == len(keys)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeDynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	key := aws.StringValue(input.Item["lease_key"].S)
+	if _, ok := f.items[key]; ok {
+		return nil, conditionalCheckFailed()
+	}
+	f.items[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	item, ok := f.items[aws.StringValue(input.Key["lease_key"].S)]
+	values := input.ExpressionAttributeValues
+	if !ok || aws.StringValue(item["lease_counter"].N) != aws.StringValue(values[":counter"].N) {
+		return nil, conditionalCheckFailed()
+	}
+	item["lease_owner"] = values[":owner"]
+	item["expiration"] = values[":expiration"]
+	item["lease_counter"] = values[":next"]
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func TestDynamoDBLeaseStore(t *testing.T) {
+	api := &fakeDynamoDB{items: map[string]map[string]*dynamodb.AttributeValue{}}
+	store := NewDynamoDBLeaseStore(api, "leases")
+	testLeaseStore(t, store)
+
+	api.items["broken:s1"] = map[string]*dynamodb.AttributeValue{
+		"stream_name":   {S: aws.String("broken")},
+		"shard_id":      {S: aws.String("s1")},
+		"lease_counter": {N: aws.String("one")},
+	}
+	if _, err := store.ListLeases(context.Background(), "broken"); err == nil {
+		t.Errorf("ListLeases() with an invalid lease should fail")
+	}
+}
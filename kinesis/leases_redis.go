@@ -0,0 +1,105 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// updateLeaseScript replaces a lease if its stored counter is still ARGV[2].
+var updateLeaseScript = redis.NewScript(`
+local stored = redis.call('HGET', KEYS[1], ARGV[1])
+if not stored or string.match(stored, '^(%d+):') ~= ARGV[2] then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+return 1
+`)
+
+// RedisLeaseStore keeps the leases of each stream in a Redis hash named after
+// the stream with keyPrefix, whose fields are the shard IDs. Updates run as a
+// script so the counter is compared and increased atomically.
+type RedisLeaseStore struct {
+	client    redis.UniversalClient
+	keyPrefix string
+}
+
+func NewRedisLeaseStore(client redis.UniversalClient, keyPrefix string) *RedisLeaseStore {
+	return &RedisLeaseStore{
+		client:    client,
+		keyPrefix: keyPrefix,
+	}
+}
+
+func (r *RedisLeaseStore) key(streamName string) string {
+	return r.keyPrefix + streamName
+}
+
+func (r *RedisLeaseStore) ListLeases(ctx context.Context, streamName string) ([]Lease, error) {
+	fields, err := r.client.HGetAll(ctx, r.key(streamName)).Result()
+	if err != nil {
+		return nil, err
+	}
+	leases := make([]Lease, 0, len(fields))
+	for shardID, value := range fields {
+		lease, err := decodeRedisLease(value)
+		if err != nil {
+			return nil, err
+		}
+		lease.StreamName = streamName
+		lease.ShardID = shardID
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+func (r *RedisLeaseStore) CreateLease(ctx context.Context, streamName, shardID string) error {
+	return r.client.HSetNX(ctx, r.key(streamName), shardID, encodeRedisLease(Lease{})).Err()
+}
+
+func (r *RedisLeaseStore) UpdateLease(ctx context.Context, lease Lease) (Lease, error) {
+	next := lease
+	next.Counter++
+	updated, err := updateLeaseScript.Run(ctx, r.client, []string{r.key(lease.StreamName)},
+		lease.ShardID, strconv.FormatInt(lease.Counter, 10), encodeRedisLease(next)).Int()
+	if err != nil {
+		return Lease{}, err
+	}
+	if updated == 0 {
+		return Lease{}, ErrLeaseConflict
+	}
+	return next, nil
+}
+
+// encodeRedisLease encodes a lease as "counter:expiration:owner". The owner is
+// last so it may contain colons.
+func encodeRedisLease(lease Lease) string {
+	var expiration int64
+	if !lease.Expiration.IsZero() {
+		expiration = lease.Expiration.UnixNano()
+	}
+	return fmt.Sprintf("%d:%d:%s", lease.Counter, expiration, lease.Owner)
+}
+
+func decodeRedisLease(value string) (Lease, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 {
+		return Lease{}, fmt.Errorf("invalid lease %q", value)
+	}
+	counter, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Lease{}, fmt.Errorf("invalid lease counter: %w", err)
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Lease{}, fmt.Errorf("invalid lease expiration: %w", err)
+	}
+	lease := Lease{Owner: parts[2], Counter: counter}
+	if nanos != 0 {
+		lease.Expiration = time.Unix(0, nanos)
+	}
+	return lease, nil
+}
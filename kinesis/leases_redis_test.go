@@ -0,0 +1,20 @@
+package kinesis
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+)
+
+func TestRedisLeaseStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	testLeaseStore(t, NewRedisLeaseStore(client, "leases:"))
+
+	server.HSet("leases:broken", "s1", "owner")
+	if _, err := NewRedisLeaseStore(client, "leases:").ListLeases(context.Background(), "broken"); err == nil {
+		t.Errorf("ListLeases() with an invalid lease should fail")
+	}
+}
@@ -0,0 +1,78 @@
+package kinesis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SQLLeaseStore keeps the leases in a SQL table. The statements use PostgreSQL
+// syntax and expect a table created as:
+//
+//	CREATE TABLE <table> (
+//		stream_name TEXT NOT NULL,
+//		shard_id TEXT NOT NULL,
+//		lease_owner TEXT NOT NULL DEFAULT '',
+//		expiration BIGINT NOT NULL DEFAULT 0,
+//		lease_counter BIGINT NOT NULL DEFAULT 0,
+//		PRIMARY KEY (stream_name, shard_id)
+//	)
+type SQLLeaseStore struct {
+	db        *sql.DB
+	tableName string
+}
+
+func NewSQLLeaseStore(db *sql.DB, tableName string) *SQLLeaseStore {
+	return &SQLLeaseStore{
+		db:        db,
+		tableName: tableName,
+	}
+}
+
+func (s *SQLLeaseStore) ListLeases(ctx context.Context, streamName string) ([]Lease, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(
+		`SELECT shard_id, lease_owner, expiration, lease_counter FROM %s WHERE stream_name = $1`,
+		s.tableName), streamName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var leases []Lease
+	for rows.Next() {
+		lease := Lease{StreamName: streamName}
+		var expiration int64
+		if err := rows.Scan(&lease.ShardID, &lease.Owner, &expiration, &lease.Counter); err != nil {
+			return nil, err
+		}
+		lease.Expiration = time.Unix(0, expiration)
+		leases = append(leases, lease)
+	}
+	return leases, rows.Err()
+}
+
+func (s *SQLLeaseStore) CreateLease(ctx context.Context, streamName, shardID string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		`INSERT INTO %s (stream_name, shard_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		s.tableName), streamName, shardID)
+	return err
+}
+
+func (s *SQLLeaseStore) UpdateLease(ctx context.Context, lease Lease) (Lease, error) {
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		`UPDATE %s SET lease_owner = $1, expiration = $2, lease_counter = lease_counter + 1
+		WHERE stream_name = $3 AND shard_id = $4 AND lease_counter = $5`,
+		s.tableName), lease.Owner, lease.Expiration.UnixNano(), lease.StreamName, lease.ShardID, lease.Counter)
+	if err != nil {
+		return Lease{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Lease{}, err
+	}
+	if n == 0 {
+		return Lease{}, ErrLeaseConflict
+	}
+	lease.Counter++
+	return lease, nil
+}
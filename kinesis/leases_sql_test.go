@@ -0,0 +1,62 @@
+package kinesis
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"testing"
+	"time"
+)
+
+func TestSQLLeaseStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := NewSQLLeaseStore(db, "leases")
+	ctx := context.Background()
+
+	mock.ExpectExec(`INSERT INTO leases \(stream_name, shard_id\) VALUES \(\$1, \$2\) ON CONFLICT DO NOTHING`).
+		WithArgs("stream", "s1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := store.CreateLease(ctx, "stream", "s1"); err != nil {
+		t.Errorf("CreateLease() error = %v", err)
+	}
+
+	expiration := time.Unix(10, 0)
+	update := `UPDATE leases SET lease_owner = \$1, expiration = \$2, lease_counter = lease_counter \+ 1\s+WHERE stream_name = \$3 AND shard_id = \$4 AND lease_counter = \$5`
+	mock.ExpectExec(update).
+		WithArgs("a", expiration.UnixNano(), "stream", "s1", int64(0)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	updated, err := store.UpdateLease(ctx, Lease{StreamName: "stream", ShardID: "s1", Owner: "a", Expiration: expiration})
+	if err != nil {
+		t.Fatalf("UpdateLease() error = %v", err)
+	}
+	if updated.Counter != 1 {
+		t.Errorf("UpdateLease() counter = %v, want 1", updated.Counter)
+	}
+
+	// no row matches a stale counter
+	mock.ExpectExec(update).
+		WithArgs("b", int64(0), "stream", "s1", int64(0)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if _, err := store.UpdateLease(ctx, Lease{StreamName: "stream", ShardID: "s1", Owner: "b", Expiration: time.Unix(0, 0)}); err != ErrLeaseConflict {
+		t.Errorf("UpdateLease() with stale counter error = %v, want %v", err, ErrLeaseConflict)
+	}
+
+	mock.ExpectQuery(`SELECT shard_id, lease_owner, expiration, lease_counter FROM leases WHERE stream_name = \$1`).
+		WithArgs("stream").
+		WillReturnRows(sqlmock.NewRows([]string{"shard_id", "lease_owner", "expiration", "lease_counter"}).
+			AddRow("s1", "a", expiration.UnixNano(), 1).
+			AddRow("s2", "", 0, 0))
+	leases, err := store.ListLeases(ctx, "stream")
+	if err != nil {
+		t.Fatalf("ListLeases() error = %v", err)
+	}
+	if len(leases) != 2 || leases[0].Owner != "a" || !leases[0].Expiration.Equal(expiration) || leases[0].Counter != 1 || leases[1].ShardID != "s2" || leases[1].StreamName != "stream" {
+		t.Errorf("ListLeases() got = %+v", leases)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
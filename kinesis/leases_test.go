@@ -0,0 +1,397 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestCoordinators(t *testing.T, store LeaseStore, clock Clock, workers ...string) map[string]*LeaseCoordinator {
+	coordinators := map[string]*LeaseCoordinator{}
+	for _, worker := range workers {
+		c, err := NewLeaseCoordinator(LeaseConfig{
+			WorkerID:      worker,
+			Store:         store,
+			LeaseDuration: 10 * time.Second,
+			Clock:         clock,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		coordinators[worker] = c
+	}
+	return coordinators
+}
+
+// rounds runs n lease rounds for the workers in order advancing the clock by a
+// renew interval after each round.
+func rounds(t *testing.T, n int, clock *fakeClock, shardIDs []string, workers []string, coordinators map[string]*LeaseCoordinator) {
+	for i := 0; i < n; i++ {
+		for _, worker := range workers {
+			if err := coordinators[worker].Coordinate(context.Background(), "stream", shardIDs); err != nil {
+				t.Fatalf("Coordinate() error = %v", err)
+			}
+		}
+		clock.Add(3 * time.Second)
+	}
+}
+
+func ownedShards(c *LeaseCoordinator, shardIDs []string) []string {
+	var owned []string
+	for _, shardID := range shardIDs {
+		if c.Owns("stream", shardID) {
+			owned = append(owned, shardID)
+		}
+	}
+	return owned
+}
+
+// assertExclusive checks every shard is owned by exactly one worker and returns
+// the number of shards owned by each worker.
+func assertExclusive(t *testing.T, shardIDs []string, coordinators map[string]*LeaseCoordinator) map[string]int {
+	counts := map[string]int{}
+	for _, shardID := range shardIDs {
+		var owners []string
+		for worker, c := range coordinators {
+			if c.Owns("stream", shardID) {
+				owners = append(owners, worker)
+				counts[worker]++
+			}
+		}
+		if len(owners) != 1 {
+			t.Errorf("shard %v owners = %v, want a single owner", shardID, owners)
+		}
+	}
+	return counts
+}
+
+func TestLeaseCoordinator_Coordinate(t *testing.T) {
+	shardIDs := []string{"s1", "s2", "s3", "s4", "s5"}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := NewMemoryLeaseStore()
+	coordinators := newTestCoordinators(t, store, clock, "a", "b", "c")
+
+	rounds(t, 1, clock, shardIDs, []string{"a"}, coordinators)
+	if got := ownedShards(coordinators["a"], shardIDs); len(got) != len(shardIDs) {
+		t.Fatalf("single worker owns %v, want every shard", got)
+	}
+
+	// scale out: b steals from a until balanced
+	rounds(t, 5, clock, shardIDs, []string{"a", "b"}, coordinators)
+	delete(coordinators, "c")
+	counts := assertExclusive(t, shardIDs, coordinators)
+	if counts["a"] != 3 || counts["b"] != 2 {
+		t.Errorf("balanced counts = %v, want a:3 b:2", counts)
+	}
+
+	// a dies: its leases expire and b takes them
+	clock.Add(10 * time.Second)
+	rounds(t, 1, clock, shardIDs, []string{"b"}, coordinators)
+	if got := ownedShards(coordinators["b"], shardIDs); len(got) != len(shardIDs) {
+		t.Errorf("surviving worker owns %v, want every shard", got)
+	}
+
+	// a comes back, notices it lost its leases and steals one which b notices
+	rounds(t, 1, clock, shardIDs, []string{"a", "b"}, coordinators)
+	counts = assertExclusive(t, shardIDs, coordinators)
+	if counts["a"] != 1 {
+		t.Errorf("returning worker owns %v shards, want 1 stolen", counts["a"])
+	}
+}
+
+func TestLeaseCoordinator_ThreeWorkers(t *testing.T) {
+	var shardIDs []string
+	for i := 0; i < 9; i++ {
+		shardIDs = append(shardIDs, fmt.Sprintf("s%d", i))
+	}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	coordinators := newTestCoordinators(t, NewMemoryLeaseStore(), clock, "a", "b", "c")
+	rounds(t, 10, clock, shardIDs, []string{"a", "b", "c"}, coordinators)
+	counts := assertExclusive(t, shardIDs, coordinators)
+	for worker, count := range counts {
+		if count != 3 {
+			t.Errorf("worker %v owns %v shards, want 3", worker, count)
+		}
+	}
+}
+
+func TestLeaseCoordinator_ClockSkew(t *testing.T) {
+	shardIDs := []string{"s1"}
+	// b runs an hour ahead so every Expiration written by a is in its past
+	clockA := &fakeClock{now: time.Unix(0, 0)}
+	clockB := &fakeClock{now: time.Unix(3600, 0)}
+	store := NewMemoryLeaseStore()
+	a := newTestCoordinators(t, store, clockA, "a")["a"]
+	b := newTestCoordinators(t, store, clockB, "b")["b"]
+	coordinate := func(c *LeaseCoordinator) {
+		if err := c.Coordinate(context.Background(), "stream", shardIDs); err != nil {
+			t.Fatalf("Coordinate() error = %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		coordinate(a)
+		coordinate(b)
+		clockA.Add(3 * time.Second)
+		clockB.Add(3 * time.Second)
+	}
+	if !a.Owns("stream", "s1") || b.Owns("stream", "s1") {
+		t.Fatalf("lease renewed by a was taken by a worker with a skewed clock")
+	}
+
+	// a stops renewing: b takes the lease once the counter is unchanged for the
+	// lease duration of its own clock
+	clockB.Add(10 * time.Second)
+	coordinate(b)
+	if !b.Owns("stream", "s1") {
+		t.Errorf("lease of a dead worker was not taken")
+	}
+}
+
+// failingLeaseStore fails every call while err is set.
+type failingLeaseStore struct {
+	LeaseStore
+	mu  sync.Mutex
+	err error
+}
+
+func (f *failingLeaseStore) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *failingLeaseStore) failure() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *failingLeaseStore) ListLeases(ctx context.Context, streamName string) ([]Lease, error) {
+	if err := f.failure(); err != nil {
+		return nil, err
+	}
+	return f.LeaseStore.ListLeases(ctx, streamName)
+}
+
+func (f *failingLeaseStore) CreateLease(ctx context.Context, streamName, shardID string) error {
+	if err := f.failure(); err != nil {
+		return err
+	}
+	return f.LeaseStore.CreateLease(ctx, streamName, shardID)
+}
+
+func (f *failingLeaseStore) UpdateLease(ctx context.Context, lease Lease) (Lease, error) {
+	if err := f.failure(); err != nil {
+		return Lease{}, err
+	}
+	return f.LeaseStore.UpdateLease(ctx, lease)
+}
+
+func TestLeaseCoordinator_StoreFailure(t *testing.T) {
+	shardIDs := []string{"s1", "s2"}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := &failingLeaseStore{LeaseStore: NewMemoryLeaseStore()}
+	c := newTestCoordinators(t, store, clock, "a")["a"]
+	rounds(t, 1, clock, shardIDs, []string{"a"}, map[string]*LeaseCoordinator{"a": c})
+
+	store.fail(errors.New("store unavailable"))
+	if err := c.Coordinate(context.Background(), "stream", shardIDs); err == nil {
+		t.Fatalf("Coordinate() with a failing store should fail")
+	}
+	if got := ownedShards(c, shardIDs); len(got) != len(shardIDs) {
+		t.Errorf("owned before the lease duration = %v, want every shard", got)
+	}
+	clock.Add(7 * time.Second)
+	if got := ownedShards(c, shardIDs); len(got) != 0 {
+		t.Errorf("owned after the lease duration without renewal = %v, want none", got)
+	}
+}
+
+func TestShardLifecycle_RenewLeases(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := &failingLeaseStore{LeaseStore: NewMemoryLeaseStore()}
+	leases, err := NewLeaseCoordinator(LeaseConfig{
+		WorkerID:      "a",
+		Store:         store,
+		LeaseDuration: 10 * time.Second,
+		RenewInterval: time.Millisecond,
+		Clock:         clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed bool
+	events := make(chan ShardEvent, 10)
+	l := &shardLifecycle{
+		streamName: "stream",
+		// only the first listing succeeds so the leases must be renewed apart
+		listShards: func(ctx context.Context) ([]*kinesis.Shard, error) {
+			if listed {
+				return nil, errors.New("list failed")
+			}
+			listed = true
+			return []*kinesis.Shard{shard("s1", "", "")}, nil
+		},
+		scanShard: func(ctx context.Context, shardID string) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		store:    new(memoryStore),
+		interval: time.Millisecond,
+		leases:   leases,
+		onEvent: func(e ShardEvent) {
+			events <- e
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- l.run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	next := func() ShardEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for a shard event")
+			return ShardEvent{}
+		}
+	}
+	if e := next(); e.Type != ShardAdded {
+		t.Fatalf("event = %+v, want %v", e, ShardAdded)
+	}
+	for i := 0; i < 4; i++ {
+		clock.Add(5 * time.Second)
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("event = %+v while the lease is renewed", e)
+	default:
+	}
+
+	// the lease can no longer be confirmed so the shard is stopped
+	store.fail(errors.New("store unavailable"))
+	clock.Add(10 * time.Second)
+	if e := next(); e.Type != ShardReleased {
+		t.Errorf("event = %+v, want %v", e, ShardReleased)
+	}
+}
+
+// testLeaseStore checks the behavior every LeaseStore must have.
+func testLeaseStore(t *testing.T, store LeaseStore) {
+	ctx := context.Background()
+	for _, shardID := range []string{"s1", "s1", "s2"} {
+		if err := store.CreateLease(ctx, "stream", shardID); err != nil {
+			t.Fatalf("CreateLease() error = %v", err)
+		}
+	}
+	if err := store.CreateLease(ctx, "other", "s1"); err != nil {
+		t.Fatalf("CreateLease() error = %v", err)
+	}
+	expiration := time.Unix(10, 0)
+	updated, err := store.UpdateLease(ctx, Lease{StreamName: "stream", ShardID: "s1", Owner: "a", Expiration: expiration})
+	if err != nil {
+		t.Fatalf("UpdateLease() error = %v", err)
+	}
+	if updated.Counter != 1 {
+		t.Errorf("UpdateLease() counter = %v, want 1", updated.Counter)
+	}
+	stale := Lease{StreamName: "stream", ShardID: "s1", Owner: "b"}
+	if _, err := store.UpdateLease(ctx, stale); err != ErrLeaseConflict {
+		t.Errorf("UpdateLease() with stale counter error = %v, want %v", err, ErrLeaseConflict)
+	}
+	leases, err := store.ListLeases(ctx, "stream")
+	if err != nil {
+		t.Fatalf("ListLeases() error = %v", err)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].ShardID < leases[j].ShardID
+	})
+	if len(leases) != 2 {
+		t.Fatalf("ListLeases() got = %+v, want the leases of s1 and s2", leases)
+	}
+	if got := leases[0]; got.ShardID != "s1" || got.Owner != "a" || got.Counter != 1 || !got.Expiration.Equal(expiration) {
+		t.Errorf("ListLeases() s1 = %+v, want owned by a with counter 1", got)
+	}
+	if got := leases[1]; got.StreamName != "stream" || got.ShardID != "s2" || got.Owner != "" || got.Counter != 0 {
+		t.Errorf("ListLeases() s2 = %+v, want unowned with counter 0", got)
+	}
+}
+
+func TestMemoryLeaseStore(t *testing.T) {
+	testLeaseStore(t, NewMemoryLeaseStore())
+}
+
+func TestStreamer_Leases(t *testing.T) {
+	api := &fakeKinesis{
+		shards:  []*kinesis.Shard{shard("s1", "", ""), shard("s2", "", ""), shard("s3", "", ""), shard("s4", "", "")},
+		records: map[string][]string{"s1": {"11", "12"}, "s2": {"21"}, "s3": {"31", "32"}, "s4": {"41"}},
+	}
+	shardIDs := []string{"s1", "s2", "s3", "s4"}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	coordinators := newTestCoordinators(t, NewMemoryLeaseStore(), clock, "a", "b")
+	// leases are balanced before streaming and the frozen clock keeps them
+	rounds(t, 5, clock, shardIDs, []string{"a", "b"}, coordinators)
+	assertExclusive(t, shardIDs, coordinators)
+
+	var got []string
+	for _, worker := range []string{"a", "b"} {
+		want := 0
+		for _, shardID := range ownedShards(coordinators[worker], shardIDs) {
+			want += len(api.records[shardID])
+		}
+		s := newTestStreamer(t, api, WithLeaseCoordinator(coordinators[worker]), WithCheckpointStore(new(memoryStore)))
+		got = append(got, scanStreamer(t, s, want)...)
+	}
+	sort.Strings(got)
+	want := []string{"11", "12", "21", "31", "32", "41"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("records read by both workers = %v, want each record once %v", got, want)
+	}
+}
+
+func TestNewLeaseCoordinator(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     LeaseConfig
+		wantErr bool
+	}{
+		{"default", LeaseConfig{WorkerID: "a", Store: NewMemoryLeaseStore()}, false},
+		{"missingWorkerID", LeaseConfig{Store: NewMemoryLeaseStore()}, true},
+		{"missingStore", LeaseConfig{WorkerID: "a"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewLeaseCoordinator(tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("NewLeaseCoordinator() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package kinesis
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/nicolasassi/kinestesia/logging"
+)
+
+// WithLogging sets the Logger for the events of the Streamer, as the shards
+// started and stopped or the records which failed to translate. The default is
+// logging.Default. Streamers of NewStreamers given this option share l.
+func WithLogging(l logging.Logger) StreamerOption {
+	return func(s *Streamer) {
+		s.logger = l
+	}
+}
+
+// WithClientLogging logs the requests of the client with l at debug level.
+// WithLogger sets how much of the requests is logged.
+func WithClientLogging(l logging.Logger) ClientOption {
+	return func(c *aws.Config) {
+		c.WithLogger(aws.LoggerFunc(func(args ...interface{}) {
+			l.Log(logging.LevelDebug, fmt.Sprint(args...), nil)
+		}))
+		if c.LogLevel == nil {
+			c.WithLogLevel(aws.LogDebug)
+		}
+	}
+}
+
+// logShardEvent logs e as a logging.ShardStarted or logging.ShardStopped.
+func (s *Streamer) logShardEvent(e ShardEvent) {
+	fields := logging.Fields{"stream": e.StreamName, "shard": e.ShardID}
+	switch e.Type {
+	case ShardAdded:
+		s.logger.Log(logging.LevelInfo, logging.ShardStarted, fields)
+	case ShardClosed:
+		fields["reason"] = "closed"
+		s.logger.Log(logging.LevelInfo, logging.ShardStopped, fields)
+	case ShardReleased:
+		fields["reason"] = "released"
+		s.logger.Log(logging.LevelInfo, logging.ShardStopped, fields)
+	}
+}
+
+// recordFields identify the record of del read for the receiver rec.
+func (s *Streamer) recordFields(rec string, del delivery) logging.Fields {
+	return logging.Fields{
+		"stream":          s.name,
+		"shard":           del.shardID,
+		"receiver":        rec,
+		"sequence_number": aws.StringValue(del.record.SequenceNumber),
+		"partition_key":   aws.StringValue(del.record.PartitionKey),
+	}
+}
+
+// logStop logs a logging.StreamStopped, as an error if streaming failed.
+func (s *Streamer) logStop(undelivered int, err error) {
+	fields := logging.Fields{"stream": s.name, "undelivered": undelivered}
+	if err != nil {
+		fields["error"] = err
+		s.logger.Log(logging.LevelError, logging.StreamStopped, fields)
+		return
+	}
+	s.logger.Log(logging.LevelInfo, logging.StreamStopped, fields)
+}
@@ -0,0 +1,84 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/nicolasassi/kinestesia/logging"
+	"sync"
+	"testing"
+	"time"
+)
+
+type event struct {
+	level  logging.Level
+	msg    string
+	fields logging.Fields
+}
+
+type fakeLogger struct {
+	mu     sync.Mutex
+	events []event
+}
+
+func (f *fakeLogger) Log(level logging.Level, msg string, fields logging.Fields) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event{level: level, msg: msg, fields: fields})
+}
+
+func (f *fakeLogger) find(msg string) (event, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range f.events {
+		if e.msg == msg {
+			return e, true
+		}
+	}
+	return event{}, false
+}
+
+func TestStreamer_Logging(t *testing.T) {
+	api := &fakeKinesis{
+		shards:  []*kinesis.Shard{shard("s1", "", "")},
+		records: map[string][]string{"s1": {"a"}},
+	}
+	logger := new(fakeLogger)
+	s := newTestStreamer(t, api, WithLogging(logger))
+	rec := newFakeReceiver("rec", 1, func(b []byte) ([]byte, error) {
+		return nil, errors.New("not JSON")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stream(ctx, rec); err == nil {
+		t.Fatalf("Stream() error = nil, want the translation failure")
+	}
+	tests := []struct {
+		msg    string
+		level  logging.Level
+		fields map[string]interface{}
+	}{
+		{logging.ShardStarted, logging.LevelInfo, map[string]interface{}{"stream": "stream", "shard": "s1"}},
+		{logging.TranslationFailed, logging.LevelError, map[string]interface{}{"stream": "stream", "shard": "s1", "receiver": "rec", "sequence_number": "a"}},
+		{logging.StreamStopped, logging.LevelError, map[string]interface{}{"stream": "stream", "undelivered": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			got, ok := logger.find(tt.msg)
+			if !ok {
+				t.Fatalf("%q not logged", tt.msg)
+			}
+			if got.level != tt.level {
+				t.Errorf("level got = %v, want %v", got.level, tt.level)
+			}
+			for k, v := range tt.fields {
+				if got.fields[k] != v {
+					t.Errorf("field %s got = %v, want %v", k, got.fields[k], v)
+				}
+			}
+			if tt.level == logging.LevelError && got.fields["error"] == nil {
+				t.Errorf("no error field in %v", got.fields)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package kinesis
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"sync"
+)
+
+// WithMetrics sets the Recorder for the measurements of the Streamer.
+func WithMetrics(r metrics.Recorder) StreamerOption {
+	return func(s *Streamer) {
+		s.metrics = r
+	}
+}
+
+// lagClient records metrics.MillisBehindLatest of every GetRecords response.
+// GetRecords only knows the shard iterator so the shard of each iterator is
+// followed from GetShardIterator through every NextShardIterator.
+type lagClient struct {
+	kinesisiface.KinesisAPI
+	streamName string
+	recorder   metrics.Recorder
+
+	mu     sync.Mutex
+	shards map[string]string
+}
+
+func newLagClient(streamName string, client kinesisiface.KinesisAPI, recorder metrics.Recorder) *lagClient {
+	return &lagClient{
+		KinesisAPI: client,
+		streamName: streamName,
+		recorder:   recorder,
+		shards:     map[string]string{},
+	}
+}
+
+func (l *lagClient) GetShardIteratorWithContext(ctx aws.Context, input *kinesis.GetShardIteratorInput, opts ...request.Option) (*kinesis.GetShardIteratorOutput, error) {
+	out, err := l.KinesisAPI.GetShardIteratorWithContext(ctx, input, opts...)
+	if err == nil && out.ShardIterator != nil {
+		l.mu.Lock()
+		l.shards[*out.ShardIterator] = aws.StringValue(input.ShardId)
+		l.mu.Unlock()
+	}
+	return out, err
+}
+
+func (l *lagClient) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	iterator := aws.StringValue(input.ShardIterator)
+	l.mu.Lock()
+	shardID, ok := l.shards[iterator]
+	delete(l.shards, iterator)
+	l.mu.Unlock()
+	out, err := l.KinesisAPI.GetRecords(input)
+	if err != nil || !ok {
+		return out, err
+	}
+	if out.NextShardIterator != nil {
+		l.mu.Lock()
+		l.shards[*out.NextShardIterator] = shardID
+		l.mu.Unlock()
+	}
+	if out.MillisBehindLatest != nil {
+		l.recorder.Set(metrics.MillisBehindLatest, float64(*out.MillisBehindLatest), metrics.Labels{
+			"stream": l.streamName,
+			"shard":  shardID,
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,418 @@
+package kinesis
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/go-ini/ini"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSTSRegion      = "us-east-1"
+	defaultProfile        = "default"
+	maxSourceProfileDepth = 5
+
+	// ProfileProviderName is the ProviderName of the credentials of a profile.
+	ProfileProviderName = "ProfileProvider"
+	// WebIdentityProviderName is the ProviderName of the credentials of a web
+	// identity.
+	WebIdentityProviderName = "WebIdentityProvider"
+)
+
+// AssumeRoleConfig sets the role assumed with STS AssumeRole.
+type AssumeRoleConfig struct {
+	// RoleARN is the role assumed.
+	RoleARN string
+	// RoleSessionName identifies the session. The default is a timestamp.
+	RoleSessionName string
+	// ExternalID is the external ID required by the trust policy of the role, if
+	// any.
+	ExternalID string
+	// Duration is how long the credentials are valid. The default is 15 minutes.
+	Duration time.Duration
+	// MFASerial is the serial number or ARN of the MFA device required by the
+	// role, if any. MFATokenProvider must be set with it.
+	MFASerial string
+	// MFATokenProvider returns the current code of the MFA device.
+	MFATokenProvider func() (string, error)
+	// Source provides the credentials calling STS. The default is the
+	// environment variables.
+	Source credentials.Provider
+	// Region is the region of STS. The default is us-east-1.
+	Region string
+	// Endpoint overrides the endpoint of STS, as a local STS stand-in.
+	Endpoint string
+	// Refresh sets when the role is assumed again.
+	Refresh RefreshConfig
+}
+
+// NewAssumeRoleProvider creates a credentials.Provider assuming the role of cfg.
+// The role is assumed again ahead of the expiration of the credentials.
+func NewAssumeRoleProvider(cfg AssumeRoleConfig) (*RefreshingProvider, error) {
+	if cfg.RoleARN == "" {
+		return nil, credentialsErrorf(cfg.RoleARN, "assume role requires a role ARN")
+	}
+	if cfg.MFASerial != "" && cfg.MFATokenProvider == nil {
+		return nil, credentialsErrorf(cfg.RoleARN, "assume role %s with MFA requires a token provider", cfg.RoleARN)
+	}
+	source := cfg.Source
+	if source == nil {
+		source = &credentials.EnvProvider{}
+	}
+	client, err := newSTSClient(credentials.NewCredentials(source), cfg.Region, cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return NewRefreshingProvider(assumeRole(client, cfg), cfg.Refresh), nil
+}
+
+func assumeRole(client stsiface.STSAPI, cfg AssumeRoleConfig) RefreshFunc {
+	if cfg.Duration <= 0 {
+		cfg.Duration = stscreds.DefaultDuration
+	}
+	return func() (credentials.Value, time.Time, error) {
+		input := &sts.AssumeRoleInput{
+			RoleArn:         aws.String(cfg.RoleARN),
+			RoleSessionName: aws.String(sessionName(cfg.RoleSessionName)),
+			DurationSeconds: aws.Int64(int64(cfg.Duration / time.Second)),
+		}
+		if cfg.ExternalID != "" {
+			input.ExternalId = aws.String(cfg.ExternalID)
+		}
+		if cfg.MFASerial != "" {
+			code, err := cfg.MFATokenProvider()
+			if err != nil {
+				return credentials.Value{}, time.Time{}, fmt.Errorf("mfa token of %s: %w", cfg.MFASerial, err)
+			}
+			input.SerialNumber = aws.String(cfg.MFASerial)
+			input.TokenCode = aws.String(code)
+		}
+		out, err := client.AssumeRole(input)
+		if err != nil {
+			return credentials.Value{}, time.Time{}, fmt.Errorf("assume role %s: %w", cfg.RoleARN, err)
+		}
+		return stsValue(out.Credentials, stscreds.ProviderName)
+	}
+}
+
+// WebIdentityConfig sets the role assumed with STS AssumeRoleWithWebIdentity,
+// as done by the pods of EKS with IAM roles for service accounts.
+type WebIdentityConfig struct {
+	// RoleARN is the role assumed. The default is AWS_ROLE_ARN.
+	RoleARN string
+	// TokenFile is the file holding the web identity token. It is read on every
+	// refresh since the token rotates. The default is AWS_WEB_IDENTITY_TOKEN_FILE.
+	TokenFile string
+	// RoleSessionName identifies the session. The default is AWS_ROLE_SESSION_NAME
+	// or a timestamp.
+	RoleSessionName string
+	// Duration is how long the credentials are valid. The default is decided by
+	// STS.
+	Duration time.Duration
+	// Region is the region of STS. The default is us-east-1.
+	Region string
+	// Endpoint overrides the endpoint of STS, as a local STS stand-in.
+	Endpoint string
+	// Refresh sets when the role is assumed again.
+	Refresh RefreshConfig
+}
+
+// NewWebIdentityProvider creates a credentials.Provider assuming the role of cfg
+// with a web identity token. The role is assumed again ahead of the expiration
+// of the credentials.
+func NewWebIdentityProvider(cfg WebIdentityConfig) (*RefreshingProvider, error) {
+	if cfg.RoleARN == "" {
+		cfg.RoleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	if cfg.TokenFile == "" {
+		cfg.TokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if cfg.RoleSessionName == "" {
+		cfg.RoleSessionName = os.Getenv("AWS_ROLE_SESSION_NAME")
+	}
+	if cfg.RoleARN == "" || cfg.TokenFile == "" {
+		return nil, credentialsErrorf(WebIdentityProviderName, "web identity requires a role ARN and a token file")
+	}
+	// the token authenticates the call so it is not signed
+	client, err := newSTSClient(credentials.AnonymousCredentials, cfg.Region, cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return NewRefreshingProvider(assumeRoleWithWebIdentity(client, cfg), cfg.Refresh), nil
+}
+
+func assumeRoleWithWebIdentity(client stsiface.STSAPI, cfg WebIdentityConfig) RefreshFunc {
+	return func() (credentials.Value, time.Time, error) {
+		token, err := ioutil.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return credentials.Value{}, time.Time{}, err
+		}
+		input := &sts.AssumeRoleWithWebIdentityInput{
+			RoleArn:          aws.String(cfg.RoleARN),
+			RoleSessionName:  aws.String(sessionName(cfg.RoleSessionName)),
+			WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+		}
+		if cfg.Duration > 0 {
+			input.DurationSeconds = aws.Int64(int64(cfg.Duration / time.Second))
+		}
+		out, err := client.AssumeRoleWithWebIdentity(input)
+		if err != nil {
+			return credentials.Value{}, time.Time{}, fmt.Errorf("assume role %s with web identity: %w", cfg.RoleARN, err)
+		}
+		return stsValue(out.Credentials, WebIdentityProviderName)
+	}
+}
+
+// sessionName returns name or, if empty, a timestamp hopefully unique.
+func sessionName(name string) string {
+	if name != "" {
+		return name
+	}
+	return strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+func stsValue(c *sts.Credentials, providerName string) (credentials.Value, time.Time, error) {
+	if c == nil {
+		return credentials.Value{}, time.Time{}, fmt.Errorf("STS returned no credentials")
+	}
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(c.AccessKeyId),
+		SecretAccessKey: aws.StringValue(c.SecretAccessKey),
+		SessionToken:    aws.StringValue(c.SessionToken),
+		ProviderName:    providerName,
+	}, aws.TimeValue(c.Expiration), nil
+}
+
+func newSTSClient(creds *credentials.Credentials, region, endpoint string) (*sts.STS, error) {
+	if region == "" {
+		region = defaultSTSRegion
+	}
+	config := aws.NewConfig().WithCredentials(creds).WithRegion(region)
+	if endpoint != "" {
+		config.WithEndpoint(endpoint)
+	}
+	s, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("new aws session error: %w", err)
+	}
+	return sts.New(s), nil
+}
+
+// ProfileConfig locates a named profile of the shared AWS credentials and
+// config files.
+type ProfileConfig struct {
+	// Profile is the name of the profile. The default is AWS_PROFILE or
+	// "default".
+	Profile string
+	// CredentialsFile is the shared credentials file. The default is
+	// AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials.
+	CredentialsFile string
+	// ConfigFile is the shared config file. The default is AWS_CONFIG_FILE or
+	// ~/.aws/config.
+	ConfigFile string
+	// MFATokenProvider returns the MFA code of the profiles with mfa_serial.
+	MFATokenProvider func() (string, error)
+	// STSEndpoint overrides the endpoint of STS for the profiles assuming a role,
+	// as a local STS stand-in.
+	STSEndpoint string
+	// Refresh sets when the profiles assuming a role assume it again.
+	Refresh RefreshConfig
+}
+
+// NewProfileProvider creates a credentials.Provider for the profile of cfg. The
+// profile can hold static keys, assume a role with role_arn from a
+// source_profile or credential_source = Environment, with external_id and
+// mfa_serial, assume a role with a web_identity_token_file or run a
+// credential_process as NewProcessProvider. The files are read on the first
+// Retrieve so the provider can be part of a chain whether or not they exist.
+func NewProfileProvider(cfg ProfileConfig) credentials.Provider {
+	if cfg.Profile == "" {
+		cfg.Profile = os.Getenv("AWS_PROFILE")
+	}
+	if cfg.Profile == "" {
+		cfg.Profile = defaultProfile
+	}
+	home, _ := os.UserHomeDir()
+	if cfg.CredentialsFile == "" {
+		cfg.CredentialsFile = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if cfg.CredentialsFile == "" {
+		cfg.CredentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	if cfg.ConfigFile == "" {
+		cfg.ConfigFile = os.Getenv("AWS_CONFIG_FILE")
+	}
+	if cfg.ConfigFile == "" {
+		cfg.ConfigFile = filepath.Join(home, ".aws", "config")
+	}
+	return &profileProvider{cfg: cfg}
+}
+
+// profileProvider resolves its profile into the provider it delegates to.
+type profileProvider struct {
+	cfg ProfileConfig
+
+	mu       sync.Mutex
+	provider credentials.Provider
+}
+
+func (p *profileProvider) Retrieve() (credentials.Value, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.provider == nil {
+		provider, err := p.resolve(p.cfg.Profile, 0)
+		if err != nil {
+			return credentials.Value{ProviderName: ProfileProviderName}, err
+		}
+		p.provider = provider
+	}
+	return p.provider.Retrieve()
+}
+
+func (p *profileProvider) IsExpired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.provider == nil || p.provider.IsExpired()
+}
+
+// resolve returns the provider of profile, which is depth source profiles away
+// from the profile of p.
+func (p *profileProvider) resolve(profile string, depth int) (credentials.Provider, error) {
+	if depth > maxSourceProfileDepth {
+		return nil, credentialsErrorf(p.cfg.Profile, "profile %s: too many chained source profiles", p.cfg.Profile)
+	}
+	values, err := p.load(profile)
+	if err != nil {
+		return nil, err
+	}
+	roleARN := values["role_arn"]
+	if roleARN == "" {
+		if command := values["credential_process"]; command != "" {
+			provider, err := NewProcessProvider(ProcessConfig{Command: command, Refresh: p.cfg.Refresh})
+			if err != nil {
+				return nil, err
+			}
+			return provider, nil
+		}
+		if values["aws_access_key_id"] == "" || values["aws_secret_access_key"] == "" {
+			return nil, credentialsErrorf(profile, "profile %s has no credentials", profile)
+		}
+		return WithParameters(values["aws_access_key_id"], values["aws_secret_access_key"], values["aws_session_token"], ProfileProviderName), nil
+	}
+	if tokenFile := values["web_identity_token_file"]; tokenFile != "" {
+		provider, err := NewWebIdentityProvider(WebIdentityConfig{
+			RoleARN:         roleARN,
+			TokenFile:       tokenFile,
+			RoleSessionName: values["role_session_name"],
+			Region:          values["region"],
+			Endpoint:        p.cfg.STSEndpoint,
+			Refresh:         p.cfg.Refresh,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+	}
+	var source credentials.Provider
+	switch {
+	case values["source_profile"] != "":
+		if source, err = p.resolve(values["source_profile"], depth+1); err != nil {
+			return nil, err
+		}
+	case values["credential_source"] == "Environment":
+		source = &credentials.EnvProvider{}
+	default:
+		return nil, credentialsErrorf(profile, "profile %s assumes role %s without source_profile or credential_source", profile, roleARN)
+	}
+	var duration time.Duration
+	if seconds := values["duration_seconds"]; seconds != "" {
+		n, err := strconv.Atoi(seconds)
+		if err != nil {
+			return nil, credentialsErrorf(profile, "profile %s: invalid duration_seconds %q", profile, seconds)
+		}
+		duration = time.Duration(n) * time.Second
+	}
+	provider, err := NewAssumeRoleProvider(AssumeRoleConfig{
+		RoleARN:          roleARN,
+		RoleSessionName:  values["role_session_name"],
+		ExternalID:       values["external_id"],
+		Duration:         duration,
+		MFASerial:        values["mfa_serial"],
+		MFATokenProvider: p.cfg.MFATokenProvider,
+		Source:           source,
+		Region:           values["region"],
+		Endpoint:         p.cfg.STSEndpoint,
+		Refresh:          p.cfg.Refresh,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// load returns the keys of profile in the config file overridden by the ones in
+// the credentials file.
+func (p *profileProvider) load(profile string) (map[string]string, error) {
+	values := map[string]string{}
+	found := false
+	configSection := "profile " + profile
+	if profile == defaultProfile {
+		configSection = defaultProfile
+	}
+	for _, file := range []struct{ path, section string }{
+		{p.cfg.ConfigFile, configSection},
+		{p.cfg.CredentialsFile, profile},
+	} {
+		f, err := ini.Load(file.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, credentialsErrorf(profile, "%w", err)
+		}
+		section, err := f.GetSection(file.section)
+		if err != nil {
+			continue
+		}
+		found = true
+		for _, key := range section.Keys() {
+			values[key.Name()] = key.String()
+		}
+	}
+	if !found {
+		return nil, credentialsErrorf(profile, "profile %s not found in %s or %s", profile, p.cfg.ConfigFile, p.cfg.CredentialsFile)
+	}
+	return values, nil
+}
+
+// NewChainProvider creates a credentials.Provider taking the credentials of the
+// first of providers which has them.
+func NewChainProvider(providers ...credentials.Provider) credentials.Provider {
+	return &credentials.ChainProvider{
+		Providers:     append([]credentials.Provider{}, providers...),
+		VerboseErrors: true,
+	}
+}
+
+// NewDefaultChainProvider creates the standard AWS chain: the environment
+// variables, the web identity of AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE
+// if set and the profile of AWS_PROFILE in the shared files.
+func NewDefaultChainProvider() credentials.Provider {
+	providers := []credentials.Provider{&credentials.EnvProvider{}}
+	if webIdentity, err := NewWebIdentityProvider(WebIdentityConfig{}); err == nil {
+		providers = append(providers, webIdentity)
+	}
+	providers = append(providers, NewProfileProvider(ProfileConfig{}))
+	return NewChainProvider(providers...)
+}
@@ -0,0 +1,316 @@
+package kinesis
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSTS is a local STS stand-in answering AssumeRole and
+// AssumeRoleWithWebIdentity with credentials named after the role.
+type fakeSTS struct {
+	*httptest.Server
+	expiration time.Time
+
+	mu       sync.Mutex
+	requests []url.Values
+	// signers has the access key signing each request, empty if unsigned.
+	signers []string
+}
+
+func newFakeSTS(t *testing.T) *fakeSTS {
+	f := &fakeSTS{expiration: time.Now().Add(time.Hour)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("fake STS: %v", err)
+		}
+		signer := ""
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			signer = strings.SplitN(strings.SplitN(auth, "Credential=", 2)[1], "/", 2)[0]
+		}
+		f.mu.Lock()
+		f.requests = append(f.requests, r.PostForm)
+		f.signers = append(f.signers, signer)
+		f.mu.Unlock()
+		action := r.PostForm.Get("Action")
+		arn := r.PostForm.Get("RoleArn")
+		role := arn[strings.LastIndex(arn, "/")+1:]
+		if action == "AssumeRoleWithWebIdentity" && r.PostForm.Get("WebIdentityToken") != "token" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>InvalidIdentityToken</Code><Message>bad token</Message></Error></ErrorResponse>`)
+			return
+		}
+		fmt.Fprintf(w, `<%[1]sResponse><%[1]sResult><Credentials>
+			<AccessKeyId>AKID-%[2]s</AccessKeyId>
+			<SecretAccessKey>secret-%[2]s</SecretAccessKey>
+			<SessionToken>token-%[2]s</SessionToken>
+			<Expiration>%[3]s</Expiration>
+			</Credentials></%[1]sResult></%[1]sResponse>`, action, role, f.expiration.UTC().Format(time.RFC3339))
+	}))
+	return f
+}
+
+func (f *fakeSTS) last() (url.Values, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		return nil, ""
+	}
+	return f.requests[len(f.requests)-1], f.signers[len(f.signers)-1]
+}
+
+func roleARN(name string) string {
+	return "arn:aws:iam::123456789012:role/" + name
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewAssumeRoleProvider(t *testing.T) {
+	sts := newFakeSTS(t)
+	defer sts.Close()
+	mfaSerial := "arn:aws:iam::123456789012:mfa/user"
+	tests := []struct {
+		name       string
+		cfg        AssumeRoleConfig
+		wantErr    bool
+		wantParams map[string]string
+	}{
+		{"noRole", AssumeRoleConfig{}, true, nil},
+		{"mfaWithoutToken", AssumeRoleConfig{RoleARN: roleARN("admin"), MFASerial: mfaSerial}, true, nil},
+		{"externalID", AssumeRoleConfig{RoleARN: roleARN("cross"), ExternalID: "ext", RoleSessionName: "session"}, false, map[string]string{
+			"RoleArn":         roleARN("cross"),
+			"ExternalId":      "ext",
+			"RoleSessionName": "session",
+			"DurationSeconds": "900",
+		}},
+		{"mfa", AssumeRoleConfig{RoleARN: roleARN("admin"), MFASerial: mfaSerial, Duration: time.Hour, MFATokenProvider: func() (string, error) {
+			return "123456", nil
+		}}, false, map[string]string{
+			"RoleArn":         roleARN("admin"),
+			"SerialNumber":    mfaSerial,
+			"TokenCode":       "123456",
+			"DurationSeconds": "3600",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Source = WithParameters("source", "secret", "", "")
+			tt.cfg.Endpoint = sts.URL
+			p, err := NewAssumeRoleProvider(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewAssumeRoleProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !p.IsExpired() {
+				t.Errorf("IsExpired() before Retrieve = false, want true")
+			}
+			value, err := p.Retrieve()
+			if err != nil {
+				t.Fatalf("Retrieve() error = %v", err)
+			}
+			role := tt.cfg.RoleARN[strings.LastIndex(tt.cfg.RoleARN, "/")+1:]
+			if value.AccessKeyID != "AKID-"+role || value.SessionToken != "token-"+role {
+				t.Errorf("Retrieve() = %+v, want the credentials of %s", value, tt.cfg.RoleARN)
+			}
+			if p.IsExpired() {
+				t.Errorf("IsExpired() after Retrieve = true, want false")
+			}
+			params, signer := sts.last()
+			if signer != "source" {
+				t.Errorf("request signed by %q, want the source credentials", signer)
+			}
+			for k, want := range tt.wantParams {
+				if got := params.Get(k); got != want {
+					t.Errorf("request %s = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewWebIdentityProvider(t *testing.T) {
+	sts := newFakeSTS(t)
+	defer sts.Close()
+	dir, err := ioutil.TempDir("", "web-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := writeFile(t, dir, "token", "token\n")
+	clock := &fakeClock{now: time.Now()}
+	var refreshErrs []error
+	p, err := NewWebIdentityProvider(WebIdentityConfig{
+		RoleARN:   roleARN("pod"),
+		TokenFile: tokenFile,
+		Endpoint:  sts.URL,
+		Refresh: RefreshConfig{Clock: clock, OnError: func(err error) {
+			refreshErrs = append(refreshErrs, err)
+		}},
+	})
+	if err != nil {
+		t.Fatalf("NewWebIdentityProvider() error = %v", err)
+	}
+	value, err := p.Retrieve()
+	if err != nil {
+		t.Fatalf("Retrieve() error = %v", err)
+	}
+	if value.AccessKeyID != "AKID-pod" || value.ProviderName != WebIdentityProviderName {
+		t.Errorf("Retrieve() = %+v, want the credentials of pod", value)
+	}
+	if _, signer := sts.last(); signer != "" {
+		t.Errorf("request signed by %q, want it unsigned", signer)
+	}
+	// the token is read again on every refresh
+	writeFile(t, dir, "token", "rotated")
+	clock.Add(58 * time.Minute)
+	if value, err := p.Retrieve(); err != nil || value.AccessKeyID != "AKID-pod" {
+		t.Errorf("Retrieve() = %v, %v, want the current credentials until they expire", value, err)
+	}
+	if len(refreshErrs) != 1 {
+		t.Errorf("refresh errors = %v, want the rotated token rejected", refreshErrs)
+	}
+	if _, err := NewWebIdentityProvider(WebIdentityConfig{RoleARN: roleARN("pod")}); err == nil {
+		t.Errorf("NewWebIdentityProvider() error = nil, want the token file required")
+	}
+}
+
+func TestNewProfileProvider(t *testing.T) {
+	sts := newFakeSTS(t)
+	defer sts.Close()
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := writeFile(t, dir, "token", "token")
+	credentialsFile := writeFile(t, dir, "credentials", `
+[default]
+aws_access_key_id = default-key
+aws_secret_access_key = default-secret
+
+[base]
+aws_access_key_id = base-key
+aws_secret_access_key = base-secret
+aws_session_token = base-token
+`)
+	configFile := writeFile(t, dir, "config", `
+[default]
+region = eu-west-1
+
+[profile cross]
+role_arn = arn:aws:iam::123456789012:role/cross-role
+source_profile = base
+external_id = ext
+
+[profile chained]
+role_arn = arn:aws:iam::123456789012:role/chained-role
+source_profile = cross
+
+[profile eks]
+role_arn = arn:aws:iam::123456789012:role/eks-role
+web_identity_token_file = `+tokenFile+`
+
+[profile loop]
+role_arn = arn:aws:iam::123456789012:role/loop-role
+source_profile = loop
+
+[profile orphan]
+role_arn = arn:aws:iam::123456789012:role/orphan-role
+
+[profile process]
+credential_process = echo '{"Version": 1, "AccessKeyId": "process-key", "SecretAccessKey": "process-secret"}'
+
+[profile empty]
+region = eu-west-1
+`)
+	tests := []struct {
+		name       string
+		profile    string
+		want       string
+		wantSigner string
+		wantErr    bool
+	}{
+		{"default", "", "default-key", "", false},
+		{"static", "base", "base-key", "", false},
+		{"assumeRole", "cross", "AKID-cross-role", "base-key", false},
+		{"chainedRoles", "chained", "AKID-chained-role", "AKID-cross-role", false},
+		{"webIdentity", "eks", "AKID-eks-role", "", false},
+		{"process", "process", "process-key", "", false},
+		{"sourceLoop", "loop", "", "", true},
+		{"noSource", "orphan", "", "", true},
+		{"noCredentials", "empty", "", "", true},
+		{"missing", "missing", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProfileProvider(ProfileConfig{
+				Profile:         tt.profile,
+				CredentialsFile: credentialsFile,
+				ConfigFile:      configFile,
+				STSEndpoint:     sts.URL,
+			})
+			value, err := p.Retrieve()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Retrieve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if value.AccessKeyID != tt.want {
+				t.Errorf("Retrieve() AccessKeyID = %v, want %v", value.AccessKeyID, tt.want)
+			}
+			if tt.wantSigner != "" {
+				if _, signer := sts.last(); signer != tt.wantSigner {
+					t.Errorf("request signed by %q, want %q", signer, tt.wantSigner)
+				}
+			}
+		})
+	}
+}
+
+func TestNewChainProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := NewProfileProvider(ProfileConfig{
+		CredentialsFile: filepath.Join(dir, "credentials"),
+		ConfigFile:      filepath.Join(dir, "config"),
+	})
+	tests := []struct {
+		name      string
+		providers []credentials.Provider
+		want      string
+		wantErr   bool
+	}{
+		{"first", []credentials.Provider{WithParameters("first", "s", "", ""), WithParameters("second", "s", "", "")}, "first", false},
+		{"skipsFailures", []credentials.Provider{missing, WithParameters("second", "s", "", "")}, "second", false},
+		{"none", []credentials.Provider{missing}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := NewChainProvider(tt.providers...).Retrieve()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Retrieve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if value.AccessKeyID != tt.want {
+				t.Errorf("Retrieve() AccessKeyID = %v, want %v", value.AccessKeyID, tt.want)
+			}
+		})
+	}
+}
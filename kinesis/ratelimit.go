@@ -0,0 +1,86 @@
+package kinesis
+
+import (
+	"context"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"sync"
+)
+
+// RateLimit sets how many records and bytes per second are let through. It is
+// the receivers.RateLimit of the receivers.Throttle middleware.
+type RateLimit = receivers.RateLimit
+
+// WithReadRateLimit limits the records read from the stream. The scan pauses
+// while the limit is reached.
+func WithReadRateLimit(l RateLimit) StreamerOption {
+	return func(s *Streamer) {
+		s.rateLimits.read.Set(l)
+	}
+}
+
+// SetReadRateLimit changes the limit of the records read from the stream, also
+// while streaming.
+func (s *Streamer) SetReadRateLimit(l RateLimit) {
+	s.rateLimits.read.Set(l)
+}
+
+// ReadRateLimit returns the limit of the records read from the stream.
+func (s *Streamer) ReadRateLimit() RateLimit {
+	return s.rateLimits.read.Limit()
+}
+
+// SetReceiverRateLimit changes the limit of the records delivered to the
+// receiver whose String method returns receiver, also while streaming. It
+// overrides the RateLimit of its ReceiverConfig.
+func (s *Streamer) SetReceiverRateLimit(receiver string, l RateLimit) {
+	s.rateLimits.receiver(receiver, l).Set(l)
+}
+
+// ReceiverRateLimit returns the limit of the records delivered to receiver.
+func (s *Streamer) ReceiverRateLimit(receiver string) RateLimit {
+	s.rateLimits.mu.Lock()
+	defer s.rateLimits.mu.Unlock()
+	if l, ok := s.rateLimits.receivers[receiver]; ok {
+		return l.Limit()
+	}
+	return s.receiverConfigs[receiver].RateLimit
+}
+
+// waitReadRateLimit waits for the read rate limit to allow r.
+func (s Streamer) waitReadRateLimit(ctx context.Context, r *consumer.Record) error {
+	waited, err := s.rateLimits.read.Wait(ctx, 1, len(r.Data))
+	if waited > 0 {
+		s.metrics.Add(metrics.RateLimitSeconds, waited.Seconds(), metrics.Labels{"stream": s.name, "receiver": ""})
+	}
+	return err
+}
+
+// rateLimits holds the limiters of a Streamer, which are shared by its copies
+// so they can be changed while streaming.
+type rateLimits struct {
+	read *receivers.RateLimiter
+
+	mu        sync.Mutex
+	receivers map[string]*receivers.RateLimiter
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{
+		read:      receivers.NewRateLimiter(RateLimit{}),
+		receivers: map[string]*receivers.RateLimiter{},
+	}
+}
+
+// receiver returns the limiter of receiver, creating it with l if it has none.
+func (r *rateLimits) receiver(receiver string, l RateLimit) *receivers.RateLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	limiter, ok := r.receivers[receiver]
+	if !ok {
+		limiter = receivers.NewRateLimiter(l)
+		r.receivers[receiver] = limiter
+	}
+	return limiter
+}
@@ -0,0 +1,98 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"testing"
+	"time"
+)
+
+func TestStreamer_StreamRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []StreamerOption
+		labels  metrics.Labels
+		wantMin time.Duration
+	}{
+		{
+			name:    "receiverMessages",
+			opts:    []StreamerOption{WithReceiverConfig("limited", ReceiverConfig{RateLimit: RateLimit{MessagesPerSecond: 50, MessageBurst: 1}})},
+			labels:  metrics.Labels{"stream": "stream", "receiver": "limited"},
+			wantMin: 80 * time.Millisecond,
+		},
+		{
+			name:    "receiverBytes",
+			opts:    []StreamerOption{WithReceiverConfig("limited", ReceiverConfig{RateLimit: RateLimit{BytesPerSecond: 100, ByteBurst: 2}})},
+			labels:  metrics.Labels{"stream": "stream", "receiver": "limited"},
+			wantMin: 80 * time.Millisecond,
+		},
+		{
+			name:    "read",
+			opts:    []StreamerOption{WithReadRateLimit(RateLimit{MessagesPerSecond: 50, MessageBurst: 1})},
+			labels:  metrics.Labels{"stream": "stream", "receiver": ""},
+			wantMin: 80 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := newFakeRecorder()
+			s := newTestStreamer(t, &fakeKinesis{}, append(tt.opts, WithMetrics(recorder))...)
+			s.c = sliceScanner{"s1": {"aa", "bb", "cc", "dd", "ee", "ff"}}
+			rec := newFakeReceiver("limited", 6, nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go func() {
+				<-rec.done
+				cancel()
+			}()
+			start := time.Now()
+			if err := s.Stream(ctx, rec); err != nil {
+				t.Fatalf("Stream() error = %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantMin {
+				t.Errorf("Stream() took %v, want at least %v", elapsed, tt.wantMin)
+			}
+			if got := fmt.Sprint(rec.received()); got != "[aa bb cc dd ee ff]" {
+				t.Errorf("received = %v, want every record", got)
+			}
+			if got := recorder.value(metrics.RateLimitSeconds, tt.labels); got <= 0 {
+				t.Errorf("%v%v = %v, want more than 0", metrics.RateLimitSeconds, tt.labels, got)
+			}
+		})
+	}
+}
+
+func TestStreamer_SetReceiverRateLimit(t *testing.T) {
+	s := newTestStreamer(t, &fakeKinesis{}, WithReceiverConfig("limited", ReceiverConfig{
+		Workers:   1,
+		RateLimit: RateLimit{MessagesPerSecond: 0.1, MessageBurst: 1},
+	}))
+	s.c = sliceScanner{"s1": {"a", "b", "c"}}
+	rec := newFakeReceiver("limited", 3, nil)
+	if got, want := s.ReceiverRateLimit("limited"), (RateLimit{MessagesPerSecond: 0.1, MessageBurst: 1}); got != want {
+		t.Errorf("ReceiverRateLimit() = %v, want %v", got, want)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-rec.done
+		cancel()
+	}()
+	go func() {
+		// lift the limit once the first record went through
+		for len(rec.received()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		s.SetReceiverRateLimit("limited", RateLimit{MessagesPerSecond: 1000})
+	}()
+	if err := s.Stream(ctx, rec); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	if got := fmt.Sprint(rec.received()); got != "[a b c]" {
+		t.Errorf("received = %v, want [a b c]", got)
+	}
+	if got, want := s.ReceiverRateLimit("limited"), (RateLimit{MessagesPerSecond: 1000, MessageBurst: 1000}); got != want {
+		t.Errorf("ReceiverRateLimit() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,200 @@
+package kinesis
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/nicolasassi/kinestesia/logging"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRefreshWindow     = 5 * time.Minute
+	defaultRefreshBackoff    = time.Second
+	defaultRefreshMaxBackoff = time.Minute
+	refreshJitter            = 0.2
+
+	// RefreshingProviderName is the default ProviderName of the credentials of a
+	// RefreshingProvider.
+	RefreshingProviderName = "RefreshingProvider"
+)
+
+// RefreshFunc reads the credentials from their source, as a file or STS, with
+// the time they expire. A zero expiration never expires.
+type RefreshFunc func() (credentials.Value, time.Time, error)
+
+// RefreshConfig sets when a RefreshingProvider reads its source again.
+type RefreshConfig struct {
+	// Window is how long before they expire the credentials are refreshed. The
+	// default is 5 minutes.
+	Window time.Duration
+	// Interval is how often the credentials without expiration are refreshed, as
+	// the ones of a file rotated in place. Zero never refreshes them.
+	Interval time.Duration
+	// Backoff is how long the source is not read after a failed refresh,
+	// doubled on every consecutive failure and randomized by 20%. The default is
+	// 1 second.
+	Backoff time.Duration
+	// MaxBackoff bounds Backoff. The default is 1 minute.
+	MaxBackoff time.Duration
+	// OnError is called with every failed refresh. The default logs it with logging.Default.
+	OnError func(err error)
+	// Clock tells the current time. The default is the system clock.
+	Clock Clock
+}
+
+// RefreshingProvider is a credentials.Provider reading its source again ahead of
+// the expiration of the credentials. A failed refresh keeps the current
+// credentials until they expire, and the source is read again on the first use
+// after the backoff, returning the error of the failure meanwhile once the
+// credentials expired. It is safe for concurrent use, as by the clients of NewClient and
+// the consumers sharing it.
+type RefreshingProvider struct {
+	source RefreshFunc
+	cfg    RefreshConfig
+
+	mu         sync.Mutex
+	value      credentials.Value
+	retrieved  bool
+	refreshed  time.Time
+	expiration time.Time
+	// failures counts the consecutive failed refreshes, the last one err, and
+	// the source is not read before retryAt.
+	failures int
+	err      error
+	retryAt  time.Time
+}
+
+func NewRefreshingProvider(source RefreshFunc, cfg RefreshConfig) *RefreshingProvider {
+	if cfg.Window <= 0 {
+		cfg.Window = defaultRefreshWindow
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = defaultRefreshBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultRefreshMaxBackoff
+	}
+	if cfg.OnError == nil {
+		cfg.OnError = func(err error) {
+			logging.Default.Log(logging.LevelWarn, logging.CredentialsRefreshFailed, logging.Fields{"error": err})
+		}
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = systemClock{}
+	}
+	return &RefreshingProvider{source: source, cfg: cfg}
+}
+
+// Retrieve returns the current credentials, reading the source if they are
+// due to be refreshed and it is not backing off a failure.
+func (p *RefreshingProvider) Retrieve() (credentials.Value, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.cfg.Clock.Now()
+	if p.retrieved && !p.due(now) {
+		return p.value, nil
+	}
+	if p.err != nil && now.Before(p.retryAt) {
+		return p.failed(now)
+	}
+	value, expiration, err := p.source()
+	if err == nil && !expiration.IsZero() && !now.Before(expiration) {
+		err = fmt.Errorf("credentials expired at %v", expiration)
+	}
+	if err != nil {
+		p.cfg.OnError(err)
+		var credsErr *CredentialsError
+		if !errors.As(err, &credsErr) {
+			err = &CredentialsError{Source: RefreshingProviderName, Err: err}
+		}
+		p.failures++
+		p.err = err
+		p.retryAt = now.Add(p.backoff())
+		return p.failed(now)
+	}
+	if value.ProviderName == "" {
+		value.ProviderName = RefreshingProviderName
+	}
+	p.value, p.retrieved, p.refreshed, p.expiration = value, true, now, expiration
+	p.failures, p.err, p.retryAt = 0, nil, time.Time{}
+	return value, nil
+}
+
+// failed returns the current credentials until they expire and then the error
+// of the last refresh. It must be called with p.mu held.
+func (p *RefreshingProvider) failed(now time.Time) (credentials.Value, error) {
+	if p.retrieved && !p.expired(now) {
+		return p.value, nil
+	}
+	return credentials.Value{ProviderName: RefreshingProviderName}, p.err
+}
+
+// backoff is the wait after the consecutive failures, randomized by the jitter.
+// It must be called with p.mu held.
+func (p *RefreshingProvider) backoff() time.Duration {
+	d := p.cfg.Backoff
+	for i := 1; i < p.failures && d < p.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.cfg.MaxBackoff {
+		d = p.cfg.MaxBackoff
+	}
+	spread := float64(d) * refreshJitter
+	return time.Duration(float64(d) - spread + 2*spread*rand.Float64())
+}
+
+// IsExpired tells whether the credentials are due to be refreshed.
+func (p *RefreshingProvider) IsExpired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.retrieved || p.due(p.cfg.Clock.Now())
+}
+
+// Expiration returns when the current credentials expire, zero if they don't.
+func (p *RefreshingProvider) Expiration() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.expiration
+}
+
+// due must be called with p.mu held.
+func (p *RefreshingProvider) due(now time.Time) bool {
+	if p.expiration.IsZero() {
+		return p.cfg.Interval > 0 && !now.Before(p.refreshed.Add(p.cfg.Interval))
+	}
+	return !now.Before(p.expiration.Add(-p.cfg.Window))
+}
+
+// expired must be called with p.mu held.
+func (p *RefreshingProvider) expired(now time.Time) bool {
+	return !p.expiration.IsZero() && !now.Before(p.expiration)
+}
+
+// EnvSource is a RefreshFunc reading the variables of WithEnvironmentVariables
+// and the expiration from AWS_CREDENTIAL_EXPIRATION in RFC 3339, if set. It
+// fails if the keys are not set.
+func EnvSource() (credentials.Value, time.Time, error) {
+	c := WithEnvironmentVariables()
+	if c.Value.AccessKeyID == "" || c.Value.SecretAccessKey == "" {
+		return credentials.Value{}, time.Time{}, fmt.Errorf("AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY not set")
+	}
+	var expiration time.Time
+	if s := os.Getenv("AWS_CREDENTIAL_EXPIRATION"); s != "" {
+		var err error
+		if expiration, err = time.Parse(time.RFC3339, s); err != nil {
+			return credentials.Value{}, time.Time{}, fmt.Errorf("invalid AWS_CREDENTIAL_EXPIRATION: %w", err)
+		}
+	}
+	return c.Value, expiration, nil
+}
+
+// JSONFileSource returns a RefreshFunc reading the file of WithJSONFile.
+func JSONFileSource(path string) RefreshFunc {
+	return CredentialsSource(func() (*Credentials, error) {
+		return WithJSONFile(path)
+	})
+}
@@ -0,0 +1,185 @@
+package kinesis
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSource returns credentials numbered by call expiring after ttl, or err.
+type fakeSource struct {
+	clock *fakeClock
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	calls int
+	err   error
+}
+
+func (f *fakeSource) retrieve() (credentials.Value, time.Time, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return credentials.Value{}, time.Time{}, f.err
+	}
+	var expiration time.Time
+	if f.ttl > 0 {
+		expiration = f.clock.Now().Add(f.ttl)
+	}
+	return credentials.Value{AccessKeyID: "key-" + strconv.Itoa(f.calls), SecretAccessKey: "secret"}, expiration, nil
+}
+
+func (f *fakeSource) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func TestRefreshingProvider_Retrieve(t *testing.T) {
+	failed := errors.New("source down")
+	type step struct {
+		advance     time.Duration
+		err         error
+		wantKey     string
+		wantErr     bool
+		wantExpired bool
+	}
+	tests := []struct {
+		name       string
+		ttl        time.Duration
+		cfg        RefreshConfig
+		steps      []step
+		wantErrors int
+	}{
+		{"refreshAheadOfExpiration", time.Hour, RefreshConfig{Window: 10 * time.Minute}, []step{
+			{0, nil, "key-1", false, true},
+			{45 * time.Minute, nil, "key-1", false, false},
+			{5 * time.Minute, nil, "key-2", false, true},
+			{40 * time.Minute, nil, "key-2", false, false},
+		}, 0},
+		{"noExpiration", 0, RefreshConfig{}, []step{
+			{0, nil, "key-1", false, true},
+			{24 * time.Hour, nil, "key-1", false, false},
+		}, 0},
+		{"interval", 0, RefreshConfig{Interval: time.Minute}, []step{
+			{0, nil, "key-1", false, true},
+			{30 * time.Second, nil, "key-1", false, false},
+			{30 * time.Second, nil, "key-2", false, true},
+		}, 0},
+		{"failureKeepsCredentialsUntilExpired", time.Hour, RefreshConfig{}, []step{
+			{0, nil, "key-1", false, true},
+			{56 * time.Minute, failed, "key-1", false, true},
+			{2 * time.Minute, failed, "key-1", false, true},
+			{2 * time.Minute, failed, "", true, true},
+			{time.Minute, nil, "key-5", false, true},
+		}, 3},
+		{"firstFailure", time.Hour, RefreshConfig{}, []step{
+			{0, failed, "", true, true},
+			{time.Minute, nil, "key-2", false, true},
+		}, 1},
+		// the source is not read while backing off, from 8 to 12 seconds and then
+		// from 16 to 24 seconds
+		{"backoff", time.Hour, RefreshConfig{Backoff: 10 * time.Second}, []step{
+			{0, failed, "", true, true},
+			{5 * time.Second, nil, "", true, true},
+			{10 * time.Second, failed, "", true, true},
+			{10 * time.Second, nil, "", true, true},
+			{15 * time.Second, nil, "key-3", false, true},
+		}, 2},
+		{"backoffKeepsCredentials", time.Hour, RefreshConfig{Backoff: 10 * time.Second}, []step{
+			{0, nil, "key-1", false, true},
+			{56 * time.Minute, failed, "key-1", false, true},
+			{time.Second, nil, "key-1", false, true},
+			{20 * time.Second, nil, "key-3", false, true},
+		}, 1},
+		{"maxBackoff", time.Hour, RefreshConfig{Backoff: 10 * time.Second, MaxBackoff: 10 * time.Second}, []step{
+			{0, failed, "", true, true},
+			{15 * time.Second, failed, "", true, true},
+			{15 * time.Second, nil, "key-3", false, true},
+		}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Now()}
+			source := &fakeSource{clock: clock, ttl: tt.ttl}
+			var errs []error
+			tt.cfg.Clock = clock
+			tt.cfg.OnError = func(err error) {
+				errs = append(errs, err)
+			}
+			p := NewRefreshingProvider(source.retrieve, tt.cfg)
+			for i, s := range tt.steps {
+				clock.Add(s.advance)
+				source.setErr(s.err)
+				if got := p.IsExpired(); got != s.wantExpired {
+					t.Errorf("step %d: IsExpired() = %v, want %v", i, got, s.wantExpired)
+				}
+				value, err := p.Retrieve()
+				if (err != nil) != s.wantErr {
+					t.Fatalf("step %d: Retrieve() error = %v, wantErr %v", i, err, s.wantErr)
+				}
+				if value.AccessKeyID != s.wantKey {
+					t.Errorf("step %d: Retrieve() AccessKeyID = %v, want %v", i, value.AccessKeyID, s.wantKey)
+				}
+			}
+			if len(errs) != tt.wantErrors {
+				t.Errorf("OnError called %v times, want %v", len(errs), tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestRefreshingProvider_Concurrent(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	source := &fakeSource{clock: clock, ttl: time.Hour}
+	p := NewRefreshingProvider(source.retrieve, RefreshConfig{Clock: clock})
+	// a client and a consumer sharing the provider
+	clients := []*credentials.Credentials{credentials.NewCredentials(p), credentials.NewCredentials(p)}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%5 == 0 {
+				clock.Add(20 * time.Minute)
+			}
+			if _, err := clients[i%2].Get(); err != nil {
+				t.Errorf("Get() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// the 80 minutes elapsed need a single refresh at most twice
+	if source.calls > 3 {
+		t.Errorf("source called %v times, want each refresh shared", source.calls)
+	}
+}
+
+func TestEnvSource(t *testing.T) {
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	defer os.Unsetenv("AWS_CREDENTIAL_EXPIRATION")
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	if _, _, err := EnvSource(); err == nil {
+		t.Errorf("EnvSource() error = nil, want the missing keys reported")
+	}
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	os.Setenv("AWS_CREDENTIAL_EXPIRATION", "2030-01-02T03:04:05Z")
+	value, expiration, err := EnvSource()
+	if err != nil {
+		t.Fatalf("EnvSource() error = %v", err)
+	}
+	if value.AccessKeyID != "key" || !expiration.Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("EnvSource() = %v, %v", value, expiration)
+	}
+	os.Setenv("AWS_CREDENTIAL_EXPIRATION", "tomorrow")
+	if _, _, err := EnvSource(); err == nil {
+		t.Errorf("EnvSource() error = nil, want the invalid expiration reported")
+	}
+}
@@ -0,0 +1,37 @@
+package kinesis
+
+import (
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"math/rand"
+)
+
+// SampleConfig sets the fraction of the records delivered to a receiver.
+type SampleConfig struct {
+	// Rate is the fraction of the records delivered, from 0 to 1.
+	Rate float64
+	// Key samples the records by its hash, so the records with the same key are
+	// all delivered or skipped. It can be PartitionKey or the result of
+	// FieldOrderingKey. Nil samples the records randomly.
+	Key func(shardID string, r *consumer.Record) string
+}
+
+// sampled tells whether r is delivered to q, counting metrics.SampledMessages.
+func (d *dispatcher) sampled(q *receiverQueue, shardID string, r *consumer.Record) bool {
+	if q.sample == nil {
+		return true
+	}
+	var sampled bool
+	if q.sample.Key != nil {
+		sampled = receivers.InSample(q.sample.Key(shardID, r), q.sample.Rate)
+	} else {
+		sampled = rand.Float64() < q.sample.Rate
+	}
+	result := "skipped"
+	if sampled {
+		result = "sampled"
+	}
+	d.s.metrics.Add(metrics.SampledMessages, 1, metrics.Labels{"receiver": q.rec.String(), "result": result})
+	return sampled
+}
@@ -0,0 +1,229 @@
+// Package sdkv2 implements the enhanced fan-out of kinestesia over the Kinesis
+// client of aws-sdk-go-v2, which supports SubscribeToShard:
+//
+//	cfg, err := config.LoadDefaultConfig(ctx)
+//	api := sdkv2.NewFanOutAPI(awskinesis.NewFromConfig(cfg))
+//	streamer, err := kinesis.NewStreamer(ctx, "orders", kinesis.WithFanOut(kinesis.FanOutConfig{
+//		ConsumerName: "kinestesia",
+//		API:          api,
+//	}))
+package sdkv2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awskinesis "github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	awsv1 "github.com/aws/aws-sdk-go/aws"
+	kinesisv1 "github.com/aws/aws-sdk-go/service/kinesis"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/kinesis"
+	"sync"
+)
+
+// API is the subset of *kinesis.Client of aws-sdk-go-v2 used for enhanced
+// fan-out.
+type API interface {
+	ListShards(ctx context.Context, params *awskinesis.ListShardsInput, optFns ...func(*awskinesis.Options)) (*awskinesis.ListShardsOutput, error)
+	DescribeStreamSummary(ctx context.Context, params *awskinesis.DescribeStreamSummaryInput, optFns ...func(*awskinesis.Options)) (*awskinesis.DescribeStreamSummaryOutput, error)
+	RegisterStreamConsumer(ctx context.Context, params *awskinesis.RegisterStreamConsumerInput, optFns ...func(*awskinesis.Options)) (*awskinesis.RegisterStreamConsumerOutput, error)
+	DescribeStreamConsumer(ctx context.Context, params *awskinesis.DescribeStreamConsumerInput, optFns ...func(*awskinesis.Options)) (*awskinesis.DescribeStreamConsumerOutput, error)
+	SubscribeToShard(ctx context.Context, params *awskinesis.SubscribeToShardInput, optFns ...func(*awskinesis.Options)) (*awskinesis.SubscribeToShardOutput, error)
+}
+
+// NewFanOutAPI returns the kinesis.FanOutAPI of api.
+func NewFanOutAPI(api API) kinesis.FanOutAPI {
+	return &fanOutAPI{
+		api: api,
+		subscribe: func(ctx context.Context, input *awskinesis.SubscribeToShardInput) (awskinesis.SubscribeToShardEventStreamReader, error) {
+			out, err := api.SubscribeToShard(ctx, input)
+			if err != nil {
+				return nil, err
+			}
+			return out.GetStream(), nil
+		},
+	}
+}
+
+type fanOutAPI struct {
+	api API
+	// subscribe opens the event stream of a shard. The event stream of a
+	// SubscribeToShardOutput can only be set by the SDK so tests replace it.
+	subscribe func(ctx context.Context, input *awskinesis.SubscribeToShardInput) (awskinesis.SubscribeToShardEventStreamReader, error)
+}
+
+func (f *fanOutAPI) ListShards(ctx context.Context, streamName string) ([]*kinesisv1.Shard, error) {
+	var shards []*kinesisv1.Shard
+	input := &awskinesis.ListShardsInput{StreamName: aws.String(streamName)}
+	for {
+		out, err := f.api.ListShards(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range out.Shards {
+			shards = append(shards, shard(s))
+		}
+		if out.NextToken == nil {
+			return shards, nil
+		}
+		// the stream name must not be given with a token
+		input = &awskinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+}
+
+func shard(s types.Shard) *kinesisv1.Shard {
+	converted := &kinesisv1.Shard{
+		ShardId:               s.ShardId,
+		ParentShardId:         s.ParentShardId,
+		AdjacentParentShardId: s.AdjacentParentShardId,
+	}
+	if s.SequenceNumberRange != nil {
+		converted.SequenceNumberRange = &kinesisv1.SequenceNumberRange{
+			StartingSequenceNumber: s.SequenceNumberRange.StartingSequenceNumber,
+			EndingSequenceNumber:   s.SequenceNumberRange.EndingSequenceNumber,
+		}
+	}
+	if s.HashKeyRange != nil {
+		converted.HashKeyRange = &kinesisv1.HashKeyRange{
+			StartingHashKey: s.HashKeyRange.StartingHashKey,
+			EndingHashKey:   s.HashKeyRange.EndingHashKey,
+		}
+	}
+	return converted
+}
+
+// RegisterStreamConsumer registers consumerName on the stream or describes it if
+// it is already registered.
+func (f *fanOutAPI) RegisterStreamConsumer(ctx context.Context, streamName, consumerName string) (*kinesis.StreamConsumer, error) {
+	summary, err := f.api.DescribeStreamSummary(ctx, &awskinesis.DescribeStreamSummaryInput{StreamName: aws.String(streamName)})
+	if err != nil {
+		return nil, err
+	}
+	if summary.StreamDescriptionSummary == nil {
+		return nil, fmt.Errorf("stream %s has no description", streamName)
+	}
+	streamARN := summary.StreamDescriptionSummary.StreamARN
+	out, err := f.api.RegisterStreamConsumer(ctx, &awskinesis.RegisterStreamConsumerInput{
+		StreamARN:    streamARN,
+		ConsumerName: aws.String(consumerName),
+	})
+	var inUse *types.ResourceInUseException
+	if errors.As(err, &inUse) {
+		described, err := f.api.DescribeStreamConsumer(ctx, &awskinesis.DescribeStreamConsumerInput{
+			StreamARN:    streamARN,
+			ConsumerName: aws.String(consumerName),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return streamConsumer(described.ConsumerDescription.ConsumerARN, described.ConsumerDescription.ConsumerName, described.ConsumerDescription.ConsumerStatus), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return streamConsumer(out.Consumer.ConsumerARN, out.Consumer.ConsumerName, out.Consumer.ConsumerStatus), nil
+}
+
+func (f *fanOutAPI) DescribeStreamConsumer(ctx context.Context, consumerARN string) (*kinesis.StreamConsumer, error) {
+	out, err := f.api.DescribeStreamConsumer(ctx, &awskinesis.DescribeStreamConsumerInput{ConsumerARN: aws.String(consumerARN)})
+	if err != nil {
+		return nil, err
+	}
+	return streamConsumer(out.ConsumerDescription.ConsumerARN, out.ConsumerDescription.ConsumerName, out.ConsumerDescription.ConsumerStatus), nil
+}
+
+func streamConsumer(arn, name *string, status types.ConsumerStatus) *kinesis.StreamConsumer {
+	return &kinesis.StreamConsumer{
+		ARN:    aws.ToString(arn),
+		Name:   aws.ToString(name),
+		Status: string(status),
+	}
+}
+
+func (f *fanOutAPI) SubscribeToShard(ctx context.Context, input *kinesis.SubscribeToShardInput) (kinesis.ShardSubscription, error) {
+	position := &types.StartingPosition{Type: types.ShardIteratorType(input.StartingPosition.Type)}
+	if input.StartingPosition.SequenceNumber != "" {
+		position.SequenceNumber = aws.String(input.StartingPosition.SequenceNumber)
+	}
+	position.Timestamp = input.StartingPosition.Timestamp
+	reader, err := f.subscribe(ctx, &awskinesis.SubscribeToShardInput{
+		ConsumerARN:      aws.String(input.ConsumerARN),
+		ShardId:          aws.String(input.ShardID),
+		StartingPosition: position,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sub := &subscription{
+		reader: reader,
+		events: make(chan *kinesis.SubscribeToShardEvent),
+		done:   make(chan struct{}),
+	}
+	go sub.run()
+	return sub, nil
+}
+
+// subscription converts the events of an event stream of aws-sdk-go-v2.
+type subscription struct {
+	reader awskinesis.SubscribeToShardEventStreamReader
+	events chan *kinesis.SubscribeToShardEvent
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func (s *subscription) run() {
+	defer close(s.events)
+	for event := range s.reader.Events() {
+		e, ok := event.(*types.SubscribeToShardEventStreamMemberSubscribeToShardEvent)
+		if !ok {
+			continue
+		}
+		select {
+		case s.events <- shardEvent(e.Value):
+		case <-s.done:
+			return
+		}
+	}
+	// the error is only read once events is closed
+	s.err = s.reader.Err()
+}
+
+func shardEvent(e types.SubscribeToShardEvent) *kinesis.SubscribeToShardEvent {
+	converted := &kinesis.SubscribeToShardEvent{
+		ContinuationSequenceNumber: aws.ToString(e.ContinuationSequenceNumber),
+		MillisBehindLatest:         aws.ToInt64(e.MillisBehindLatest),
+	}
+	for _, r := range e.Records {
+		record := &consumer.Record{
+			Data:                        r.Data,
+			PartitionKey:                r.PartitionKey,
+			SequenceNumber:              r.SequenceNumber,
+			ApproximateArrivalTimestamp: r.ApproximateArrivalTimestamp,
+		}
+		if r.EncryptionType != "" {
+			record.EncryptionType = awsv1.String(string(r.EncryptionType))
+		}
+		converted.Records = append(converted.Records, record)
+	}
+	return converted
+}
+
+func (s *subscription) Events() <-chan *kinesis.SubscribeToShardEvent {
+	return s.events
+}
+
+func (s *subscription) Err() error {
+	return s.err
+}
+
+func (s *subscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.reader.Close()
+	})
+	return err
+}
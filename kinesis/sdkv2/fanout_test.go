@@ -0,0 +1,171 @@
+package sdkv2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awskinesis "github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/nicolasassi/kinestesia/kinesis"
+	"reflect"
+	"testing"
+)
+
+// fakeAPI serves two pages of shards and a consumer registered once.
+type fakeAPI struct {
+	API
+	registered bool
+	inputs     []*awskinesis.ListShardsInput
+}
+
+func (f *fakeAPI) ListShards(ctx context.Context, params *awskinesis.ListShardsInput, optFns ...func(*awskinesis.Options)) (*awskinesis.ListShardsOutput, error) {
+	f.inputs = append(f.inputs, params)
+	if params.NextToken == nil {
+		return &awskinesis.ListShardsOutput{
+			Shards:    []types.Shard{{ShardId: aws.String("s1")}},
+			NextToken: aws.String("page2"),
+		}, nil
+	}
+	return &awskinesis.ListShardsOutput{Shards: []types.Shard{{
+		ShardId:             aws.String("s2"),
+		ParentShardId:       aws.String("s1"),
+		SequenceNumberRange: &types.SequenceNumberRange{StartingSequenceNumber: aws.String("1")},
+	}}}, nil
+}
+
+func (f *fakeAPI) DescribeStreamSummary(ctx context.Context, params *awskinesis.DescribeStreamSummaryInput, optFns ...func(*awskinesis.Options)) (*awskinesis.DescribeStreamSummaryOutput, error) {
+	return &awskinesis.DescribeStreamSummaryOutput{StreamDescriptionSummary: &types.StreamDescriptionSummary{
+		StreamARN: aws.String("arn:stream:" + aws.ToString(params.StreamName)),
+	}}, nil
+}
+
+func (f *fakeAPI) RegisterStreamConsumer(ctx context.Context, params *awskinesis.RegisterStreamConsumerInput, optFns ...func(*awskinesis.Options)) (*awskinesis.RegisterStreamConsumerOutput, error) {
+	if f.registered {
+		return nil, &types.ResourceInUseException{Message: aws.String("already registered")}
+	}
+	f.registered = true
+	return &awskinesis.RegisterStreamConsumerOutput{Consumer: &types.Consumer{
+		ConsumerARN:    aws.String(aws.ToString(params.StreamARN) + ":" + aws.ToString(params.ConsumerName)),
+		ConsumerName:   params.ConsumerName,
+		ConsumerStatus: types.ConsumerStatusCreating,
+	}}, nil
+}
+
+func (f *fakeAPI) DescribeStreamConsumer(ctx context.Context, params *awskinesis.DescribeStreamConsumerInput, optFns ...func(*awskinesis.Options)) (*awskinesis.DescribeStreamConsumerOutput, error) {
+	arn := aws.ToString(params.ConsumerARN)
+	if arn == "" {
+		arn = aws.ToString(params.StreamARN) + ":" + aws.ToString(params.ConsumerName)
+	}
+	return &awskinesis.DescribeStreamConsumerOutput{ConsumerDescription: &types.ConsumerDescription{
+		ConsumerARN:    aws.String(arn),
+		ConsumerName:   params.ConsumerName,
+		ConsumerStatus: types.ConsumerStatusActive,
+	}}, nil
+}
+
+// fakeReader is an event stream which ends with err.
+type fakeReader struct {
+	events chan types.SubscribeToShardEventStream
+	err    error
+	closed bool
+}
+
+func (f *fakeReader) Events() <-chan types.SubscribeToShardEventStream {
+	return f.events
+}
+
+func (f *fakeReader) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *fakeReader) Err() error {
+	return f.err
+}
+
+func TestFanOutAPI_ListShards(t *testing.T) {
+	api := &fakeAPI{}
+	shards, err := NewFanOutAPI(api).ListShards(context.Background(), "stream")
+	if err != nil {
+		t.Fatalf("ListShards() error = %v", err)
+	}
+	if len(shards) != 2 || aws.ToString(shards[1].ParentShardId) != "s1" || aws.ToString(shards[1].SequenceNumberRange.StartingSequenceNumber) != "1" {
+		t.Errorf("ListShards() got = %v, want the shards of both pages", shards)
+	}
+	if len(api.inputs) != 2 || api.inputs[1].StreamName != nil {
+		t.Errorf("ListShards() inputs = %+v, want the next page without the stream name", api.inputs)
+	}
+}
+
+func TestFanOutAPI_RegisterStreamConsumer(t *testing.T) {
+	api := NewFanOutAPI(&fakeAPI{})
+	want := []kinesis.StreamConsumer{
+		{ARN: "arn:stream:orders:app", Name: "app", Status: "CREATING"},
+		{ARN: "arn:stream:orders:app", Name: "app", Status: kinesis.StreamConsumerStatusActive},
+	}
+	for i, want := range want {
+		got, err := api.RegisterStreamConsumer(context.Background(), "orders", "app")
+		if err != nil {
+			t.Fatalf("RegisterStreamConsumer() error = %v", err)
+		}
+		if *got != want {
+			t.Errorf("RegisterStreamConsumer() call %d got = %+v, want %+v", i, *got, want)
+		}
+	}
+}
+
+func TestFanOutAPI_SubscribeToShard(t *testing.T) {
+	errExpired := errors.New("subscription expired")
+	reader := &fakeReader{events: make(chan types.SubscribeToShardEventStream, 2), err: errExpired}
+	reader.events <- &types.SubscribeToShardEventStreamMemberSubscribeToShardEvent{Value: types.SubscribeToShardEvent{
+		Records: []types.Record{{
+			Data:           []byte("a"),
+			PartitionKey:   aws.String("k"),
+			SequenceNumber: aws.String("1"),
+			EncryptionType: types.EncryptionTypeKms,
+		}},
+		ContinuationSequenceNumber: aws.String("1"),
+		MillisBehindLatest:         aws.Int64(10),
+	}}
+	// a closed shard has no continuation sequence number
+	reader.events <- &types.SubscribeToShardEventStreamMemberSubscribeToShardEvent{Value: types.SubscribeToShardEvent{}}
+	close(reader.events)
+	var input *awskinesis.SubscribeToShardInput
+	api := &fanOutAPI{subscribe: func(ctx context.Context, in *awskinesis.SubscribeToShardInput) (awskinesis.SubscribeToShardEventStreamReader, error) {
+		input = in
+		return reader, nil
+	}}
+	sub, err := api.SubscribeToShard(context.Background(), &kinesis.SubscribeToShardInput{
+		ConsumerARN:      "arn",
+		ShardID:          "s1",
+		StartingPosition: kinesis.StartingPosition{Type: "AFTER_SEQUENCE_NUMBER", SequenceNumber: "0"},
+	})
+	if err != nil {
+		t.Fatalf("SubscribeToShard() error = %v", err)
+	}
+	defer sub.Close()
+	wantPosition := types.StartingPosition{Type: types.ShardIteratorTypeAfterSequenceNumber, SequenceNumber: aws.String("0")}
+	if aws.ToString(input.ShardId) != "s1" || !reflect.DeepEqual(*input.StartingPosition, wantPosition) {
+		t.Errorf("SubscribeToShard() input = %+v", input)
+	}
+	var got []string
+	for event := range sub.Events() {
+		var data []string
+		for _, r := range event.Records {
+			data = append(data, fmt.Sprintf("%s:%s:%s:%s", r.Data, aws.ToString(r.PartitionKey), aws.ToString(r.SequenceNumber), aws.ToString(r.EncryptionType)))
+		}
+		got = append(got, fmt.Sprintf("%v %q %d", data, event.ContinuationSequenceNumber, event.MillisBehindLatest))
+	}
+	want := []string{`[a:k:1:KMS] "1" 10`, `[] "" 0`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events got = %v, want %v", got, want)
+	}
+	if sub.Err() != errExpired {
+		t.Errorf("Err() = %v, want %v", sub.Err(), errExpired)
+	}
+	sub.Close()
+	if !reader.closed {
+		t.Errorf("Close() should close the event stream")
+	}
+}
@@ -0,0 +1,386 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	consumer "github.com/harlow/kinesis-consumer"
+	"sync"
+	"time"
+)
+
+const (
+	// ShardEndCheckpoint is the checkpoint stored for shards which were closed by
+	// resharding and read until their last record.
+	ShardEndCheckpoint = "SHARD_END"
+
+	defaultShardListInterval = 30 * time.Second
+)
+
+type ShardEventType string
+
+const (
+	// ShardAdded is emitted when a shard starts being read, which for child shards
+	// only happens after every parent is closed.
+	ShardAdded ShardEventType = "SHARD_ADDED"
+	// ShardClosed is emitted when a shard is read until its end.
+	ShardClosed ShardEventType = "SHARD_CLOSED"
+	// ShardReleased is emitted when a shard stops being read because its lease
+	// was taken by another worker.
+	ShardReleased ShardEventType = "SHARD_RELEASED"
+)
+
+// ShardEvent reports a change in the lifecycle of a shard.
+type ShardEvent struct {
+	Type           ShardEventType
+	StreamName     string
+	ShardID        string
+	ParentShardIDs []string
+}
+
+// WithShardEvents sets fn to be called on every ShardEvent of the Streamer.
+// fn is called from the goroutine managing the shards so it should not block.
+func WithShardEvents(fn func(ShardEvent)) StreamerOption {
+	return func(s *Streamer) {
+		s.onShardEvent = fn
+	}
+}
+
+// WithKinesisClient overrides the client used to list shards and read records.
+func WithKinesisClient(client kinesisiface.KinesisAPI) StreamerOption {
+	return func(s *Streamer) {
+		s.client = client
+	}
+}
+
+// WithCheckpointStore sets the storage for the scan progress. Besides the
+// sequence numbers it keeps ShardEndCheckpoint for closed shards so they are not
+// read again after a restart.
+func WithCheckpointStore(store consumer.Store) StreamerOption {
+	return func(s *Streamer) {
+		s.store = store
+	}
+}
+
+// shardLifecycle reads every shard of a stream, polling for the shards created
+// by resharding. Children are only read after their parents are closed.
+// If leases is set only the shards leased by this worker are read.
+type shardLifecycle struct {
+	streamName string
+	listShards func(ctx context.Context) ([]*kinesis.Shard, error)
+	// scanShard reads a shard returning nil when it is closed.
+	scanShard func(ctx context.Context, shardID string) error
+	// closed, if set, is called before the end of a shard is checkpointed.
+	closed   shardFunc
+	store    consumer.Store
+	interval time.Duration
+	leases   *LeaseCoordinator
+	onEvent  func(ShardEvent)
+	// onList is called with the outcome of every listing of the shards.
+	onList func(error)
+}
+
+type shardResult struct {
+	shard  *kinesis.Shard
+	closed bool
+}
+
+func (l *shardLifecycle) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		errc    = make(chan error, 1)
+		resultc = make(chan shardResult)
+		started = map[string]bool{}
+		closed  = map[string]bool{}
+		running = map[string]context.CancelFunc{}
+		wg      = new(sync.WaitGroup)
+	)
+	var (
+		// shards and open are kept from the last successful listing so leases
+		// are renewed even when listing fails
+		shards []*kinesis.Shard
+		open   []string
+	)
+	listOpenShards := func() error {
+		listed, err := l.listShards(ctx)
+		if l.onList != nil && ctx.Err() == nil {
+			l.onList(err)
+		}
+		if err != nil {
+			return &StreamError{StreamName: l.streamName, Op: "list shards", Err: err}
+		}
+		// shards may have been finished in previous runs or by other workers
+		var listedOpen []string
+		for _, shard := range listed {
+			shardID := aws.StringValue(shard.ShardId)
+			if closed[shardID] {
+				continue
+			}
+			if !started[shardID] {
+				checkpoint, err := l.store.GetCheckpoint(l.streamName, shardID)
+				if err != nil {
+					return &StreamError{StreamName: l.streamName, ShardID: shardID, Op: "get checkpoint", Err: err}
+				}
+				if checkpoint == ShardEndCheckpoint {
+					started[shardID] = true
+					closed[shardID] = true
+					continue
+				}
+			}
+			listedOpen = append(listedOpen, shardID)
+		}
+		shards, open = listed, listedOpen
+		return nil
+	}
+	// coordinate renews the leases and stops reading every shard whose lease is
+	// not confirmed, including when the lease store fails.
+	coordinate := func() error {
+		if l.leases == nil {
+			return nil
+		}
+		err := l.leases.Coordinate(ctx, l.streamName, open)
+		for shardID, cancelShard := range running {
+			if !l.leases.Owns(l.streamName, shardID) {
+				cancelShard()
+			}
+		}
+		if err != nil {
+			return &StreamError{StreamName: l.streamName, Op: "coordinate leases", Err: err}
+		}
+		return nil
+	}
+	startShards := func() {
+		for _, shard := range readyShards(shards, started, closed) {
+			shardID := aws.StringValue(shard.ShardId)
+			if l.leases != nil && !l.leases.Owns(l.streamName, shardID) {
+				continue
+			}
+			started[shardID] = true
+			shardCtx, cancelShard := context.WithCancel(ctx)
+			running[shardID] = cancelShard
+			l.emit(ShardAdded, shard)
+			wg.Add(1)
+			go func(shard *kinesis.Shard) {
+				defer wg.Done()
+				shardID := aws.StringValue(shard.ShardId)
+				err := l.scanShard(shardCtx, shardID)
+				if err == nil && l.closed != nil {
+					err = l.closed(shardCtx, shardID)
+				}
+				result := shardResult{shard: shard}
+				// stopped because the lease was lost or the stream is done
+				if shardCtx.Err() == nil {
+					if err == nil {
+						err = l.store.SetCheckpoint(l.streamName, shardID, ShardEndCheckpoint)
+					}
+					if err != nil {
+						select {
+						case errc <- &StreamError{StreamName: l.streamName, ShardID: shardID, Op: "read shard", Err: err}:
+							cancel()
+						default:
+						}
+						return
+					}
+					result.closed = true
+				}
+				select {
+				case resultc <- result:
+				case <-ctx.Done():
+				}
+			}(shard)
+		}
+	}
+	if err := listOpenShards(); err != nil {
+		return err
+	}
+	if err := coordinate(); err != nil {
+		return err
+	}
+	startShards()
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	var renew <-chan time.Time
+	if l.leases != nil {
+		renewTicker := time.NewTicker(l.leases.renewInterval)
+		defer renewTicker.Stop()
+		renew = renewTicker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			select {
+			case err := <-errc:
+				return err
+			default:
+				return nil
+			}
+		case result := <-resultc:
+			shardID := aws.StringValue(result.shard.ShardId)
+			running[shardID]()
+			delete(running, shardID)
+			if result.closed {
+				closed[shardID] = true
+				l.emit(ShardClosed, result.shard)
+			} else {
+				started[shardID] = false
+				l.emit(ShardReleased, result.shard)
+			}
+			// errors here are recovered by the next tick
+			if listOpenShards() == nil && coordinate() == nil {
+				startShards()
+			}
+		case <-ticker.C:
+			if listOpenShards() == nil && coordinate() == nil {
+				startShards()
+			}
+		case <-renew:
+			if coordinate() == nil {
+				startShards()
+			}
+		}
+	}
+}
+
+func (l *shardLifecycle) emit(t ShardEventType, shard *kinesis.Shard) {
+	if l.onEvent == nil {
+		return
+	}
+	var parents []string
+	for _, id := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+		if aws.StringValue(id) != "" {
+			parents = append(parents, aws.StringValue(id))
+		}
+	}
+	l.onEvent(ShardEvent{
+		Type:           t,
+		StreamName:     l.streamName,
+		ShardID:        aws.StringValue(shard.ShardId),
+		ParentShardIDs: parents,
+	})
+}
+
+// readyShards returns the shards not started yet whose parents are closed or
+// no longer listed because they expired.
+func readyShards(shards []*kinesis.Shard, started, closed map[string]bool) []*kinesis.Shard {
+	listed := map[string]bool{}
+	for _, shard := range shards {
+		listed[aws.StringValue(shard.ShardId)] = true
+	}
+	parentDone := func(parentID *string) bool {
+		id := aws.StringValue(parentID)
+		return id == "" || !listed[id] || closed[id]
+	}
+	var ready []*kinesis.Shard
+	for _, shard := range shards {
+		if started[aws.StringValue(shard.ShardId)] {
+			continue
+		}
+		if parentDone(shard.ParentShardId) && parentDone(shard.AdjacentParentShardId) {
+			ready = append(ready, shard)
+		}
+	}
+	return ready
+}
+
+// pollingScanner reads the shards with GetRecords through the consumer library
+// while managing the shard lifecycle itself.
+type pollingScanner struct {
+	streamName string
+	c          *consumer.Consumer
+	client     kinesisiface.KinesisAPI
+	store      consumer.Store
+	interval   time.Duration
+	leases     *LeaseCoordinator
+	onEvent    func(ShardEvent)
+	onList     func(error)
+}
+
+func (p *pollingScanner) Scan(ctx context.Context, fn recordFunc, closed shardFunc) error {
+	l := &shardLifecycle{
+		streamName: p.streamName,
+		listShards: func(ctx context.Context) ([]*kinesis.Shard, error) {
+			return listShards(ctx, p.client, p.streamName)
+		},
+		scanShard: func(ctx context.Context, shardID string) error {
+			return p.c.ScanShard(ctx, shardID, func(r *consumer.Record) error {
+				return fn(shardID, r)
+			})
+		},
+		closed:   closed,
+		store:    p.store,
+		interval: p.interval,
+		leases:   p.leases,
+		onEvent:  p.onEvent,
+		onList:   p.onList,
+	}
+	return l.run(ctx)
+}
+
+func listShards(ctx context.Context, client kinesisiface.KinesisAPI, streamName string) ([]*kinesis.Shard, error) {
+	var shards []*kinesis.Shard
+	input := &kinesis.ListShardsInput{StreamName: aws.String(streamName)}
+	for {
+		resp, err := client.ListShardsWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, resp.Shards...)
+		if resp.NextToken == nil {
+			return shards, nil
+		}
+		input = &kinesis.ListShardsInput{NextToken: resp.NextToken}
+	}
+}
+
+// memoryStore keeps the checkpoints for the life of the process when no store
+// is given, so closed shards are still tracked.
+type memoryStore struct {
+	sync.Map
+}
+
+func (m *memoryStore) GetCheckpoint(streamName, shardID string) (string, error) {
+	v, ok := m.Load(streamName + ":" + shardID)
+	if !ok {
+		return "", nil
+	}
+	return v.(string), nil
+}
+
+func (m *memoryStore) SetCheckpoint(streamName, shardID, sequenceNumber string) error {
+	m.Store(streamName+":"+shardID, sequenceNumber)
+	return nil
+}
+
+// WithStartingPosition sets where the shards without a checkpoint start being
+// read: LATEST, which is the default, TRIM_HORIZON or AT_TIMESTAMP with its
+// Timestamp. It applies to the polling consumer and to enhanced fan-out.
+func WithStartingPosition(p StartingPosition) StreamerOption {
+	return func(s *Streamer) {
+		s.start = &p
+	}
+}
+
+func (p StartingPosition) validate() error {
+	switch p.Type {
+	case kinesis.ShardIteratorTypeLatest, kinesis.ShardIteratorTypeTrimHorizon:
+		return nil
+	case kinesis.ShardIteratorTypeAtTimestamp:
+		if p.Timestamp == nil {
+			return fmt.Errorf("starting position %s requires a timestamp", p.Type)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported starting position %q", p.Type)
+	}
+}
+
+func (p StartingPosition) consumerOptions() []consumer.Option {
+	if p.Type == kinesis.ShardIteratorTypeAtTimestamp {
+		return []consumer.Option{consumer.WithTimestamp(*p.Timestamp)}
+	}
+	return []consumer.Option{consumer.WithShardIteratorType(p.Type)}
+}
@@ -0,0 +1,221 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	consumer "github.com/harlow/kinesis-consumer"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKinesis is a local stand-in for the Kinesis API serving GetRecords.
+// Shard iterators are "shardID:index" and closed shards return no next iterator
+// once every record was read.
+type fakeKinesis struct {
+	kinesisiface.KinesisAPI
+	mu      sync.Mutex
+	shards  []*kinesis.Shard
+	records map[string][]string
+	closed  map[string]bool
+	// status is the StreamStatus of the stream, ACTIVE if empty.
+	status string
+}
+
+func (f *fakeKinesis) DescribeStreamSummaryWithContext(ctx aws.Context, input *kinesis.DescribeStreamSummaryInput, opts ...request.Option) (*kinesis.DescribeStreamSummaryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := f.status
+	if status == "" {
+		status = kinesis.StreamStatusActive
+	}
+	return &kinesis.DescribeStreamSummaryOutput{StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+		StreamName:   input.StreamName,
+		StreamStatus: aws.String(status),
+	}}, nil
+}
+
+func (f *fakeKinesis) ListShardsWithContext(ctx aws.Context, input *kinesis.ListShardsInput, opts ...request.Option) (*kinesis.ListShardsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &kinesis.ListShardsOutput{Shards: f.shards}, nil
+}
+
+func (f *fakeKinesis) GetShardIteratorWithContext(ctx aws.Context, input *kinesis.GetShardIteratorInput, opts ...request.Option) (*kinesis.GetShardIteratorOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shardID := aws.StringValue(input.ShardId)
+	index := 0
+	if aws.StringValue(input.ShardIteratorType) == kinesis.ShardIteratorTypeAfterSequenceNumber {
+		for i, seq := range f.records[shardID] {
+			if seq == aws.StringValue(input.StartingSequenceNumber) {
+				index = i + 1
+			}
+		}
+	}
+	return &kinesis.GetShardIteratorOutput{
+		ShardIterator: aws.String(fmt.Sprintf("%s:%d", shardID, index)),
+	}, nil
+}
+
+func (f *fakeKinesis) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(aws.StringValue(input.ShardIterator), ":")
+	shardID := parts[0]
+	index, _ := strconv.Atoi(parts[1])
+	records := f.records[shardID]
+	out := &kinesis.GetRecordsOutput{}
+	if index < len(records) {
+		out.Records = []*kinesis.Record{{
+			SequenceNumber: aws.String(records[index]),
+			Data:           []byte(records[index]),
+		}}
+		index++
+	}
+	out.MillisBehindLatest = aws.Int64(int64(len(records) - index))
+	if index == len(records) && f.closed[shardID] {
+		return out, nil
+	}
+	out.NextShardIterator = aws.String(fmt.Sprintf("%s:%d", shardID, index))
+	return out, nil
+}
+
+func newTestStreamer(t *testing.T, api *fakeKinesis, opts ...StreamerOption) *Streamer {
+	opts = append(opts, WithKinesisClient(api), WithConsumerOptions(consumer.WithScanInterval(time.Millisecond)))
+	s, err := NewStreamer(context.Background(), "stream", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func scanStreamer(t *testing.T, s *Streamer, want int) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var got []string
+	err := s.c.Scan(ctx, func(shardID string, r *consumer.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, aws.StringValue(r.SequenceNumber))
+		if len(got) == want {
+			cancel()
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	return got
+}
+
+func TestPollingScanner_Scan(t *testing.T) {
+	tests := []struct {
+		name   string
+		api    *fakeKinesis
+		before map[string][]string
+	}{
+		{"split", &fakeKinesis{
+			shards: []*kinesis.Shard{shard("p", "", ""), shard("c1", "p", ""), shard("c2", "p", "")},
+			records: map[string][]string{
+				"p":  {"p1", "p2", "p3"},
+				"c1": {"c11", "c12"},
+				"c2": {"c21"},
+			},
+			closed: map[string]bool{"p": true},
+		}, map[string][]string{"p3": {"c11", "c21"}}},
+		{"merge", &fakeKinesis{
+			shards: []*kinesis.Shard{shard("a", "", ""), shard("b", "", ""), shard("m", "a", "b")},
+			records: map[string][]string{
+				"a": {"a1", "a2"},
+				"b": {"b1", "b2", "b3"},
+				"m": {"m1", "m2"},
+			},
+			closed: map[string]bool{"a": true, "b": true},
+		}, map[string][]string{"a2": {"m1"}, "b3": {"m1"}}},
+		{"splitThenMerge", &fakeKinesis{
+			shards: []*kinesis.Shard{
+				shard("p", "", ""), shard("c1", "p", ""), shard("c2", "p", ""), shard("m", "c1", "c2"),
+			},
+			records: map[string][]string{
+				"p":  {"p1"},
+				"c1": {"c11"},
+				"c2": {"c21", "c22"},
+				"m":  {"m1"},
+			},
+			closed: map[string]bool{"p": true, "c1": true, "c2": true},
+		}, map[string][]string{"p1": {"c11", "c21"}, "c11": {"m1"}, "c22": {"m1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := 0
+			for _, records := range tt.api.records {
+				want += len(records)
+			}
+			got := scanStreamer(t, newTestStreamer(t, tt.api), want)
+			if len(got) != want {
+				t.Fatalf("Scan() got %v records, want %v", len(got), want)
+			}
+			for parent, children := range tt.before {
+				for _, child := range children {
+					if indexOf(got, parent) > indexOf(got, child) {
+						t.Errorf("Scan() got %v before %v: %v", child, parent, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPollingScanner_ShardEnd(t *testing.T) {
+	api := &fakeKinesis{
+		shards: []*kinesis.Shard{shard("p", "", ""), shard("c", "p", "")},
+		records: map[string][]string{
+			"p": {"p1", "p2"},
+			"c": {"c1"},
+		},
+		closed: map[string]bool{"p": true},
+	}
+	store := new(memoryStore)
+	var mu sync.Mutex
+	var events []ShardEvent
+	onEvent := func(e ShardEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+	got := scanStreamer(t, newTestStreamer(t, api, WithCheckpointStore(store), WithShardEvents(onEvent)), 3)
+	if want := []string{"p1", "p2", "c1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan() got = %v, want %v", got, want)
+	}
+	if checkpoint, _ := store.GetCheckpoint("stream", "p"); checkpoint != ShardEndCheckpoint {
+		t.Errorf("GetCheckpoint() got = %v, want %v", checkpoint, ShardEndCheckpoint)
+	}
+	wantEvents := []ShardEvent{
+		{Type: ShardAdded, StreamName: "stream", ShardID: "p"},
+		{Type: ShardClosed, StreamName: "stream", ShardID: "p"},
+		{Type: ShardAdded, StreamName: "stream", ShardID: "c", ParentShardIDs: []string{"p"}},
+	}
+	mu.Lock()
+	if !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("events got = %+v, want %+v", events, wantEvents)
+	}
+	mu.Unlock()
+
+	// a restarted Streamer skips the closed parent and resumes the child
+	api.mu.Lock()
+	api.records["c"] = append(api.records["c"], "c2")
+	api.mu.Unlock()
+	got = scanStreamer(t, newTestStreamer(t, api, WithCheckpointStore(store)), 1)
+	if want := []string{"c2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan() after restart got = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,218 @@
+package kinesis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/go-ini/ini"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultProcessTimeout = time.Minute
+
+	// ProcessProviderName is the ProviderName of the credentials of a
+	// credential_process command.
+	ProcessProviderName = "ProcessProvider"
+)
+
+// WithINIFile creates a new Credentials using profile of an AWS shared
+// credentials file, as a mounted secret. The keys read are aws_access_key_id,
+// aws_secret_access_key and aws_session_token, of which the first two are
+// required.
+func WithINIFile(path, profile string) (*Credentials, error) {
+	if profile == "" {
+		profile = defaultProfile
+	}
+	f, err := ini.Load(path)
+	if err != nil {
+		return nil, credentialsErrorf(path, "%w", err)
+	}
+	section, err := f.GetSection(profile)
+	if err != nil {
+		return nil, credentialsErrorf(path, "profile %s not found in %s", profile, path)
+	}
+	return newValidCredentials(path, credentials.Value{
+		AccessKeyID:     section.Key("aws_access_key_id").String(),
+		SecretAccessKey: section.Key("aws_secret_access_key").String(),
+		SessionToken:    section.Key("aws_session_token").String(),
+		ProviderName:    ProfileProviderName,
+	}, "")
+}
+
+// awsJSONCredentials is the JSON written by credential_process commands. The
+// output of "aws sts assume-role" has it under Credentials.
+type awsJSONCredentials struct {
+	Version         *int
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      string
+	Credentials     *awsJSONCredentials
+}
+
+// WithAWSJSONFile creates a new Credentials using the AWS JSON format of a
+// file, as written by credential_process commands or "aws sts assume-role":
+// {"Version": 1, "AccessKeyId": "...", "SecretAccessKey": "...",
+// "SessionToken": "...", "Expiration": "2020-01-02T15:04:05Z"}.
+// AccessKeyId and SecretAccessKey are required.
+func WithAWSJSONFile(path string) (*Credentials, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, credentialsErrorf(path, "%w", err)
+	}
+	return parseAWSJSON(path, b)
+}
+
+func parseAWSJSON(source string, b []byte) (*Credentials, error) {
+	var c awsJSONCredentials
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); err != nil {
+		return nil, credentialsErrorf(source, "invalid credentials of %s: %w", source, err)
+	}
+	if c.Credentials != nil {
+		c = *c.Credentials
+	}
+	if c.Version != nil && *c.Version != 1 {
+		return nil, credentialsErrorf(source, "unsupported version %d of the credentials of %s", *c.Version, source)
+	}
+	return newValidCredentials(source, credentials.Value{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+	}, c.Expiration)
+}
+
+// WithEnvFile creates a new Credentials using the variables of
+// WithEnvironmentVariables set in an env file, one KEY=value per line. Empty
+// lines, # comments, an export prefix and quoted values are supported. The
+// expiration is read from AWS_CREDENTIAL_EXPIRATION in RFC 3339, if set.
+func WithEnvFile(path string) (*Credentials, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, credentialsErrorf(path, "%w", err)
+	}
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		kv := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, credentialsErrorf(path, "%s:%d: expected KEY=value", path, n)
+		}
+		value := strings.TrimSpace(kv[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+			if value[len(value)-1] != value[0] {
+				return nil, credentialsErrorf(path, "%s:%d: unterminated quote", path, n)
+			}
+			if value[0] == '"' {
+				if value, err = strconv.Unquote(value); err != nil {
+					return nil, credentialsErrorf(path, "%s:%d: %w", path, n, err)
+				}
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		vars[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, credentialsErrorf(path, "%w", err)
+	}
+	return newValidCredentials(path, credentials.Value{
+		AccessKeyID:     vars["AWS_ACCESS_KEY_ID"],
+		SecretAccessKey: vars["AWS_SECRET_ACCESS_KEY"],
+		SessionToken:    vars["AWS_SESSION_TOKEN"],
+		ProviderName:    vars["AWS_PROVIDER_NAME"],
+	}, vars["AWS_CREDENTIAL_EXPIRATION"])
+}
+
+// newValidCredentials returns the Credentials of value read from source,
+// expiring at expiration in RFC 3339 unless empty. The access key and secret
+// are required.
+func newValidCredentials(source string, value credentials.Value, expiration string) (*Credentials, error) {
+	if value.AccessKeyID == "" || value.SecretAccessKey == "" {
+		return nil, credentialsErrorf(source, "%s has no access key ID or secret access key", source)
+	}
+	c := &Credentials{Value: value}
+	if expiration != "" {
+		t, err := time.Parse(time.RFC3339, expiration)
+		if err != nil {
+			return nil, credentialsErrorf(source, "invalid expiration of %s: %w", source, err)
+		}
+		c.expiration = t
+	}
+	return c, nil
+}
+
+// CredentialsSource returns a RefreshFunc reading the Credentials with read, as
+// one of WithINIFile, WithAWSJSONFile or WithEnvFile, so a RefreshingProvider
+// reads a mounted secret again when it is rotated.
+func CredentialsSource(read func() (*Credentials, error)) RefreshFunc {
+	return func() (credentials.Value, time.Time, error) {
+		c, err := read()
+		if err != nil {
+			return credentials.Value{}, time.Time{}, err
+		}
+		return c.Value, c.expiration, nil
+	}
+}
+
+// ProcessConfig sets an external command giving the credentials, as the
+// credential_process of the AWS shared config.
+type ProcessConfig struct {
+	// Command is run with /bin/sh -c and must write the AWS JSON format of
+	// WithAWSJSONFile, with Version 1, to its standard output.
+	Command string
+	// Timeout is how long the command can run. The default is 1 minute.
+	Timeout time.Duration
+	// Refresh sets when the command is run again. Credentials without
+	// Expiration are only refreshed if Refresh.Interval is set.
+	Refresh RefreshConfig
+}
+
+// NewProcessProvider creates a credentials.Provider running the command of cfg.
+func NewProcessProvider(cfg ProcessConfig) (*RefreshingProvider, error) {
+	if strings.TrimSpace(cfg.Command) == "" {
+		return nil, credentialsErrorf(ProcessProviderName, "credential process requires a command")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultProcessTimeout
+	}
+	return NewRefreshingProvider(runProcess(cfg), cfg.Refresh), nil
+}
+
+func runProcess(cfg ProcessConfig) RefreshFunc {
+	return func() (credentials.Value, time.Time, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+		defer cancel()
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", cfg.Command)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Run(); err != nil {
+			return credentials.Value{}, time.Time{}, fmt.Errorf("credential process %q: %w: %s", cfg.Command, err, strings.TrimSpace(stderr.String()))
+		}
+		var version struct{ Version int }
+		if err := json.Unmarshal(stdout.Bytes(), &version); err != nil || version.Version != 1 {
+			return credentials.Value{}, time.Time{}, fmt.Errorf("credential process %q: output should be a JSON object with Version 1", cfg.Command)
+		}
+		c, err := parseAWSJSON("credential process "+strconv.Quote(cfg.Command), stdout.Bytes())
+		if err != nil {
+			return credentials.Value{}, time.Time{}, err
+		}
+		c.Value.ProviderName = ProcessProviderName
+		return c.Value, c.expiration, nil
+	}
+}
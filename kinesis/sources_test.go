@@ -0,0 +1,190 @@
+package kinesis
+
+import (
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWithINIFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, "credentials", `
+[default]
+aws_access_key_id = AKID
+aws_secret_access_key = SECRET
+aws_session_token = TOKEN
+
+[missing]
+aws_access_key_id = AKID
+`)
+	tests := []struct {
+		name    string
+		path    string
+		profile string
+		want    *Credentials
+		wantErr bool
+	}{
+		{"default", path, "", &Credentials{Value: credentials.Value{
+			AccessKeyID:     "AKID",
+			SecretAccessKey: "SECRET",
+			SessionToken:    "TOKEN",
+			ProviderName:    ProfileProviderName,
+		}}, false},
+		{"missingSecret", path, "missing", nil, true},
+		{"profileNotFound", path, "other", nil, true},
+		{"fileNotFound", dir + "/404", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := WithINIFile(tt.path, tt.profile)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("WithINIFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WithINIFile() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithAWSJSONFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	expiration := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name    string
+		content string
+		want    *Credentials
+		wantErr bool
+	}{
+		{"process", `{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": "SECRET", "SessionToken": "TOKEN", "Expiration": "2020-01-02T15:04:05Z"}`,
+			&Credentials{Value: credentials.Value{
+				AccessKeyID:     "AKID",
+				SecretAccessKey: "SECRET",
+				SessionToken:    "TOKEN",
+			}, expiration: expiration}, false},
+		{"assumeRole", `{"Credentials": {"AccessKeyId": "AKID", "SecretAccessKey": "SECRET", "SessionToken": "TOKEN", "Expiration": "2020-01-02T15:04:05Z"}}`,
+			&Credentials{Value: credentials.Value{
+				AccessKeyID:     "AKID",
+				SecretAccessKey: "SECRET",
+				SessionToken:    "TOKEN",
+			}, expiration: expiration}, false},
+		{"noExpiration", `{"AccessKeyId": "AKID", "SecretAccessKey": "SECRET"}`,
+			&Credentials{Value: credentials.Value{
+				AccessKeyID:     "AKID",
+				SecretAccessKey: "SECRET",
+			}}, false},
+		{"version", `{"Version": 2, "AccessKeyId": "AKID", "SecretAccessKey": "SECRET"}`, nil, true},
+		{"missingSecret", `{"Version": 1, "AccessKeyId": "AKID"}`, nil, true},
+		{"notString", `{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": 42}`, nil, true},
+		{"unknownField", `{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": "SECRET", "Secret": "SECRET"}`, nil, true},
+		{"expiration", `{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": "SECRET", "Expiration": "tomorrow"}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := WithAWSJSONFile(writeFile(t, dir, tt.name+".json", tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("WithAWSJSONFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WithAWSJSONFile() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		content string
+		want    *Credentials
+		wantErr bool
+	}{
+		{"default", `
+# rotated by the agent
+export AWS_ACCESS_KEY_ID=AKID
+AWS_SECRET_ACCESS_KEY="SECRET=="
+AWS_SESSION_TOKEN='TOKEN'
+AWS_CREDENTIAL_EXPIRATION=2020-01-02T15:04:05Z
+OTHER=value
+`, &Credentials{Value: credentials.Value{
+			AccessKeyID:     "AKID",
+			SecretAccessKey: "SECRET==",
+			SessionToken:    "TOKEN",
+		}, expiration: time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)}, false},
+		{"missingSecret", "AWS_ACCESS_KEY_ID=AKID\n", nil, true},
+		{"noValue", "AWS_ACCESS_KEY_ID=AKID\nAWS_SECRET_ACCESS_KEY\n", nil, true},
+		{"unterminatedQuote", "AWS_ACCESS_KEY_ID=AKID\nAWS_SECRET_ACCESS_KEY=\"SECRET\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := WithEnvFile(writeFile(t, dir, tt.name+".env", tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("WithEnvFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WithEnvFile() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewProcessProvider(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name    string
+		command string
+		want    credentials.Value
+		wantErr bool
+	}{
+		{"default", `echo '{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": "SECRET", "Expiration": "` + expiration + `"}'`,
+			credentials.Value{
+				AccessKeyID:     "AKID",
+				SecretAccessKey: "SECRET",
+				ProviderName:    ProcessProviderName,
+			}, false},
+		{"noVersion", `echo '{"AccessKeyId": "AKID", "SecretAccessKey": "SECRET"}'`, credentials.Value{}, true},
+		{"expired", `echo '{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": "SECRET", "Expiration": "2020-01-02T15:04:05Z"}'`, credentials.Value{}, true},
+		{"failed", `echo denied >&2; exit 1`, credentials.Value{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewProcessProvider(ProcessConfig{
+				Command: tt.command,
+				Refresh: RefreshConfig{OnError: func(error) {}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Retrieve()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Retrieve() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Retrieve() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if _, err := NewProcessProvider(ProcessConfig{}); err == nil {
+		t.Error("NewProcessProvider() without command should fail")
+	}
+}
@@ -0,0 +1,262 @@
+package kinesis
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	consumer "github.com/harlow/kinesis-consumer"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ShardState is the state of a shard read by a Streamer.
+type ShardState string
+
+const (
+	// ShardReading is the state of a shard being read.
+	ShardReading ShardState = "READING"
+	// ShardFinished is the state of a shard read until its end.
+	ShardFinished ShardState = "FINISHED"
+	// ShardLost is the state of a shard whose lease was taken by another worker.
+	ShardLost ShardState = "LOST"
+)
+
+// ShardStatus is the position of a Streamer in a shard.
+type ShardStatus struct {
+	ShardID string
+	State   ShardState
+	// SequenceNumber is the last record read, which may not be delivered yet.
+	SequenceNumber string
+	// LastReadAt is when the last record was read.
+	LastReadAt time.Time
+	// Checkpoint is the sequence number stored by the checkpoint store given
+	// with WithCheckpointStore, if any.
+	Checkpoint string
+}
+
+// StreamStatus tells the progress of a Streamer.
+type StreamStatus struct {
+	StreamName string
+	// Streaming is true while Stream runs.
+	Streaming bool
+	// Ready is true while Stream runs and the last listing of the shards
+	// succeeded.
+	Ready bool
+	// Error is why the last listing of the shards failed, if it did.
+	Error  string
+	Shards []ShardStatus
+	// PausedReceivers are the receivers paused with PauseReceiver.
+	PausedReceivers []string
+}
+
+// Name returns the name of the stream.
+func (s *Streamer) Name() string {
+	return s.name
+}
+
+// Ready tells whether the Streamer is streaming and reached the stream the last
+// time it listed the shards.
+func (s *Streamer) Ready() bool {
+	return s.state.ready()
+}
+
+// Status returns the progress of the Streamer.
+func (s *Streamer) Status() StreamStatus {
+	status := s.state.status(s.name)
+	if s.store != nil {
+		for i := range status.Shards {
+			// the checkpoint is informative so a failing store leaves it empty
+			status.Shards[i].Checkpoint, _ = s.store.GetCheckpoint(s.name, status.Shards[i].ShardID)
+		}
+	}
+	return status
+}
+
+// PauseReceiver stops delivering records to the receiver whose String method
+// returns receiver until ResumeReceiver is called. Its records wait in its
+// queue, pausing the scan once the queue is full, so the other receivers of
+// the Streamer pause too. Records still queued when Stream returns are
+// reported by the DrainError.
+func (s *Streamer) PauseReceiver(receiver string) {
+	s.state.gate(receiver).pause()
+}
+
+// ResumeReceiver resumes delivering records to receiver.
+func (s *Streamer) ResumeReceiver(receiver string) {
+	s.state.gate(receiver).resume()
+}
+
+// ReceiverPaused tells whether receiver is paused.
+func (s *Streamer) ReceiverPaused(receiver string) bool {
+	return s.state.gate(receiver).isPaused()
+}
+
+// streamState holds the progress of a Streamer, which is shared by its copies
+// so it can be read while streaming.
+type streamState struct {
+	mu sync.Mutex
+	// streaming counts the calls to Stream running.
+	streaming int
+	listed    bool
+	listErr   error
+	shards    map[string]*ShardStatus
+	gates     map[string]*pauseGate
+}
+
+func newStreamState() *streamState {
+	return &streamState{
+		shards: map[string]*ShardStatus{},
+		gates:  map[string]*pauseGate{},
+	}
+}
+
+// start marks the Streamer as streaming until stop is called.
+func (st *streamState) start() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.streaming == 0 {
+		st.listed, st.listErr = false, nil
+	}
+	st.streaming++
+}
+
+func (st *streamState) stop() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.streaming--
+}
+
+// list records the outcome of a listing of the shards.
+func (st *streamState) list(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.listed, st.listErr = true, err
+}
+
+func (st *streamState) ready() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.streaming > 0 && st.listed && st.listErr == nil
+}
+
+// read records r as the last record read from shardID.
+func (st *streamState) read(shardID string, r *consumer.Record) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	shard := st.shard(shardID)
+	shard.SequenceNumber = aws.StringValue(r.SequenceNumber)
+	shard.LastReadAt = time.Now()
+}
+
+func (st *streamState) shardEvent(e ShardEvent) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	shard := st.shard(e.ShardID)
+	switch e.Type {
+	case ShardAdded:
+		shard.State = ShardReading
+	case ShardClosed:
+		shard.State = ShardFinished
+	case ShardReleased:
+		shard.State = ShardLost
+	}
+}
+
+// shard must be called with st.mu held.
+func (st *streamState) shard(shardID string) *ShardStatus {
+	shard, ok := st.shards[shardID]
+	if !ok {
+		shard = &ShardStatus{ShardID: shardID, State: ShardReading}
+		st.shards[shardID] = shard
+	}
+	return shard
+}
+
+func (st *streamState) status(streamName string) StreamStatus {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	status := StreamStatus{
+		StreamName: streamName,
+		Streaming:  st.streaming > 0,
+		Ready:      st.streaming > 0 && st.listed && st.listErr == nil,
+		Shards:     []ShardStatus{},
+	}
+	if st.listErr != nil {
+		status.Error = st.listErr.Error()
+	}
+	for _, shard := range st.shards {
+		status.Shards = append(status.Shards, *shard)
+	}
+	sort.Slice(status.Shards, func(i, j int) bool {
+		return status.Shards[i].ShardID < status.Shards[j].ShardID
+	})
+	for receiver, gate := range st.gates {
+		if gate.isPaused() {
+			status.PausedReceivers = append(status.PausedReceivers, receiver)
+		}
+	}
+	sort.Strings(status.PausedReceivers)
+	return status
+}
+
+// gate returns the pauseGate of receiver, creating it if it has none.
+func (st *streamState) gate(receiver string) *pauseGate {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	gate, ok := st.gates[receiver]
+	if !ok {
+		gate = newPauseGate()
+		st.gates[receiver] = gate
+	}
+	return gate
+}
+
+// pauseGate holds the workers of a receiver while it is paused.
+type pauseGate struct {
+	mu     sync.Mutex
+	paused bool
+	// resumed is closed and replaced when the gate is resumed.
+	resumed chan struct{}
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{resumed: make(chan struct{})}
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = true
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// wait waits while the gate is paused and ctx is not done.
+func (g *pauseGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.mu.Unlock()
+	if !paused {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,119 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it is true or fails the test after 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamer_Status(t *testing.T) {
+	api := &fakeKinesis{
+		shards:  []*kinesis.Shard{shard("s1", "", ""), shard("s2", "", "")},
+		records: map[string][]string{"s1": {"a", "b"}, "s2": {"c"}},
+		closed:  map[string]bool{"s2": true},
+	}
+	store := new(memoryStore)
+	s := newTestStreamer(t, api, WithCheckpointStore(store))
+	if s.Ready() {
+		t.Errorf("Ready() before Stream = true, want false")
+	}
+	rec := newFakeReceiver("rec", 3, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Stream(ctx, rec)
+	}()
+	<-rec.done
+	waitFor(t, "s1 to be checkpointed and s2 to finish", func() bool {
+		status := s.Status()
+		return len(status.Shards) == 2 && status.Shards[0].Checkpoint == "b" && status.Shards[1].State == ShardFinished
+	})
+	status := s.Status()
+	if !status.Streaming || !status.Ready || !s.Ready() {
+		t.Errorf("Status() = %+v, want streaming and ready", status)
+	}
+	want := []struct {
+		shardID, sequenceNumber, checkpoint string
+		state                               ShardState
+	}{
+		{"s1", "b", "b", ShardReading},
+		{"s2", "c", ShardEndCheckpoint, ShardFinished},
+	}
+	for i, w := range want {
+		got := status.Shards[i]
+		if got.ShardID != w.shardID || got.SequenceNumber != w.sequenceNumber || got.Checkpoint != w.checkpoint || got.State != w.state || got.LastReadAt.IsZero() {
+			t.Errorf("shard %v = %+v, want %+v", i, got, w)
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	if status := s.Status(); status.Streaming || status.Ready {
+		t.Errorf("Status() after Stream = %+v, want not streaming", status)
+	}
+}
+
+func TestStreamer_StatusListError(t *testing.T) {
+	s := &Streamer{name: "stream", state: newStreamState()}
+	s.state.start()
+	s.state.list(fmt.Errorf("access denied"))
+	if status := s.Status(); status.Ready || status.Error != "access denied" {
+		t.Errorf("Status() = %+v, want not ready with the error", status)
+	}
+	s.state.list(nil)
+	if !s.Ready() {
+		t.Errorf("Ready() after a listing succeeded = false, want true")
+	}
+}
+
+func TestStreamer_PauseReceiver(t *testing.T) {
+	api := &fakeKinesis{
+		shards:  []*kinesis.Shard{shard("s1", "", "")},
+		records: map[string][]string{"s1": {"a", "b", "c"}},
+	}
+	s := newTestStreamer(t, api)
+	paused := newFakeReceiver("paused", 3, nil)
+	other := newFakeReceiver("other", 3, nil)
+	s.PauseReceiver("paused")
+	if !s.ReceiverPaused("paused") || s.ReceiverPaused("other") {
+		t.Fatalf("ReceiverPaused() got = %v, %v", s.ReceiverPaused("paused"), s.ReceiverPaused("other"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Stream(ctx, paused, other)
+	}()
+	<-other.done
+	if got := paused.received(); len(got) != 0 {
+		t.Errorf("paused received = %v, want nothing", got)
+	}
+	if got := s.Status().PausedReceivers; fmt.Sprint(got) != "[paused]" {
+		t.Errorf("PausedReceivers = %v, want [paused]", got)
+	}
+	s.ResumeReceiver("paused")
+	select {
+	case <-paused.done:
+	case <-ctx.Done():
+		t.Fatalf("resumed receiver got %v", paused.received())
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+}
@@ -2,12 +2,22 @@ package kinesis
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/logging"
+	"github.com/nicolasassi/kinestesia/metrics"
 	"github.com/nicolasassi/kinestesia/receivers"
+	"github.com/nicolasassi/kinestesia/tracing"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/sync/semaphore"
+	"reflect"
 	"sync"
+	"time"
 )
 
 const (
@@ -18,130 +28,403 @@ type Streaming interface {
 	Stream(ctx context.Context, receivers ...receivers.Receiver) error
 }
 
+// recordFunc is called for every record read from a shard. As consumer.ScanFunc
+// it stops the scan if an error other than consumer.ErrSkipCheckpoint is returned.
+type recordFunc func(shardID string, r *consumer.Record) error
+
+// shardFunc is called once every record of a closed shard was read, before the
+// end of the shard is checkpointed. The shard is left open if it fails.
+type shardFunc func(ctx context.Context, shardID string) error
+
+// scanner reads every record of a stream calling fn for each of them and closed
+// for each shard read to its end. closed may be nil.
+// It is implemented by the polling and by the enhanced fan-out scanners.
+type scanner interface {
+	Scan(ctx context.Context, fn recordFunc, closed shardFunc) error
+}
+
 type Streamer struct {
-	c *consumer.Consumer
+	name         string
+	c            scanner
+	fanOut       *FanOutConfig
+	client       kinesisiface.KinesisAPI
+	store        consumer.Store
+	checkpoints  consumer.Store
+	leases       *LeaseCoordinator
+	onShardEvent func(ShardEvent)
+	metrics      metrics.Recorder
+	tracer       trace.Tracer
+	logger       logging.Logger
+
+	workers         int
+	receiverConfigs map[string]ReceiverConfig
+	deliveryMode    DeliveryMode
+	orderingKey     OrderingKeyFunc
+	drainTimeout    time.Duration
+	rateLimits      *rateLimits
+	state           *streamState
+	start           *StartingPosition
+	skipValidation  bool
+	consumerOpts    []consumer.Option
+	// bound are the receivers of the stream given to a StreamersBuilder.
+	bound []receivers.Receiver
 }
 
-type streamController struct {
-	c   *consumer.Consumer
-	err error
+// StreamerOption is used to override defaults when creating a new Streamer.
+type StreamerOption func(*Streamer)
+
+// WithConsumerOptions passes opts to the polling consumer. Shards are listed and
+// checkpointed by the Streamer so the client and store are given with
+// WithKinesisClient and WithCheckpointStore: NewStreamer fails with
+// ErrConsumerOption given consumer.WithClient or consumer.WithStore.
+func WithConsumerOptions(opts ...consumer.Option) StreamerOption {
+	return func(s *Streamer) {
+		s.consumerOpts = append(s.consumerOpts, opts...)
+	}
 }
 
-func NewStreamer(ctx context.Context, streamName string, opts ...consumer.Option) (*Streamer, error) {
-	controller := make(chan streamController, 1)
-	go func() {
-		c, err := consumer.New(streamName, opts...)
+// WithStreamValidation sets whether NewStreamer checks with DescribeStreamSummary
+// that the stream exists and can be read, which it does by default. Disabling it
+// suits credentials not allowed to describe the stream. Streamers consuming with
+// enhanced fan-out are only checked if a client is given with WithKinesisClient.
+func WithStreamValidation(enabled bool) StreamerOption {
+	return func(s *Streamer) {
+		s.skipValidation = !enabled
+	}
+}
+
+// NewStreamer creates a Streamer for streamName configured with opts. Options
+// of the polling consumer are given with WithConsumerOptions.
+// It fails with a *StreamError if the stream does not exist or is not ACTIVE,
+// unless disabled with WithStreamValidation, and with the error of ctx if it is
+// done.
+func NewStreamer(ctx context.Context, streamName string, opts ...StreamerOption) (*Streamer, error) {
+	s := &Streamer{
+		name:         streamName,
+		metrics:      metrics.Discard,
+		logger:       logging.Default,
+		drainTimeout: defaultDrainTimeout,
+		rateLimits:   newRateLimits(),
+		state:        newStreamState(),
+		tracer:       tracing.Tracer(nil),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.start != nil {
+		if err := s.start.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c, err := s.newScanner(streamName, s.consumerOpts)
+	if err != nil {
+		return nil, fmt.Errorf("new consumer error: %w", err)
+	}
+	s.c = c
+	if !s.skipValidation && s.client != nil {
+		if err := s.describe(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// describe checks the stream exists and is ACTIVE, or UPDATING as when it is
+// being resharded, which can still be read.
+func (s *Streamer) describe(ctx context.Context) error {
+	out, err := s.client.DescribeStreamSummaryWithContext(ctx, &kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(s.name),
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return &StreamError{StreamName: s.name, Op: "describe stream", Err: err}
+	}
+	var status string
+	if out.StreamDescriptionSummary != nil {
+		status = aws.StringValue(out.StreamDescriptionSummary.StreamStatus)
+	}
+	switch status {
+	case kinesis.StreamStatusActive, kinesis.StreamStatusUpdating:
+		return nil
+	}
+	return &StreamError{StreamName: s.name, Op: "describe stream", Err: fmt.Errorf("%w: status %s", ErrStreamNotActive, status)}
+}
+
+func (s *Streamer) newScanner(streamName string, consumerOpts []consumer.Option) (scanner, error) {
+	if err := checkConsumerOptions(consumerOpts); err != nil {
+		return nil, err
+	}
+	if s.fanOut != nil {
+		cfg := *s.fanOut
+		if cfg.Store == nil {
+			cfg.Store = s.store
+		}
+		if s.start != nil {
+			cfg.ShardIteratorType, cfg.Timestamp = s.start.Type, s.start.Timestamp
+		}
+		f, err := newFanOutScanner(streamName, cfg)
 		if err != nil {
-			controller <- streamController{
-				err: fmt.Errorf("new consumer error: %v", err),
-			}
-			return
+			return nil, err
 		}
-		controller <- streamController{
-			c: c,
+		f.leases = s.leases
+		f.onEvent = s.shardEvent
+		f.onList = s.state.list
+		f.metrics = s.metrics
+		s.checkpoints = f.store
+		return f, nil
+	}
+	if s.client == nil {
+		newSession, err := session.NewSession(aws.NewConfig())
+		if err != nil {
+			return nil, err
 		}
-	}()
-	select {
-	case <-ctx.Done():
-		return nil, nil
-	case ctrl := <-controller:
-		if ctrl.err != nil {
-			return nil, ctrl.err
+		s.client = kinesis.New(newSession)
+	}
+	client := s.client
+	if s.metrics != metrics.Discard {
+		client = newLagClient(streamName, client, s.metrics)
+	}
+	if s.start != nil {
+		consumerOpts = append(consumerOpts, s.start.consumerOptions()...)
+	}
+	store := s.store
+	if store != nil {
+		consumerOpts = append(consumerOpts, consumer.WithStore(store))
+	} else {
+		store = new(memoryStore)
+	}
+	c, err := consumer.New(streamName, append(consumerOpts, consumer.WithClient(client))...)
+	if err != nil {
+		return nil, err
+	}
+	s.checkpoints = store
+	return &pollingScanner{
+		streamName: streamName,
+		c:          c,
+		client:     client,
+		store:      store,
+		interval:   defaultShardListInterval,
+		leases:     s.leases,
+		onEvent:    s.shardEvent,
+		onList:     s.state.list,
+	}, nil
+}
+
+// checkConsumerOptions fails if one of opts sets the client or the store of the
+// consumer, which would not be the ones the Streamer lists and checkpoints the
+// shards with. The fields of the consumer are unexported so every option is
+// applied alone to an empty one to tell which it sets.
+func checkConsumerOptions(opts []consumer.Option) error {
+	for _, opt := range opts {
+		var c consumer.Consumer
+		opt(&c)
+		v := reflect.ValueOf(c)
+		switch {
+		case !v.FieldByName("client").IsNil():
+			return fmt.Errorf("%w: consumer.WithClient, use WithKinesisClient", ErrConsumerOption)
+		case !v.FieldByName("store").IsNil():
+			return fmt.Errorf("%w: consumer.WithStore, use WithCheckpointStore", ErrConsumerOption)
 		}
-		return &Streamer{c: ctrl.c}, nil
 	}
+	return nil
 }
 
+// shardEvent records e in the status of the Streamer, logs it and passes it to
+// the function of WithShardEvents.
+func (s *Streamer) shardEvent(e ShardEvent) {
+	s.state.shardEvent(e)
+	if e.Type == ShardClosed || e.Type == ShardReleased {
+		// the lag of a shard no longer read would be reported forever
+		metrics.Delete(s.metrics, metrics.MillisBehindLatest, metrics.Labels{"stream": e.StreamName, "shard": e.ShardID})
+	}
+	s.logShardEvent(e)
+	if s.onShardEvent != nil {
+		s.onShardEvent(e)
+	}
+}
+
+// Stream delivers the records of the stream to args until ctx is done, the scan
+// ends or a receiver fails. It then stops scanning, waits for the records read
+// to be delivered and for the receivers to flush for up to the drain timeout and
+// flushes the checkpoint store. A shard is only checkpointed up to the records
+// delivered to every receiver, so the records failed or left by the drain, which
+// a *DrainError lists, are read again.
 func (s Streamer) Stream(ctx context.Context, args ...receivers.Receiver) error {
-	errChan := make(chan error, 1)
+	if s.rateLimits == nil {
+		s.rateLimits = newRateLimits()
+	}
+	if s.state == nil {
+		s.state = newStreamState()
+	}
+	if s.logger == nil {
+		s.logger = logging.Default
+	}
+	if s.tracer == nil {
+		s.tracer = tracing.Tracer(nil)
+	}
+	s.state.start()
+	defer s.state.stop()
+	// receivers and workers outlive ctx to deliver the records already read
+	sendCtx, stopSend := context.WithCancel(valueContext{ctx})
+	defer stopSend()
+	sent := make(chan error, len(args))
 	for _, rec := range args {
 		go func(rec receivers.Receiver) {
-			errChan <- rec.Send(ctx)
+			sent <- rec.Send(sendCtx)
 		}(rec)
 	}
+	workersCtx, stopWorkers := context.WithCancel(valueContext{ctx})
+	defer stopWorkers()
+	errChan := make(chan error, 1)
+	d := s.newDispatcher(args, errChan)
+	d.start(workersCtx)
+	checkpoints := newCheckpointer(s.name, s.checkpoints, func(err error) {
+		d.report(err)
+	})
+	scanCtx, stopScan := context.WithCancel(ctx)
+	defer stopScan()
+	scanned := make(chan error, 1)
 	go func() {
-		sem := semaphore.NewWeighted(int64(maxWorkersForReceivers))
-		errChan <- s.c.Scan(ctx, func(r *consumer.Record) error {
-			for _, rec := range args {
-				if err := sem.Acquire(ctx, 1); err != nil {
-					errChan <- err
-					break
-				}
-				go func(rec receivers.Receiver, data []byte) {
-					defer sem.Release(1)
-					if rec.TranslationRequired() {
-						translated, err := rec.Translate(data)
-						if err != nil {
-							errChan <- fmt.Errorf("receiver service %s error: %v", rec.String(), err)
-							return
-						}
-						if translated != nil {
-							rec.AddMessage(translated)
-						}
-						return
-					}
-					rec.AddMessage(data)
-				}(rec, r.Data)
-				if ctx.Err() != nil {
-					return ctx.Err()
-				}
+		scanned <- s.c.Scan(scanCtx, func(shardID string, r *consumer.Record) error {
+			shardLabels := metrics.Labels{"stream": s.name, "shard": shardID}
+			s.metrics.Add(metrics.RecordsRead, 1, shardLabels)
+			s.metrics.Add(metrics.BytesRead, float64(len(r.Data)), shardLabels)
+			s.state.read(shardID, r)
+			if err := s.waitReadRateLimit(scanCtx, r); err != nil {
+				return err
 			}
-			return ctx.Err() // continue scanning if ctx not done
-		})
+			recordCtx, span := s.startRecordSpan(workersCtx, shardID, r)
+			read := newReadRecord(span, checkpoints.read(shardID, aws.StringValue(r.SequenceNumber)))
+			defer read.done()
+			if err := d.dispatch(scanCtx, recordCtx, read, shardID, r); err != nil {
+				read.fail(err)
+				return err
+			}
+			// the record is checkpointed once delivered
+			return consumer.ErrSkipCheckpoint
+		}, checkpoints.wait)
 	}()
+
+	var err error
+	scanDone := false
+	sendsDone := 0
 	select {
 	case <-ctx.Done():
-		return nil
-	case err := <-errChan:
-		return err
+	case err = <-scanned:
+		scanDone = true
+	case err = <-errChan:
+	case err = <-sent:
+		sendsDone++
 	}
+
+	// stop scanning, then drain the records read and flush the receivers
+	deadline := time.Now().Add(s.drainTimeout)
+	stopScan()
+	if !scanDone {
+		<-scanned
+	}
+	undelivered := d.drain(deadline)
+	stopWorkers()
+	stopSend()
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+flush:
+	for ; sendsDone < len(args); sendsDone++ {
+		select {
+		case sendErr := <-sent:
+			if err == nil {
+				err = sendErr
+			}
+		case <-timeout.C:
+			break flush
+		}
+	}
+	if storeErr := s.closeStore(); err == nil {
+		err = storeErr
+	}
+	if err == nil && len(undelivered) > 0 {
+		err = &DrainError{StreamName: s.name, Undelivered: undelivered}
+	}
+	s.logStop(len(undelivered), err)
+	return err
 }
 
 type Streamers []*Streamer
 
+// NewStreamers creates a Streamer for every stream name in args, concurrently,
+// with the consumer.Option and StreamerOption of args. The Streamers are in the
+// order of the names. If any of them fails a *StreamersError lists every stream
+// which failed.
 func NewStreamers(ctx context.Context, args ...interface{}) (*Streamers, error) {
 	var streamNames []string
-	var opts []consumer.Option
-	var streamers Streamers
+	var opts []StreamerOption
 	for _, arg := range args {
-		switch arg.(type) {
+		switch arg := arg.(type) {
 		case string:
-			if arg.(string) == "" {
+			if arg == "" {
 				continue
 			}
-			streamNames = append(streamNames, arg.(string))
+			streamNames = append(streamNames, arg)
 		case consumer.Option:
-			opts = append(opts, arg.(consumer.Option))
+			opts = append(opts, WithConsumerOptions(arg))
+		case StreamerOption:
+			opts = append(opts, arg)
 		}
 	}
-	g := new(errgroup.Group)
-	locker := new(sync.Mutex)
-	for _, streamName := range streamNames {
-		func(streamName string) {
-			g.Go(func() error {
-				streamer, err := NewStreamer(ctx, streamName, opts...)
-				if err != nil {
-					return err
-				}
-				locker.Lock()
-				defer locker.Unlock()
-				streamers = append(streamers, streamer)
-				return nil
-			})
-		}(streamName)
-	}
-	if err := g.Wait(); err != nil {
+	streamers, err := newStreamers(ctx, streamNames, func(string) []StreamerOption {
+		return opts
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &streamers, nil
 }
 
-func (ss *Streamers) Stream(ctx context.Context, receivers ...receivers.Receiver) error {
+// newStreamers creates a Streamer for every stream of streamNames with the
+// options returned by opts for it.
+func newStreamers(ctx context.Context, streamNames []string, opts func(streamName string) []StreamerOption) (Streamers, error) {
+	streamers := make(Streamers, len(streamNames))
+	errs := make([]error, len(streamNames))
+	var wg sync.WaitGroup
+	for i, streamName := range streamNames {
+		wg.Add(1)
+		go func(i int, streamName string) {
+			defer wg.Done()
+			streamers[i], errs[i] = NewStreamer(ctx, streamName, opts(streamName)...)
+		}(i, streamName)
+	}
+	wg.Wait()
+	var failed []*StreamError
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		var streamErr *StreamError
+		if !errors.As(err, &streamErr) || streamErr.StreamName != streamNames[i] {
+			streamErr = &StreamError{StreamName: streamNames[i], Op: "new streamer", Err: err}
+		}
+		failed = append(failed, streamErr)
+	}
+	if len(failed) > 0 {
+		return nil, &StreamersError{Errors: failed}
+	}
+	return streamers, nil
+}
+
+// Stream streams every Streamer to its receivers, the ones of a StreamersBuilder,
+// and to args.
+func (ss *Streamers) Stream(ctx context.Context, args ...receivers.Receiver) error {
 	g := new(errgroup.Group)
 	for _, streamer := range *ss {
 		func(streamer *Streamer) {
 			g.Go(func() error {
-				if err := streamer.Stream(ctx, receivers...); err != nil {
+				recs := append(streamer.Receivers(), args...)
+				if err := streamer.Stream(ctx, recs...); err != nil {
 					return err
 				}
 				return nil
@@ -0,0 +1,798 @@
+package kinesis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"github.com/nicolasassi/kinestesia/tracing"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/sync/errgroup"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeReceiver collects the messages added and signals done once it has want
+// of them.
+type fakeReceiver struct {
+	name      string
+	translate func(b []byte) ([]byte, error)
+	want      int
+	done      chan struct{}
+
+	mu       sync.Mutex
+	messages []string
+}
+
+func newFakeReceiver(name string, want int, translate func(b []byte) ([]byte, error)) *fakeReceiver {
+	return &fakeReceiver{
+		name:      name,
+		translate: translate,
+		want:      want,
+		done:      make(chan struct{}),
+	}
+}
+
+func (f *fakeReceiver) Send(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeReceiver) AddMessage(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, string(b))
+	if len(f.messages) == f.want {
+		close(f.done)
+	}
+}
+
+func (f *fakeReceiver) Translate(b []byte) ([]byte, error) {
+	return f.translate(b)
+}
+
+func (f *fakeReceiver) TranslationRequired() bool {
+	return f.translate != nil
+}
+
+func (f *fakeReceiver) String() string {
+	return f.name
+}
+
+func (f *fakeReceiver) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	messages := append([]string(nil), f.messages...)
+	sort.Strings(messages)
+	return messages
+}
+
+// fakeRecorder keeps the last value of every measurement by name and labels.
+type fakeRecorder struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newFakeRecorder() *fakeRecorder {
+	return &fakeRecorder{values: map[string]float64{}}
+}
+
+func (f *fakeRecorder) key(name string, labels metrics.Labels) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *fakeRecorder) Add(name string, value float64, labels metrics.Labels) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[f.key(name, labels)] += value
+}
+
+func (f *fakeRecorder) Set(name string, value float64, labels metrics.Labels) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[f.key(name, labels)] = value
+}
+
+func (f *fakeRecorder) Observe(name string, value float64, labels metrics.Labels) {
+	f.Add(name, value, labels)
+}
+
+func (f *fakeRecorder) Delete(name string, labels metrics.Labels) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.values, f.key(name, labels))
+}
+
+func (f *fakeRecorder) value(name string, labels metrics.Labels) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.values[f.key(name, labels)]
+}
+
+func (f *fakeRecorder) has(name string, labels metrics.Labels) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.values[f.key(name, labels)]
+	return ok
+}
+
+func TestStreamer_StreamMetrics(t *testing.T) {
+	api := &fakeKinesis{
+		shards:  []*kinesis.Shard{shard("s1", "", ""), shard("s2", "", "")},
+		records: map[string][]string{"s1": {"a", "drop", "b"}, "s2": {"c"}},
+	}
+	recorder := newFakeRecorder()
+	s := newTestStreamer(t, api, WithMetrics(recorder))
+	raw := newFakeReceiver("raw", 4, nil)
+	filtered := newFakeReceiver("filtered", 3, func(b []byte) ([]byte, error) {
+		if string(b) == "drop" {
+			return nil, nil
+		}
+		return []byte(strings.ToUpper(string(b))), nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-raw.done
+		<-filtered.done
+		cancel()
+	}()
+	if err := s.Stream(ctx, raw, filtered); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	if got, want := fmt.Sprint(raw.received()), "[a b c drop]"; got != want {
+		t.Errorf("raw received = %v, want %v", got, want)
+	}
+	if got, want := fmt.Sprint(filtered.received()), "[A B C]"; got != want {
+		t.Errorf("filtered received = %v, want %v", got, want)
+	}
+	tests := []struct {
+		name   string
+		labels metrics.Labels
+		want   float64
+	}{
+		{metrics.RecordsRead, metrics.Labels{"stream": "stream", "shard": "s1"}, 3},
+		{metrics.RecordsRead, metrics.Labels{"stream": "stream", "shard": "s2"}, 1},
+		{metrics.BytesRead, metrics.Labels{"stream": "stream", "shard": "s1"}, 6},
+		{metrics.FilterDrops, metrics.Labels{"stream": "stream", "receiver": "filtered"}, 1},
+		{metrics.MillisBehindLatest, metrics.Labels{"stream": "stream", "shard": "s1"}, 0},
+		{metrics.WorkersLimit, metrics.Labels{"stream": "stream"}, maxWorkersForReceivers},
+	}
+	for _, tt := range tests {
+		if got := recorder.value(tt.name, tt.labels); got != tt.want {
+			t.Errorf("%v%v = %v, want %v", tt.name, tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestStreamer_StreamDeletesClosedShardLag(t *testing.T) {
+	api := &fakeKinesis{
+		shards:  []*kinesis.Shard{shard("p", "", ""), shard("c", "p", "")},
+		records: map[string][]string{"p": {"p1"}, "c": {"c1"}},
+		closed:  map[string]bool{"p": true},
+	}
+	recorder := newFakeRecorder()
+	got := scanStreamer(t, newTestStreamer(t, api, WithMetrics(recorder)), 2)
+	if want := "[p1 c1]"; fmt.Sprint(got) != want {
+		t.Fatalf("Scan() got = %v, want %v", got, want)
+	}
+	if recorder.has(metrics.MillisBehindLatest, metrics.Labels{"stream": "stream", "shard": "p"}) {
+		t.Errorf("lag of the closed shard p is still reported")
+	}
+	if !recorder.has(metrics.MillisBehindLatest, metrics.Labels{"stream": "stream", "shard": "c"}) {
+		t.Errorf("lag of the open shard c is not reported")
+	}
+}
+
+func TestStreamer_StreamTranslationFailure(t *testing.T) {
+	api := &fakeKinesis{
+		shards:  []*kinesis.Shard{shard("s1", "", "")},
+		records: map[string][]string{"s1": {"a"}},
+	}
+	recorder := newFakeRecorder()
+	s := newTestStreamer(t, api, WithMetrics(recorder))
+	failing := newFakeReceiver("failing", 1, func(b []byte) ([]byte, error) {
+		return nil, fmt.Errorf("invalid JSON")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stream(ctx, failing); err == nil {
+		t.Fatalf("Stream() error = nil, want translation error")
+	}
+	labels := metrics.Labels{"stream": "stream", "receiver": "failing"}
+	if got := recorder.value(metrics.TranslationFailures, labels); got != 1 {
+		t.Errorf("%v = %v, want 1", metrics.TranslationFailures, got)
+	}
+}
+
+// contextReceiver is a fakeReceiver which keeps the trace context of each message.
+type contextReceiver struct {
+	*fakeReceiver
+	traceparents []string
+}
+
+func (c *contextReceiver) AddMessageContext(ctx context.Context, b []byte) {
+	c.mu.Lock()
+	c.traceparents = append(c.traceparents, tracing.Inject(ctx, nil)[tracing.TraceparentKey])
+	c.mu.Unlock()
+	c.AddMessage(b)
+}
+
+func TestStreamer_StreamTracing(t *testing.T) {
+	payload := `{"traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}`
+	api := &fakeKinesis{
+		shards:  []*kinesis.Shard{shard("s1", "", "")},
+		records: map[string][]string{"s1": {payload}},
+	}
+	recorder := tracetest.NewSpanRecorder()
+	s := newTestStreamer(t, api, WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))))
+	rec := &contextReceiver{fakeReceiver: newFakeReceiver("traced", 1, func(b []byte) ([]byte, error) {
+		return b, nil
+	})}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-rec.done
+		cancel()
+	}()
+	if err := s.Stream(ctx, rec); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	read, ok := spans["kinesis.read"]
+	if !ok {
+		t.Fatalf("spans got = %v, want kinesis.read", recorder.Ended())
+	}
+	if read.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || read.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("kinesis.read = %v/%v, want child of the payload traceparent", read.SpanContext().TraceID(), read.Parent().SpanID())
+	}
+	attributes := map[string]string{}
+	for _, kv := range read.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attributes["shard"] != "s1" || attributes["sequence_number"] != payload {
+		t.Errorf("kinesis.read attributes = %v", attributes)
+	}
+	for _, name := range []string{"receiver.translate", "receiver.deliver"} {
+		if spans[name].Parent().SpanID() != read.SpanContext().SpanID() {
+			t.Errorf("%v parent = %v, want %v", name, spans[name].Parent().SpanID(), read.SpanContext().SpanID())
+		}
+	}
+	if deliver := spans["receiver.deliver"]; read.EndTime().Before(deliver.EndTime()) {
+		t.Errorf("kinesis.read ended at %v before the delivery at %v", read.EndTime(), deliver.EndTime())
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	deliverSC := spans["receiver.deliver"].SpanContext()
+	if want := fmt.Sprintf("00-%s-%s-01", deliverSC.TraceID(), deliverSC.SpanID()); len(rec.traceparents) != 1 || rec.traceparents[0] != want {
+		t.Errorf("AddMessageContext() traceparents = %v, want %v", rec.traceparents, want)
+	}
+}
+
+func TestStreamer_StreamTracingFailure(t *testing.T) {
+	api := &fakeKinesis{
+		shards:  []*kinesis.Shard{shard("s1", "", "")},
+		records: map[string][]string{"s1": {"a"}},
+	}
+	recorder := tracetest.NewSpanRecorder()
+	s := newTestStreamer(t, api, WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))))
+	rec := &failingReceiver{fakeReceiver: newFakeReceiver("rec", 1, nil), fail: func(b []byte) error {
+		return errors.New("down")
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stream(ctx, rec); err == nil {
+		t.Fatalf("Stream() should fail with the delivery error")
+	}
+	for _, span := range recorder.Ended() {
+		if span.Name() == "kinesis.read" {
+			if span.Status().Code != codes.Error || span.Status().Description != "down" {
+				t.Errorf("kinesis.read status = %+v, want the delivery error", span.Status())
+			}
+			return
+		}
+	}
+	t.Errorf("kinesis.read did not end, spans = %v", recorder.Ended())
+}
+
+// sliceScanner scans the records of every shard in parallel as fast as fn
+// returns and then waits for ctx to be done.
+type sliceScanner map[string][]string
+
+func (s sliceScanner) Scan(ctx context.Context, fn recordFunc, closed shardFunc) error {
+	g := new(errgroup.Group)
+	for shardID, records := range s {
+		shardID, records := shardID, records
+		g.Go(func() error {
+			for _, data := range records {
+				if err := fn(shardID, &consumer.Record{Data: []byte(data)}); err != nil && err != consumer.ErrSkipCheckpoint {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// blockingReceiver is a fakeReceiver whose AddMessage calls wait first.
+type blockingReceiver struct {
+	*fakeReceiver
+	wait func()
+}
+
+func (b *blockingReceiver) AddMessage(data []byte) {
+	b.wait()
+	b.fakeReceiver.AddMessage(data)
+}
+
+func TestStreamer_StreamShardOrderedDelivery(t *testing.T) {
+	records := sliceScanner{}
+	for _, shardID := range []string{"s1", "s2", "s3"} {
+		for i := 0; i < 50; i++ {
+			records[shardID] = append(records[shardID], fmt.Sprintf("%s:%03d", shardID, i))
+		}
+	}
+	var n int64
+	rec := &blockingReceiver{fakeReceiver: newFakeReceiver("ordered", 150, nil), wait: func() {
+		// delay every other message to reorder unordered deliveries
+		if atomic.AddInt64(&n, 1)%2 == 0 {
+			time.Sleep(100 * time.Microsecond)
+		}
+	}}
+	s := Streamer{
+		name:            "stream",
+		c:               records,
+		metrics:         metrics.Discard,
+		deliveryMode:    ShardOrderedDelivery,
+		receiverConfigs: map[string]ReceiverConfig{"ordered": {Workers: 4}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-rec.done
+		cancel()
+	}()
+	if err := s.Stream(ctx, rec); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.messages) != 150 {
+		t.Fatalf("received %v messages, want 150", len(rec.messages))
+	}
+	last := map[string]string{}
+	for _, m := range rec.messages {
+		shardID := strings.Split(m, ":")[0]
+		if m < last[shardID] {
+			t.Errorf("received %v after %v", m, last[shardID])
+		}
+		last[shardID] = m
+	}
+}
+
+func TestStreamer_StreamReceiverIsolation(t *testing.T) {
+	// the slow receiver gets 2 of the workers and queues 2 records, which
+	// neither pauses the scan nor takes the workers of the fast one
+	records := sliceScanner{"s1": {"a", "b", "c", "d"}}
+	release := make(chan struct{})
+	slow := &blockingReceiver{fakeReceiver: newFakeReceiver("slow", 4, nil), wait: func() {
+		<-release
+	}}
+	fast := newFakeReceiver("fast", 4, nil)
+	s := newTestStreamer(t, &fakeKinesis{}, WithWorkers(4))
+	s.c = records
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		// the slow receiver only moves once the fast one got every record
+		<-fast.done
+		close(release)
+		<-slow.done
+		cancel()
+	}()
+	if err := s.Stream(ctx, slow, fast); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("Stream() ended with %v, want every record delivered", ctx.Err())
+	}
+	if got, want := fmt.Sprint(slow.received()), "[a b c d]"; got != want {
+		t.Errorf("slow received = %v, want %v", got, want)
+	}
+}
+
+func TestStreamer_StreamOpenBreakerIsolation(t *testing.T) {
+	records := sliceScanner{"s1": {"a", "b", "c", "d"}}
+	// the broken receiver could take every worker, which it gives back while
+	// its breaker is open
+	broken := receivers.NewRetryReceiver(&failingReceiver{fakeReceiver: newFakeReceiver("broken", -1, nil), fail: func(b []byte) error {
+		return errors.New("unavailable")
+	}}, receivers.RetryPolicy{
+		MaxAttempts:      100,
+		InitialBackoff:   time.Millisecond,
+		FailureThreshold: 1,
+		OpenTimeout:      time.Hour,
+	})
+	fast := newFakeReceiver("fast", 4, nil)
+	s := newTestStreamer(t, &fakeKinesis{}, WithWorkers(2), WithDrainTimeout(10*time.Millisecond),
+		WithReceiverConfig("broken", ReceiverConfig{Workers: 2}))
+	s.c = records
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-fast.done
+		cancel()
+	}()
+	var drainErr *DrainError
+	if err := s.Stream(ctx, broken, fast); err != nil && !errors.As(err, &drainErr) {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	if got, want := fmt.Sprint(fast.received()), "[a b c d]"; got != want {
+		t.Errorf("fast received = %v, want %v", got, want)
+	}
+}
+
+// BenchmarkStreamer_SlowReceiver measures how long a fast receiver takes to get
+// every record while a slow receiver shares the workers.
+func BenchmarkStreamer_SlowReceiver(b *testing.B) {
+	benchmarks := []struct {
+		name        string
+		slowWorkers int
+	}{
+		{"fairShare", 0},
+		{"isolated", 2},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			records := sliceScanner{}
+			for i := 0; i < b.N; i++ {
+				shardID := fmt.Sprintf("s%d", i%4)
+				records[shardID] = append(records[shardID], strconv.Itoa(i))
+			}
+			slow := &blockingReceiver{fakeReceiver: newFakeReceiver("slow", b.N, nil), wait: func() {
+				time.Sleep(time.Millisecond)
+			}}
+			fast := newFakeReceiver("fast", b.N, nil)
+			s := Streamer{
+				name:    "stream",
+				c:       records,
+				metrics: metrics.Discard,
+				workers: 8,
+				// the slow receiver gets its records once the fast one is done
+				drainTimeout: time.Minute,
+				// the queues take every record so scanning never waits for the slow receiver
+				receiverConfigs: map[string]ReceiverConfig{
+					"slow": {Workers: bm.slowWorkers, QueueSize: b.N},
+					"fast": {QueueSize: b.N},
+				},
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			start := time.Now()
+			fastElapsed := make(chan time.Duration, 1)
+			go func() {
+				<-fast.done
+				fastElapsed <- time.Since(start)
+				cancel()
+			}()
+			b.ResetTimer()
+			if err := s.Stream(ctx, slow, fast); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64((<-fastElapsed).Nanoseconds())/float64(b.N), "fast-ns/record")
+		})
+	}
+}
+
+// keyedReceiver is a fakeReceiver which keeps the ordering key of each message.
+type keyedReceiver struct {
+	*fakeReceiver
+	wait func()
+	keys []string
+}
+
+func (k *keyedReceiver) AddMessageContext(ctx context.Context, b []byte) {
+	k.wait()
+	k.mu.Lock()
+	k.keys = append(k.keys, receivers.OrderingKey(ctx))
+	k.mu.Unlock()
+	k.AddMessage(b)
+}
+
+func TestStreamer_StreamKeyOrderedDelivery(t *testing.T) {
+	records := sliceScanner{}
+	for i := 0; i < 120; i++ {
+		records["s1"] = append(records["s1"], fmt.Sprintf(`{"entity":{"id":"e%d"},"seq":"%03d"}`, i%6, i))
+	}
+	var n int64
+	rec := &keyedReceiver{fakeReceiver: newFakeReceiver("keyed", 120, nil), wait: func() {
+		if atomic.AddInt64(&n, 1)%3 == 0 {
+			time.Sleep(100 * time.Microsecond)
+		}
+	}}
+	s := newTestStreamer(t, &fakeKinesis{}, WithDeliveryMode(KeyOrderedDelivery),
+		WithOrderingKey(FieldOrderingKey("entity.id")), WithReceiverConfig("keyed", ReceiverConfig{Workers: 4}))
+	s.c = records
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-rec.done
+		cancel()
+	}()
+	if err := s.Stream(ctx, rec); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.messages) != 120 {
+		t.Fatalf("received %v messages, want 120", len(rec.messages))
+	}
+	last := map[string]string{}
+	for i, m := range rec.messages {
+		var payload struct {
+			Entity struct {
+				ID string `json:"id"`
+			} `json:"entity"`
+		}
+		if err := json.Unmarshal([]byte(m), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if rec.keys[i] != payload.Entity.ID {
+			t.Errorf("ordering key of %v = %v, want %v", m, rec.keys[i], payload.Entity.ID)
+		}
+		if m < last[payload.Entity.ID] {
+			t.Errorf("received %v after %v", m, last[payload.Entity.ID])
+		}
+		last[payload.Entity.ID] = m
+	}
+}
+
+func TestFieldOrderingKey(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		data string
+		want string
+	}{
+		{"nested", "entity.id", `{"entity":{"id":"e1"}}`, "e1"},
+		{"number", "id", `{"id":42}`, "42"},
+		{"index", "contacts.[1].id", `{"contacts":[{"id":"c0"},{"id":"c1"}]}`, "c1"},
+		{"missing", "entity.id", `{"other":1}`, "partition"},
+		{"notJSON", "entity.id", `entity`, "partition"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &consumer.Record{Data: []byte(tt.data), PartitionKey: aws.String("partition")}
+			if got := FieldOrderingKey(tt.path)("s1", r); got != tt.want {
+				t.Errorf("FieldOrderingKey() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// failingReceiver is a fakeReceiver whose deliveries fail with fail before
+// the message is added.
+type failingReceiver struct {
+	*fakeReceiver
+	fail func(b []byte) error
+}
+
+func (f *failingReceiver) Deliver(ctx context.Context, b []byte) error {
+	if err := f.fail(b); err != nil {
+		return err
+	}
+	f.AddMessage(b)
+	return nil
+}
+
+func TestStreamer_StreamRetry(t *testing.T) {
+	records := sliceScanner{"s1": {"a", "b", "c"}}
+	var attempts int64
+	rec := &failingReceiver{fakeReceiver: newFakeReceiver("flaky", 3, nil), fail: func(b []byte) error {
+		// every other attempt fails
+		if atomic.AddInt64(&attempts, 1)%2 == 1 {
+			return fmt.Errorf("unavailable")
+		}
+		return nil
+	}}
+	s := newTestStreamer(t, &fakeKinesis{}, WithReceiverConfig("flaky", ReceiverConfig{Workers: 1}))
+	s.c = records
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-rec.done
+		cancel()
+	}()
+	retrying := receivers.NewRetryReceiver(rec, receivers.RetryPolicy{InitialBackoff: time.Millisecond})
+	if err := s.Stream(ctx, retrying); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	if got, want := fmt.Sprint(rec.received()), "[a b c]"; got != want {
+		t.Errorf("received = %v, want %v", got, want)
+	}
+
+	// without retries the first failure ends the stream
+	atomic.StoreInt64(&attempts, 0)
+	rec = &failingReceiver{fakeReceiver: newFakeReceiver("flaky", 3, nil), fail: rec.fail}
+	s.c = sliceScanner{"s1": {"a"}}
+	if err := s.Stream(context.Background(), rec); err == nil {
+		t.Errorf("Stream() error = nil, want the delivery error")
+	}
+}
+
+func TestStreamer_StreamDeadLetter(t *testing.T) {
+	rec := &failingReceiver{fakeReceiver: newFakeReceiver("failing", 2, nil), fail: func(b []byte) error {
+		if string(b) == "b" {
+			return fmt.Errorf("unavailable")
+		}
+		return nil
+	}}
+	deadLetters := newFakeReceiver("dead letters", 1, nil)
+	s := newTestStreamer(t, &fakeKinesis{}, WithReceiverConfig("failing", ReceiverConfig{Workers: 1}))
+	s.c = sliceScanner{"s1": {"a", "b", "c"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-rec.done
+		<-deadLetters.done
+		cancel()
+	}()
+	retrying := receivers.NewRetryReceiver(rec, receivers.RetryPolicy{
+		InitialBackoff: time.Millisecond,
+		DeadLetter:     receivers.DeadLetterTo(deadLetters),
+	})
+	// the failed record goes to the dead letters instead of ending the stream
+	if err := s.Stream(ctx, retrying); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	if got, want := fmt.Sprint(rec.received(), deadLetters.received()), "[a c] [b]"; got != want {
+		t.Errorf("received = %v, want %v", got, want)
+	}
+}
+
+func TestStreamer_StreamSample(t *testing.T) {
+	var records []string
+	wantSampled := 0
+	for i := 0; i < 200; i++ {
+		id := "k" + strconv.Itoa(i%50)
+		records = append(records, `{"id":"`+id+`"}`)
+		if receivers.InSample(id, 0.3) {
+			wantSampled++
+		}
+	}
+	recorder := newFakeRecorder()
+	s := newTestStreamer(t, &fakeKinesis{}, WithMetrics(recorder), WithReceiverConfig("shadow", ReceiverConfig{
+		Sample: &SampleConfig{Rate: 0.3, Key: FieldOrderingKey("id")},
+	}))
+	s.c = sliceScanner{"s1": records}
+	shadow := newFakeReceiver("shadow", wantSampled, nil)
+	all := newFakeReceiver("all", len(records), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		<-shadow.done
+		<-all.done
+		cancel()
+	}()
+	if err := s.Stream(ctx, shadow, all); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	for _, m := range shadow.received() {
+		var payload struct{ ID string }
+		json.Unmarshal([]byte(m), &payload)
+		if !receivers.InSample(payload.ID, 0.3) {
+			t.Errorf("shadow received %v, which is not in the sample", m)
+		}
+	}
+	if got := len(shadow.received()); got != wantSampled {
+		t.Errorf("shadow received %v records, want %v", got, wantSampled)
+	}
+	sampled := recorder.value(metrics.SampledMessages, metrics.Labels{"receiver": "shadow", "result": "sampled"})
+	skipped := recorder.value(metrics.SampledMessages, metrics.Labels{"receiver": "shadow", "result": "skipped"})
+	if int(sampled) != wantSampled || int(sampled+skipped) != len(records) {
+		t.Errorf("sampled = %v and skipped = %v, want %v of %v", sampled, skipped, wantSampled, len(records))
+	}
+}
+
+// missingKinesis fails to describe the stream as it does not exist.
+type missingKinesis struct {
+	*fakeKinesis
+}
+
+func (f missingKinesis) DescribeStreamSummaryWithContext(ctx aws.Context, input *kinesis.DescribeStreamSummaryInput, opts ...request.Option) (*kinesis.DescribeStreamSummaryOutput, error) {
+	return nil, awserr.New(kinesis.ErrCodeResourceNotFoundException, "stream not found", nil)
+}
+
+func TestNewStreamer(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		api     kinesisiface.KinesisAPI
+		opts    []StreamerOption
+		wantErr error
+	}{
+		{"active", context.Background(), &fakeKinesis{}, nil, nil},
+		{"updating", context.Background(), &fakeKinesis{status: kinesis.StreamStatusUpdating}, nil, nil},
+		{"creating", context.Background(), &fakeKinesis{status: kinesis.StreamStatusCreating}, nil, ErrStreamNotActive},
+		{"notFound", context.Background(), missingKinesis{&fakeKinesis{}}, nil, ErrStreamNotFound},
+		{"validationDisabled", context.Background(), missingKinesis{&fakeKinesis{}}, []StreamerOption{WithStreamValidation(false)}, nil},
+		{"cancelled", cancelled, &fakeKinesis{}, nil, context.Canceled},
+		{"consumerClient", context.Background(), &fakeKinesis{}, []StreamerOption{WithConsumerOptions(consumer.WithClient(&fakeKinesis{}))}, ErrConsumerOption},
+		{"consumerStore", context.Background(), &fakeKinesis{}, []StreamerOption{WithConsumerOptions(consumer.WithScanInterval(time.Millisecond), consumer.WithStore(new(memoryStore)))}, ErrConsumerOption},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStreamer(tt.ctx, "stream", append(tt.opts, WithKinesisClient(tt.api))...)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("NewStreamer() error = %v, want %v", err, tt.wantErr)
+			}
+			if (s == nil) == (err == nil) {
+				t.Errorf("NewStreamer() = %v, %v, want either a Streamer or an error", s, err)
+			}
+		})
+	}
+}
+
+func TestNewStreamers(t *testing.T) {
+	streamers, err := NewStreamers(context.Background(), "a", "b", "c", WithKinesisClient(&fakeKinesis{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range *streamers {
+		names = append(names, s.Name())
+	}
+	if fmt.Sprint(names) != "[a b c]" {
+		t.Errorf("NewStreamers() got = %v, want the streams in order", names)
+	}
+
+	_, err = NewStreamers(context.Background(), "a", "b", "c", WithKinesisClient(missingKinesis{&fakeKinesis{}}))
+	var streamersErr *StreamersError
+	if !errors.As(err, &streamersErr) {
+		t.Fatalf("NewStreamers() error = %v, want a StreamersError", err)
+	}
+	if got := fmt.Sprint(streamersErr.Streams()); got != "[a b c]" {
+		t.Errorf("StreamersError.Streams() got = %v, want every stream", got)
+	}
+	if !errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("NewStreamers() error = %v, want ErrStreamNotFound", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	streamers, err = NewStreamers(ctx, "a", WithKinesisClient(&fakeKinesis{}))
+	if streamers != nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("NewStreamers() = %v, %v, want the error of the context", streamers, err)
+	}
+}
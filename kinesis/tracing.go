@@ -0,0 +1,45 @@
+package kinesis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	consumer "github.com/harlow/kinesis-consumer"
+	"github.com/nicolasassi/kinestesia/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// WithTracerProvider sets the TracerProvider of the spans of every record
+// streamed. The default is the global TracerProvider of OpenTelemetry.
+func WithTracerProvider(tp trace.TracerProvider) StreamerOption {
+	return func(s *Streamer) {
+		s.tracer = tracing.Tracer(tp)
+	}
+}
+
+// startRecordSpan starts the span of r read from shardID. Kinesis records have
+// no attributes so the trace context is taken from the traceparent field of a
+// JSON payload, when present.
+func (s Streamer) startRecordSpan(ctx context.Context, shardID string, r *consumer.Record) (context.Context, trace.Span) {
+	if bytes.Contains(r.Data, []byte(tracing.TraceparentKey)) {
+		var payload struct {
+			Traceparent string `json:"traceparent"`
+		}
+		if err := json.Unmarshal(r.Data, &payload); err == nil {
+			ctx = tracing.Extract(ctx, map[string]string{tracing.TraceparentKey: payload.Traceparent})
+		}
+	}
+	attributes := []attribute.KeyValue{
+		attribute.String("stream", s.name),
+		attribute.String("shard", shardID),
+		attribute.String("sequence_number", aws.StringValue(r.SequenceNumber)),
+		attribute.String("partition_key", aws.StringValue(r.PartitionKey)),
+	}
+	if r.ApproximateArrivalTimestamp != nil {
+		attributes = append(attributes, attribute.String("approximate_arrival", r.ApproximateArrivalTimestamp.UTC().Format(time.RFC3339Nano)))
+	}
+	return s.tracer.Start(ctx, "kinesis.read", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attributes...))
+}
@@ -0,0 +1,249 @@
+// Package logging is the structured logging of kinestesia. Streamers, clients
+// and receivers log events through a Logger, which adapters connect to the
+// standard log package, log/slog, zap or logrus.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Messages of the events logged by kinestesia.
+const (
+	// ShardStarted is logged when a shard starts being read.
+	// Fields: stream, shard.
+	ShardStarted = "shard started"
+	// ShardStopped is logged when a shard stops being read because it was read
+	// until its end or its lease was taken. Fields: stream, shard, reason.
+	ShardStopped = "shard stopped"
+	// TranslationFailed is logged when a receiver fails to translate a record.
+	// Fields: stream, shard, receiver, sequence_number, partition_key, error.
+	TranslationFailed = "translation failed"
+	// DeliveryFailed is logged when a receiver fails to deliver a message.
+	// Fields: receiver, bytes, duration, error.
+	DeliveryFailed = "delivery failed"
+	// PublishFailed is logged when a message fails to be published to a topic.
+	// Fields: receiver, topic, error.
+	PublishFailed = "publish failed"
+	// BackpressureEngaged is logged when scanning starts pausing for the
+	// in-flight limits of a receiver. Fields: stream, receiver, records, bytes.
+	BackpressureEngaged = "backpressure engaged"
+	// BackpressureReleased is logged when scanning stops pausing for the
+	// in-flight limits of a receiver. Fields: stream, receiver.
+	BackpressureReleased = "backpressure released"
+	// DedupFailed is logged when the dedup store of a receiver fails, which
+	// delivers the record. Fields: stream, unless logged by the receivers.Dedup
+	// middleware, receiver, error.
+	DedupFailed = "dedup store failed"
+	// BreakerChanged is logged when the circuit breaker of a receiver changes its
+	// state. Fields: receiver, state, failures.
+	BreakerChanged = "circuit breaker changed"
+	// CredentialsRefreshFailed is logged when credentials fail to be refreshed.
+	// Fields: error.
+	CredentialsRefreshFailed = "credentials refresh failed"
+	// StreamStopped is logged when a Streamer stops streaming.
+	// Fields: stream, undelivered, error.
+	StreamStopped = "stream stopped"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// Fields are the values of an event by key.
+type Fields map[string]interface{}
+
+// Logger logs events. It must be safe for concurrent use.
+type Logger interface {
+	Log(level Level, msg string, fields Fields)
+}
+
+// Discard is a Logger which drops every event.
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Log(level Level, msg string, fields Fields) {}
+
+// Default is the Logger used when none is set. It logs the warnings and errors
+// with the standard logger.
+var Default = WithLevel(NewStdLogger(nil), LevelWarn)
+
+// NewStdLogger logs with l, or with the standard logger if l is nil, in the
+// logfmt format:
+//
+//	level=warn msg="backpressure engaged" receiver=pubsub stream=orders
+//
+// Fields are sorted by key.
+func NewStdLogger(l *log.Logger) Logger {
+	output := log.Output
+	if l != nil {
+		output = l.Output
+	}
+	return stdLogger{output: output}
+}
+
+type stdLogger struct {
+	output func(calldepth int, s string) error
+}
+
+func (l stdLogger) Log(level Level, msg string, fields Fields) {
+	var b strings.Builder
+	b.WriteString("level=")
+	b.WriteString(level.String())
+	b.WriteString(" msg=")
+	b.WriteString(quote(msg))
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(" ")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(quote(fmt.Sprint(fields[k])))
+	}
+	l.output(2, b.String())
+}
+
+// quote quotes s if it is empty or has spaces, quotes or equal signs.
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// WithLevel drops the events of l below min.
+func WithLevel(l Logger, min Level) Logger {
+	return leveled{l: l, min: min}
+}
+
+type leveled struct {
+	l   Logger
+	min Level
+}
+
+func (l leveled) Log(level Level, msg string, fields Fields) {
+	if level >= l.min {
+		l.l.Log(level, msg, fields)
+	}
+}
+
+// With adds fields to every event of l. The fields of an event take precedence.
+func With(l Logger, fields Fields) Logger {
+	if w, ok := l.(with); ok {
+		return with{l: w.l, fields: merge(w.fields, fields)}
+	}
+	return with{l: l, fields: fields}
+}
+
+type with struct {
+	l      Logger
+	fields Fields
+}
+
+func (w with) Log(level Level, msg string, fields Fields) {
+	w.l.Log(level, msg, merge(w.fields, fields))
+}
+
+func merge(base, fields Fields) Fields {
+	merged := make(Fields, len(base)+len(fields))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return merged
+}
+
+const defaultSampleInterval = time.Second
+
+// SampleConfig sets how the events of a noisy Logger are sampled.
+type SampleConfig struct {
+	// Interval is the period over which events are counted. The default is 1
+	// second.
+	Interval time.Duration
+	// First events of every level and message in an interval are logged.
+	First int
+	// Thereafter every Thereafter-th event of a level and message in an interval
+	// is logged after the first ones. Zero drops them.
+	Thereafter int
+}
+
+// Sample logs a sample of the events of l with the same level and message, as
+// a TranslationFailed for every record of a malformed batch.
+func Sample(l Logger, cfg SampleConfig) Logger {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultSampleInterval
+	}
+	return &sampler{l: l, cfg: cfg, now: time.Now, counts: map[sampleKey]*sampleCount{}}
+}
+
+type sampleKey struct {
+	level Level
+	msg   string
+}
+
+type sampleCount struct {
+	start time.Time
+	n     int
+}
+
+type sampler struct {
+	l   Logger
+	cfg SampleConfig
+	now func() time.Time
+
+	mu     sync.Mutex
+	counts map[sampleKey]*sampleCount
+}
+
+func (s *sampler) Log(level Level, msg string, fields Fields) {
+	if s.sampled(sampleKey{level: level, msg: msg}) {
+		s.l.Log(level, msg, fields)
+	}
+}
+
+func (s *sampler) sampled(key sampleKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	c, ok := s.counts[key]
+	if !ok || now.Sub(c.start) >= s.cfg.Interval {
+		c = &sampleCount{start: now}
+		s.counts[key] = c
+	}
+	c.n++
+	if c.n <= s.cfg.First {
+		return true
+	}
+	return s.cfg.Thereafter > 0 && (c.n-s.cfg.First)%s.cfg.Thereafter == 0
+}
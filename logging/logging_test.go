@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0))
+	l.Log(LevelWarn, BackpressureEngaged, Fields{"stream": "orders", "error": errors.New("a b"), "empty": ""})
+	want := `level=warn msg="backpressure engaged" empty="" error="a b" stream=orders` + "\n"
+	if buf.String() != want {
+		t.Errorf("NewStdLogger() logged %q, want %q", buf.String(), want)
+	}
+}
+
+func TestWithLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := WithLevel(NewStdLogger(log.New(&buf, "", 0)), LevelWarn)
+	l.Log(LevelInfo, "info", nil)
+	l.Log(LevelWarn, "warn", nil)
+	l.Log(LevelError, "error", nil)
+	if got := strings.Count(buf.String(), "\n"); got != 2 {
+		t.Errorf("WithLevel() logged %q, want the warning and the error", buf.String())
+	}
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	l := With(With(NewStdLogger(log.New(&buf, "", 0)), Fields{"stream": "a", "shard": "s1"}), Fields{"receiver": "r"})
+	l.Log(LevelInfo, "m", Fields{"shard": "s2"})
+	want := "level=info msg=m receiver=r shard=s2 stream=a\n"
+	if buf.String() != want {
+		t.Errorf("With() logged %q, want %q", buf.String(), want)
+	}
+}
+
+type countingLogger map[string]int
+
+func (c countingLogger) Log(level Level, msg string, fields Fields) {
+	c[level.String()+" "+msg]++
+}
+
+func TestSample(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  SampleConfig
+		want int
+	}{
+		{"first only", SampleConfig{First: 3}, 3},
+		{"first and thereafter", SampleConfig{First: 2, Thereafter: 4}, 4},
+		{"thereafter only", SampleConfig{Thereafter: 5}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts := countingLogger{}
+			now := time.Unix(0, 0)
+			s := Sample(counts, tt.cfg).(*sampler)
+			s.now = func() time.Time { return now }
+			for i := 0; i < 10; i++ {
+				s.Log(LevelError, TranslationFailed, nil)
+			}
+			s.Log(LevelInfo, ShardStarted, nil)
+			if got := counts["error "+TranslationFailed]; got != tt.want {
+				t.Errorf("logged %v, want %v", got, tt.want)
+			}
+			if got := counts["info "+ShardStarted]; got != 1 && tt.cfg.First > 0 {
+				t.Errorf("other message logged %v, want 1", got)
+			}
+			now = now.Add(time.Second)
+			s.Log(LevelError, TranslationFailed, nil)
+			if got := counts["error "+TranslationFailed]; tt.cfg.First > 0 && got != tt.want+1 {
+				t.Errorf("logged %v after the interval, want %v", got, tt.want+1)
+			}
+		})
+	}
+}
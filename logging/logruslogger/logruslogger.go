@@ -0,0 +1,30 @@
+// Package logruslogger adapts a logrus logger to a logging.Logger.
+package logruslogger
+
+import (
+	"github.com/nicolasassi/kinestesia/logging"
+	"github.com/sirupsen/logrus"
+)
+
+type logger struct {
+	l logrus.FieldLogger
+}
+
+// New logs the events with l, as a *logrus.Logger or a *logrus.Entry.
+func New(l logrus.FieldLogger) logging.Logger {
+	return logger{l: l}
+}
+
+func (l logger) Log(level logging.Level, msg string, fields logging.Fields) {
+	entry := l.l.WithFields(logrus.Fields(fields))
+	switch {
+	case level <= logging.LevelDebug:
+		entry.Debug(msg)
+	case level == logging.LevelInfo:
+		entry.Info(msg)
+	case level == logging.LevelWarn:
+		entry.Warn(msg)
+	default:
+		entry.Error(msg)
+	}
+}
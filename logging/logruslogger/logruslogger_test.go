@@ -0,0 +1,23 @@
+package logruslogger
+
+import (
+	"github.com/nicolasassi/kinestesia/logging"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	base, hook := test.NewNullLogger()
+	base.SetLevel(logrus.InfoLevel)
+	l := New(base.WithField("app", "kinestesia"))
+	l.Log(logging.LevelDebug, "debug", nil)
+	l.Log(logging.LevelError, logging.TranslationFailed, logging.Fields{"shard": "s1"})
+	if len(hook.AllEntries()) != 1 {
+		t.Fatalf("logged %v, want the error only", hook.AllEntries())
+	}
+	got := hook.LastEntry()
+	if got.Level != logrus.ErrorLevel || got.Message != logging.TranslationFailed || got.Data["shard"] != "s1" || got.Data["app"] != "kinestesia" {
+		t.Errorf("logged %v %q %v", got.Level, got.Message, got.Data)
+	}
+}
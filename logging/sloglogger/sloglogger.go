@@ -0,0 +1,51 @@
+// Package sloglogger adapts a slog.Logger to a logging.Logger. log/slog is in
+// the standard library since Go 1.21, below the go directive of the module, so
+// the package builds without a build constraint.
+package sloglogger
+
+import (
+	"context"
+	"github.com/nicolasassi/kinestesia/logging"
+	"log/slog"
+	"sort"
+)
+
+type logger struct {
+	l *slog.Logger
+}
+
+// New logs the events with l, the fields sorted by key.
+func New(l *slog.Logger) logging.Logger {
+	return logger{l: l}
+}
+
+func (l logger) Log(level logging.Level, msg string, fields logging.Fields) {
+	ctx := context.Background()
+	lvl := slogLevel(level)
+	if !l.l.Enabled(ctx, lvl) {
+		return
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]slog.Attr, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, slog.Any(k, fields[k]))
+	}
+	l.l.LogAttrs(ctx, lvl, msg, attrs...)
+}
+
+func slogLevel(level logging.Level) slog.Level {
+	switch {
+	case level <= logging.LevelDebug:
+		return slog.LevelDebug
+	case level == logging.LevelInfo:
+		return slog.LevelInfo
+	case level == logging.LevelWarn:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
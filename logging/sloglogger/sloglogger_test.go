@@ -0,0 +1,28 @@
+package sloglogger
+
+import (
+	"bytes"
+	"github.com/nicolasassi/kinestesia/logging"
+	"log/slog"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	l := New(slog.New(h))
+	l.Log(logging.LevelDebug, "debug", nil)
+	l.Log(logging.LevelInfo, logging.ShardStarted, logging.Fields{"stream": "orders", "shard": "s1"})
+	want := `level=INFO msg="shard started" shard=s1 stream=orders` + "\n"
+	if buf.String() != want {
+		t.Errorf("logged %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,48 @@
+// Package zaplogger adapts a zap.Logger to a logging.Logger.
+package zaplogger
+
+import (
+	"github.com/nicolasassi/kinestesia/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"sort"
+)
+
+type logger struct {
+	l *zap.Logger
+}
+
+// New logs the events with l, the fields sorted by key.
+func New(l *zap.Logger) logging.Logger {
+	return logger{l: l}
+}
+
+func (l logger) Log(level logging.Level, msg string, fields logging.Fields) {
+	ce := l.l.Check(zapLevel(level), msg)
+	if ce == nil {
+		return
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	zapFields := make([]zap.Field, 0, len(keys))
+	for _, k := range keys {
+		zapFields = append(zapFields, zap.Any(k, fields[k]))
+	}
+	ce.Write(zapFields...)
+}
+
+func zapLevel(level logging.Level) zapcore.Level {
+	switch {
+	case level <= logging.LevelDebug:
+		return zapcore.DebugLevel
+	case level == logging.LevelInfo:
+		return zapcore.InfoLevel
+	case level == logging.LevelWarn:
+		return zapcore.WarnLevel
+	default:
+		return zapcore.ErrorLevel
+	}
+}
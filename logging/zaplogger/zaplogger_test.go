@@ -0,0 +1,27 @@
+package zaplogger
+
+import (
+	"github.com/nicolasassi/kinestesia/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	l := New(zap.New(core))
+	l.Log(logging.LevelDebug, "debug", nil)
+	l.Log(logging.LevelWarn, logging.PublishFailed, logging.Fields{"receiver": "pubsub", "topic": "orders"})
+	entries := logs.AllUntimed()
+	if len(entries) != 1 {
+		t.Fatalf("logged %v, want the warning only", entries)
+	}
+	got := entries[0]
+	if got.Level != zapcore.WarnLevel || got.Message != logging.PublishFailed {
+		t.Errorf("logged %v %q", got.Level, got.Message)
+	}
+	if fields := got.ContextMap(); fields["receiver"] != "pubsub" || fields["topic"] != "orders" {
+		t.Errorf("fields got = %v", fields)
+	}
+}
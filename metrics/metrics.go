@@ -0,0 +1,109 @@
+package metrics
+
+// Names of the metrics recorded by kinestesia.
+const (
+	// MillisBehindLatest is a gauge of how far the reading of a shard is from the
+	// tip of the stream. Labels: stream, shard.
+	MillisBehindLatest = "kinestesia_millis_behind_latest"
+	// RecordsRead counts the records read from Kinesis. Labels: stream, shard.
+	RecordsRead = "kinestesia_records_read_total"
+	// BytesRead counts the bytes of the records read from Kinesis.
+	// Labels: stream, shard.
+	BytesRead = "kinestesia_bytes_read_total"
+	// TranslationFailures counts the records a receiver failed to translate.
+	// Labels: stream, receiver.
+	TranslationFailures = "kinestesia_translation_failures_total"
+	// FilterDrops counts the records dropped by the filter rules of a receiver.
+	// Labels: stream, receiver.
+	FilterDrops = "kinestesia_filter_drops_total"
+	// MessagesPublished counts the messages a receiver published.
+	// Labels: receiver, topic.
+	MessagesPublished = "kinestesia_messages_published_total"
+	// PublishErrors counts the messages a receiver failed to publish.
+	// Labels: receiver, topic.
+	PublishErrors = "kinestesia_publish_errors_total"
+	// PublishLatency is a histogram of the seconds taken to publish a message.
+	// Labels: receiver, topic.
+	PublishLatency = "kinestesia_publish_latency_seconds"
+	// WorkersInUse is a gauge of the workers delivering records to receivers.
+	// Labels: stream.
+	WorkersInUse = "kinestesia_workers_in_use"
+	// WorkersLimit is a gauge of the maximum number of workers delivering records
+	// to receivers. Labels: stream.
+	WorkersLimit = "kinestesia_workers_limit"
+	// InFlightRecords is a gauge of the records of a receiver queued or being
+	// delivered. Labels: stream, receiver.
+	InFlightRecords = "kinestesia_in_flight_records"
+	// InFlightBytes is a gauge of the bytes of the records of a receiver queued or
+	// being delivered. Labels: stream, receiver.
+	InFlightBytes = "kinestesia_in_flight_bytes"
+	// BackpressurePauses counts the times scanning paused for the in-flight
+	// limits of a receiver. Labels: stream, receiver.
+	BackpressurePauses = "kinestesia_backpressure_pauses_total"
+	// BackpressureSeconds counts the seconds scanning was paused for the in-flight
+	// limits of a receiver. Labels: stream, receiver.
+	BackpressureSeconds = "kinestesia_backpressure_seconds_total"
+	// RateLimitSeconds counts the seconds records waited for a rate limit.
+	// Labels: stream, receiver, which is empty for the read rate of the stream.
+	// The stream is empty for the receivers.Throttle middleware.
+	RateLimitSeconds = "kinestesia_rate_limit_seconds_total"
+	// DedupHits counts the duplicated records dropped before a receiver.
+	// Labels: stream, receiver. The stream is empty for the receivers.Dedup
+	// middleware.
+	DedupHits = "kinestesia_dedup_hits_total"
+	// SampledMessages counts the messages of a sampled receiver by result,
+	// sampled or skipped. Labels: receiver, result.
+	SampledMessages = "kinestesia_sampled_messages_total"
+	// DeliveryRetries counts the deliveries to a receiver tried again after
+	// failing. Labels: receiver.
+	DeliveryRetries = "kinestesia_delivery_retries_total"
+	// DeadLetters counts the messages of a receiver given to its dead-letter
+	// function after failing to be delivered. Labels: receiver.
+	DeadLetters = "kinestesia_dead_letters_total"
+	// BreakerState is a gauge of the circuit breaker of a receiver: 0 closed,
+	// 1 half-open and 2 open. Labels: receiver.
+	BreakerState = "kinestesia_breaker_state"
+	// Deliveries counts the messages delivered to a receiver by result, success
+	// or failure. Labels: receiver, result.
+	Deliveries = "kinestesia_deliveries_total"
+	// DeliveryLatency is a histogram of the seconds taken to deliver a message to
+	// a receiver. Labels: receiver.
+	DeliveryLatency = "kinestesia_delivery_latency_seconds"
+)
+
+// Labels qualify a measurement, as the stream or receiver it belongs to.
+type Labels map[string]string
+
+// Recorder receives the measurements. Implementations must be safe for
+// concurrent use.
+type Recorder interface {
+	// Add increases the counter name by value.
+	Add(name string, value float64, labels Labels)
+	// Set sets the gauge name to value.
+	Set(name string, value float64, labels Labels)
+	// Observe adds value to the histogram name.
+	Observe(name string, value float64, labels Labels)
+}
+
+// Deleter is implemented by the Recorders able to remove a series, as the
+// gauges of a shard which is no longer read.
+type Deleter interface {
+	// Delete removes the series of name with exactly labels.
+	Delete(name string, labels Labels)
+}
+
+// Delete removes the series of name with labels from r if it is a Deleter.
+func Delete(r Recorder, name string, labels Labels) {
+	if d, ok := r.(Deleter); ok {
+		d.Delete(name, labels)
+	}
+}
+
+// Discard is a Recorder which ignores every measurement.
+var Discard Recorder = discard{}
+
+type discard struct{}
+
+func (discard) Add(string, float64, Labels)     {}
+func (discard) Set(string, float64, Labels)     {}
+func (discard) Observe(string, float64, Labels) {}
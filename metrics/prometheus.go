@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the histogram buckets.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var help = map[string]string{
+	MillisBehindLatest:  "Milliseconds the reading of a shard is behind the tip of the stream.",
+	RecordsRead:         "Records read from Kinesis.",
+	BytesRead:           "Bytes of the records read from Kinesis.",
+	TranslationFailures: "Records a receiver failed to translate.",
+	FilterDrops:         "Records dropped by the filter rules of a receiver.",
+	MessagesPublished:   "Messages published by a receiver.",
+	PublishErrors:       "Messages a receiver failed to publish.",
+	PublishLatency:      "Seconds taken to publish a message.",
+	WorkersInUse:        "Workers delivering records to receivers.",
+	WorkersLimit:        "Maximum number of workers delivering records to receivers.",
+	InFlightRecords:     "Records of a receiver queued or being delivered.",
+	InFlightBytes:       "Bytes of the records of a receiver queued or being delivered.",
+	BackpressurePauses:  "Times scanning paused for the in-flight limits of a receiver.",
+	BackpressureSeconds: "Seconds scanning was paused for the in-flight limits of a receiver.",
+	RateLimitSeconds:    "Seconds records waited for a rate limit.",
+	DedupHits:           "Duplicated records dropped before a receiver.",
+	SampledMessages:     "Messages of a sampled receiver by result.",
+	DeliveryRetries:     "Deliveries to a receiver tried again after failing.",
+	DeadLetters:         "Messages of a receiver given to its dead-letter function.",
+	BreakerState:        "Circuit breaker of a receiver: 0 closed, 1 half-open, 2 open.",
+	Deliveries:          "Messages delivered to a receiver by result.",
+	DeliveryLatency:     "Seconds taken to deliver a message to a receiver.",
+}
+
+// Prometheus is a Recorder which serves the measurements in the Prometheus text
+// exposition format. It should be mounted at /metrics:
+// http.Handle("/metrics", metrics.NewPrometheus())
+type Prometheus struct {
+	buckets []float64
+
+	mu      sync.Mutex
+	kinds   map[string]string
+	samples map[string]map[string]*sample
+}
+
+type sample struct {
+	labels Labels
+	value  float64
+	// buckets and count are only used by histograms
+	buckets []uint64
+	count   uint64
+}
+
+func NewPrometheus() *Prometheus {
+	return &Prometheus{
+		buckets: DefaultBuckets,
+		kinds:   map[string]string{},
+		samples: map[string]map[string]*sample{},
+	}
+}
+
+// SetBuckets overrides DefaultBuckets. It should be called before any
+// measurement is recorded.
+func (p *Prometheus) SetBuckets(buckets []float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buckets = append([]float64(nil), buckets...)
+	sort.Float64s(p.buckets)
+}
+
+func (p *Prometheus) Add(name string, value float64, labels Labels) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sample("counter", name, labels).value += value
+}
+
+func (p *Prometheus) Set(name string, value float64, labels Labels) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sample("gauge", name, labels).value = value
+}
+
+func (p *Prometheus) Observe(name string, value float64, labels Labels) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.sample("histogram", name, labels)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(p.buckets))
+	}
+	for i, upper := range p.buckets {
+		if value <= upper {
+			s.buckets[i]++
+		}
+	}
+	s.value += value
+	s.count++
+}
+
+func (p *Prometheus) Delete(name string, labels Labels) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.samples[name], formatLabels(labels, "", ""))
+}
+
+// sample returns the series of name with labels creating it if needed.
+// It must be called holding p.mu.
+func (p *Prometheus) sample(kind, name string, labels Labels) *sample {
+	if _, ok := p.kinds[name]; !ok {
+		p.kinds[name] = kind
+		p.samples[name] = map[string]*sample{}
+	}
+	key := formatLabels(labels, "", "")
+	s, ok := p.samples[name][key]
+	if !ok {
+		copied := Labels{}
+		for k, v := range labels {
+			copied[k] = v
+		}
+		s = &sample{labels: copied}
+		p.samples[name][key] = s
+	}
+	return s
+}
+
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	p.write(bw)
+	bw.Flush()
+}
+
+func (p *Prometheus) write(w *bufio.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var names []string
+	for name := range p.kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if h, ok := help[name]; ok {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, h)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, p.kinds[name])
+		var keys []string
+		for key := range p.samples[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := p.samples[name][key]
+			if p.kinds[name] != "histogram" {
+				fmt.Fprintf(w, "%s%s %s\n", name, key, formatValue(s.value))
+				continue
+			}
+			for i, upper := range p.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(s.labels, "le", formatValue(upper)), s.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, key, formatValue(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, key, s.count)
+		}
+	}
+}
+
+// formatLabels returns the labels sorted by name as {name="value",...}.
+// If extraName is not empty it is added as the last label.
+func formatLabels(labels Labels, extraName, extraValue string) string {
+	var names []string
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape(labels[name])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrometheus_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name   string
+		record func(p *Prometheus)
+		want   string
+	}{
+		{"counter", func(p *Prometheus) {
+			p.Add(RecordsRead, 1, Labels{"stream": "orders", "shard": "s1"})
+			p.Add(RecordsRead, 2, Labels{"stream": "orders", "shard": "s1"})
+			p.Add(RecordsRead, 1, Labels{"stream": "orders", "shard": "s0"})
+		}, `# HELP kinestesia_records_read_total Records read from Kinesis.
+# TYPE kinestesia_records_read_total counter
+kinestesia_records_read_total{shard="s0",stream="orders"} 1
+kinestesia_records_read_total{shard="s1",stream="orders"} 3
+`},
+		{"gauge", func(p *Prometheus) {
+			p.Set(WorkersInUse, 4, Labels{"stream": "orders"})
+			p.Set(WorkersInUse, 2, Labels{"stream": "orders"})
+		}, `# HELP kinestesia_workers_in_use Workers delivering records to receivers.
+# TYPE kinestesia_workers_in_use gauge
+kinestesia_workers_in_use{stream="orders"} 2
+`},
+		{"histogram", func(p *Prometheus) {
+			p.SetBuckets([]float64{1, 0.1})
+			p.Observe(PublishLatency, 0.05, Labels{"receiver": "pubsub"})
+			p.Observe(PublishLatency, 0.5, Labels{"receiver": "pubsub"})
+			p.Observe(PublishLatency, 2, Labels{"receiver": "pubsub"})
+		}, `# HELP kinestesia_publish_latency_seconds Seconds taken to publish a message.
+# TYPE kinestesia_publish_latency_seconds histogram
+kinestesia_publish_latency_seconds_bucket{receiver="pubsub",le="0.1"} 1
+kinestesia_publish_latency_seconds_bucket{receiver="pubsub",le="1"} 2
+kinestesia_publish_latency_seconds_bucket{receiver="pubsub",le="+Inf"} 3
+kinestesia_publish_latency_seconds_sum{receiver="pubsub"} 2.55
+kinestesia_publish_latency_seconds_count{receiver="pubsub"} 3
+`},
+		{"deleted", func(p *Prometheus) {
+			p.Set(MillisBehindLatest, 10, Labels{"stream": "orders", "shard": "s1"})
+			p.Set(MillisBehindLatest, 20, Labels{"stream": "orders", "shard": "s2"})
+			p.Delete(MillisBehindLatest, Labels{"shard": "s1", "stream": "orders"})
+			p.Delete(MillisBehindLatest, Labels{"shard": "s3", "stream": "orders"})
+		}, `# HELP kinestesia_millis_behind_latest Milliseconds the reading of a shard is behind the tip of the stream.
+# TYPE kinestesia_millis_behind_latest gauge
+kinestesia_millis_behind_latest{shard="s2",stream="orders"} 20
+`},
+		{"customAndEscaped", func(p *Prometheus) {
+			p.Add("custom_total", 1, Labels{"path": `a"b\c`})
+			p.Add("custom_total", 1, nil)
+		}, `# TYPE custom_total counter
+custom_total 1
+custom_total{path="a\"b\\c"} 1
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPrometheus()
+			tt.record(p)
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			got, err := ioutil.ReadAll(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ServeHTTP() got =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
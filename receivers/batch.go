@@ -0,0 +1,56 @@
+package receivers
+
+import (
+	"context"
+	"github.com/nicolasassi/kinestesia/translator"
+)
+
+// BatchReceiver is a Receiver which takes the messages in batches, as sinks
+// with bulk writes. The Streamer assembles the batches by count, size and
+// linger time.
+type BatchReceiver interface {
+	Receiver
+	// DeliverBatch sends batch and returns the error of each message by index.
+	// A nil slice means every message was delivered. Messages which failed with
+	// a retryable error are sent again in a later batch.
+	DeliverBatch(ctx context.Context, batch [][]byte) []error
+}
+
+// NewBatchAdapter returns a BatchReceiver delivering every message of a batch
+// to rec one at a time.
+func NewBatchAdapter(rec Receiver) BatchReceiver {
+	return &batchAdapter{Receiver: rec, deliver: DeliverTo(rec)}
+}
+
+type batchAdapter struct {
+	Receiver
+	deliver DeliverFunc
+}
+
+func (b *batchAdapter) DeliverBatch(ctx context.Context, batch [][]byte) []error {
+	var errs []error
+	for i, m := range batch {
+		if err := b.deliver(ctx, m); err != nil {
+			if errs == nil {
+				errs = make([]error, len(batch))
+			}
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// Ready checks the adapted Receiver if it is a ReadyReceiver.
+func (b *batchAdapter) Ready(ctx context.Context) error {
+	return readyOf(ctx, b.Receiver)
+}
+
+// Translation returns the Translator of the adapted Receiver, if any.
+func (b *batchAdapter) Translation() *translator.Translator {
+	return translationOf(b.Receiver)
+}
+
+// Unwrap returns the adapted Receiver.
+func (b *batchAdapter) Unwrap() Receiver {
+	return b.Receiver
+}
@@ -0,0 +1,22 @@
+package receivers
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestNewBatchAdapter(t *testing.T) {
+	failed := errors.New("failed")
+	rec := &fakeDeliverer{fail: []error{nil, failed}}
+	errs := NewBatchAdapter(rec).DeliverBatch(context.Background(), [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	if len(errs) != 3 || errs[0] != nil || errs[1] != failed || errs[2] != nil {
+		t.Errorf("DeliverBatch() = %v, want [<nil> %v <nil>]", errs, failed)
+	}
+	if got := rec.attempted(); got != 3 {
+		t.Errorf("attempts = %v, want 3", got)
+	}
+	if errs := NewBatchAdapter(&fakeDeliverer{}).DeliverBatch(context.Background(), [][]byte{[]byte("a")}); errs != nil {
+		t.Errorf("DeliverBatch() = %v, want nil", errs)
+	}
+}
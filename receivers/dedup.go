@@ -0,0 +1,213 @@
+package receivers
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/nicolasassi/kinestesia/logging"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupWindow   = 10 * time.Minute
+	defaultDedupCapacity = 100000
+)
+
+// DedupConfig sets how the Dedup middleware drops the duplicated messages.
+type DedupConfig struct {
+	// Key identifies the duplicates. The default is ContentHash.
+	Key func(b []byte) string
+	// Window is how long a key is remembered. The default is 10 minutes.
+	Window time.Duration
+	// Store remembers the keys. It can be shared by receivers. The default is a
+	// MemoryDedupStore of 100000 keys for the receiver.
+	Store DedupStore
+	// Metrics counts metrics.DedupHits. The default is metrics.Discard.
+	Metrics metrics.Recorder
+	// Logger logs the failures of the store. The default is logging.Default.
+	Logger logging.Logger
+}
+
+// ContentHash is the default key of DedupConfig, the SHA-256 of the message.
+func ContentHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Dedup drops the messages whose key was already delivered within the window,
+// reporting them as delivered. A key is recorded before its message is
+// delivered, dropping the duplicates delivered meanwhile, and forgotten if the
+// delivery fails so the message can be sent again. Messages are delivered when
+// the store fails. The keys of receivers sharing a store are kept apart by the
+// receiver name.
+func Dedup(cfg DedupConfig) Middleware {
+	if cfg.Key == nil {
+		cfg.Key = ContentHash
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaultDedupWindow
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.Discard
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = logging.Default
+	}
+	return func(rec Receiver) Receiver {
+		store := cfg.Store
+		if store == nil {
+			store = NewMemoryDedupStore(defaultDedupCapacity)
+		}
+		return DeliveryMiddleware(func(rec Receiver, next DeliverFunc) DeliverFunc {
+			return func(ctx context.Context, b []byte) error {
+				key := rec.String() + "\x00" + cfg.Key(b)
+				seen, err := store.Seen(ctx, key, cfg.Window)
+				if err != nil {
+					cfg.Logger.Log(logging.LevelWarn, logging.DedupFailed, logging.Fields{"receiver": rec.String(), "error": err})
+					return next(ctx, b)
+				}
+				if seen {
+					cfg.Metrics.Add(metrics.DedupHits, 1, metrics.Labels{"stream": "", "receiver": rec.String()})
+					return nil
+				}
+				if err := next(ctx, b); err != nil {
+					// the message may have been abandoned because ctx is done
+					if forgetErr := store.Forget(context.WithoutCancel(ctx), key); forgetErr != nil {
+						cfg.Logger.Log(logging.LevelWarn, logging.DedupFailed, logging.Fields{"receiver": rec.String(), "error": forgetErr})
+					}
+					return err
+				}
+				return nil
+			}
+		})(rec)
+	}
+}
+
+// DedupStore remembers the keys of the records delivered. Its methods must be
+// safe for concurrent use.
+type DedupStore interface {
+	// Seen records key for window and tells whether it was already recorded
+	// less than window ago.
+	Seen(ctx context.Context, key string, window time.Duration) (bool, error)
+	// Forget removes key, recorded by Seen for a record which was not
+	// delivered.
+	Forget(ctx context.Context, key string) error
+}
+
+// MemoryDedupStore keeps the keys in memory, forgetting the least recently
+// recorded ones beyond its capacity.
+type MemoryDedupStore struct {
+	capacity int
+
+	mu    sync.Mutex
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+func NewMemoryDedupStore(capacity int) *MemoryDedupStore {
+	if capacity <= 0 {
+		capacity = defaultDedupCapacity
+	}
+	return &MemoryDedupStore{
+		capacity: capacity,
+		order:    list.New(),
+		keys:     map[string]*list.Element{},
+	}
+}
+
+func (m *MemoryDedupStore) Seen(ctx context.Context, key string, window time.Duration) (bool, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.keys[key]; ok {
+		entry := e.Value.(*dedupEntry)
+		if now.Before(entry.expires) {
+			return true, nil
+		}
+		entry.expires = now.Add(window)
+		m.order.MoveToFront(e)
+		return false, nil
+	}
+	m.keys[key] = m.order.PushFront(&dedupEntry{key: key, expires: now.Add(window)})
+	for m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.keys, oldest.Value.(*dedupEntry).key)
+	}
+	return false, nil
+}
+
+func (m *MemoryDedupStore) Forget(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.keys[key]; ok {
+		m.order.Remove(e)
+		delete(m.keys, key)
+	}
+	return nil
+}
+
+// SQLDedupStore keeps the keys in a SQL table, so they survive restarts and are
+// shared by the workers of a stream. The statements use PostgreSQL syntax and
+// expect a table created as:
+//
+//	CREATE TABLE <table> (
+//		dedup_key TEXT PRIMARY KEY,
+//		expiration BIGINT NOT NULL
+//	)
+//
+// Expired keys are replaced when seen again. Use DeleteExpired to remove the
+// others.
+type SQLDedupStore struct {
+	db        *sql.DB
+	tableName string
+}
+
+func NewSQLDedupStore(db *sql.DB, tableName string) *SQLDedupStore {
+	return &SQLDedupStore{
+		db:        db,
+		tableName: tableName,
+	}
+}
+
+func (s *SQLDedupStore) Seen(ctx context.Context, key string, window time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		`INSERT INTO %[1]s (dedup_key, expiration) VALUES ($1, $2)
+		ON CONFLICT (dedup_key) DO UPDATE SET expiration = EXCLUDED.expiration
+		WHERE %[1]s.expiration <= $3`,
+		s.tableName), key, now.Add(window).UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 0, nil
+}
+
+func (s *SQLDedupStore) Forget(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		`DELETE FROM %s WHERE dedup_key = $1`,
+		s.tableName), key)
+	return err
+}
+
+// DeleteExpired removes the keys which expired.
+func (s *SQLDedupStore) DeleteExpired(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		`DELETE FROM %s WHERE expiration <= $1`,
+		s.tableName), time.Now().UnixNano())
+	return err
+}
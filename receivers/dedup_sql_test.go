@@ -0,0 +1,50 @@
+package receivers
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"testing"
+	"time"
+)
+
+func TestSQLDedupStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := NewSQLDedupStore(db, "dedup")
+	ctx := context.Background()
+
+	insert := `INSERT INTO dedup \(dedup_key, expiration\) VALUES \(\$1, \$2\)\s+ON CONFLICT \(dedup_key\) DO UPDATE SET expiration = EXCLUDED.expiration\s+WHERE dedup.expiration <= \$3`
+	mock.ExpectExec(insert).
+		WithArgs("a", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if seen, err := store.Seen(ctx, "a", time.Minute); err != nil || seen {
+		t.Errorf("Seen() of a new key = %v, %v, want false", seen, err)
+	}
+	// no row is changed while the key is recorded
+	mock.ExpectExec(insert).
+		WithArgs("a", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if seen, err := store.Seen(ctx, "a", time.Minute); err != nil || !seen {
+		t.Errorf("Seen() of a recorded key = %v, %v, want true", seen, err)
+	}
+
+	mock.ExpectExec(`DELETE FROM dedup WHERE dedup_key = \$1`).
+		WithArgs("a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := store.Forget(ctx, "a"); err != nil {
+		t.Errorf("Forget() error = %v", err)
+	}
+
+	mock.ExpectExec(`DELETE FROM dedup WHERE expiration <= \$1`).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	if err := store.DeleteExpired(ctx); err != nil {
+		t.Errorf("DeleteExpired() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
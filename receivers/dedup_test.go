@@ -0,0 +1,95 @@
+package receivers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryDedupStore_Seen(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryDedupStore(2)
+	steps := []struct {
+		key    string
+		window time.Duration
+		sleep  time.Duration
+		want   bool
+	}{
+		{"a", time.Hour, 0, false},
+		{"a", time.Hour, 0, true},
+		{"b", time.Millisecond, 0, false},
+		{"b", time.Millisecond, 5 * time.Millisecond, false},
+		{"b", time.Hour, 0, true},
+		// c evicts a, the least recently recorded key
+		{"c", time.Hour, 0, false},
+		{"a", time.Hour, 0, false},
+		{"c", time.Hour, 0, true},
+	}
+	for i, step := range steps {
+		time.Sleep(step.sleep)
+		got, err := m.Seen(ctx, step.key, step.window)
+		if err != nil {
+			t.Fatalf("step %d: Seen() error = %v", i, err)
+		}
+		if got != step.want {
+			t.Errorf("step %d: Seen(%q) = %v, want %v", i, step.key, got, step.want)
+		}
+	}
+}
+
+func TestMemoryDedupStore_Forget(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryDedupStore(2)
+	m.Seen(ctx, "a", time.Hour)
+	if err := m.Forget(ctx, "a"); err != nil {
+		t.Fatalf("Forget() error = %v", err)
+	}
+	if err := m.Forget(ctx, "missing"); err != nil {
+		t.Fatalf("Forget() of a missing key error = %v", err)
+	}
+	if seen, _ := m.Seen(ctx, "a", time.Hour); seen {
+		t.Errorf("Seen() of a forgotten key = true, want false")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	store := NewMemoryDedupStore(10)
+	first, second := &fakeDeliverer{}, &namedDeliverer{fakeDeliverer: &fakeDeliverer{}, name: "second"}
+	firstDedup := Chain(first, Dedup(DedupConfig{Store: store})).(Deliverer)
+	secondDedup := Chain(second, Dedup(DedupConfig{Store: store})).(Deliverer)
+	for _, m := range []string{"a", "b", "a"} {
+		if err := firstDedup.Deliver(context.Background(), []byte(m)); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+	if got := first.attempted(); got != 2 {
+		t.Errorf("Deliver() attempts = %v, want the duplicate dropped", got)
+	}
+	// receivers sharing the store keep their keys apart
+	secondDedup.Deliver(context.Background(), []byte("a"))
+	if got := second.attempted(); got != 1 {
+		t.Errorf("Deliver() attempts of the second receiver = %v, want 1", got)
+	}
+	// a message which failed is delivered again
+	second.setFail(errors.New("down"))
+	if err := secondDedup.Deliver(context.Background(), []byte("b")); err == nil {
+		t.Fatalf("Deliver() error = nil, want the delivery error")
+	}
+	if err := secondDedup.Deliver(context.Background(), []byte("b")); err != nil {
+		t.Fatalf("Deliver() again error = %v", err)
+	}
+	if got := second.attempted(); got != 3 {
+		t.Errorf("Deliver() attempts of the second receiver = %v, want 3", got)
+	}
+}
+
+// namedDeliverer is a fakeDeliverer with another name.
+type namedDeliverer struct {
+	*fakeDeliverer
+	name string
+}
+
+func (n *namedDeliverer) String() string {
+	return n.name
+}
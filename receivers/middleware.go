@@ -0,0 +1,165 @@
+package receivers
+
+import (
+	"context"
+	"github.com/nicolasassi/kinestesia/logging"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"github.com/nicolasassi/kinestesia/translator"
+	"log"
+	"time"
+)
+
+// DeliverFunc sends a message and reports its outcome.
+type DeliverFunc func(ctx context.Context, b []byte) error
+
+// DeliverTo returns the DeliverFunc of rec. Messages of receivers which are not
+// a Deliverer are added and reported as delivered.
+func DeliverTo(rec Receiver) DeliverFunc {
+	return func(ctx context.Context, b []byte) error {
+		switch rec := rec.(type) {
+		case Deliverer:
+			return rec.Deliver(ctx, b)
+		case ContextReceiver:
+			rec.AddMessageContext(ctx, b)
+		default:
+			rec.AddMessage(b)
+		}
+		return nil
+	}
+}
+
+// Middleware wraps a Receiver adding behavior around the delivery of its
+// messages, as retries or metrics.
+type Middleware func(Receiver) Receiver
+
+// Chain wraps rec with mws. The first middleware is the outermost one: a
+// message goes through mws in order before reaching rec, and its outcome comes
+// back in the reverse order. Send, Translate, TranslationRequired and String
+// reach rec unchanged, so a chain is configured as rec by its name, and so do
+// Ready and Translation when rec is a ReadyReceiver or a TranslationReceiver.
+func Chain(rec Receiver, mws ...Middleware) Receiver {
+	for i := len(mws) - 1; i >= 0; i-- {
+		rec = mws[i](rec)
+	}
+	return rec
+}
+
+// DeliveryMiddleware returns a Middleware wrapping the delivery of every message
+// with wrap. next delivers the message to the wrapped receiver.
+func DeliveryMiddleware(wrap func(rec Receiver, next DeliverFunc) DeliverFunc) Middleware {
+	return func(rec Receiver) Receiver {
+		return &wrapped{Receiver: rec, deliver: wrap(rec, DeliverTo(rec))}
+	}
+}
+
+// wrapped is a Receiver whose deliveries go through a DeliveryMiddleware. It is
+// a ReadyReceiver and a TranslationReceiver forwarding to the wrapped Receiver.
+type wrapped struct {
+	Receiver
+	deliver DeliverFunc
+}
+
+func (w *wrapped) AddMessage(b []byte) {
+	w.deliver(context.Background(), b)
+}
+
+func (w *wrapped) AddMessageContext(ctx context.Context, b []byte) {
+	w.deliver(ctx, b)
+}
+
+func (w *wrapped) Deliver(ctx context.Context, b []byte) error {
+	return w.deliver(ctx, b)
+}
+
+// Ready checks the wrapped Receiver if it is a ReadyReceiver.
+func (w *wrapped) Ready(ctx context.Context) error {
+	return readyOf(ctx, w.Receiver)
+}
+
+// Translation returns the Translator of the wrapped Receiver, if any.
+func (w *wrapped) Translation() *translator.Translator {
+	return translationOf(w.Receiver)
+}
+
+// Unwrap returns the wrapped Receiver.
+func (w *wrapped) Unwrap() Receiver {
+	return w.Receiver
+}
+
+// Retry retries the deliveries as NewRetryReceiver.
+func Retry(policy RetryPolicy) Middleware {
+	return func(rec Receiver) Receiver {
+		return NewRetryReceiver(rec, policy)
+	}
+}
+
+// Logging logs the deliveries which fail as LogTo with l, or with the standard
+// logger if l is nil, in the format of logging.NewStdLogger.
+func Logging(l *log.Logger) Middleware {
+	return LogTo(logging.NewStdLogger(l))
+}
+
+// LogTo logs the deliveries which fail with l as a logging.DeliveryFailed.
+func LogTo(l logging.Logger) Middleware {
+	return DeliveryMiddleware(func(rec Receiver, next DeliverFunc) DeliverFunc {
+		return func(ctx context.Context, b []byte) error {
+			start := time.Now()
+			err := next(ctx, b)
+			if err != nil {
+				l.Log(logging.LevelError, logging.DeliveryFailed, logging.Fields{
+					"receiver": rec.String(),
+					"bytes":    len(b),
+					"duration": time.Since(start),
+					"error":    err,
+				})
+			}
+			return err
+		}
+	})
+}
+
+// Metrics records metrics.Deliveries and metrics.DeliveryLatency of every
+// delivery.
+func Metrics(r metrics.Recorder) Middleware {
+	return DeliveryMiddleware(func(rec Receiver, next DeliverFunc) DeliverFunc {
+		return func(ctx context.Context, b []byte) error {
+			start := time.Now()
+			err := next(ctx, b)
+			result := "success"
+			if err != nil {
+				result = "failure"
+			}
+			r.Observe(metrics.DeliveryLatency, time.Since(start).Seconds(), metrics.Labels{"receiver": rec.String()})
+			r.Add(metrics.Deliveries, 1, metrics.Labels{"receiver": rec.String(), "result": result})
+			return err
+		}
+	})
+}
+
+// Translation translates the messages of the receiver with t instead of its own
+// translation, as for the records of a stream sharing t across its receivers.
+// The wrapped receiver is no longer a BatchReceiver.
+func Translation(t *translator.Translator) Middleware {
+	return func(rec Receiver) Receiver {
+		return &translated{wrapped: &wrapped{Receiver: rec, deliver: DeliverTo(rec)}, t: t}
+	}
+}
+
+// translated is a Receiver whose translation is replaced by a Translator.
+type translated struct {
+	*wrapped
+	t *translator.Translator
+}
+
+func (r *translated) TranslationRequired() bool {
+	return true
+}
+
+func (r *translated) Translate(b []byte) ([]byte, error) {
+	return r.t.TranslateJSON(b)
+}
+
+// Translation returns the Translator of the messages, as a TranslationReceiver.
+func (r *translated) Translation() *translator.Translator {
+	return r.t
+}
@@ -0,0 +1,142 @@
+package receivers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"github.com/nicolasassi/kinestesia/translator"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tracingMiddleware appends to calls when a message goes in and out of it.
+func tracingMiddleware(name string, mu *sync.Mutex, calls *[]string) Middleware {
+	return DeliveryMiddleware(func(rec Receiver, next DeliverFunc) DeliverFunc {
+		return func(ctx context.Context, b []byte) error {
+			mu.Lock()
+			*calls = append(*calls, name+" in")
+			mu.Unlock()
+			err := next(ctx, b)
+			mu.Lock()
+			*calls = append(*calls, name+" out")
+			mu.Unlock()
+			return err
+		}
+	})
+}
+
+// countingRecorder sums every measurement by name.
+type countingRecorder struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *countingRecorder) Add(name string, value float64, labels metrics.Labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[name+"/"+labels["result"]] += value
+}
+
+func (c *countingRecorder) Set(name string, value float64, labels metrics.Labels) {}
+
+func (c *countingRecorder) Observe(name string, value float64, labels metrics.Labels) {
+	c.Add(name, 1, labels)
+}
+
+func TestChain(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	rec := &fakeDeliverer{}
+	chain := Chain(rec,
+		tracingMiddleware("outer", &mu, &calls),
+		tracingMiddleware("inner", &mu, &calls))
+	if err := chain.(Deliverer).Deliver(context.Background(), []byte("m")); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	want := []string{"outer in", "inner in", "inner out", "outer out"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls got = %v, want %v", calls, want)
+	}
+	if chain.String() != rec.String() || chain.TranslationRequired() != rec.TranslationRequired() {
+		t.Errorf("Chain() should keep the name and translation of the receiver")
+	}
+	if got := rec.attempted(); got != 1 {
+		t.Errorf("Deliver() attempts = %v, want 1", got)
+	}
+	// AddMessage goes through the chain as well
+	chain.AddMessage([]byte("m"))
+	if len(calls) != 8 {
+		t.Errorf("AddMessage() calls got = %v, want 8", len(calls))
+	}
+}
+
+func TestChain_BuiltIns(t *testing.T) {
+	var logs bytes.Buffer
+	recorder := &countingRecorder{values: map[string]float64{}}
+	rec := &fakeDeliverer{fail: []error{errors.New("down"), errors.New("down"), errors.New("down")}}
+	chain := Chain(rec,
+		Logging(log.New(&logs, "", 0)),
+		Metrics(recorder),
+		Retry(RetryPolicy{MaxAttempts: 2, InitialBackoff: 1}))
+	deliver := chain.(Deliverer).Deliver
+	if err := deliver(context.Background(), []byte("m")); err == nil {
+		t.Fatalf("Deliver() error = nil, want the second failure")
+	}
+	if err := deliver(context.Background(), []byte("m")); err != nil {
+		t.Fatalf("Deliver() error = %v, want the retry to succeed", err)
+	}
+	// metrics sit outside the retries so each message is counted once
+	want := map[string]float64{
+		metrics.Deliveries + "/failure": 1,
+		metrics.Deliveries + "/success": 1,
+		metrics.DeliveryLatency + "/":   2,
+	}
+	if !reflect.DeepEqual(recorder.values, want) {
+		t.Errorf("metrics got = %v, want %v", recorder.values, want)
+	}
+	if got := strings.Count(logs.String(), `level=error msg="delivery failed" bytes=1`); got != 1 || !strings.Contains(logs.String(), "receiver=fake") {
+		t.Errorf("logged %q, want one failure", logs.String())
+	}
+}
+
+// readyDeliverer is a fakeDeliverer which is a ReadyReceiver and a
+// TranslationReceiver.
+type readyDeliverer struct {
+	*fakeDeliverer
+	err error
+	t   *translator.Translator
+}
+
+func (r *readyDeliverer) Ready(ctx context.Context) error {
+	return r.err
+}
+
+func (r *readyDeliverer) Translation() *translator.Translator {
+	return r.t
+}
+
+func TestChain_ForwardsOptionalInterfaces(t *testing.T) {
+	errNotReady := errors.New("not ready")
+	rec := &readyDeliverer{fakeDeliverer: &fakeDeliverer{}, err: errNotReady, t: translator.NewTranslator(map[string]string{"a": "b"}, "")}
+	chain := Chain(NewBatchAdapter(rec), Logging(nil), Retry(RetryPolicy{}), Throttle(NewRateLimiter(RateLimit{}), nil))
+	ready, ok := chain.(ReadyReceiver)
+	if !ok || ready.Ready(context.Background()) != errNotReady {
+		t.Errorf("Ready() of the chain should check the receiver")
+	}
+	translating, ok := chain.(TranslationReceiver)
+	if !ok || translating.Translation() != rec.t {
+		t.Errorf("Translation() of the chain should return the one of the receiver")
+	}
+	// a receiver without them is ready and has no translation
+	plain := Chain(&fakeDeliverer{}, Logging(nil))
+	if err := plain.(ReadyReceiver).Ready(context.Background()); err != nil {
+		t.Errorf("Ready() error = %v, want nil", err)
+	}
+	if plain.(TranslationReceiver).Translation() != nil {
+		t.Errorf("Translation() got a Translator, want nil")
+	}
+}
@@ -0,0 +1,398 @@
+package pubsub
+
+import (
+	"bytes"
+	"cloud.google.com/go/pubsub"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultIAMCredentialsEndpoint = "https://iamcredentials.googleapis.com"
+	defaultTokenLifetime          = time.Hour
+	maxTokenLifetime              = 12 * time.Hour
+	tokenRequestTimeout           = 30 * time.Second
+)
+
+// AuthMode selects how a Client authenticates to Google Cloud.
+type AuthMode string
+
+const (
+	// AuthDefault uses the Application Default Credentials. It is the mode of an
+	// empty AuthConfig.
+	AuthDefault AuthMode = "default"
+	// AuthServiceAccountFile uses the service account key file at
+	// CredentialsFile.
+	AuthServiceAccountFile AuthMode = "service_account_file"
+	// AuthServiceAccountEnv uses the service account key JSON held by the
+	// environment variable CredentialsEnv.
+	AuthServiceAccountEnv AuthMode = "service_account_env"
+	// AuthWorkloadIdentity exchanges the AWS credentials, or the token of a file
+	// or URL, for Google Cloud credentials as set by the workload identity
+	// federation config at CredentialsFile.
+	AuthWorkloadIdentity AuthMode = "workload_identity"
+	// AuthEmulator connects without authentication to the Pub/Sub emulator at
+	// EmulatorHost.
+	AuthEmulator AuthMode = "emulator"
+)
+
+// AuthConfig sets how a Client authenticates, so it can be read from the
+// configuration of a pipeline, as:
+//
+//	{"mode": "workload_identity", "credentials_file": "/etc/gcp/federation.json"}
+//
+// Use Validate at startup to check the config and the files it refers to.
+type AuthConfig struct {
+	Mode AuthMode `json:"mode"`
+	// CredentialsFile is the service account key file of AuthServiceAccountFile
+	// or the config file of AuthWorkloadIdentity.
+	CredentialsFile string `json:"credentials_file"`
+	// CredentialsEnv is the variable holding the service account key JSON of
+	// AuthServiceAccountEnv.
+	CredentialsEnv string `json:"credentials_env"`
+	// EmulatorHost is the host:port of AuthEmulator. The default is the
+	// PUBSUB_EMULATOR_HOST variable.
+	EmulatorHost string `json:"emulator_host"`
+	// Impersonate uses the credentials of the mode to impersonate a service
+	// account. It can't be used with AuthEmulator.
+	Impersonate *ImpersonateConfig `json:"impersonate"`
+	// Scopes are the OAuth scopes of the credentials. The default is
+	// cloud-platform.
+	Scopes []string `json:"scopes"`
+	// AWSCredentials are the credentials exchanged by AuthWorkloadIdentity from
+	// AWS, as the ones of the kinesis Client. The default is the default chain
+	// of the AWS SDK.
+	AWSCredentials *credentials.Credentials `json:"-"`
+	// HTTPClient sends the token requests of AuthWorkloadIdentity and
+	// Impersonate.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// ImpersonateConfig sets the service account impersonated by the credentials
+// of an AuthConfig, which need the Service Account Token Creator role on it.
+type ImpersonateConfig struct {
+	// ServiceAccount is the email of the service account.
+	ServiceAccount string `json:"service_account"`
+	// Delegates are the service accounts impersonated in turn to reach
+	// ServiceAccount, if the credentials can't impersonate it directly.
+	Delegates []string `json:"delegates"`
+	// LifetimeSeconds is how long the tokens last, up to 43200. The default is
+	// 3600.
+	LifetimeSeconds int `json:"lifetime_seconds"`
+	// Endpoint overrides the IAM Credentials API URL.
+	Endpoint string `json:"endpoint"`
+}
+
+// NewPubSubClientWithAuth creates a Client authenticated as set by auth. The
+// options are applied after the ones of auth.
+func NewPubSubClientWithAuth(ctx context.Context, projectID string, auth AuthConfig, opts ...option.ClientOption) (*Client, error) {
+	authOpts, err := auth.ClientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewPubSubClient(ctx, projectID, append(authOpts, opts...)...)
+}
+
+// Validate checks the fields of the mode of c and reads the credentials it
+// refers to, without requesting any token.
+func (c AuthConfig) Validate() error {
+	_, err := c.load()
+	return err
+}
+
+// ClientOptions returns the options authenticating a Client as set by c.
+func (c AuthConfig) ClientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	creds, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	if c.Mode == AuthEmulator {
+		return []option.ClientOption{
+			option.WithEndpoint(creds.emulatorHost),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithInsecure()),
+		}, nil
+	}
+	var source oauth2.TokenSource
+	switch {
+	case creds.external != nil:
+		if source, err = creds.external.tokenSource(ctx, c); err != nil {
+			return nil, err
+		}
+	case c.Impersonate == nil && creds.json != nil:
+		return []option.ClientOption{option.WithCredentialsJSON(creds.json), option.WithScopes(c.scopes()...)}, nil
+	case c.Impersonate == nil:
+		// the client finds the Application Default Credentials itself
+		if len(c.Scopes) > 0 {
+			return []option.ClientOption{option.WithScopes(c.Scopes...)}, nil
+		}
+		return nil, nil
+	case creds.json != nil:
+		googleCreds, err := google.CredentialsFromJSON(ctx, creds.json, pubsub.ScopeCloudPlatform)
+		if err != nil {
+			return nil, &AuthError{Source: c.source(), Err: err}
+		}
+		source = googleCreds.TokenSource
+	default:
+		if source, err = google.DefaultTokenSource(ctx, pubsub.ScopeCloudPlatform); err != nil {
+			return nil, &AuthError{Err: err}
+		}
+	}
+	if c.Impersonate != nil {
+		source = &impersonatedSource{
+			base:           oauth2.ReuseTokenSource(nil, source),
+			serviceAccount: c.Impersonate.ServiceAccount,
+			url:            c.Impersonate.url(),
+			scopes:         c.scopes(),
+			delegates:      c.Impersonate.Delegates,
+			lifetime:       c.Impersonate.lifetime(),
+			client:         c.httpClient(),
+		}
+	}
+	return []option.ClientOption{option.WithTokenSource(oauth2.ReuseTokenSource(nil, source))}, nil
+}
+
+// authCredentials are the credentials an AuthConfig refers to.
+type authCredentials struct {
+	json         []byte
+	external     *externalAccount
+	emulatorHost string
+}
+
+// load validates c and reads its credentials.
+func (c AuthConfig) load() (authCredentials, error) {
+	var creds authCredentials
+	switch c.Mode {
+	case "", AuthDefault:
+	case AuthServiceAccountFile:
+		if c.CredentialsFile == "" {
+			return creds, authErrorf("", "mode %s requires credentials_file", c.Mode)
+		}
+		b, err := readFile(c.CredentialsFile)
+		if err != nil {
+			return creds, err
+		}
+		if err := validateServiceAccount(c.CredentialsFile, b); err != nil {
+			return creds, err
+		}
+		creds.json = b
+	case AuthServiceAccountEnv:
+		if c.CredentialsEnv == "" {
+			return creds, authErrorf("", "mode %s requires credentials_env", c.Mode)
+		}
+		s := os.Getenv(c.CredentialsEnv)
+		if s == "" {
+			return creds, authErrorf(c.CredentialsEnv, "not set")
+		}
+		if err := validateServiceAccount(c.CredentialsEnv, []byte(s)); err != nil {
+			return creds, err
+		}
+		creds.json = []byte(s)
+	case AuthWorkloadIdentity:
+		if c.CredentialsFile == "" {
+			return creds, authErrorf("", "mode %s requires credentials_file", c.Mode)
+		}
+		account, err := loadExternalAccount(c.CredentialsFile)
+		if err != nil {
+			return creds, err
+		}
+		creds.external = account
+	case AuthEmulator:
+		if c.Impersonate != nil {
+			return creds, authErrorf("", "mode %s can't impersonate a service account", c.Mode)
+		}
+		creds.emulatorHost = c.EmulatorHost
+		if creds.emulatorHost == "" {
+			creds.emulatorHost = os.Getenv("PUBSUB_EMULATOR_HOST")
+		}
+		if _, _, err := net.SplitHostPort(creds.emulatorHost); err != nil {
+			return creds, authErrorf("", "mode %s requires emulator_host as host:port: %w", c.Mode, err)
+		}
+	default:
+		return creds, authErrorf("", "unknown mode %q", c.Mode)
+	}
+	if c.Impersonate != nil {
+		if err := c.Impersonate.validate(); err != nil {
+			return creds, err
+		}
+	}
+	return creds, nil
+}
+
+// source is the file or variable of the credentials of c, if any.
+func (c AuthConfig) source() string {
+	if c.Mode == AuthServiceAccountEnv {
+		return c.CredentialsEnv
+	}
+	return c.CredentialsFile
+}
+
+func (c AuthConfig) scopes() []string {
+	if len(c.Scopes) == 0 {
+		return []string{pubsub.ScopeCloudPlatform}
+	}
+	return c.Scopes
+}
+
+func (c AuthConfig) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return &http.Client{Timeout: tokenRequestTimeout}
+	}
+	return c.HTTPClient
+}
+
+// readFile reads the file at path, returning an *AuthError of path.
+func readFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		// the path is the source of the error
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return nil, &AuthError{Source: path, Err: err}
+	}
+	return b, nil
+}
+
+// validateServiceAccount checks that b, read from source, is a service account
+// key.
+func validateServiceAccount(source string, b []byte) error {
+	var key struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(b, &key); err != nil {
+		return authErrorf(source, "invalid service account key: %w", err)
+	}
+	if key.Type != "service_account" {
+		return authErrorf(source, "%q key, not a service_account one", key.Type)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return authErrorf(source, "service account key has no client_email or private_key")
+	}
+	return nil
+}
+
+func (c ImpersonateConfig) validate() error {
+	if !strings.Contains(c.ServiceAccount, "@") {
+		return authErrorf("", "impersonate requires the email of a service_account, got %q", c.ServiceAccount)
+	}
+	if c.LifetimeSeconds < 0 || time.Duration(c.LifetimeSeconds)*time.Second > maxTokenLifetime {
+		return authErrorf(c.ServiceAccount, "impersonate lifetime_seconds should be between 0 and %d", int(maxTokenLifetime.Seconds()))
+	}
+	return nil
+}
+
+func (c ImpersonateConfig) url() string {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = defaultIAMCredentialsEndpoint
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/v1/" + serviceAccountResource(c.ServiceAccount) + ":generateAccessToken"
+}
+
+func (c ImpersonateConfig) lifetime() time.Duration {
+	if c.LifetimeSeconds == 0 {
+		return defaultTokenLifetime
+	}
+	return time.Duration(c.LifetimeSeconds) * time.Second
+}
+
+func serviceAccountResource(email string) string {
+	return "projects/-/serviceAccounts/" + email
+}
+
+// impersonatedSource generates the tokens of a service account with the IAM
+// Credentials API.
+type impersonatedSource struct {
+	base           oauth2.TokenSource
+	serviceAccount string
+	url            string
+	scopes         []string
+	delegates      []string
+	lifetime       time.Duration
+	client         *http.Client
+}
+
+func (s *impersonatedSource) Token() (*oauth2.Token, error) {
+	base, err := s.base.Token()
+	if err != nil {
+		return nil, authErrorf(s.serviceAccount, "impersonate: %w", err)
+	}
+	delegates := make([]string, len(s.delegates))
+	for i, delegate := range s.delegates {
+		delegates[i] = serviceAccountResource(delegate)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"scope":     s.scopes,
+		"delegates": delegates,
+		"lifetime":  fmt.Sprintf("%ds", int(s.lifetime.Seconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, authErrorf(s.serviceAccount, "impersonate: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	base.SetAuthHeader(req)
+	var resp struct {
+		AccessToken string `json:"accessToken"`
+		ExpireTime  string `json:"expireTime"`
+	}
+	if err := doTokenRequest(s.client, req, &resp); err != nil {
+		return nil, authErrorf(s.serviceAccount, "impersonate: %w", err)
+	}
+	expiry, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		return nil, authErrorf(s.serviceAccount, "impersonate: invalid expireTime: %w", err)
+	}
+	return &oauth2.Token{AccessToken: resp.AccessToken, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+// authTokenSource returns the errors of base as *AuthError of source.
+type authTokenSource struct {
+	source string
+	base   oauth2.TokenSource
+}
+
+func (s *authTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.base.Token()
+	if err != nil {
+		return nil, &AuthError{Source: s.source, Err: err}
+	}
+	return token, nil
+}
+
+// doTokenRequest sends req and decodes the JSON response into out.
+func doTokenRequest(client *http.Client, req *http.Request, out interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, bytes.TrimSpace(b))
+	}
+	return json.Unmarshal(b, out)
+}
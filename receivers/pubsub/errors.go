@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"strings"
+)
+
+var _ receivers.PartialDelivery = (*DeliveryError)(nil)
+
+// AuthError is a failure to authenticate a Client, as an AuthConfig which is not
+// valid or a token which can't be obtained. Source is the file, variable,
+// audience or service account the credentials were taken from, if any.
+type AuthError struct {
+	Source string
+	Err    error
+}
+
+func (e *AuthError) Error() string {
+	if e.Source == "" {
+		return "[AUTH]: " + e.Err.Error()
+	}
+	return fmt.Sprintf("[AUTH]: %s: %v", e.Source, e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// authErrorf returns an *AuthError of source whose Err is formatted as
+// fmt.Errorf.
+func authErrorf(source, format string, args ...interface{}) error {
+	return &AuthError{Source: source, Err: fmt.Errorf(format, args...)}
+}
+
+// PublishError is a message which failed to be published to a topic. Deliver
+// returns it, and Send returns it for the messages added with AddMessage.
+type PublishError struct {
+	Receiver string
+	Topic    string
+	Err      error
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("[PUBLISH]: topic %s: %v", e.Topic, e.Err)
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// DeliveryError is returned by Deliver when a message failed to be published to
+// some of the topics. It is a receivers.PartialDelivery whose Retry publishes the
+// message again to those topics only.
+type DeliveryError struct {
+	Errors []*PublishError
+	retry  func(ctx context.Context) error
+}
+
+func (e *DeliveryError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *DeliveryError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Retry publishes the message to the topics which failed.
+func (e *DeliveryError) Retry(ctx context.Context) error {
+	return e.retry(ctx)
+}
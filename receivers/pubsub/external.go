@@ -0,0 +1,202 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google/externalaccount"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const awsEnvironmentID = "aws1"
+
+// externalAccount is the workload identity federation config written by
+// "gcloud iam workload-identity-pools create-cred-config".
+type externalAccount struct {
+	Type                           string `json:"type"`
+	Audience                       string `json:"audience"`
+	SubjectTokenType               string `json:"subject_token_type"`
+	TokenURL                       string `json:"token_url"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	ServiceAccountImpersonation    struct {
+		TokenLifetimeSeconds int `json:"token_lifetime_seconds"`
+	} `json:"service_account_impersonation"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// CredentialSource tells where the subject token exchanged for Google Cloud
+	// credentials is read from: a file, a URL, or AWS for environment_id aws1.
+	// The AWS credentials are the ones of AuthConfig.AWSCredentials instead of
+	// the metadata url of the config.
+	CredentialSource externalaccount.CredentialSource `json:"credential_source"`
+}
+
+// loadExternalAccount reads and validates the config at path.
+func loadExternalAccount(path string) (*externalAccount, error) {
+	b, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var a externalAccount
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, authErrorf(path, "invalid workload identity config: %w", err)
+	}
+	if a.Type != "external_account" {
+		return nil, authErrorf(path, "%q config, not an external_account one", a.Type)
+	}
+	if a.Audience == "" || a.SubjectTokenType == "" {
+		return nil, authErrorf(path, "workload identity config has no audience or subject_token_type")
+	}
+	if !absoluteURL(a.TokenURL) {
+		return nil, authErrorf(path, "workload identity config has an invalid token_url %q", a.TokenURL)
+	}
+	if a.ServiceAccountImpersonationURL != "" && !absoluteURL(a.ServiceAccountImpersonationURL) {
+		return nil, authErrorf(path, "workload identity config has an invalid service_account_impersonation_url %q", a.ServiceAccountImpersonationURL)
+	}
+	src := a.CredentialSource
+	switch {
+	case src.EnvironmentID != "":
+		if src.EnvironmentID != awsEnvironmentID {
+			return nil, authErrorf(path, "workload identity config has unsupported environment_id %q", src.EnvironmentID)
+		}
+		if !strings.Contains(src.RegionalCredVerificationURL, "{region}") {
+			return nil, authErrorf(path, "workload identity config has no regional_cred_verification_url")
+		}
+	case src.File != "" && src.URL != "":
+		return nil, authErrorf(path, "workload identity config has both a file and a url credential_source")
+	case src.File == "" && src.URL == "":
+		return nil, authErrorf(path, "workload identity config has no file or url credential_source")
+	}
+	switch src.Format.Type {
+	case "", "text":
+	case "json":
+		if src.Format.SubjectTokenFieldName == "" {
+			return nil, authErrorf(path, "workload identity config has a json format without subject_token_field_name")
+		}
+	default:
+		return nil, authErrorf(path, "workload identity config has unsupported format %q", src.Format.Type)
+	}
+	return &a, nil
+}
+
+func absoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.IsAbs()
+}
+
+// tokenSource returns the source exchanging the subject token of a for Google
+// Cloud access tokens with the Security Token Service, impersonating the
+// service account of the config if it has one. The token requests are sent by
+// the HTTP client of auth.
+func (a externalAccount) tokenSource(ctx context.Context, auth AuthConfig) (oauth2.TokenSource, error) {
+	cfg := externalaccount.Config{
+		Audience:                       a.Audience,
+		SubjectTokenType:               a.SubjectTokenType,
+		TokenURL:                       a.TokenURL,
+		ServiceAccountImpersonationURL: a.ServiceAccountImpersonationURL,
+		ServiceAccountImpersonationLifetimeSeconds: a.ServiceAccountImpersonation.TokenLifetimeSeconds,
+		ClientID:     a.ClientID,
+		ClientSecret: a.ClientSecret,
+		Scopes:       auth.scopes(),
+	}
+	if a.CredentialSource.EnvironmentID == awsEnvironmentID {
+		creds := auth.AWSCredentials
+		if creds == nil {
+			creds = defaults.CredChain(defaults.Config(), defaults.Handlers())
+		}
+		cfg.AwsSecurityCredentialsSupplier = &awsSupplier{source: a.CredentialSource, creds: creds, client: auth.httpClient()}
+	} else {
+		src := a.CredentialSource
+		cfg.CredentialSource = &src
+	}
+	// the tokens are requested while the Client lives, not only while it is
+	// created
+	ctx = context.WithValue(context.WithoutCancel(ctx), oauth2.HTTPClient, auth.httpClient())
+	source, err := externalaccount.NewTokenSource(ctx, cfg)
+	if err != nil {
+		return nil, &AuthError{Source: a.Audience, Err: err}
+	}
+	return &authTokenSource{source: a.Audience, base: source}, nil
+}
+
+// awsSupplier gives the AWS credentials to the workload identity federation of
+// AWS.
+type awsSupplier struct {
+	source externalaccount.CredentialSource
+	creds  *credentials.Credentials
+	client *http.Client
+}
+
+// AwsRegion returns the region of AWS_REGION or AWS_DEFAULT_REGION, or the one
+// of the availability zone of the instance read from region_url.
+func (s *awsSupplier) AwsRegion(ctx context.Context, options externalaccount.SupplierOptions) (string, error) {
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(env); region != "" {
+			return region, nil
+		}
+	}
+	if s.source.RegionURL == "" {
+		return "", fmt.Errorf("AWS region not set and workload identity config has no region_url")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.source.RegionURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if s.source.IMDSv2SessionTokenURL != "" {
+		tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, s.source.IMDSv2SessionTokenURL, nil)
+		if err != nil {
+			return "", err
+		}
+		tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+		token, err := s.get(tokenReq)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	}
+	zone, err := s.get(req)
+	if err != nil {
+		return "", err
+	}
+	// the region is the availability zone without its letter
+	if len(zone) < 2 {
+		return "", fmt.Errorf("invalid availability zone %q", zone)
+	}
+	return string(zone[:len(zone)-1]), nil
+}
+
+func (s *awsSupplier) AwsSecurityCredentials(ctx context.Context, options externalaccount.SupplierOptions) (*externalaccount.AwsSecurityCredentials, error) {
+	value, err := s.creds.Get()
+	if err != nil {
+		return nil, err
+	}
+	return &externalaccount.AwsSecurityCredentials{
+		AccessKeyID:     value.AccessKeyID,
+		SecretAccessKey: value.SecretAccessKey,
+		SessionToken:    value.SessionToken,
+	}, nil
+}
+
+// get sends req and returns the body of its response.
+func (s *awsSupplier) get(req *http.Request) ([]byte, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return bytes.TrimSpace(b), nil
+}
@@ -3,10 +3,17 @@ package pubsub
 import (
 	"cloud.google.com/go/pubsub"
 	"context"
-	"encoding/json"
 	"fmt"
+	"github.com/nicolasassi/kinestesia/logging"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"github.com/nicolasassi/kinestesia/tracing"
 	"github.com/nicolasassi/kinestesia/translator"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/option"
+	"sync"
+	"time"
 )
 
 type Client struct {
@@ -16,22 +23,71 @@ type Client struct {
 	// Translator represents how should the incoming data be in the end of the process.
 	// If Translator is nil the data will go as it came to the receiver.
 	translator *translator.Translator
-	stream chan []byte
+	stream chan message
 	sent chan struct{}
 	errors chan error
+	metrics metrics.Recorder
+	tracer trace.Tracer
+	logger logging.Logger
+	// ordering publishes the messages with the ordering key of their context.
+	ordering bool
+}
+
+// message is data to be published within the context of the record it came from.
+// topics restricts the topics it is published to when not nil. outcome is nil
+// unless the message is delivered with Deliver.
+type message struct {
+	ctx     context.Context
+	data    []byte
+	topics  []string
+	outcome *outcome
+}
+
+// outcome collects the results of a message across its topics.
+type outcome struct {
+	mu        sync.Mutex
+	remaining int
+	errs      []*PublishError
+	done      chan []*PublishError
+}
+
+func (o *outcome) add(err *PublishError) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err != nil {
+		o.errs = append(o.errs, err)
+	}
+	o.remaining--
+	if o.remaining == 0 {
+		o.done <- o.errs
+	}
+}
+
+// publishResult is a message published to topic at start waiting for its result.
+// orderingKey is the ordering key of the message, if any.
+type publishResult struct {
+	result      *pubsub.PublishResult
+	topic       *pubsub.Topic
+	orderingKey string
+	start       time.Time
+	span    trace.Span
+	outcome *outcome
 }
 
 func NewPubSubClient(ctx context.Context, projectID string, opts ...option.ClientOption) (*Client, error) {
 	client, err := pubsub.NewClient(ctx, projectID, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("new pubsub client error: %v", err)
+		return nil, fmt.Errorf("new pubsub client error: %w", err)
 	}
 	return &Client{
 		client: client,
 		name: "pubsub",
-		stream: make(chan []byte),
+		stream: make(chan message),
 		sent: make(chan struct{}),
 		errors: make(chan error, 1),
+		metrics: metrics.Discard,
+		tracer: tracing.Tracer(nil),
+		logger: logging.Default,
 	}, nil
 }
 
@@ -44,10 +100,106 @@ func (c *Client) AddTopics(topics ...string) {
 }
 
 func (c *Client) AddMessage(b []byte) {
-	c.stream <- b
+	c.AddMessageContext(context.Background(), b)
+}
+
+// AddMessageContext adds b to be published as a child of the span in ctx.
+// The trace context is sent in the traceparent attribute of the message.
+// The message is dropped if ctx is done before Send takes it.
+func (c *Client) AddMessageContext(ctx context.Context, b []byte) {
+	select {
+	case c.stream <- message{ctx: ctx, data: b}:
+	case <-ctx.Done():
+		return
+	}
 	<-c.sent
 }
 
+// Deliver publishes b to every topic as AddMessageContext and waits for the
+// results. A failure is returned instead of ending Send, as a *DeliveryError
+// which retries the topics which failed only. The Streamer delivers through
+// Deliver so every worker waits for its publish, and the number of workers
+// bounds the messages published at once.
+func (c *Client) Deliver(ctx context.Context, b []byte) error {
+	return c.deliver(ctx, b, nil)
+}
+
+// deliver publishes b to topics, or to every topic if topics is nil.
+func (c *Client) deliver(ctx context.Context, b []byte, topics []string) error {
+	o := &outcome{done: make(chan []*PublishError, 1)}
+	select {
+	case c.stream <- message{ctx: ctx, data: b, topics: topics, outcome: o}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-c.sent
+	select {
+	case errs := <-o.done:
+		if len(errs) == 0 {
+			return nil
+		}
+		failed := make([]string, len(errs))
+		for i, err := range errs {
+			failed[i] = err.Topic
+		}
+		return &DeliveryError{Errors: errs, retry: func(ctx context.Context) error {
+			return c.deliver(ctx, b, failed)
+		}}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetName is a setter for the name returned by String, which is "pubsub" by
+// default. Clients streamed together, as a shadow client getting a sample of
+// the records, need different names to be configured apart.
+func (c *Client) SetName(name string) {
+	c.name = name
+}
+
+// SetMetrics is a setter for the Recorder of the published messages.
+func (c *Client) SetMetrics(r metrics.Recorder) {
+	c.metrics = r
+}
+
+// EnableMessageOrdering publishes the messages added with a receivers.WithOrderingKey
+// context with that ordering key, so subscriptions with message ordering receive
+// them in the order they were added. Ordering keys require a regional endpoint,
+// as option.WithEndpoint("us-east1-pubsub.googleapis.com:443").
+func (c *Client) EnableMessageOrdering() {
+	c.ordering = true
+}
+
+// SetLogger is a setter for the Logger of the messages which fail to be
+// published, which is logging.Default by default.
+func (c *Client) SetLogger(l logging.Logger) {
+	c.logger = l
+}
+
+// SetTracerProvider is a setter for the TracerProvider of the spans of the
+// published messages, which is the global TracerProvider by default.
+func (c *Client) SetTracerProvider(tp trace.TracerProvider) {
+	c.tracer = tracing.Tracer(tp)
+}
+
+// Ready checks that every topic exists, which also tells that the client
+// reaches Pub/Sub with valid credentials.
+func (c *Client) Ready(ctx context.Context) error {
+	if c.client == nil {
+		return fmt.Errorf("pubsub client not initialized")
+	}
+	for _, topicID := range c.topics {
+		exists, err := c.client.Topic(topicID).Exists(ctx)
+		if err != nil {
+			return fmt.Errorf("topic %s: %w", topicID, err)
+		}
+		if !exists {
+			return fmt.Errorf("topic %s does not exist", topicID)
+		}
+	}
+	return nil
+}
+
 func (c Client) TranslationRequired() bool {
 	return c.translator != nil
 }
@@ -66,34 +218,38 @@ func (c *Client) SetTranslation(t *translator.Translator) {
 	c.translator = t
 }
 
+// Translation returns the Translator set with SetTranslation.
+func (c *Client) Translation() *translator.Translator {
+	return c.translator
+}
+
+// Translate translates b with the Translator of SetTranslation. Data which is
+// not a JSON object fails with translator.ErrInvalidJSON.
 func (c *Client) Translate(b []byte) ([]byte, error) {
-	var m map[string]interface{}
-	if err := json.Unmarshal(b, &m); err != nil {
-		return nil, err
-	}
-	resp := c.translator.Translate(m)
-	if resp == nil {
-		return nil, nil
-	}
-	bb, err := json.Marshal(resp)
-	if err != nil {
-		return nil, err
-	}
-	return bb, nil
+	return c.translator.TranslateJSON(b)
 }
 
 func (c *Client) Send(ctx context.Context) error {
+	if c.logger == nil {
+		c.logger = logging.Default
+	}
+	if c.tracer == nil {
+		c.tracer = tracing.Tracer(nil)
+	}
 	var topics []*pubsub.Topic
 	for _, topicID := range c.topics {
 		topic := c.client.Topic(topicID)
+		topic.EnableMessageOrdering = c.ordering
 		topics = append(topics, topic)
 	}
 
-	results := make(chan *pubsub.PublishResult)
-	go c.watch(ctx, results)
+	results := make(chan publishResult)
+	go c.watch(results)
+	defer close(results)
 	for {
 		select {
 		case <-ctx.Done():
+			// Stop flushes the messages published and not yet sent
 			for _, topic := range topics {
 				topic.Stop()
 			}
@@ -101,28 +257,84 @@ func (c *Client) Send(ctx context.Context) error {
 		case err := <-c.errors:
 			return err
 		case message := <-c.stream:
-			for _, topic := range topics {
-				r := topic.Publish(ctx, &pubsub.Message{
-					Data: message,
-				})
-				results <- r
-				c.sent <- struct{}{}
+			targets := topics
+			if message.topics != nil {
+				targets = selectTopics(topics, message.topics)
 			}
+			if message.outcome != nil {
+				message.outcome.remaining = len(targets)
+				if len(targets) == 0 {
+					message.outcome.done <- nil
+				}
+			}
+			for _, topic := range targets {
+				start := time.Now()
+				spanCtx, span := c.tracer.Start(message.ctx, "pubsub.publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+					attribute.String("receiver", c.name),
+					attribute.String("topic", topic.ID()),
+				))
+				m := &pubsub.Message{
+					Data:       message.data,
+					Attributes: tracing.Inject(spanCtx, nil),
+				}
+				if c.ordering {
+					m.OrderingKey = receivers.OrderingKey(message.ctx)
+				}
+				r := topic.Publish(ctx, m)
+				results <- publishResult{result: r, topic: topic, orderingKey: m.OrderingKey, start: start, span: span, outcome: message.outcome}
+			}
+			c.sent <- struct{}{}
 		}
 	}
 }
 
-func (c *Client) watch(ctx context.Context, results chan *pubsub.PublishResult) {
-	for result := range results {
-		go func(result *pubsub.PublishResult) {
-			_, err := result.Get(ctx)
-			if err == context.Canceled {
-				return
+// selectTopics returns the topics whose ID is in ids.
+func selectTopics(topics []*pubsub.Topic, ids []string) []*pubsub.Topic {
+	var selected []*pubsub.Topic
+	for _, topic := range topics {
+		for _, id := range ids {
+			if topic.ID() == id {
+				selected = append(selected, topic)
+				break
 			}
+		}
+	}
+	return selected
+}
+
+// watch records the outcome of every result. Results are resolved even after
+// Send returns, once the topics are stopped. Pub/Sub pauses an ordering key
+// after a failure so it is resumed for the next messages to be published.
+func (c *Client) watch(results chan publishResult) {
+	for result := range results {
+		go func(result publishResult) {
+			_, err := result.result.Get(context.Background())
+			tracing.SetError(result.span, err)
+			result.span.End()
+			labels := metrics.Labels{"receiver": c.name, "topic": result.topic.ID()}
+			c.metrics.Observe(metrics.PublishLatency, time.Since(result.start).Seconds(), labels)
+			var publishErr *PublishError
 			if err != nil {
-				c.errors <- fmt.Errorf("[PUBLISH]: %v", err)
+				if result.orderingKey != "" {
+					result.topic.ResumePublish(result.orderingKey)
+				}
+				c.metrics.Add(metrics.PublishErrors, 1, labels)
+				c.logger.Log(logging.LevelError, logging.PublishFailed, logging.Fields{"receiver": c.name, "topic": result.topic.ID(), "error": err})
+				publishErr = &PublishError{Receiver: c.name, Topic: result.topic.ID(), Err: err}
+			} else {
+				c.metrics.Add(metrics.MessagesPublished, 1, labels)
+			}
+			if result.outcome != nil {
+				result.outcome.add(publishErr)
 				return
 			}
+			if publishErr != nil {
+				select {
+				case c.errors <- publishErr:
+				default:
+					// Send already has an error to return
+				}
+			}
 		}(result)
 	}
 }
@@ -2,11 +2,26 @@ package pubsub
 
 import (
 	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"context"
 	"encoding/json"
+	"errors"
+	"github.com/nicolasassi/kinestesia/logging"
+	"github.com/nicolasassi/kinestesia/receivers"
+	"github.com/nicolasassi/kinestesia/tracing"
 	"github.com/nicolasassi/kinestesia/translator"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"log"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestClient_Translate(t *testing.T) {
@@ -14,7 +29,7 @@ func TestClient_Translate(t *testing.T) {
 		client     *pubsub.Client
 		topics     []string
 		translator *translator.Translator
-		stream     chan []byte
+		stream     chan message
 		errors     chan error
 	}
 	type args struct {
@@ -157,7 +172,7 @@ func TestClient_TranslateWithFilter(t *testing.T) {
 		name       string
 		topics     []string
 		translator *translator.Translator
-		stream     chan []byte
+		stream     chan message
 		sent       chan struct{}
 		errors     chan error
 	}
@@ -206,4 +221,215 @@ func TestClient_TranslateWithFilter(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func newTestClient(t *testing.T, topics ...string) (*Client, *pstest.Server) {
+	return newTestClientWithOptions(t, nil, topics...)
+}
+
+func newTestClientWithOptions(t *testing.T, opts []option.ClientOption, topics ...string) (*Client, *pstest.Server) {
+	srv := pstest.NewServer()
+	ctx := context.Background()
+	opts = append([]option.ClientOption{
+		option.WithEndpoint(srv.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	}, opts...)
+	c, err := NewPubSubClient(ctx, "project", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range topics {
+		if _, err := c.client.CreateTopic(ctx, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.AddTopics(topics...)
+	return c, srv
+}
+
+func waitMessages(t *testing.T, srv *pstest.Server, want int) []*pstest.Message {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if messages := srv.Messages(); len(messages) >= want {
+			return messages
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("published %v messages, want %v", len(srv.Messages()), want)
+	return nil
+}
+
+func TestClient_AddMessageContext(t *testing.T) {
+	c, srv := newTestClient(t, "topic")
+	defer srv.Close()
+	c.EnableMessageOrdering()
+	provider := sdktrace.NewTracerProvider()
+	c.SetTracerProvider(provider)
+	tracer := tracing.Tracer(provider)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Send(ctx)
+
+	msgCtx, span := tracer.Start(receivers.WithOrderingKey(context.Background(), "entity-1"), "record")
+	c.AddMessageContext(msgCtx, []byte("first"))
+	c.AddMessageContext(msgCtx, []byte("second"))
+	span.End()
+	messages := waitMessages(t, srv, 2)
+	for i, want := range []string{"first", "second"} {
+		if got := string(messages[i].Data); got != want {
+			t.Errorf("message %v got = %v, want %v", i, got, want)
+		}
+		if messages[i].OrderingKey != "entity-1" {
+			t.Errorf("message %v ordering key = %v, want entity-1", i, messages[i].OrderingKey)
+		}
+		sc := trace.SpanContextFromContext(tracing.Extract(context.Background(), messages[i].Attributes))
+		if !sc.IsValid() {
+			t.Fatalf("message %v has no valid trace context in %v", i, messages[i].Attributes)
+		}
+		if sc.TraceID() != span.SpanContext().TraceID() {
+			t.Errorf("message %v trace id = %v, want %v", i, sc.TraceID(), span.SpanContext().TraceID())
+		}
+	}
+}
+
+func TestClient_AddMessageContextCancelled(t *testing.T) {
+	c, srv := newTestClient(t, "topic")
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		// Send is not running so only ctx can end the call
+		c.AddMessageContext(ctx, []byte("m"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AddMessageContext() blocked with a done context")
+	}
+}
+
+func TestClient_DeliverResumesOrderingKey(t *testing.T) {
+	var publishes int32
+	// the first publish fails with an error which is not retried
+	failFirst := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if strings.HasSuffix(method, "/Publish") && atomic.AddInt32(&publishes, 1) == 1 {
+			return status.Error(codes.InvalidArgument, "rejected")
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	c, srv := newTestClientWithOptions(t, []option.ClientOption{option.WithGRPCDialOption(grpc.WithUnaryInterceptor(failFirst))}, "topic")
+	defer srv.Close()
+	c.EnableMessageOrdering()
+	c.SetLogger(logging.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Send(ctx)
+	msgCtx := receivers.WithOrderingKey(ctx, "entity-1")
+	if err := c.Deliver(msgCtx, []byte("first")); err == nil {
+		t.Fatalf("Deliver() of the rejected message should fail")
+	}
+	if err := c.Deliver(msgCtx, []byte("second")); err != nil {
+		t.Fatalf("Deliver() after a failure of the ordering key error = %v", err)
+	}
+	if messages := srv.Messages(); len(messages) != 1 || string(messages[0].Data) != "second" {
+		t.Errorf("published %v, want the second message", messages)
+	}
+}
+
+func TestClient_SendFlushesOnShutdown(t *testing.T) {
+	c, srv := newTestClient(t, "topic-a", "topic-b")
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Send(ctx)
+	}()
+	for _, data := range []string{"a", "b", "c"} {
+		c.AddMessage([]byte(data))
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	// every message added is published to every topic once Send returns
+	if got := len(srv.Messages()); got != 6 {
+		t.Errorf("published %v messages, want 6", got)
+	}
+}
+
+func TestClient_Deliver(t *testing.T) {
+	c, srv := newTestClient(t, "topic-a", "topic-b")
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Send(ctx)
+	if err := c.Deliver(ctx, []byte("m")); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	// Deliver returns once both topics have the message
+	if got := len(srv.Messages()); got != 2 {
+		t.Errorf("published %v messages, want 2", got)
+	}
+}
+
+func TestClient_DeliverPublishError(t *testing.T) {
+	c, srv := newTestClient(t)
+	defer srv.Close()
+	c.AddTopics("missing")
+	c.SetLogger(logging.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Send(ctx)
+	err := c.Deliver(ctx, []byte("m"))
+	var publishErr *PublishError
+	if !errors.As(err, &publishErr) || publishErr.Topic != "missing" || publishErr.Receiver != "pubsub" {
+		t.Fatalf("Deliver() error = %v, want a PublishError of the topic", err)
+	}
+	if receivers.DefaultRetryable(err) {
+		t.Errorf("DefaultRetryable(%v) = true, want a missing topic not to be retried", err)
+	}
+}
+
+func TestClient_DeliverRetriesFailedTopics(t *testing.T) {
+	c, srv := newTestClient(t, "topic")
+	defer srv.Close()
+	c.AddTopics("missing")
+	c.SetLogger(logging.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Send(ctx)
+	err := c.Deliver(ctx, []byte("m"))
+	var deliveryErr *DeliveryError
+	if !errors.As(err, &deliveryErr) || len(deliveryErr.Errors) != 1 || deliveryErr.Errors[0].Topic != "missing" {
+		t.Fatalf("Deliver() error = %v, want a DeliveryError of the missing topic", err)
+	}
+	if _, err := c.client.CreateTopic(ctx, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := deliveryErr.Retry(ctx); err != nil {
+		t.Fatalf("Retry() error = %v", err)
+	}
+	// the topic which succeeded does not get the message again
+	if got := len(srv.Messages()); got != 2 {
+		t.Errorf("published %v messages, want one for each topic", got)
+	}
+}
+
+func TestClient_Chain(t *testing.T) {
+	c, srv := newTestClient(t, "topic")
+	defer srv.Close()
+	chain := receivers.Chain(c, receivers.Logging(nil), receivers.Retry(receivers.RetryPolicy{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go chain.Send(ctx)
+	if err := chain.(receivers.Deliverer).Deliver(ctx, []byte("m")); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	chain.AddMessage([]byte("n"))
+	waitMessages(t, srv, 2)
+	if chain.String() != "pubsub" {
+		t.Errorf("String() got = %v, want pubsub", chain.String())
+	}
+}
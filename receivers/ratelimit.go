@@ -0,0 +1,189 @@
+package receivers
+
+import (
+	"context"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit sets how many messages and bytes per second are let through, as a
+// token bucket filled at the rate and holding up to the burst. Reaching a limit
+// makes the messages wait instead of dropping them.
+type RateLimit struct {
+	// MessagesPerSecond is the rate of messages. Zero is no limit.
+	MessagesPerSecond float64
+	// MessageBurst is the number of messages let through at once while the rate
+	// allows. A batch bigger than the burst waits for a full bucket and the
+	// messages after it for the rate to make up the rest of the batch. The
+	// default is one second of MessagesPerSecond.
+	MessageBurst int
+	// BytesPerSecond is the rate of the bytes of the messages. Zero is no limit.
+	BytesPerSecond float64
+	// ByteBurst is the number of bytes let through at once while the rate allows.
+	// A message bigger than the burst waits for a full bucket and the messages
+	// after it for the rate to make up the rest of its bytes. The default is one
+	// second of BytesPerSecond.
+	ByteBurst int
+}
+
+// Throttle waits for limiter to allow every message before delivering it,
+// counting the seconds waited as metrics.RateLimitSeconds with r, which may be
+// nil. limiter can be shared by receivers and changed while they deliver.
+func Throttle(limiter *RateLimiter, r metrics.Recorder) Middleware {
+	if r == nil {
+		r = metrics.Discard
+	}
+	return DeliveryMiddleware(func(rec Receiver, next DeliverFunc) DeliverFunc {
+		return func(ctx context.Context, b []byte) error {
+			waited, err := limiter.Wait(ctx, 1, len(b))
+			if waited > 0 {
+				r.Add(metrics.RateLimitSeconds, waited.Seconds(), metrics.Labels{"stream": "", "receiver": rec.String()})
+			}
+			if err != nil {
+				return err
+			}
+			return next(ctx, b)
+		}
+	})
+}
+
+// RateLimiter limits messages by count and by size. Its limit can be changed
+// while it is used. It is safe for concurrent use.
+type RateLimiter struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func NewRateLimiter(l RateLimit) *RateLimiter {
+	return &RateLimiter{
+		messages: newTokenBucket(l.MessagesPerSecond, l.MessageBurst),
+		bytes:    newTokenBucket(l.BytesPerSecond, l.ByteBurst),
+	}
+}
+
+// Set changes the limit, releasing the waiters the new limit allows.
+func (r *RateLimiter) Set(l RateLimit) {
+	r.messages.set(l.MessagesPerSecond, l.MessageBurst)
+	r.bytes.set(l.BytesPerSecond, l.ByteBurst)
+}
+
+// Limit returns the current limit.
+func (r *RateLimiter) Limit() RateLimit {
+	var l RateLimit
+	l.MessagesPerSecond, l.MessageBurst = r.messages.get()
+	l.BytesPerSecond, l.ByteBurst = r.bytes.get()
+	return l
+}
+
+// Wait waits for the limits to allow count messages of size bytes. It returns
+// how long it waited, which is zero unless a limit was reached.
+func (r *RateLimiter) Wait(ctx context.Context, count, size int) (time.Duration, error) {
+	waited, err := r.messages.wait(ctx, count)
+	if err != nil {
+		return waited, err
+	}
+	waitedBytes, err := r.bytes.wait(ctx, size)
+	return waited + waitedBytes, err
+}
+
+// tokenBucket is filled with rate tokens per second up to burst. A zero rate
+// lets everything through. Taking more tokens than the burst leaves the bucket
+// in debt, with negative tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+	// changed is closed and replaced whenever the limit changes.
+	changed chan struct{}
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := &tokenBucket{changed: make(chan struct{})}
+	b.set(rate, burst)
+	return b
+}
+
+func (b *tokenBucket) set(rate float64, burst int) {
+	if rate < 0 {
+		rate = 0
+	}
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.rate == 0 {
+		b.tokens = float64(burst)
+	} else {
+		b.refill(now)
+	}
+	b.rate, b.burst, b.last = rate, burst, now
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *tokenBucket) get() (float64, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return 0, 0
+	}
+	return b.rate, b.burst
+}
+
+// refill must be called with b.mu held.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait takes n tokens, waiting for them while ctx is not done, and returns how
+// long it waited. If n is more than the burst it waits for a full bucket, so
+// the tokens beyond the burst are paid by the next waiters.
+func (b *tokenBucket) wait(ctx context.Context, n int) (time.Duration, error) {
+	var start time.Time
+	waited := func() time.Duration {
+		if start.IsZero() {
+			return 0
+		}
+		return time.Since(start)
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		if b.rate == 0 {
+			b.mu.Unlock()
+			return waited(), nil
+		}
+		need := math.Min(float64(n), float64(b.burst))
+		b.refill(now)
+		if b.tokens >= need {
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			return waited(), nil
+		}
+		if start.IsZero() {
+			start = now
+		}
+		timer := time.NewTimer(time.Duration((need - b.tokens) / b.rate * float64(time.Second)))
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-timer.C:
+		case <-changed:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		if ctx.Err() != nil {
+			return waited(), ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package receivers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_Wait(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		takes   []int
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{"unlimited", 0, 0, []int{1000, 1000}, 0, 10 * time.Millisecond},
+		{"withinBurst", 100, 5, []int{1, 1, 1, 1, 1}, 0, 10 * time.Millisecond},
+		{"overBurst", 100, 1, []int{1, 1, 1, 1, 1}, 35 * time.Millisecond, time.Second},
+		// the second take waits for the 8 tokens the first one owes and its own 2
+		{"moreThanBurst", 100, 2, []int{10, 10}, 95 * time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate, tt.burst)
+			start := time.Now()
+			for _, n := range tt.takes {
+				if _, err := b.wait(context.Background(), n); err != nil {
+					t.Fatalf("wait() error = %v", err)
+				}
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantMin || elapsed > tt.wantMax {
+				t.Errorf("wait() took %v, want between %v and %v", elapsed, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestTokenBucket_Set(t *testing.T) {
+	b := newTokenBucket(0.1, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b.wait(ctx, 1)
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.wait(ctx, 1)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b.set(0, 0)
+	if err := <-done; err != nil {
+		t.Errorf("wait() error = %v, want the waiter released by the new limit", err)
+	}
+
+	b.set(0.1, 1)
+	b.wait(ctx, 1)
+	canceled, stop := context.WithCancel(ctx)
+	stop()
+	if _, err := b.wait(canceled, 1); err != context.Canceled {
+		t.Errorf("wait() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRateLimiter_WaitBatch(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{MessagesPerSecond: 1000, MessageBurst: 10})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := limiter.Wait(context.Background(), 50, 0); err != nil {
+			t.Fatalf("Wait() error = %v", err)
+		}
+	}
+	// every batch after the first waits for the 50 messages of the one before
+	if elapsed := time.Since(start); elapsed < 95*time.Millisecond {
+		t.Errorf("Wait() took %v, want the batches limited to 1000 messages per second", elapsed)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{MessagesPerSecond: 100, MessageBurst: 1})
+	rec := &fakeDeliverer{}
+	throttled := Chain(rec, Throttle(limiter, nil)).(Deliverer)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := throttled.Deliver(context.Background(), []byte("m")); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("Deliver() took %v, want the messages limited to 100 per second", elapsed)
+	}
+	if rec.attempted() != 5 {
+		t.Errorf("Deliver() attempts = %v, want 5", rec.attempted())
+	}
+
+	// the limit is changed while in use
+	limiter.Set(RateLimit{})
+	start = time.Now()
+	for i := 0; i < 5; i++ {
+		throttled.Deliver(context.Background(), []byte("m"))
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("Deliver() took %v, want no limit", elapsed)
+	}
+}
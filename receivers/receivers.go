@@ -2,6 +2,7 @@ package receivers
 
 import (
 	"context"
+	"github.com/nicolasassi/kinestesia/translator"
 )
 
 type Receiver interface {
@@ -12,4 +13,99 @@ type Receiver interface {
 	String() string
 }
 
+// ContextReceiver is a Receiver whose messages carry the context of the record
+// they came from, so the trace of the record follows the message when it is sent.
+type ContextReceiver interface {
+	Receiver
+	AddMessageContext(ctx context.Context, b []byte)
+}
+
+type orderingKey struct{}
+
+// WithOrderingKey returns a context for a message which must be sent in order
+// with the other messages of key.
+func WithOrderingKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, orderingKey{}, key)
+}
+
+// OrderingKey returns the key set with WithOrderingKey or "" if there is none.
+func OrderingKey(ctx context.Context) string {
+	key, _ := ctx.Value(orderingKey{}).(string)
+	return key
+}
+
+type idleKey struct{}
+
+type idleFuncs struct {
+	release func()
+	acquire func(ctx context.Context) error
+}
+
+// WithIdle returns a context for a message delivered by one of a limited number
+// of workers. The waits of its delivery, as the backoff between retries, call
+// release before and acquire after waiting so the worker delivers other
+// messages meanwhile.
+func WithIdle(ctx context.Context, release func(), acquire func(ctx context.Context) error) context.Context {
+	return context.WithValue(ctx, idleKey{}, idleFuncs{release: release, acquire: acquire})
+}
+
+// Idle calls wait giving back the worker of ctx set with WithIdle, if any, until
+// it returns.
+func Idle(ctx context.Context, wait func(ctx context.Context) error) error {
+	idle, ok := ctx.Value(idleKey{}).(idleFuncs)
+	if !ok {
+		return wait(ctx)
+	}
+	idle.release()
+	err := wait(ctx)
+	if acquireErr := idle.acquire(ctx); err == nil {
+		err = acquireErr
+	}
+	return err
+}
+
+// Deliverer is a Receiver which reports the outcome of each message. Deliver
+// blocks until the message is sent or fails to be.
+type Deliverer interface {
+	Receiver
+	Deliver(ctx context.Context, b []byte) error
+}
+
+// PartialDelivery is implemented by the errors of deliveries which reached part
+// of their destinations, as the topics of a Pub/Sub client. Retry delivers the
+// message again to the destinations which failed only, so the others don't get
+// it twice.
+type PartialDelivery interface {
+	error
+	Retry(ctx context.Context) error
+}
+
+// ReadyReceiver is a Receiver which can tell whether its client is able to send
+// messages, as for a readiness probe.
+type ReadyReceiver interface {
+	Receiver
+	Ready(ctx context.Context) error
+}
+
+// TranslationReceiver is a Receiver whose translation can be inspected.
+type TranslationReceiver interface {
+	Receiver
+	// Translation returns the Translator of the receiver, nil if it has none.
+	Translation() *translator.Translator
+}
 
+// readyOf checks rec if it is a ReadyReceiver. Other receivers are ready.
+func readyOf(ctx context.Context, rec Receiver) error {
+	if ready, ok := rec.(ReadyReceiver); ok {
+		return ready.Ready(ctx)
+	}
+	return nil
+}
+
+// translationOf returns the Translator of rec if it is a TranslationReceiver.
+func translationOf(rec Receiver) *translator.Translator {
+	if translating, ok := rec.(TranslationReceiver); ok {
+		return translating.Translation()
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package receivers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nicolasassi/kinestesia/logging"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"github.com/nicolasassi/kinestesia/translator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 10 * time.Second
+	defaultMultiplier     = 2
+	defaultJitter         = 0.2
+	defaultOpenTimeout    = 30 * time.Second
+)
+
+// RetryPolicy sets how the deliveries to a receiver are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a message is tried. The default is 3.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry. The default is 100ms.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between retries. The default is 10 seconds.
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after every retry. The default is 2.
+	Multiplier float64
+	// Jitter is the fraction of every wait which is randomized, from 0 to 1.
+	// The default is 0.2.
+	Jitter float64
+	// Retryable tells whether a delivery failing with err should be tried again.
+	// The default is DefaultRetryable.
+	Retryable func(err error) bool
+	// DeadLetter is given the messages which failed every attempt or with an
+	// error which is not retryable, as to publish them to a dead-letter topic.
+	// The delivery succeeds once DeadLetter returns nil so the stream goes on.
+	// Nil fails the delivery.
+	DeadLetter DeadLetterFunc
+	// FailureThreshold is the number of consecutive retryable failures which open
+	// the circuit breaker. While open, deliveries to the receiver wait. Zero
+	// disables the breaker. Deliveries waiting for the breaker or between
+	// retries give back their worker, see Idle.
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before a single delivery is
+	// tried to close it. The default is 30 seconds.
+	OpenTimeout time.Duration
+	// Metrics records the retries and the state of the breaker. The default is
+	// metrics.Discard.
+	Metrics metrics.Recorder
+	// Logger logs the changes of the state of the breaker. The default is
+	// logging.Default.
+	Logger logging.Logger
+}
+
+// DeadLetterFunc takes a message b which failed to be delivered with err.
+type DeadLetterFunc func(ctx context.Context, b []byte, err error) error
+
+// DeadLetterTo returns a DeadLetterFunc delivering the messages to rec.
+func DeadLetterTo(rec Receiver) DeadLetterFunc {
+	deliver := DeliverTo(rec)
+	return func(ctx context.Context, b []byte, err error) error {
+		return deliver(ctx, b)
+	}
+}
+
+// DefaultRetryable retries the gRPC errors which are likely to be transient,
+// as Unavailable, and every error without a gRPC status. Errors as
+// InvalidArgument or PermissionDenied, and data which is not JSON, are not
+// retried.
+func DefaultRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, translator.ErrInvalidJSON) {
+		return false
+	}
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &grpcErr) {
+		return true
+	}
+	switch grpcErr.GRPCStatus().Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+// RetryReceiver is a Receiver whose deliveries are retried with exponential
+// backoff and guarded by a circuit breaker. Errors are only seen for messages
+// of receivers implementing Deliverer, others are added once.
+type RetryReceiver struct {
+	Receiver
+	policy  RetryPolicy
+	breaker *breaker
+}
+
+func NewRetryReceiver(rec Receiver, policy RetryPolicy) *RetryReceiver {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultMaxAttempts
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = defaultInitialBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = defaultMaxBackoff
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = defaultMultiplier
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		policy.Jitter = defaultJitter
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = DefaultRetryable
+	}
+	if policy.OpenTimeout <= 0 {
+		policy.OpenTimeout = defaultOpenTimeout
+	}
+	if policy.Metrics == nil {
+		policy.Metrics = metrics.Discard
+	}
+	if policy.Logger == nil {
+		policy.Logger = logging.Default
+	}
+	r := &RetryReceiver{Receiver: rec, policy: policy}
+	if policy.FailureThreshold > 0 {
+		r.breaker = newBreaker(rec.String(), policy.FailureThreshold, policy.OpenTimeout, policy.Metrics, policy.Logger)
+	}
+	return r
+}
+
+func (r *RetryReceiver) AddMessage(b []byte) {
+	r.AddMessageContext(context.Background(), b)
+}
+
+// AddMessageContext delivers b as Deliver. As it can't return the error of a
+// message which failed, the error is logged.
+func (r *RetryReceiver) AddMessageContext(ctx context.Context, b []byte) {
+	start := time.Now()
+	if err := r.Deliver(ctx, b); err != nil {
+		r.policy.Logger.Log(logging.LevelError, logging.DeliveryFailed, logging.Fields{
+			"receiver": r.String(),
+			"bytes":    len(b),
+			"duration": time.Since(start),
+			"error":    err,
+		})
+	}
+}
+
+// Deliver tries b until it is delivered, fails with an error which is not
+// retryable or runs out of attempts, in which case b is given to the dead-letter
+// function of the policy, if any. A receivers.PartialDelivery error is retried
+// with its Retry method.
+func (r *RetryReceiver) Deliver(ctx context.Context, b []byte) error {
+	err := r.deliver(ctx, b)
+	if err == nil || r.policy.DeadLetter == nil || ctx.Err() != nil {
+		return err
+	}
+	if deadLetterErr := r.policy.DeadLetter(ctx, b, err); deadLetterErr != nil {
+		return fmt.Errorf("%w, dead letter error: %w", err, deadLetterErr)
+	}
+	r.policy.Metrics.Add(metrics.DeadLetters, 1, metrics.Labels{"receiver": r.String()})
+	return nil
+}
+
+func (r *RetryReceiver) deliver(ctx context.Context, b []byte) error {
+	backoff := r.policy.InitialBackoff
+	deliver := DeliverTo(r.Receiver)
+	for attempt := 1; ; attempt++ {
+		// the worker delivering b is given back while the breaker holds it
+		for !r.breaker.enter() {
+			if err := Idle(ctx, r.breaker.wait); err != nil {
+				return err
+			}
+		}
+		err := deliver(ctx, b)
+		retryable := err != nil && r.policy.Retryable(err)
+		r.breaker.record(err, retryable)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= r.policy.MaxAttempts {
+			return fmt.Errorf("receiver %s delivery failed after %d attempts: %w", r.String(), attempt, err)
+		}
+		var partial PartialDelivery
+		if errors.As(err, &partial) {
+			deliver = func(ctx context.Context, b []byte) error {
+				return partial.Retry(ctx)
+			}
+		}
+		r.policy.Metrics.Add(metrics.DeliveryRetries, 1, metrics.Labels{"receiver": r.String()})
+		wait := r.jitter(backoff)
+		if err := Idle(ctx, func(ctx context.Context) error {
+			return sleep(ctx, wait)
+		}); err != nil {
+			return err
+		}
+		backoff = time.Duration(float64(backoff) * r.policy.Multiplier)
+		if backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+	}
+}
+
+// State returns the state of the circuit breaker.
+func (r *RetryReceiver) State() BreakerState {
+	return r.breaker.current()
+}
+
+// Ready checks the retried Receiver if it is a ReadyReceiver.
+func (r *RetryReceiver) Ready(ctx context.Context) error {
+	return readyOf(ctx, r.Receiver)
+}
+
+// Translation returns the Translator of the retried Receiver, if any.
+func (r *RetryReceiver) Translation() *translator.Translator {
+	return translationOf(r.Receiver)
+}
+
+// Unwrap returns the retried Receiver.
+func (r *RetryReceiver) Unwrap() Receiver {
+	return r.Receiver
+}
+
+func (r *RetryReceiver) jitter(d time.Duration) time.Duration {
+	spread := float64(d) * r.policy.Jitter
+	return time.Duration(float64(d) - spread + 2*spread*rand.Float64())
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// BreakerState is the state of the circuit breaker of a RetryReceiver.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every delivery through.
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a single delivery through to decide whether to close.
+	BreakerHalfOpen
+	// BreakerOpen holds every delivery until the open timeout passes.
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// breaker opens after threshold consecutive failures. A nil *breaker is always
+// closed.
+type breaker struct {
+	name      string
+	threshold int
+	timeout   time.Duration
+	recorder  metrics.Recorder
+	logger    logging.Logger
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	// changed is closed and replaced whenever the state changes or a probe
+	// ends.
+	changed chan struct{}
+}
+
+func newBreaker(name string, threshold int, timeout time.Duration, recorder metrics.Recorder, logger logging.Logger) *breaker {
+	b := &breaker{
+		name:      name,
+		threshold: threshold,
+		timeout:   timeout,
+		recorder:  recorder,
+		logger:    logger,
+		changed:   make(chan struct{}),
+	}
+	recorder.Set(metrics.BreakerState, float64(BreakerClosed), metrics.Labels{"receiver": name})
+	return b
+}
+
+// enter lets a delivery through unless the breaker holds it. The first delivery
+// let through once the open timeout passes is the one probing the receiver.
+func (b *breaker) enter() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Now().Before(b.openedAt.Add(b.timeout)) {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+	default:
+		return true
+	}
+	b.probing = true
+	return true
+}
+
+// wait blocks until the state of the breaker changes or its open timeout
+// passes, so a delivery held by enter can try again.
+func (b *breaker) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	var opened <-chan time.Time
+	switch b.state {
+	case BreakerClosed:
+		b.mu.Unlock()
+		return nil
+	case BreakerOpen:
+		wait := time.Until(b.openedAt.Add(b.timeout))
+		if wait <= 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		opened = timer.C
+	case BreakerHalfOpen:
+		if !b.probing {
+			b.mu.Unlock()
+			return nil
+		}
+	}
+	changed := b.changed
+	b.mu.Unlock()
+	select {
+	case <-changed:
+		return nil
+	case <-opened:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// record updates the breaker with the outcome of a delivery. Failures which
+// are not retryable blame the message instead of the receiver and are ignored.
+func (b *breaker) record(err error, retryable bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probed := b.state == BreakerHalfOpen
+	b.probing = false
+	switch {
+	case err == nil:
+		b.failures = 0
+		b.setState(BreakerClosed)
+	case retryable:
+		b.failures++
+		if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+			b.openedAt = time.Now()
+			b.setState(BreakerOpen)
+		}
+	}
+	// a probe failing with an error which is not retryable leaves the breaker
+	// half-open for the next delivery to probe
+	if probed && b.state == BreakerHalfOpen {
+		b.notify()
+	}
+}
+
+// setState must be called with b.mu held.
+func (b *breaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	level := logging.LevelInfo
+	if state == BreakerOpen {
+		level = logging.LevelWarn
+	}
+	b.logger.Log(level, logging.BreakerChanged, logging.Fields{"receiver": b.name, "state": state.String(), "failures": b.failures})
+	b.state = state
+	b.recorder.Set(metrics.BreakerState, float64(state), metrics.Labels{"receiver": b.name})
+	b.notify()
+}
+
+// notify wakes the deliveries waiting for the breaker. It must be called with
+// b.mu held.
+func (b *breaker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *breaker) current() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
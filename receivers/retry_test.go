@@ -0,0 +1,340 @@
+package receivers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nicolasassi/kinestesia/logging"
+	"github.com/nicolasassi/kinestesia/translator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDeliverer fails its deliveries with the errors of fail, in order, and
+// succeeds once they run out.
+type fakeDeliverer struct {
+	mu       sync.Mutex
+	fail     []error
+	attempts int
+}
+
+func (f *fakeDeliverer) Send(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeDeliverer) AddMessage(b []byte) {}
+
+func (f *fakeDeliverer) Translate(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func (f *fakeDeliverer) TranslationRequired() bool {
+	return false
+}
+
+func (f *fakeDeliverer) String() string {
+	return "fake"
+}
+
+func (f *fakeDeliverer) Deliver(ctx context.Context, b []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts++
+	if len(f.fail) == 0 {
+		return nil
+	}
+	err := f.fail[0]
+	f.fail = f.fail[1:]
+	return err
+}
+
+func (f *fakeDeliverer) setFail(errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = errs
+}
+
+func (f *fakeDeliverer) attempted() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.attempts
+}
+
+func TestDefaultRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unavailable", status.Error(codes.Unavailable, "down"), true},
+		{"wrappedUnavailable", fmt.Errorf("publish: %w", status.Error(codes.Unavailable, "down")), true},
+		{"resourceExhausted", status.Error(codes.ResourceExhausted, "quota"), true},
+		{"invalidArgument", status.Error(codes.InvalidArgument, "too big"), false},
+		{"permissionDenied", status.Error(codes.PermissionDenied, "denied"), false},
+		{"canceled", context.Canceled, false},
+		{"plain", errors.New("connection reset"), true},
+		{"invalidJSON", fmt.Errorf("%w: unexpected end of JSON input", translator.ErrInvalidJSON), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DefaultRetryable(tt.err); got != tt.want {
+				t.Errorf("DefaultRetryable() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryReceiver_Deliver(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+	invalid := status.Error(codes.InvalidArgument, "too big")
+	tests := []struct {
+		name         string
+		fail         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"firstTime", nil, 1, nil},
+		{"afterRetries", []error{unavailable, unavailable}, 3, nil},
+		{"exhausted", []error{unavailable, unavailable, unavailable, unavailable}, 3, unavailable},
+		{"notRetryable", []error{invalid}, 1, invalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &fakeDeliverer{fail: tt.fail}
+			r := NewRetryReceiver(rec, RetryPolicy{InitialBackoff: time.Millisecond})
+			err := r.Deliver(context.Background(), []byte("m"))
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("Deliver() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := rec.attempted(); got != tt.wantAttempts {
+				t.Errorf("Deliver() attempts = %v, want %v", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryReceiver_DeadLetter(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+	errDeadLetter := errors.New("dead letter topic down")
+	tests := []struct {
+		name          string
+		deadLetterErr error
+		wantErr       []error
+	}{
+		{"deadLettered", nil, nil},
+		{"deadLetterFailed", errDeadLetter, []error{unavailable, errDeadLetter}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			var gotErr error
+			rec := &fakeDeliverer{fail: []error{unavailable, unavailable}}
+			r := NewRetryReceiver(rec, RetryPolicy{
+				MaxAttempts:    2,
+				InitialBackoff: time.Millisecond,
+				DeadLetter: func(ctx context.Context, b []byte, err error) error {
+					got = append(got, string(b))
+					gotErr = err
+					return tt.deadLetterErr
+				},
+			})
+			err := r.Deliver(context.Background(), []byte("m"))
+			for _, want := range tt.wantErr {
+				if !errors.Is(err, want) {
+					t.Errorf("Deliver() error = %v, want %v", err, want)
+				}
+			}
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("Deliver() error = %v, want the message dead-lettered", err)
+			}
+			if len(got) != 1 || got[0] != "m" || !errors.Is(gotErr, unavailable) {
+				t.Errorf("DeadLetter() got = %v with %v, want m with the delivery error", got, gotErr)
+			}
+		})
+	}
+}
+
+// partialError is a receivers.PartialDelivery whose retries go to retry.
+type partialError struct {
+	retry func(ctx context.Context) error
+}
+
+func (p *partialError) Error() string {
+	return "partially delivered"
+}
+
+func (p *partialError) Retry(ctx context.Context) error {
+	return p.retry(ctx)
+}
+
+func TestRetryReceiver_PartialDelivery(t *testing.T) {
+	retries := 0
+	partial := &partialError{retry: func(ctx context.Context) error {
+		retries++
+		return nil
+	}}
+	rec := &fakeDeliverer{fail: []error{partial}}
+	r := NewRetryReceiver(rec, RetryPolicy{InitialBackoff: time.Millisecond})
+	if err := r.Deliver(context.Background(), []byte("m")); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	// the retry only goes to the destinations which failed
+	if rec.attempted() != 1 || retries != 1 {
+		t.Errorf("Deliver() attempts = %v and retries = %v, want 1 and 1", rec.attempted(), retries)
+	}
+}
+
+func TestRetryReceiver_AddMessageContext(t *testing.T) {
+	invalid := status.Error(codes.InvalidArgument, "too big")
+	var buf bytes.Buffer
+	r := NewRetryReceiver(&fakeDeliverer{fail: []error{invalid}}, RetryPolicy{Logger: logging.NewStdLogger(log.New(&buf, "", 0))})
+	r.AddMessageContext(context.Background(), []byte("m"))
+	if got := buf.String(); !strings.Contains(got, logging.DeliveryFailed) || !strings.Contains(got, "too big") {
+		t.Errorf("logged %q, want the delivery failure", got)
+	}
+}
+
+func TestRetryReceiver_Breaker(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+	rec := &fakeDeliverer{}
+	r := NewRetryReceiver(rec, RetryPolicy{
+		MaxAttempts:      1,
+		FailureThreshold: 2,
+		OpenTimeout:      50 * time.Millisecond,
+	})
+	ctx := context.Background()
+	rec.setFail(unavailable, unavailable, unavailable)
+	r.Deliver(ctx, []byte("m"))
+	if got := r.State(); got != BreakerClosed {
+		t.Fatalf("State() after one failure = %v, want %v", got, BreakerClosed)
+	}
+	r.Deliver(ctx, []byte("m"))
+	if got := r.State(); got != BreakerOpen {
+		t.Fatalf("State() after two failures = %v, want %v", got, BreakerOpen)
+	}
+
+	// deliveries wait while open and a failed probe opens the breaker again
+	start := time.Now()
+	if err := r.Deliver(ctx, []byte("m")); err == nil {
+		t.Fatalf("Deliver() error = nil, want the probe to fail")
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Deliver() waited %v, want the open timeout", elapsed)
+	}
+	if got := r.State(); got != BreakerOpen {
+		t.Fatalf("State() after failed probe = %v, want %v", got, BreakerOpen)
+	}
+
+	// a canceled delivery gives up waiting without trying
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := r.Deliver(canceled, []byte("m")); err != context.Canceled {
+		t.Errorf("Deliver() error = %v, want %v", err, context.Canceled)
+	}
+	if got := rec.attempted(); got != 3 {
+		t.Errorf("attempts = %v, want 3", got)
+	}
+
+	// the next successful probe closes it
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := r.Deliver(ctx, []byte("m")); err != nil {
+				t.Errorf("Deliver() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := r.State(); got != BreakerClosed {
+		t.Errorf("State() after successful probe = %v, want %v", got, BreakerClosed)
+	}
+}
+
+// gatedDeliverer is a fakeDeliverer calling gate before every delivery.
+type gatedDeliverer struct {
+	*fakeDeliverer
+	gate func()
+}
+
+func (g *gatedDeliverer) Deliver(ctx context.Context, b []byte) error {
+	g.gate()
+	return g.fakeDeliverer.Deliver(ctx, b)
+}
+
+func TestRetryReceiver_BreakerProbeNotRetryable(t *testing.T) {
+	var armed int32
+	var probe sync.Once
+	probing := make(chan struct{})
+	release := make(chan struct{})
+	rec := &gatedDeliverer{fakeDeliverer: &fakeDeliverer{}, gate: func() {
+		if atomic.LoadInt32(&armed) == 1 {
+			probe.Do(func() {
+				close(probing)
+				<-release
+			})
+		}
+	}}
+	r := NewRetryReceiver(rec, RetryPolicy{
+		MaxAttempts:      1,
+		FailureThreshold: 1,
+		OpenTimeout:      10 * time.Millisecond,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	rec.setFail(status.Error(codes.Unavailable, "down"), status.Error(codes.InvalidArgument, "bad"))
+	r.Deliver(ctx, []byte("m"))
+	if got := r.State(); got != BreakerOpen {
+		t.Fatalf("State() = %v, want %v", got, BreakerOpen)
+	}
+	atomic.StoreInt32(&armed, 1)
+	probed := make(chan error, 1)
+	go func() {
+		probed <- r.Deliver(ctx, []byte("m"))
+	}()
+	<-probing
+	waited := make(chan error, 1)
+	go func() {
+		waited <- r.Deliver(ctx, []byte("m"))
+	}()
+	close(release)
+	if err := <-probed; status.Code(errors.Unwrap(err)) != codes.InvalidArgument {
+		t.Errorf("probe Deliver() error = %v, want InvalidArgument", err)
+	}
+	// the delivery waiting for the probe probes the breaker in turn
+	if err := <-waited; err != nil {
+		t.Errorf("waiting Deliver() error = %v, want it delivered after the probe", err)
+	}
+	if got := r.State(); got != BreakerClosed {
+		t.Errorf("State() = %v, want %v", got, BreakerClosed)
+	}
+}
+
+func TestRetryReceiver_Idle(t *testing.T) {
+	rec := &fakeDeliverer{}
+	rec.setFail(status.Error(codes.Unavailable, "down"), status.Error(codes.Unavailable, "down"))
+	r := NewRetryReceiver(rec, RetryPolicy{InitialBackoff: time.Millisecond})
+	var released, acquired int
+	ctx := WithIdle(context.Background(), func() {
+		released++
+	}, func(ctx context.Context) error {
+		acquired++
+		return nil
+	})
+	if err := r.Deliver(ctx, []byte("m")); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	// the worker is given back during both backoffs
+	if released != 2 || acquired != 2 {
+		t.Errorf("released %v and acquired %v times, want 2", released, acquired)
+	}
+}
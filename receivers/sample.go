@@ -0,0 +1,46 @@
+package receivers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/nicolasassi/kinestesia/metrics"
+	"math"
+	"math/rand"
+)
+
+// InSample tells whether the messages with key belong to a sample of rate, from
+// 0 to 1, of every key. The same key is always in or out of the sample.
+func InSample(key string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(key))
+	return float64(binary.BigEndian.Uint64(sum[:8])) < rate*math.MaxUint64
+}
+
+// Sample delivers a fraction rate, from 0 to 1, of the messages and drops the
+// others, as for a shadow receiver getting part of the traffic. Messages are
+// sampled by the hash of key(b) or randomly if key is nil. The sampled and
+// skipped messages are counted in metrics.SampledMessages of r, which can be nil.
+func Sample(rate float64, key func(b []byte) string, r metrics.Recorder) Middleware {
+	if r == nil {
+		r = metrics.Discard
+	}
+	return DeliveryMiddleware(func(rec Receiver, next DeliverFunc) DeliverFunc {
+		return func(ctx context.Context, b []byte) error {
+			var sampled bool
+			if key != nil {
+				sampled = InSample(key(b), rate)
+			} else {
+				sampled = rand.Float64() < rate
+			}
+			if !sampled {
+				r.Add(metrics.SampledMessages, 1, metrics.Labels{"receiver": rec.String(), "result": "skipped"})
+				return nil
+			}
+			r.Add(metrics.SampledMessages, 1, metrics.Labels{"receiver": rec.String(), "result": "sampled"})
+			return next(ctx, b)
+		}
+	})
+}
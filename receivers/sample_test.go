@@ -0,0 +1,81 @@
+package receivers
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestInSample(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		wantMin int
+		wantMax int
+	}{
+		{"none", 0, 0, 0},
+		{"fivePercent", 0.05, 400, 600},
+		{"half", 0.5, 4700, 5300},
+		{"all", 1, 10000, 10000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := 0
+			for i := 0; i < 10000; i++ {
+				key := "key-" + strconv.Itoa(i)
+				in := InSample(key, tt.rate)
+				if in != InSample(key, tt.rate) {
+					t.Fatalf("InSample(%q) is not deterministic", key)
+				}
+				if in {
+					got++
+				}
+			}
+			if got < tt.wantMin || got > tt.wantMax {
+				t.Errorf("InSample() sampled %v keys, want between %v and %v", got, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestSample(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate        float64
+		key         func(b []byte) string
+		wantSampled float64
+	}{
+		{"byKey", 0.5, func(b []byte) string { return string(b[:1]) }, 0},
+		{"randomNone", 0, nil, 0},
+		{"randomAll", 1, nil, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &fakeDeliverer{}
+			r := &countingRecorder{values: map[string]float64{}}
+			sampled := Chain(rec, Sample(tt.rate, tt.key, r)).(Deliverer)
+			want := tt.wantSampled
+			for i := 0; i < 100; i++ {
+				b := []byte("m" + strconv.Itoa(i))
+				if err := sampled.Deliver(context.Background(), b); err != nil {
+					t.Fatalf("Deliver() error = %v", err)
+				}
+			}
+			if tt.key != nil {
+				// every message shares the key "m" so all or none are sampled
+				if InSample("m", tt.rate) {
+					want = 100
+				}
+			}
+			if got := float64(rec.attempted()); got != want {
+				t.Errorf("deliveries = %v, want %v", got, want)
+			}
+			if got := r.values["kinestesia_sampled_messages_total/sampled"]; got != want {
+				t.Errorf("sampled = %v, want %v", got, want)
+			}
+			if got := r.values["kinestesia_sampled_messages_total/skipped"]; got != 100-want {
+				t.Errorf("skipped = %v, want %v", got, 100-want)
+			}
+		})
+	}
+}
@@ -0,0 +1,427 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv/v1.26.0"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultOTLPBatchSize     = 512
+	defaultOTLPQueueSize     = 2048
+	defaultOTLPFlushInterval = 5 * time.Second
+)
+
+// OTLPConfig sets how spans are sent to an OpenTelemetry collector.
+type OTLPConfig struct {
+	// Endpoint is the base URL of the collector OTLP/HTTP receiver, as
+	// http://localhost:4318. Spans are posted to Endpoint/v1/traces.
+	Endpoint string
+	// ServiceName overrides the service.name attribute of the resource of the
+	// TracerProvider.
+	ServiceName string
+	Headers     map[string]string
+	HTTPClient  *http.Client
+	// BatchSize is the number of spans which triggers an export. The default
+	// is 512.
+	BatchSize int
+	// QueueSize is the number of spans waiting to be exported. Spans ended while
+	// it is full are dropped and counted by Dropped. The default is 2048.
+	QueueSize int
+	// FlushInterval is how often pending spans are exported. The default is
+	// 5 seconds.
+	FlushInterval time.Duration
+}
+
+// OTLPExporter is a trace.SpanExporter of the OpenTelemetry SDK which sends the
+// spans in batches to an OpenTelemetry collector using OTLP/HTTP with JSON
+// encoding. It queues the spans itself so it never blocks the ending of spans:
+//
+//	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+type OTLPExporter struct {
+	cfg     OTLPConfig
+	spans   chan sdktrace.ReadOnlySpan
+	flush   chan chan error
+	done    chan struct{}
+	errors  chan error
+	once    sync.Once
+	dropped uint64
+}
+
+var _ sdktrace.SpanExporter = (*OTLPExporter)(nil)
+
+func NewOTLPExporter(cfg OTLPConfig) (*OTLPExporter, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("OTLP endpoint is required")
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultOTLPBatchSize
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultOTLPQueueSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultOTLPFlushInterval
+	}
+	e := &OTLPExporter{
+		cfg:    cfg,
+		spans:  make(chan sdktrace.ReadOnlySpan, cfg.QueueSize),
+		flush:  make(chan chan error),
+		done:   make(chan struct{}),
+		errors: make(chan error, 1),
+	}
+	go e.run()
+	return e, nil
+}
+
+// ExportSpans queues spans to be sent with the next batch. The spans which do
+// not fit in the queue are dropped.
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	for _, s := range spans {
+		select {
+		case <-e.done:
+			return nil
+		default:
+		}
+		select {
+		case e.spans <- s:
+		default:
+			atomic.AddUint64(&e.dropped, 1)
+		}
+	}
+	return nil
+}
+
+// Dropped returns the number of spans dropped because the queue was full.
+func (e *OTLPExporter) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+// Errors receives the errors of the exports done in the background. Errors are
+// dropped if the channel is not drained.
+func (e *OTLPExporter) Errors() <-chan error {
+	return e.errors
+}
+
+// Shutdown exports the pending spans and stops the exporter.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	errc := make(chan error, 1)
+	select {
+	case e.flush <- errc:
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(e.cfg.FlushInterval)
+	defer ticker.Stop()
+	var batch []sdktrace.ReadOnlySpan
+	export := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := e.post(batch)
+		batch = nil
+		return err
+	}
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= e.cfg.BatchSize {
+				e.report(export())
+			}
+		case <-ticker.C:
+			e.report(export())
+		case errc := <-e.flush:
+			// spans queued before the shutdown go with the last batch
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+			errc <- export()
+			e.once.Do(func() { close(e.done) })
+			return
+		}
+	}
+}
+
+func (e *OTLPExporter) report(err error) {
+	if err == nil {
+		return
+	}
+	select {
+	case e.errors <- err:
+	default:
+	}
+}
+
+func (e *OTLPExporter) post(spans []sdktrace.ReadOnlySpan) error {
+	body, err := json.Marshal(otlpRequest(e.cfg.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(e.cfg.Endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("OTLP export error: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP export error: status %s", resp.Status)
+	}
+	return nil
+}
+
+// The types below follow the JSON encoding of the OTLP trace protobuf messages.
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue has one of its fields set. Integers are strings as every int64
+// of the JSON encoding.
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID    string         `json:"traceId"`
+	SpanID     string         `json:"spanId"`
+	TraceState string         `json:"traceState,omitempty"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+const (
+	otlpStatusUnset = 0
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+func otlpAttributes(attributes []attribute.KeyValue) []otlpKeyValue {
+	var kvs []otlpKeyValue
+	for _, a := range attributes {
+		kvs = append(kvs, otlpKeyValue{Key: string(a.Key), Value: otlpValue(a.Value)})
+	}
+	return kvs
+}
+
+// otlpValue encodes v with the field of its type, and the slices as arrays of
+// it. Values of an unknown type are encoded as strings.
+func otlpValue(v attribute.Value) otlpAnyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		b := v.AsBool()
+		return otlpAnyValue{BoolValue: &b}
+	case attribute.INT64:
+		i := strconv.FormatInt(v.AsInt64(), 10)
+		return otlpAnyValue{IntValue: &i}
+	case attribute.FLOAT64:
+		f := v.AsFloat64()
+		return otlpAnyValue{DoubleValue: &f}
+	case attribute.STRING:
+		str := v.AsString()
+		return otlpAnyValue{StringValue: &str}
+	case attribute.BOOLSLICE:
+		var values []otlpAnyValue
+		for _, b := range v.AsBoolSlice() {
+			values = append(values, otlpValue(attribute.BoolValue(b)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case attribute.INT64SLICE:
+		var values []otlpAnyValue
+		for _, i := range v.AsInt64Slice() {
+			values = append(values, otlpValue(attribute.Int64Value(i)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case attribute.FLOAT64SLICE:
+		var values []otlpAnyValue
+		for _, f := range v.AsFloat64Slice() {
+			values = append(values, otlpValue(attribute.Float64Value(f)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case attribute.STRINGSLICE:
+		var values []otlpAnyValue
+		for _, str := range v.AsStringSlice() {
+			values = append(values, otlpValue(attribute.StringValue(str)))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	}
+	str := v.Emit()
+	return otlpAnyValue{StringValue: &str}
+}
+
+// otlpEvents encodes the events of a span, as the exceptions recorded by
+// SetError.
+func otlpEvents(events []sdktrace.Event) []otlpEvent {
+	var encoded []otlpEvent
+	for _, e := range events {
+		encoded = append(encoded, otlpEvent{
+			TimeUnixNano: strconv.FormatInt(e.Time.UnixNano(), 10),
+			Name:         e.Name,
+			Attributes:   otlpAttributes(e.Attributes),
+		})
+	}
+	return encoded
+}
+
+func otlpLinks(links []sdktrace.Link) []otlpLink {
+	var encoded []otlpLink
+	for _, l := range links {
+		encoded = append(encoded, otlpLink{
+			TraceID:    l.SpanContext.TraceID().String(),
+			SpanID:     l.SpanContext.SpanID().String(),
+			TraceState: l.SpanContext.TraceState().String(),
+			Attributes: otlpAttributes(l.Attributes),
+		})
+	}
+	return encoded
+}
+
+func otlpStatusOf(s sdktrace.Status) otlpStatus {
+	switch s.Code {
+	case codes.Ok:
+		return otlpStatus{Code: otlpStatusOK}
+	case codes.Error:
+		return otlpStatus{Code: otlpStatusError, Message: s.Description}
+	}
+	return otlpStatus{Code: otlpStatusUnset}
+}
+
+// otlpRequest groups spans by resource and instrumentation scope.
+func otlpRequest(serviceName string, spans []sdktrace.ReadOnlySpan) otlpExportRequest {
+	var req otlpExportRequest
+	resources := map[attribute.Distinct]int{}
+	scopes := map[attribute.Distinct]map[string]int{}
+	for _, s := range spans {
+		resourceKey := s.Resource().Equivalent()
+		r, ok := resources[resourceKey]
+		if !ok {
+			attributes := s.Resource().Attributes()
+			if serviceName != "" {
+				attributes = append(attributes, semconv.ServiceName(serviceName))
+			}
+			// a later attribute overrides an earlier one with the same key
+			set := attribute.NewSet(attributes...)
+			resource := otlpResourceSpans{}
+			resource.Resource.Attributes = otlpAttributes(set.ToSlice())
+			req.ResourceSpans = append(req.ResourceSpans, resource)
+			r = len(req.ResourceSpans) - 1
+			resources[resourceKey] = r
+			scopes[resourceKey] = map[string]int{}
+		}
+		resource := &req.ResourceSpans[r]
+		scopeName := s.InstrumentationScope().Name
+		i, ok := scopes[resourceKey][scopeName]
+		if !ok {
+			scope := otlpScopeSpans{}
+			scope.Scope.Name = scopeName
+			scope.Scope.Version = s.InstrumentationScope().Version
+			resource.ScopeSpans = append(resource.ScopeSpans, scope)
+			i = len(resource.ScopeSpans) - 1
+			scopes[resourceKey][scopeName] = i
+		}
+		span := otlpSpan{
+			TraceID:           s.SpanContext().TraceID().String(),
+			SpanID:            s.SpanContext().SpanID().String(),
+			Name:              s.Name(),
+			Kind:              int(s.SpanKind()),
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime().UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime().UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes()),
+			Events:            otlpEvents(s.Events()),
+			Links:             otlpLinks(s.Links()),
+			Status:            otlpStatusOf(s.Status()),
+		}
+		if s.Parent().SpanID().IsValid() {
+			span.ParentSpanID = s.Parent().SpanID().String()
+		}
+		resource.ScopeSpans[i].Spans = append(resource.ScopeSpans[i].Spans, span)
+	}
+	return req
+}
@@ -0,0 +1,67 @@
+// Package tracing connects kinestesia to OpenTelemetry. Spans are created with
+// the TracerProvider of the application, the global one by default, and the
+// trace context crosses Kinesis and Pub/Sub with the global propagator.
+package tracing
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceparentKey is the attribute carrying the W3C trace context.
+const TraceparentKey = "traceparent"
+
+// InstrumentationName names the tracer of the spans of kinestesia.
+const InstrumentationName = "github.com/nicolasassi/kinestesia"
+
+// Tracer returns the tracer of kinestesia from tp. A nil tp uses the global
+// TracerProvider, so the spans follow the provider set later with
+// otel.SetTracerProvider.
+func Tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(InstrumentationName)
+}
+
+// propagator returns the global propagator or the W3C trace context one if the
+// application did not set any.
+func propagator() propagation.TextMapPropagator {
+	p := otel.GetTextMapPropagator()
+	if len(p.Fields()) == 0 {
+		return propagation.TraceContext{}
+	}
+	return p
+}
+
+// Inject sets the trace context of the span in ctx in attributes.
+// attributes is returned unchanged if ctx has no span.
+func Inject(ctx context.Context, attributes map[string]string) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return attributes
+	}
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+	propagator().Inject(ctx, propagation.MapCarrier(attributes))
+	return attributes
+}
+
+// Extract returns a context whose spans are children of the trace context in
+// attributes. ctx is returned unchanged if there is no valid trace context.
+func Extract(ctx context.Context, attributes map[string]string) context.Context {
+	return propagator().Extract(ctx, propagation.MapCarrier(attributes))
+}
+
+// SetError records err in span and marks the span as failed. A nil err is
+// ignored.
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,180 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExtractInject(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := Tracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	remote := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := Extract(context.Background(), map[string]string{TraceparentKey: remote})
+	ctx, span := tracer.Start(ctx, "span")
+	SetError(span, fmt.Errorf("failed"))
+	SetError(span, nil)
+	attributes := Inject(ctx, map[string]string{"key": "value"})
+	span.End()
+
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("ended %v spans, want 1", len(ended))
+	}
+	got := ended[0]
+	if got.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || got.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("span = %v/%v, want child of the remote span", got.SpanContext().TraceID(), got.Parent().SpanID())
+	}
+	if got.Status().Description != "failed" || len(got.Events()) != 1 {
+		t.Errorf("span status = %+v, events = %v, want the error", got.Status(), got.Events())
+	}
+	want := fmt.Sprintf("00-%s-%s-01", got.SpanContext().TraceID(), got.SpanContext().SpanID())
+	if attributes[TraceparentKey] != want || attributes["key"] != "value" {
+		t.Errorf("Inject() = %v, want %v", attributes, want)
+	}
+}
+
+func TestExtractInject_Invalid(t *testing.T) {
+	ctx := Extract(context.Background(), map[string]string{TraceparentKey: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"})
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		t.Errorf("Extract() of an invalid traceparent should not set a span context")
+	}
+	if got := Inject(ctx, nil); got != nil {
+		t.Errorf("Inject() without a span = %v, want nil", got)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan otlpExportRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		var req otlpExportRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- req
+	}))
+	defer server.Close()
+	exporter, err := NewOTLPExporter(OTLPConfig{
+		Endpoint:      server.URL,
+		ServiceName:   "kinestesia",
+		Headers:       map[string]string{"Authorization": "token"},
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := Tracer(provider)
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, linked := tracer.Start(context.Background(), "linked")
+	linked.End()
+	_, child := tracer.Start(ctx, "child", trace.WithAttributes(attribute.Int("size", 3)), trace.WithLinks(trace.Link{SpanContext: linked.SpanContext()}))
+	SetError(child, fmt.Errorf("failed"))
+	child.End()
+	parent.End()
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	req := <-requests
+	scope := req.ResourceSpans[0].ScopeSpans[0]
+	if scope.Scope.Name != InstrumentationName {
+		t.Errorf("scope = %v, want %v", scope.Scope.Name, InstrumentationName)
+	}
+	spans := scope.Spans
+	if len(spans) != 3 {
+		t.Fatalf("exported %v spans, want 3", len(spans))
+	}
+	spans = spans[1:]
+	if spans[0].Name != "child" || spans[0].ParentSpanID != spans[1].SpanID || spans[0].Status.Code != otlpStatusError {
+		t.Errorf("child span = %+v, want error status and parent %v", spans[0], spans[1].SpanID)
+	}
+	if got := spans[0].Attributes; len(got) != 1 || got[0].Key != "size" || got[0].Value.IntValue == nil || *got[0].Value.IntValue != "3" {
+		t.Errorf("child attributes = %+v, want the int size 3", got)
+	}
+	events := spans[0].Events
+	if len(events) != 1 || events[0].Name != "exception" {
+		t.Fatalf("child events = %+v, want the exception of the error", events)
+	}
+	if links := spans[0].Links; len(links) != 1 || links[0].SpanID != linked.SpanContext().SpanID().String() {
+		t.Errorf("child links = %+v, want the linked span", links)
+	}
+	var message string
+	for _, kv := range events[0].Attributes {
+		if kv.Key == "exception.message" && kv.Value.StringValue != nil {
+			message = *kv.Value.StringValue
+		}
+	}
+	if message != "failed" {
+		t.Errorf("exception.message = %v, want failed", message)
+	}
+	var serviceName string
+	for _, kv := range req.ResourceSpans[0].Resource.Attributes {
+		if kv.Key == "service.name" && kv.Value.StringValue != nil {
+			serviceName = *kv.Value.StringValue
+		}
+	}
+	if serviceName != "kinestesia" {
+		t.Errorf("service.name = %v, want kinestesia", serviceName)
+	}
+}
+
+func TestOTLPExporter_Dropped(t *testing.T) {
+	posting := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case posting <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer server.Close()
+	exporter, err := NewOTLPExporter(OTLPConfig{
+		Endpoint:      server.URL,
+		BatchSize:     1,
+		QueueSize:     1,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := func(name string) []sdktrace.ReadOnlySpan {
+		return tracetest.SpanStubs{{Name: name}}.Snapshots()
+	}
+	ctx := context.Background()
+	exporter.ExportSpans(ctx, span("first"))
+	// the first span is being posted so the second fills the queue
+	<-posting
+	done := make(chan struct{})
+	go func() {
+		exporter.ExportSpans(ctx, append(span("second"), span("third")...))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("ExportSpans() blocked on a full queue")
+	}
+	if got := exporter.Dropped(); got != 1 {
+		t.Errorf("Dropped() = %v, want 1", got)
+	}
+	close(release)
+	if err := exporter.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+}
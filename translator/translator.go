@@ -1,6 +1,9 @@
 package translator
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -9,6 +12,10 @@ import (
 
 var indexPattern = regexp.MustCompile(`^\[(\d+)]$`)
 
+// ErrInvalidJSON is matched with errors.Is by the errors of TranslateJSON for
+// data which is not a JSON object.
+var ErrInvalidJSON = errors.New("invalid JSON")
+
 type filterRule struct {
 	arg1     string
 	modifier string
@@ -56,6 +63,37 @@ func (t *Translator) AddFilterRule(arg1, modifier string, arg2 interface{}) {
 	})
 }
 
+// FilterRule is a rule added with AddFilterRule.
+type FilterRule struct {
+	Field    string
+	Modifier string
+	Value    interface{}
+}
+
+// Config describes a Translator, as the reference and separator it was created
+// with and its filter rules.
+type Config struct {
+	Reference   map[string]string
+	Separator   string
+	FilterRules []FilterRule
+}
+
+// Config returns the configuration of t.
+func (t Translator) Config() Config {
+	c := Config{
+		Reference:   map[string]string{},
+		Separator:   t.sep,
+		FilterRules: []FilterRule{},
+	}
+	for i, keys := range t.translationKeys {
+		c.Reference[strings.Join(keys, t.sep)] = t.translationValue[i]
+	}
+	for _, rule := range t.rules {
+		c.FilterRules = append(c.FilterRules, FilterRule{Field: rule.arg1, Modifier: rule.modifier, Value: rule.arg2})
+	}
+	return c
+}
+
 func (t Translator) translate(m interface{}, keys []string) interface{} {
 	key := keys[0]
 	rt := reflect.TypeOf(m)
@@ -133,6 +171,20 @@ func (t Translator) Translate(obj ObjectJSON) *ObjectJSON {
 	return &resp
 }
 
+// TranslateJSON translates the JSON object b as Translate. It returns nil if the
+// object is dropped by the filter rules.
+func (t Translator) TranslateJSON(b []byte) ([]byte, error) {
+	var obj ObjectJSON
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+	resp := t.Translate(obj)
+	if resp == nil {
+		return nil, nil
+	}
+	return json.Marshal(resp)
+}
+
 func (t Translator) filter(key string, value interface{}) bool {
 	resp := true
 	for _, rule := range t.rules {
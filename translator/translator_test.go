@@ -2,6 +2,7 @@ package translator
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"reflect"
 	"testing"
@@ -484,3 +485,30 @@ func TestTranslator_Translate(t1 *testing.T) {
 		})
 	}
 }
+
+func TestTranslator_TranslateJSON(t1 *testing.T) {
+	tests := []struct {
+		name    string
+		b       string
+		want    string
+		wantErr error
+	}{
+		{"translated", `{"a":{"b":1},"c":2}`, `{"ab":1,"c":2}`, nil},
+		{"filtered", `{"a":{"b":1},"c":3}`, "", nil},
+		{"notJSON", `a=1`, "", ErrInvalidJSON},
+		{"notObject", `[1]`, "", ErrInvalidJSON},
+	}
+	for _, tt := range tests {
+		t1.Run(tt.name, func(t1 *testing.T) {
+			t := NewTranslator(map[string]string{"a.b": "ab"}, "")
+			t.AddFilterRule("c", "!=", float64(3))
+			got, err := t.TranslateJSON([]byte(tt.b))
+			if !errors.Is(err, tt.wantErr) || (err != nil) != (tt.wantErr != nil) {
+				t1.Fatalf("TranslateJSON() error = %v, want %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t1.Errorf("TranslateJSON() got = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}